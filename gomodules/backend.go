@@ -5,42 +5,328 @@ import (
 	"database/sql"
 	"echonakama/discordbot"
 	"echonakama/server"
+	"echonakama/server/services/config"
+	"echonakama/server/services/discord"
 	"echonakama/server/services/login"
+	"echonakama/server/services/metrics"
+	"echonakama/server/services/migration"
+	"echonakama/server/services/ratelimit"
+	"echonakama/server/services/relay"
+	"echonakama/server/services/relayconfig"
+	"errors"
+	"syscall"
 
 	"github.com/heroiclabs/nakama-common/runtime"
 	_ "google.golang.org/protobuf/proto"
 )
 
 func InitModule(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, initializer runtime.Initializer) error {
+	// Read the configuration once, so a misconfigured module fails to start instead of failing requests
 	vars, _ := ctx.Value(runtime.RUNTIME_CTX_ENV).(map[string]string)
+	cfg, err := config.Load(vars)
+	if err != nil {
+		logger.Error("Unable to load the configuration: %v", err)
+		return err
+	}
 
-	// Start the bot
-	discordBot, err := discordbot.Bot(ctx, logger, nk, vars["DISCORD_BOT_TOKEN"])
+	// The Discord API is configurable, so it can be pointed at a local mock
+	discordApi := discord.NewClient(cfg.DiscordApiUrl, cfg.DiscordClientId, cfg.DiscordClientSecret, nil)
+
+	// Record the latency and errors of the Discord requests made by the RPCs, and serve the
+	// guild members from the bot's gateway events instead of requesting them on every login
+	members := discord.NewMemberCache(metrics.InstrumentDiscord(nk, discordApi), cfg.DiscordBotGuild)
+	discordClient := discord.Client(members)
+
+	// Start the bot. It connects in the background, so the module starts while Discord is unreachable;
+	// until the bot is connected, guild members are requested from the REST API. Nakama does not tell
+	// the module when it shuts down, so the bot is closed on the signals that stop the server
+	bot, err := discordbot.NewService(ctx, logger, nk, cfg.DiscordBotToken, discordApi, members)
 	if err != nil {
 		logger.Error("Unable to create bot: %v", err)
+		return err
+	}
+	bot.Start(ctx)
+	bot.CloseOnSignal(syscall.SIGINT, syscall.SIGTERM)
+
+	// Admin RPCs are limited to the admins of the system-owned admin group
+	if err := server.InitAdminGroup(ctx, logger, nk); err != nil {
+		logger.Error("Unable to set up the admin group, admin RPCs are limited to server-to-server calls: %v", err)
+	}
+
+	// Limit the requests of each caller to the RPCs that call Discord
+	limiter := ratelimit.NewLimiter(cfg.RateLimits)
+
+	// Relay RPCs return structured errors, so the relay can tell the failures apart
+	if err := initializer.RegisterRpc("relay/loginrequest", server.RelayRpc(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		return server.LoginRequestRpc(ctx, logger, db, nk, payload, cfg, discordClient, limiter)
+	})); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("relay/profileupdate", server.RelayRpc(server.ProfileUpdateRpc)); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("admin/profilehistory", server.ProfileHistoryRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("admin/profilediff", server.ProfileDiffRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("admin/profilerollback", server.ProfileRollbackRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("admin/importlegacyaccounts", server.ImportLegacyAccountsRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("echorelay/getConfig", server.GetConfigRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("echorelay/setConfig", server.SetConfigRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
 	}
 
-	if err := initializer.RegisterRpc("relay/loginrequest", func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
-		return server.LoginRequestRpc(ctx, logger, db, nk, payload, discordBot)
+	if err := initializer.RegisterRpc("echorelay/getDocument", func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		return server.GetDocumentRpc(ctx, logger, db, nk, payload, cfg)
 	}); err != nil {
 		logger.Error("Unable to register: %v", err)
 		return err
 	}
 
-	if err := initializer.RegisterRpc("signin/discord", server.DiscordSignInRpc); err != nil {
+	if err := initializer.RegisterRpc("echorelay/setDocument", server.SetDocumentRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("echorelay/getAccessControlList", server.GetAccessControlListRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("echorelay/setAccessControlList", server.SetAccessControlListRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("echorelay/getChannelInfo", server.GetChannelInfoRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("echorelay/setChannelInfo", server.SetChannelInfoRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("admin/channeldelete", server.DeleteChannelRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("admin/clientsettingsget", server.GetClientSettingsRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("admin/clientsettingsset", server.SetClientSettingsRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("admin/clientsettingsaudit", server.ListClientSettingsAuditRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("relay/authenticate", server.RelayRpc(server.RelayAuthenticateRpc)); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("admin/relaylist", server.ListRelaysRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("admin/relayset", server.SetRelayRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("admin/relaydelete", server.DeleteRelayRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("admin/relaykeycreate", server.CreateRelayKeyRpc); err != nil {
 		logger.Error("Unable to register: %v", err)
 		return err
 	}
 
-	if err := initializer.RegisterRpc("link/device", server.LinkDeviceRpc); err != nil {
+	if err := initializer.RegisterRpc("admin/relaykeyrevoke", server.RevokeRelayKeyRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("relay/heartbeat", server.RelayRpc(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		return server.RelayHeartbeatRpc(ctx, logger, db, nk, payload, cfg)
+	})); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("admin/relaystatus", func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		return server.RelayStatusRpc(ctx, logger, db, nk, payload, cfg)
+	}); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("admin/botstatus", func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		return server.BotStatusRpc(ctx, logger, db, nk, payload, bot)
+	}); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("relay/gameserverregister", server.RelayRpc(server.RegisterGameServerRpc)); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("relay/gameserversessions", server.RelayRpc(server.ReportGameServerSessionsRpc)); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("relay/gameserverunregister", server.RelayRpc(server.UnregisterGameServerRpc)); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("admin/gameserverlist", func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		return server.ListGameServersRpc(ctx, logger, db, nk, payload, cfg)
+	}); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("relay/lobbyfind", server.RelayRpc(server.LobbyFindRpc)); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("relay/lobbyassignment", server.RelayRpc(server.LobbyAssignmentRpc)); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterMatchmakerMatched(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, entries []runtime.MatchmakerEntry) (string, error) {
+		return server.MatchmakerMatched(ctx, logger, db, nk, entries, cfg)
+	}); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("party/create", server.CreatePartyRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("party/get", server.GetPartyRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("party/invite", server.InvitePartyRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("party/accept", server.AcceptPartyRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("party/leave", server.LeavePartyRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("party/kick", server.KickPartyRpc); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("signin/discord", func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		return server.DiscordSignInRpc(ctx, logger, db, nk, payload, discordClient, limiter)
+	}); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc("link/device", func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		return server.LinkDeviceRpc(ctx, logger, db, nk, payload, cfg, limiter)
+	}); err != nil {
 		logger.Error("Unable to register: %v", err)
 		return err
 	}
 
 	login.RegisterIndexes(initializer)
-	//initializer.RegisterBeforeAuthenticateCustom(login.BeforeAuthenticateCustom)
 
-	//initializer.RegisterAfterAuthenticateCustom(login.AfterAuthenticateCustom)
+	// Migrate the stored objects in the background; until a migration completes, objects are migrated as they are read
+	if err := login.RegisterMigrations(); err != nil {
+		logger.Error("Unable to register migrations: %v", err)
+		return err
+	}
+	if err := relayconfig.RegisterMigrations(); err != nil {
+		logger.Error("Unable to register migrations: %v", err)
+		return err
+	}
+	go func() {
+		if err := migration.Run(ctx, logger, nk); errors.Is(err, migration.ErrRunning) {
+			logger.Info("Migrations are running on another node: %v", err)
+		} else if err != nil {
+			logger.Error("Unable to run migrations: %v", err)
+		}
+	}()
+
+	// Only the server may use the device IDs of the imported legacy accounts
+	if err := initializer.RegisterBeforeAuthenticateDevice(login.BeforeAuthenticateDevice); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+	if err := initializer.RegisterBeforeLinkDevice(login.BeforeLinkDevice); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	// Relay users are only issued sessions for the relay's API keys
+	if err := initializer.RegisterBeforeAuthenticateCustom(relay.BeforeAuthenticateCustom); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+	if err := initializer.RegisterBeforeLinkCustom(relay.BeforeLinkCustom); err != nil {
+		logger.Error("Unable to register: %v", err)
+		return err
+	}
+
+	//initializer.RegisterBeforeAuthenticateCustom(login.BeforeAuthenticateCustom(discordClient))
+
+	//initializer.RegisterAfterAuthenticateCustom(login.AfterAuthenticateCustom(cfg, discordClient))
 
 	logger.Info("Initialized module.")
 
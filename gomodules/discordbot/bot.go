@@ -2,19 +2,63 @@ package discordbot
 
 import (
 	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"echonakama/server/services/discord"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/heroiclabs/nakama-common/runtime"
 )
 
-var bot *discordgo.Session
+// The states of the bot's gateway connection
+const (
+	StateConnecting   = "connecting"   // the bot is opening its first connection
+	StateConnected    = "connected"    // the bot is connected, and the member cache is kept up to date
+	StateDisconnected = "disconnected" // the connection failed or dropped, and the bot is reconnecting
+	StateStopped      = "stopped"      // the bot was closed
+)
 
-func Bot(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, BotToken string) (*discordgo.Session, error) {
-	var err error
+const (
+	// The delays between the attempts to open the connection, doubling from the minimum up to the maximum
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = 5 * time.Minute
+)
+
+// Health is the status of the bot's gateway connection.
+type Health struct {
+	State       string     `json:"state"`
+	Since       time.Time  `json:"since"`                  // when the bot entered the state
+	Attempts    int        `json:"attempts"`               // the failed attempts to open the connection since it was last open
+	Reconnects  int        `json:"reconnects"`             // how often the connection dropped
+	LastError   string     `json:"last_error,omitempty"`   // why the last attempt to open the connection failed
+	NextAttempt *time.Time `json:"next_attempt,omitempty"` // when the connection is opened again
+}
+
+// Service runs the bot. The bot's REST requests work without the gateway, so the Discord client uses the
+// session from the start; the gateway connection is opened in the background, retrying with a backoff
+// until it is open. Once open, discordgo reconnects a dropped connection itself.
+type Service struct {
+	Session    *discordgo.Session
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
 
-	logger.Info("Starting bot")
-	bot, err = discordgo.New("Bot " + BotToken)
+	logger runtime.Logger
+	open   func() error // opens the gateway connection
+	now    func() time.Time
 
+	mu     sync.Mutex
+	health Health
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewService creates the bot, and makes the Discord client use its session for bot requests.
+// The member cache is kept up to date with the bot's gateway events. Start connects the bot.
+func NewService(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, botToken string, discordClient *discord.APIClient, members *discord.MemberCache) (*Service, error) {
+	bot, err := discordgo.New("Bot " + botToken)
 	if err != nil {
 		return nil, err
 	}
@@ -31,23 +75,190 @@ func Bot(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, Bo
 	bot.Identify.Intents |= discordgo.IntentGuildMessageReactions
 	bot.Identify.Intents |= discordgo.IntentDirectMessages
 	bot.Identify.Intents |= discordgo.IntentDirectMessageReactions
-	bot.Identify.Intents |= discordgo.IntentMessageContent
 	bot.Identify.Intents |= discordgo.IntentAutoModerationConfiguration
-	bot.Identify.Intents |= discordgo.IntentAutoModerationExecution
-
-	// slashcommands
 
 	// list the guilds the bot is in
 	bot.StateEnabled = true
 
+	s := newService(logger, bot.Open)
+	s.Session = bot
+	discordClient.Bot = bot
+
 	bot.AddHandler(func(session *discordgo.Session, ready *discordgo.Ready) {
 		logger.Info("Bot is up")
+		s.connected()
+		if _, err := session.ApplicationCommandCreate(ready.User.ID, "", partyCommand); err != nil {
+			logger.WithField("err", err).Error("Unable to register the party command")
+		}
+	})
+	bot.AddHandler(func(session *discordgo.Session, resumed *discordgo.Resumed) {
+		s.connected()
+	})
+	bot.AddHandler(func(session *discordgo.Session, disconnect *discordgo.Disconnect) {
+		s.disconnected()
 	})
 
-	err = bot.Open()
-	if err != nil {
-		return nil, err
+	bot.AddHandler(func(session *discordgo.Session, i *discordgo.InteractionCreate) {
+		if i.Type == discordgo.InteractionApplicationCommand && i.ApplicationCommandData().Name == partyCommand.Name {
+			handlePartyCommand(ctx, logger, nk, discordClient, i)
+		}
+	})
+
+	members.AddHandlers(bot, logger)
+	return s, nil
+}
+
+func newService(logger runtime.Logger, open func() error) *Service {
+	return &Service{
+		MinBackoff: DefaultMinBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+		logger:     logger,
+		open:       open,
+		now:        time.Now,
+		health:     Health{State: StateStopped, Since: time.Now()},
 	}
+}
+
+// Start opens the gateway connection in the background, until it is open or the context is done.
+// The bot is closed when the context is done. Nakama does not cancel the context it passes to
+// InitModule when it shuts down, so use CloseOnSignal to disconnect the bot with the server.
+func (s *Service) Start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done != nil {
+		return
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	s.setState(StateConnecting)
+	go s.run(runCtx, s.done)
+	go func() {
+		<-runCtx.Done()
+		if ctx.Err() != nil {
+			s.Close()
+		}
+	}()
+}
+
+func (s *Service) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	backoff := s.MinBackoff
+	for {
+		err := s.open()
+		if err == nil {
+			break
+		}
 
-	return bot, nil
+		next := s.now().Add(backoff)
+		s.mu.Lock()
+		s.health.Attempts++
+		s.health.LastError = err.Error()
+		s.health.NextAttempt = &next
+		s.setState(StateDisconnected)
+		attempts := s.health.Attempts
+		s.mu.Unlock()
+		s.logger.WithField("err", err).WithField("attempts", attempts).WithField("backoff", backoff.String()).Warn("Unable to connect the bot")
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+	}
+
+	<-ctx.Done()
+}
+
+// Close disconnects the bot and stops the reconnection attempts. It waits for a connection attempt in
+// progress to finish, so the session is not left open.
+func (s *Service) Close() error {
+	s.mu.Lock()
+	cancel, done := s.cancel, s.done
+	s.cancel = nil
+	s.mu.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	<-done
+
+	// Stopped first, so closing the session is not counted as a dropped connection
+	s.mu.Lock()
+	s.health.NextAttempt = nil
+	s.setState(StateStopped)
+	s.mu.Unlock()
+
+	var err error
+	if s.Session != nil {
+		err = s.Session.Close()
+	}
+	s.logger.Info("Bot stopped")
+	return err
+}
+
+// CloseOnSignal closes the bot when the process receives one of the signals, such as the SIGINT or
+// SIGTERM that shut Nakama down. Nakama handles the signals itself, so they still shut the server down.
+func (s *Service) CloseOnSignal(signals ...os.Signal) {
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, signals...)
+	go func() {
+		<-received
+		signal.Stop(received)
+		s.Close()
+	}()
+}
+
+// Health returns the status of the bot's gateway connection.
+func (s *Service) Health() Health {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	health := s.health
+	if health.NextAttempt != nil {
+		next := *health.NextAttempt
+		health.NextAttempt = &next
+	}
+	return health
+}
+
+// Healthy returns whether the bot is connected.
+func (s *Service) Healthy() bool {
+	return s.Health().State == StateConnected
+}
+
+func (s *Service) connected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.health.State == StateStopped {
+		return
+	}
+	s.health.Attempts = 0
+	s.health.LastError = ""
+	s.health.NextAttempt = nil
+	s.setState(StateConnected)
+}
+
+func (s *Service) disconnected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.health.State != StateConnected {
+		return
+	}
+	s.health.Reconnects++
+	s.setState(StateDisconnected)
+	s.logger.Warn("Bot disconnected, reconnecting")
+}
+
+// setState must be called with the lock held.
+func (s *Service) setState(state string) {
+	if s.health.State != state {
+		s.health.State = state
+		s.health.Since = s.now()
+	}
 }
@@ -0,0 +1,97 @@
+package discordbot
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"echonakama/server/services/nakamatest"
+)
+
+// waitFor polls the condition until it holds, failing the test after a second.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServiceReconnect(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	open := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if attempts++; attempts < 3 {
+			return errors.New("gateway unreachable")
+		}
+		return nil
+	}
+	s := newService(nakamatest.NewLogger(t), open)
+	s.MinBackoff, s.MaxBackoff = time.Millisecond, 2*time.Millisecond
+
+	s.Start(context.Background())
+	defer s.Close()
+	waitFor(t, "the connection to open", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return attempts == 3
+	})
+	if health := s.Health(); health.State != StateDisconnected || health.Attempts != 2 || health.LastError != "gateway unreachable" || health.NextAttempt == nil {
+		t.Errorf("Health() = %+v, want the failed attempts until the bot is ready", health)
+	}
+
+	// The gateway events set the state once the connection is open
+	s.connected()
+	if health := s.Health(); !s.Healthy() || health.Attempts != 0 || health.LastError != "" || health.NextAttempt != nil {
+		t.Errorf("Health() = %+v, want connected", health)
+	}
+	s.disconnected()
+	if health := s.Health(); health.State != StateDisconnected || health.Reconnects != 1 {
+		t.Errorf("Health() = %+v, want disconnected once", health)
+	}
+	s.connected()
+	if !s.Healthy() {
+		t.Errorf("Health() = %+v, want connected after the reconnect", s.Health())
+	}
+}
+
+func TestServiceShutdown(t *testing.T) {
+	s := newService(nakamatest.NewLogger(t), func() error { return errors.New("gateway unreachable") })
+	s.MinBackoff, s.MaxBackoff = time.Hour, time.Hour
+
+	// The attempts stop when the server shuts down, without waiting for the backoff
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	waitFor(t, "the first attempt", func() bool { return s.Health().Attempts == 1 })
+	cancel()
+	waitFor(t, "the bot to stop", func() bool { return s.Health().State == StateStopped })
+
+	// A closed bot is not marked connected by a late gateway event, and closes once
+	s.connected()
+	if health := s.Health(); health.State != StateStopped || health.NextAttempt != nil {
+		t.Errorf("Health() = %+v, want stopped", health)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Close() error: %v", err)
+	}
+}
+
+func TestServiceCloseOnSignal(t *testing.T) {
+	s := newService(nakamatest.NewLogger(t), func() error { return nil })
+	s.Start(context.Background())
+	s.CloseOnSignal(syscall.SIGUSR1)
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatalf("Kill() error: %v", err)
+	}
+	waitFor(t, "the bot to stop", func() bool { return s.Health().State == StateStopped })
+}
@@ -0,0 +1,105 @@
+package discordbot
+
+import (
+	"context"
+	"fmt"
+
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+	"echonakama/server/services/discord"
+	"echonakama/server/services/party"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// partyCommand lets players manage their party with its code from Discord.
+var partyCommand = &discordgo.ApplicationCommand{
+	Name:        "party",
+	Description: "Manage your EchoVR party",
+	Options: []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "create",
+			Description: "Create a party and get its code",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "join",
+			Description: "Join a party with its code",
+			Options: []*discordgo.ApplicationCommandOption{{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "code",
+				Description: "The party code",
+				Required:    true,
+			}},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "leave",
+			Description: "Leave your party",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "show",
+			Description: "Show your party and its code",
+		},
+	},
+}
+
+// handlePartyCommand runs a /party subcommand for the Nakama user linked to the Discord user.
+func handlePartyCommand(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, discordClient discord.Client, i *discordgo.InteractionCreate) {
+	respond := func(content string) {
+		if err := discordClient.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{Content: content, Flags: discordgo.MessageFlagsEphemeral},
+		}); err != nil {
+			logger.WithField("err", err).Warn("Unable to respond to party command.")
+		}
+	}
+
+	discordUser := i.User
+	if i.Member != nil {
+		discordUser = i.Member.User
+	}
+	// Players signed in with Discord have their Discord ID as their username
+	users, err := nk.UsersGetUsername(ctx, []string{discordUser.ID})
+	if err != nil || len(users) == 0 {
+		respond("Sign in with Discord before using parties.")
+		return
+	}
+	userId := users[0].GetId()
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		NakamaModule: nk,
+		Discord:      discordClient,
+	}
+	options := i.ApplicationCommandData().Options
+	if len(options) == 0 {
+		return
+	}
+	var p *party.Party
+	var apiErr *apierror.Error
+	switch options[0].Name {
+	case "create":
+		p, apiErr = party.CreateParty(serviceContext, userId)
+	case "join":
+		p, apiErr = party.Accept(serviceContext, userId, "", options[0].Options[0].StringValue())
+	case "leave":
+		apiErr = party.Leave(serviceContext, userId)
+	case "show":
+		p, apiErr = party.GetParty(serviceContext, userId)
+	}
+	if apiErr != nil {
+		apiErr.Log(logger, "party command failed")
+		respond(fmt.Sprintf("Unable to %s party: %s", options[0].Name, apiErr.Message))
+		return
+	}
+	if p == nil {
+		respond("You left your party.")
+		return
+	}
+	respond(fmt.Sprintf("Party code: **%s** (%d/%d members)", p.Code, len(p.Members), party.MaxPartySize))
+}
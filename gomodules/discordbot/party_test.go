@@ -0,0 +1,77 @@
+package discordbot
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"echonakama/server/services/discordtest"
+	"echonakama/server/services/nakamatest"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func partyInteraction(discordId string, subcommand string, options ...*discordgo.ApplicationCommandInteractionDataOption) *discordgo.InteractionCreate {
+	return &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+		ID:     "interaction-" + subcommand,
+		Type:   discordgo.InteractionApplicationCommand,
+		Member: &discordgo.Member{User: &discordgo.User{ID: discordId}},
+		Data: discordgo.ApplicationCommandInteractionData{
+			Name: partyCommand.Name,
+			Options: []*discordgo.ApplicationCommandInteractionDataOption{{
+				Name:    subcommand,
+				Type:    discordgo.ApplicationCommandOptionSubCommand,
+				Options: options,
+			}},
+		},
+	}}
+}
+
+func TestPartyCommand(t *testing.T) {
+	ctx := context.Background()
+	nk := nakamatest.NewModule()
+	logger := nakamatest.NewLogger(t)
+	discordClient := discordtest.NewClient()
+	for _, discordId := range []string{"1001", "1002"} {
+		if _, _, _, err := nk.AuthenticateCustom(ctx, discordId, discordId, true); err != nil {
+			t.Fatalf("AuthenticateCustom() error: %v", err)
+		}
+	}
+	lastResponse := func() string {
+		responses := discordClient.Responses()
+		if len(responses) == 0 {
+			t.Fatal("Responses() is empty, want a response")
+		}
+		return responses[len(responses)-1].Response.Data.Content
+	}
+
+	handlePartyCommand(ctx, logger, nk, discordClient, partyInteraction("9999", "create"))
+	if got := lastResponse(); !strings.Contains(got, "Sign in") {
+		t.Errorf("party create response = %q, want a sign in prompt", got)
+	}
+
+	handlePartyCommand(ctx, logger, nk, discordClient, partyInteraction("1001", "create"))
+	created := lastResponse()
+	if !strings.Contains(created, "(1/") {
+		t.Fatalf("party create response = %q, want a party of one", created)
+	}
+	code := created[strings.Index(created, "**")+2 : strings.LastIndex(created, "**")]
+
+	handlePartyCommand(ctx, logger, nk, discordClient, partyInteraction("1002", "join", &discordgo.ApplicationCommandInteractionDataOption{
+		Name:  "code",
+		Type:  discordgo.ApplicationCommandOptionString,
+		Value: code,
+	}))
+	if got := lastResponse(); !strings.Contains(got, code) || !strings.Contains(got, "(2/") {
+		t.Errorf("party join response = %q, want party %s of two", got, code)
+	}
+
+	handlePartyCommand(ctx, logger, nk, discordClient, partyInteraction("1002", "leave"))
+	if got := lastResponse(); got != "You left your party." {
+		t.Errorf("party leave response = %q, want the party left", got)
+	}
+	handlePartyCommand(ctx, logger, nk, discordClient, partyInteraction("1001", "show"))
+	if got := lastResponse(); !strings.Contains(got, "(1/") {
+		t.Errorf("party show response = %q, want a party of one", got)
+	}
+}
@@ -9,24 +9,26 @@ package game
 import (
 	"encoding/json"
 	"fmt"
-
-	"github.com/go-playground/validator/v10"
 )
 
-// MergePlayerData merges a partial PlayerData with a template PlayerData.
-func (base *EchoPlayerPreferences) Merge(partial *EchoPlayerPreferences) (*EchoPlayerPreferences, error) {
-
-	partialJSON, err := json.Marshal(partial)
+// Merge returns a copy of the profile with the fields present in the partial JSON replaced.
+// Fields missing from the partial keep their current values; the profile itself is not changed.
+func (base *EchoPlayerPreferences) Merge(partial json.RawMessage) (*EchoPlayerPreferences, error) {
+	baseJSON, err := json.Marshal(base)
 	if err != nil {
-		return nil, fmt.Errorf("error marshaling partial data: %v", err)
+		return nil, fmt.Errorf("error marshaling profile: %v", err)
 	}
 
-	err = json.Unmarshal(partialJSON, &base)
-	if err != nil {
+	// Copy through JSON, so the merged profile shares no slices with the base
+	merged := &EchoPlayerPreferences{}
+	if err := json.Unmarshal(baseJSON, merged); err != nil {
+		return nil, fmt.Errorf("error copying profile: %v", err)
+	}
+	if err := json.Unmarshal(partial, merged); err != nil {
 		return nil, fmt.Errorf("error unmarshaling partial data: %v", err)
 	}
 
-	return base, nil
+	return merged, nil
 }
 
 // Profiles represents the 'profile' field in the JSON data
@@ -45,27 +47,17 @@ func (r *GameProfiles) Marshal() ([]byte, error) {
 	return json.Marshal(r)
 }
 
-// Structure
-func customFunc(fl validator.FieldLevel) bool {
-
-	if fl.Field().String() == "invalid" {
-		return false
-	}
-
-	return true
-}
-
 type EchoPlayerPreferences struct {
 	// WARNING: EchoVR dictates this struct/schema.
 	DisplayName     string `json:"displayname" validate:"required,printascii,min=3,max=20"`
-	EchoUserIdToken string `json:"xplatformid" validate:"required"`
+	EchoUserIdToken string `json:"xplatformid" validate:"required,echouserid"`
 
 	// The team name shown on the spectator scoreboard overlay
 	TeamName           string            `json:"teamname,omitempty" validate:"omitempty,ascii"`
-	CombatWeapon       string            `json:"weapon" validate:"omitnil,oneof=assault blaster rocket scout magnum smg chain rifle"`
-	CombatGrenade      string            `json:"grenade" validate:"omitnil,oneof=arc burst det stun loc"`
+	CombatWeapon       string            `json:"weapon" validate:"omitempty,oneof=assault blaster rocket scout magnum smg chain rifle"`
+	CombatGrenade      string            `json:"grenade" validate:"omitempty,oneof=arc burst det stun loc"`
 	CombatDominantHand uint8             `json:"weaponarm" validate:"eq=0|eq=1"`
-	ModifyTime         int64             `json:"modifytime" validate:"required"`
+	ModifyTime         int64             `json:"modifytime" validate:"gte=0"`
 	CombatAbility      string            `json:"ability" validate:"required"`
 	LegalConsents      LegalConsents     `json:"legal" validate:"required"`
 	MutedPlayers       Players           `json:"mute" validate:"required"`
@@ -73,29 +65,29 @@ type EchoPlayerPreferences struct {
 	NewPlayerProgress  NewPlayerProgress `json:"npe" validate:"required"`
 	Customization      Customization     `json:"customization" validate:"required"`
 	Social             Social            `json:"social" validate:"required"`
-	NewUnlocks         []int64           `json:"newunlocks" validate:"required"`
+	NewUnlocks         []int64           `json:"newunlocks" validate:"omitempty,dive,gte=0"`
 }
 
 type Customization struct {
 	// WARNING: EchoVR dictates this struct/schema.
-	BattlePassSeasonPoiVersion uint16 `json:"battlepass_season_poi_version" validate:"required"` // Battle pass season point of interest version (manually set to 3246)
-	NewUnlocksPoiVersion       uint16 `json:"new_unlocks_poi_version" validate:"required"`       // New unlocks point of interest version
-	StoreEntryPoiVersion       uint16 `json:"store_entry_poi_version" validate:"required"`       // Store entry point of interest version
-	ClearNewUnlocksVersion     uint16 `json:"clear_new_unlocks_version" validate:"required"`     // Clear new unlocks version
+	BattlePassSeasonPoiVersion uint16 `json:"battlepass_season_poi_version" validate:"gte=0"` // Battle pass season point of interest version (manually set to 3246)
+	NewUnlocksPoiVersion       uint16 `json:"new_unlocks_poi_version" validate:"gte=0"`       // New unlocks point of interest version
+	StoreEntryPoiVersion       uint16 `json:"store_entry_poi_version" validate:"gte=0"`       // Store entry point of interest version
+	ClearNewUnlocksVersion     uint16 `json:"clear_new_unlocks_version" validate:"gte=0"`     // Clear new unlocks version
 }
 
 type Players struct {
 	// WARNING: EchoVR dictates this struct/schema.
-	UserIds []string `json:"users" validate:"required"`
+	UserIds []string `json:"users" validate:"omitempty,dive,required"`
 }
 
 type LegalConsents struct {
 	// WARNING: EchoVR dictates this struct/schema.
-	PointsPolicyVersion int64 `json:"points_policy_version" validate:"required"`
-	EulaVersion         int64 `json:"eula_version" validate:"required"`
-	GameAdminVersion    int64 `json:"game_admin_version" validate:"required"`
-	SplashScreenVersion int64 `json:"splash_screen_version" validate:"required"`
-	GroupsLegalVersion  int64 `json:"groups_legal_version" validate:"required"`
+	PointsPolicyVersion int64 `json:"points_policy_version" validate:"gte=0"`
+	EulaVersion         int64 `json:"eula_version" validate:"gte=0"`
+	GameAdminVersion    int64 `json:"game_admin_version" validate:"gte=0"`
+	SplashScreenVersion int64 `json:"splash_screen_version" validate:"gte=0"`
+	GroupsLegalVersion  int64 `json:"groups_legal_version" validate:"gte=0"`
 }
 
 type NewPlayerProgress struct {
@@ -113,35 +105,35 @@ type NewPlayerProgress struct {
 
 type NpeMilestone struct {
 	// WARNING: EchoVR dictates this struct/schema.
-	Completed bool `json:"completed" validate:"boolean required"` // User has completed the milestone
+	Completed bool `json:"completed" validate:"boolean"` // User has completed the milestone
 }
 
 type Versioned struct {
 	// WARNING: EchoVR dictates this struct/schema.
-	Version int `json:"version" validate:"gte=0 required"` // A version number, 1 is seen, 0 is not seen ?
+	Version int `json:"version" validate:"gte=0"` // A version number, 1 is seen, 0 is not seen ?
 }
 
 type Social struct {
 	// WARNING: EchoVR dictates this struct/schema.
-	CommunityValuesVersion int64  `json:"community_values_version" validate:"gte=0,required"`
-	SetupVersion           int64  `json:"setup_version" validate:"gte=0,required"`
-	Group                  string `json:"group" validate:"uuid4,required"`
+	CommunityValuesVersion int64  `json:"community_values_version" validate:"gte=0"`
+	SetupVersion           int64  `json:"setup_version" validate:"gte=0"`
+	Group                  string `json:"group" validate:"omitempty,uuid_rfc4122"`
 }
 
 type ServerProfile struct {
 	// WARNING: EchoVR dictates this struct/schema.
 	DisplayName       string            `json:"displayname" validate:"required,printascii,min=3,max=20"`
-	EchoUserIdToken   string            `json:"xplatformid" validate:"required"`
-	SchemaVersion     int16             `json:"_version" validate:"gte=0,required"`            // Version of the schema(?)
-	PublisherLock     string            `json:"publisher_lock" validate:"required"`            // unused atm
-	PurchasedCombat   int8              `json:"purchasedcombat" validate:"eq=0|eq=1,required"` // unused (combat was made free)
-	LobbyVersion      int64             `json:"lobbyversion" validate:"gte=0,required"`        // set from the login request (no known effect)
-	ModifyTime        int64             `json:"modifytime" validate:"gte=0,required"`
-	LoginTime         int64             `json:"logintime" validate:"gte=0,required"`
-	UpdateTime        int64             `json:"updatetime" validate:"gte=0,required"`
-	CreateTime        int64             `json:"createtime" validate:"gte=0,required"`
+	EchoUserIdToken   string            `json:"xplatformid" validate:"required,echouserid"`
+	SchemaVersion     int16             `json:"_version" validate:"gte=0"`                 // Version of the schema(?)
+	PublisherLock     string            `json:"publisher_lock" validate:"omitempty,ascii"` // unused atm
+	PurchasedCombat   int8              `json:"purchasedcombat" validate:"eq=0|eq=1"`      // unused (combat was made free)
+	LobbyVersion      int64             `json:"lobbyversion" validate:"gte=0"`             // set from the login request (no known effect)
+	ModifyTime        int64             `json:"modifytime" validate:"gte=0"`
+	LoginTime         int64             `json:"logintime" validate:"gte=0"`
+	UpdateTime        int64             `json:"updatetime" validate:"gte=0"`
+	CreateTime        int64             `json:"createtime" validate:"gte=0"`
 	Statistics        PlayerStatistics  `json:"stats" validate:"required"`
-	MaybeStale        *bool             `json:"maybestale" validate:"boolean,required"`
+	MaybeStale        *bool             `json:"maybestale" validate:"omitnil,boolean"`
 	UnlockedCosmetics UnlockedCosmetics `json:"unlocks"`
 	EquippedCosmetics EquippedCosmetics `json:"loadout"`
 	Social            Social            `json:"social"`
@@ -152,8 +144,8 @@ type ServerProfile struct {
 
 type DeveloperFeatures struct {
 	// WARNING: EchoVR dictates this struct/schema.
-	DisableAfkTimeout bool   `json:"disable_afk_timeout" validate:"boolean required"`
-	EchoUserIdToken   string `json:"xplatformid" validate:"required"`
+	DisableAfkTimeout bool   `json:"disable_afk_timeout" validate:"boolean"`
+	EchoUserIdToken   string `json:"xplatformid" validate:"omitempty,echouserid"`
 }
 
 type PlayerStatistics struct {
@@ -244,30 +236,30 @@ type CombatStatistics struct {
 
 type CountedDiscreteStatistic struct {
 	Count   int64  `json:"cnt" validate:"gte=0,required_with=Operand Value"`
-	Operand string `json:"op" validate:"oneof=add rep max, required_with=Count Value"`
+	Operand string `json:"op" validate:"required_with=Count Value,omitempty,oneof=add rep max"`
 	Value   uint64 `json:"val" validate:"gte=0,required_with=Operand Count"`
 }
 
 type CountedContinuousStatistic struct {
-	Operand string  `json:"op" validate:"oneof=add rep max,required_with=Count Value"`
+	Operand string  `json:"op" validate:"required_with=Count Value,omitempty,oneof=add rep max"`
 	Value   float64 `json:"val" validate:"gte=0,required_with=Operand Count"`
 	Count   uint64  `json:"cnt" validate:"gte=0,required_with=Operand Value"`
 }
 
 type DiscreteStatistic struct {
-	Operand string `json:"op" validate:"oneof=add rep max,required_with=Value"`
+	Operand string `json:"op" validate:"required_with=Value,omitempty,oneof=add rep max"`
 	Value   uint64 `json:"val" validate:"gte=0,required_with=Operand"`
 }
 
 type ContinuousStatistic struct {
-	Operand string  `json:"op" validate:"oneof=add rep max,required_with=Value"`
+	Operand string  `json:"op" validate:"required_with=Value,omitempty,oneof=add rep max"`
 	Value   float64 `json:"val" validate:"gte=0,required_with=Operand"`
 }
 
 type Level struct {
-	Count   uint8  `json:"cnt" validate:"gte=0,required"`
-	Operand string `json:"op" validate:"oneof=add,required"`
-	Value   uint8  `json:"val" validate:"gte=0,required"`
+	Count   uint8  `json:"cnt" validate:"gte=0"`
+	Operand string `json:"op" validate:"required,oneof=add"`
+	Value   uint8  `json:"val" validate:"gte=0"`
 }
 
 type DailyStats struct {
@@ -1302,7 +1294,7 @@ func DefaultClientProfile(echoUserId EchoUserId, displayName string) EchoPlayerP
 		Social: Social{
 			CommunityValuesVersion: 1,
 			SetupVersion:           1,
-			Group:                  "90DD4DB5-B5DD-4655-839E-FDBE5F4BC0BF",
+			Group:                  DefaultChannelUuid,
 		},
 		NewUnlocks: []int64{},
 	}
@@ -1401,6 +1393,7 @@ func DefaultServerProfile(gameUserId EchoUserId, displayName string) ServerProfi
 		return ServerProfile{}
 	}
 	serverProfile.EchoUserIdToken = gameUserId.String()
+	serverProfile.DisplayName = displayName
 	return serverProfile
 }
 
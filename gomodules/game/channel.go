@@ -0,0 +1,29 @@
+package game
+
+// DefaultChannelUuid is the social channel new profiles start in, until the player is assigned one.
+const DefaultChannelUuid = "90DD4DB5-B5DD-4655-839E-FDBE5F4BC0BF"
+
+// ChannelInfo lists the social channels (groups) a player can choose from.
+type ChannelInfo struct {
+	// WARNING: EchoVR dictates this schema.
+	Groups []ChannelGroup `json:"group"`
+}
+
+// ChannelGroup is a social channel, as shown to the game client.
+type ChannelGroup struct {
+	// WARNING: EchoVR dictates this schema.
+	ChannelUuid  string `json:"channeluuid" validate:"required,uuid_rfc4122"` // the channel id, stored in the client profile's social.group
+	Name         string `json:"name" validate:"required,printascii,max=64"`
+	Description  string `json:"description" validate:"max=256"`
+	Rules        string `json:"rules"`
+	RulesVersion int64  `json:"rules_version" validate:"gte=0"`
+	Link         string `json:"link" validate:"omitempty,url"`
+	Priority     int64  `json:"priority" validate:"gte=0"` // the order the channel is listed in
+	Rad          bool   `json:"_rad"`
+}
+
+// Validate checks the channel against its validation tags.
+// It returns ValidationErrors listing each invalid field.
+func (g *ChannelGroup) Validate() error {
+	return validateStruct("channel", g)
+}
@@ -0,0 +1,76 @@
+package game
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	MainMenuConfigType = "main_menu"
+)
+
+// ConfigResource is a configuration resource the relay serves to game clients.
+// Each resource is identified by its type and id.
+type ConfigResource interface {
+	ConfigType() string
+	ConfigId() string
+	Validate() error
+}
+
+// configResourceTypes maps each config type to a constructor for its resource.
+var configResourceTypes = map[string]func() ConfigResource{
+	MainMenuConfigType: func() ConfigResource { return &MainMenuConfig{} },
+}
+
+// ConfigTypes returns the known config types, sorted.
+func ConfigTypes() []string {
+	types := make([]string, 0, len(configResourceTypes))
+	for configType := range configResourceTypes {
+		types = append(types, configType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// NewConfigResource returns an empty resource of the given config type.
+func NewConfigResource(configType string) (ConfigResource, error) {
+	newResource, ok := configResourceTypes[configType]
+	if !ok {
+		return nil, fmt.Errorf("unknown config type: %q", configType)
+	}
+	return newResource(), nil
+}
+
+// MainMenuConfig is the news and splash screen shown on the main menu.
+type MainMenuConfig struct {
+	// WARNING: EchoVR dictates this schema.
+	Type          string     `json:"type" validate:"eq=main_menu"`
+	Id            string     `json:"id" validate:"required,printascii,max=64"`
+	Timestamp     int64      `json:"_ts" validate:"gte=0"`
+	News          []NewsItem `json:"news" validate:"dive"`
+	Splash        []NewsItem `json:"splash" validate:"dive"`
+	SplashVersion int64      `json:"splash_version" validate:"gte=0"`
+	HelpLink      string     `json:"help_link" validate:"omitempty,url"`
+	NewsLink      string     `json:"news_link" validate:"omitempty,url"`
+	DiscordLink   string     `json:"discord_link" validate:"omitempty,url"`
+}
+
+// NewsItem is a single image, and the page it links to.
+type NewsItem struct {
+	Texture string `json:"texture" validate:"required"`
+	Link    string `json:"link" validate:"omitempty,url"`
+}
+
+func (c *MainMenuConfig) ConfigType() string {
+	return c.Type
+}
+
+func (c *MainMenuConfig) ConfigId() string {
+	return c.Id
+}
+
+// Validate checks the config against its validation tags.
+// It returns ValidationErrors listing each invalid field.
+func (c *MainMenuConfig) Validate() error {
+	return validateStruct("config", c)
+}
@@ -0,0 +1,60 @@
+package game
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestNewConfigResource(t *testing.T) {
+	resource, err := NewConfigResource(MainMenuConfigType)
+	if err != nil {
+		t.Fatalf("NewConfigResource() error: %v", err)
+	}
+	if _, ok := resource.(*MainMenuConfig); !ok {
+		t.Errorf("NewConfigResource() = %T, want *MainMenuConfig", resource)
+	}
+
+	if _, err := NewConfigResource("unknown"); err == nil {
+		t.Errorf("NewConfigResource(\"unknown\") error = nil, want error")
+	}
+}
+
+func TestMainMenuConfigValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		wantField string
+	}{
+		{"valid", `{"type":"main_menu","id":"main_menu","news":[{"texture":"news_1","link":"https://example.com/news"}],"splash":[],"help_link":"https://example.com"}`, ""},
+		{"wrong type", `{"type":"news","id":"main_menu"}`, "config.type"},
+		{"missing id", `{"type":"main_menu"}`, "config.id"},
+		{"missing texture", `{"type":"main_menu","id":"main_menu","news":[{"link":"https://example.com"}]}`, "config.news[0].texture"},
+		{"invalid link", `{"type":"main_menu","id":"main_menu","discord_link":"not a url"}`, "config.discord_link"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &MainMenuConfig{}
+			if err := json.Unmarshal([]byte(tt.data), config); err != nil {
+				t.Fatalf("json.Unmarshal() error: %v", err)
+			}
+
+			err := config.Validate()
+			if tt.wantField == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v, want nil", err)
+				}
+				return
+			}
+
+			var fieldErrors ValidationErrors
+			if !errors.As(err, &fieldErrors) {
+				t.Fatalf("Validate() error = %v, want ValidationErrors", err)
+			}
+			if fieldErrors[0].Field != tt.wantField {
+				t.Errorf("Validate() field = %q, want %q", fieldErrors[0].Field, tt.wantField)
+			}
+		})
+	}
+}
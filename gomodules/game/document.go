@@ -0,0 +1,141 @@
+package game
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	EulaDocumentType = "eula"
+
+	// LegalConsentsProfileKey prefixes the profile keys a document marks as read (e.g. "legal|eula_version").
+	LegalConsentsProfileKey = "legal|"
+)
+
+// DocumentResource is a localized document the relay serves to game clients.
+// Each document is identified by its type and language.
+type DocumentResource interface {
+	DocumentType() string
+	DocumentLang() string
+	Validate() error
+	// ConsentVersions returns the version of each legal consent the document asks players to accept,
+	// keyed by the client profile key it is recorded in.
+	ConsentVersions() map[string]int64
+}
+
+// documentResourceTypes maps each document type to a constructor for its resource.
+var documentResourceTypes = map[string]func() DocumentResource{
+	EulaDocumentType: func() DocumentResource { return &EulaDocument{} },
+}
+
+// DocumentTypes returns the known document types, sorted.
+func DocumentTypes() []string {
+	types := make([]string, 0, len(documentResourceTypes))
+	for documentType := range documentResourceTypes {
+		types = append(types, documentType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// NewDocumentResource returns an empty resource of the given document type.
+func NewDocumentResource(documentType string) (DocumentResource, error) {
+	newResource, ok := documentResourceTypes[documentType]
+	if !ok {
+		return nil, fmt.Errorf("unknown document type: %q", documentType)
+	}
+	return newResource(), nil
+}
+
+// EulaDocument is the end user license agreement, and the game administration terms.
+type EulaDocument struct {
+	// WARNING: EchoVR dictates this schema.
+	Type                   string `json:"type" validate:"eq=eula"`
+	Lang                   string `json:"lang" validate:"required,bcp47_language_tag"`
+	Version                int64  `json:"version" validate:"gte=0"`
+	VersionGa              int64  `json:"version_ga" validate:"gte=0"`
+	Text                   string `json:"text" validate:"required"`
+	TextGa                 string `json:"text_ga"`
+	MarkAsReadProfileKey   string `json:"mark_as_read_profile_key" validate:"omitempty,legalconsent"`
+	MarkAsReadProfileKeyGa string `json:"mark_as_read_profile_key_ga" validate:"omitempty,legalconsent"`
+	LinkCc                 string `json:"link_cc" validate:"omitempty,url"`
+	LinkPp                 string `json:"link_pp" validate:"omitempty,url"`
+	LinkVR                 string `json:"link_vr" validate:"omitempty,url"`
+	LinkCp                 string `json:"link_cp" validate:"omitempty,url"`
+	LinkEc                 string `json:"link_ec" validate:"omitempty,url"`
+	LinkEa                 string `json:"link_ea" validate:"omitempty,url"`
+	LinkGa                 string `json:"link_ga" validate:"omitempty,url"`
+	LinkTc                 string `json:"link_tc" validate:"omitempty,url"`
+}
+
+func (d *EulaDocument) DocumentType() string {
+	return d.Type
+}
+
+func (d *EulaDocument) DocumentLang() string {
+	return d.Lang
+}
+
+// Validate checks the document against its validation tags.
+// It returns ValidationErrors listing each invalid field.
+func (d *EulaDocument) Validate() error {
+	return validateStruct("document", d)
+}
+
+func (d *EulaDocument) ConsentVersions() map[string]int64 {
+	versions := make(map[string]int64, 2)
+	if d.MarkAsReadProfileKey != "" {
+		versions[d.MarkAsReadProfileKey] = d.Version
+	}
+	if d.MarkAsReadProfileKeyGa != "" {
+		versions[d.MarkAsReadProfileKeyGa] = d.VersionGa
+	}
+	return versions
+}
+
+// Versions returns the accepted version of each legal consent, keyed by its profile key (e.g. "legal|eula_version").
+func (c *LegalConsents) Versions() map[string]int64 {
+	data, _ := json.Marshal(c)
+	fields := make(map[string]int64)
+	_ = json.Unmarshal(data, &fields)
+
+	versions := make(map[string]int64, len(fields))
+	for field, version := range fields {
+		versions[LegalConsentsProfileKey+field] = version
+	}
+	return versions
+}
+
+// ResetOutdated resets the consents accepted in an older version than the current one (keyed by profile key,
+// as returned by Versions), so the game asks the player to accept them again. It returns the reset profile keys, sorted.
+func (c *LegalConsents) ResetOutdated(current map[string]int64) []string {
+	data, _ := json.Marshal(c)
+	fields := make(map[string]int64)
+	_ = json.Unmarshal(data, &fields)
+
+	var reset []string
+	for field, version := range fields {
+		if version != 0 && version < current[LegalConsentsProfileKey+field] {
+			fields[field] = 0
+			reset = append(reset, LegalConsentsProfileKey+field)
+		}
+	}
+	if len(reset) == 0 {
+		return nil
+	}
+	data, _ = json.Marshal(fields)
+	_ = json.Unmarshal(data, c)
+	sort.Strings(reset)
+	return reset
+}
+
+// isLegalConsentKey validates that the field is the profile key of a legal consent (e.g. "legal|eula_version").
+func isLegalConsentKey(value string) bool {
+	if !strings.HasPrefix(value, LegalConsentsProfileKey) {
+		return false
+	}
+	_, found := (&LegalConsents{}).Versions()[value]
+	return found
+}
@@ -0,0 +1,69 @@
+package game
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEulaDocumentValidate(t *testing.T) {
+	valid := EulaDocument{
+		Type:                   EulaDocumentType,
+		Lang:                   "en",
+		Version:                2,
+		VersionGa:              1,
+		Text:                   "terms",
+		MarkAsReadProfileKey:   "legal|eula_version",
+		MarkAsReadProfileKeyGa: "legal|game_admin_version",
+		LinkTc:                 "https://example.com/terms",
+	}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Validate() error = %v, want nil", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(d *EulaDocument)
+	}{
+		{"wrong type", func(d *EulaDocument) { d.Type = "news" }},
+		{"invalid lang", func(d *EulaDocument) { d.Lang = "not a language" }},
+		{"unknown consent", func(d *EulaDocument) { d.MarkAsReadProfileKey = "legal|unknown_version" }},
+		{"not a consent", func(d *EulaDocument) { d.MarkAsReadProfileKey = "eula_version" }},
+		{"invalid link", func(d *EulaDocument) { d.LinkPp = "privacy" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			document := valid
+			tt.modify(&document)
+			if err := document.Validate(); err == nil {
+				t.Errorf("Validate() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestLegalConsentsVersions(t *testing.T) {
+	consents := LegalConsents{EulaVersion: 3, GameAdminVersion: 1}
+	versions := consents.Versions()
+	if versions["legal|eula_version"] != 3 || versions["legal|game_admin_version"] != 1 {
+		t.Errorf("Versions() = %v, want eula_version 3 and game_admin_version 1", versions)
+	}
+	if len(versions) != 5 {
+		t.Errorf("Versions() has %d consents, want 5", len(versions))
+	}
+}
+
+func TestLegalConsentsResetOutdated(t *testing.T) {
+	consents := LegalConsents{EulaVersion: 2, GameAdminVersion: 1, PointsPolicyVersion: 4}
+	reset := consents.ResetOutdated(map[string]int64{"legal|eula_version": 3, "legal|game_admin_version": 1, "legal|splash_screen_version": 2})
+	if !reflect.DeepEqual(reset, []string{"legal|eula_version"}) {
+		t.Errorf("ResetOutdated() = %v, want only legal|eula_version", reset)
+	}
+	expected := LegalConsents{GameAdminVersion: 1, PointsPolicyVersion: 4}
+	if consents != expected {
+		t.Errorf("ResetOutdated() consents = %+v, want %+v", consents, expected)
+	}
+
+	if reset := consents.ResetOutdated(map[string]int64{"legal|game_admin_version": 1}); reset != nil {
+		t.Errorf("ResetOutdated() = %v, want nothing reset", reset)
+	}
+}
@@ -0,0 +1,40 @@
+package game
+
+// GameMode is the symbol EchoVR uses for a game mode.
+type GameMode string
+
+const (
+	ModeArena         GameMode = "echo_arena"
+	ModeArenaPrivate  GameMode = "echo_arena_private"
+	ModeCombat        GameMode = "echo_combat"
+	ModeCombatPrivate GameMode = "echo_combat_private"
+	ModeSocial        GameMode = "social_2.0"
+	ModeSocialPrivate GameMode = "social_2.0_private"
+	ModeSocialNPE     GameMode = "social_2.0_npe"
+)
+
+// GameModes lists the game modes EchoVR supports.
+var GameModes = []GameMode{
+	ModeArena,
+	ModeArenaPrivate,
+	ModeCombat,
+	ModeCombatPrivate,
+	ModeSocial,
+	ModeSocialPrivate,
+	ModeSocialNPE,
+}
+
+// IsValid returns true if the mode is one EchoVR supports.
+func (m GameMode) IsValid() bool {
+	for _, mode := range GameModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSocial returns true if the mode is a social lobby.
+func (m GameMode) IsSocial() bool {
+	return m == ModeSocial || m == ModeSocialPrivate || m == ModeSocialNPE
+}
@@ -0,0 +1,27 @@
+package game
+
+import "testing"
+
+func TestGameMode(t *testing.T) {
+	tests := []struct {
+		mode   GameMode
+		valid  bool
+		social bool
+	}{
+		{ModeArena, true, false},
+		{ModeCombatPrivate, true, false},
+		{ModeSocial, true, true},
+		{ModeSocialNPE, true, true},
+		{GameMode("echo_soccer"), false, false},
+		{GameMode(""), false, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.mode.IsValid(); got != tt.valid {
+			t.Errorf("GameMode(%q).IsValid() = %v, want %v", tt.mode, got, tt.valid)
+		}
+		if got := tt.mode.IsSocial(); got != tt.social {
+			t.Errorf("GameMode(%q).IsSocial() = %v, want %v", tt.mode, got, tt.social)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package game
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+const (
+	// LoadoutCorrectionNotOwned indicates the equipped item is not unlocked on the account.
+	LoadoutCorrectionNotOwned = "not_owned"
+	// LoadoutCorrectionWrongCategory indicates the equipped item does not belong in the slot.
+	LoadoutCorrectionWrongCategory = "wrong_category"
+)
+
+// loadoutSlotNames is the order in which loadout slots are validated.
+var loadoutSlotNames = []string{
+	"decal", "decal_body", "emote", "secondemote", "second_emote",
+	"tint", "tint_body", "tint_alignment_a", "tint_alignment_b",
+	"pattern", "pattern_body", "pip", "chassis", "bracer", "booster",
+	"title", "tag", "banner", "medal", "goal_fx", "emissive",
+}
+
+// loadoutSlotCategories maps each loadout slot to the item name prefixes it accepts.
+var loadoutSlotCategories = map[string][]string{
+	"decal":            {"decal_", "rwd_decal_"},
+	"decal_body":       {"decal_", "rwd_decal_"},
+	"emote":            {"emote_", "rwd_emote_"},
+	"secondemote":      {"emote_", "rwd_emote_"},
+	"second_emote":     {"emote_", "rwd_emote_"},
+	"tint":             {"tint_", "rwd_tint_"},
+	"tint_body":        {"tint_", "rwd_tint_"},
+	"tint_alignment_a": {"tint_", "rwd_tint_"},
+	"tint_alignment_b": {"tint_", "rwd_tint_"},
+	"pattern":          {"pattern_", "rwd_pattern_"},
+	"pattern_body":     {"pattern_", "rwd_pattern_"},
+	"pip":              {"rwd_pip_", "rwd_decalback_"},
+	"chassis":          {"rwd_chassis_"},
+	"bracer":           {"rwd_bracer_"},
+	"booster":          {"rwd_booster_"},
+	"title":            {"rwd_title_"},
+	"tag":              {"rwd_tag_"},
+	"banner":           {"rwd_banner_"},
+	"medal":            {"rwd_medal_"},
+	"goal_fx":          {"rwd_goal_fx_"},
+	"emissive":         {"emissive_", "rwd_emissive_"},
+}
+
+// LoadoutCorrection records an equipped item that was replaced with the slot default.
+type LoadoutCorrection struct {
+	Slot        string `json:"slot"`        // the loadout slot that was corrected
+	Item        string `json:"item"`        // the item that was equipped
+	Replacement string `json:"replacement"` // the slot default that replaced it
+	Reason      string `json:"reason"`      // why the item was rejected
+}
+
+// fields maps each slot's JSON name to the field holding its equipped item.
+func (s *Slots) fields() map[string]*string {
+	return map[string]*string{
+		"decal":            &s.Decal,
+		"decal_body":       &s.DecalBody,
+		"emote":            &s.Emote,
+		"secondemote":      &s.Secondemote,
+		"second_emote":     &s.SecondEmote,
+		"tint":             &s.Tint,
+		"tint_body":        &s.TintBody,
+		"tint_alignment_a": &s.TintAlignmentA,
+		"tint_alignment_b": &s.TintAlignmentB,
+		"pattern":          &s.Pattern,
+		"pattern_body":     &s.PatternBody,
+		"pip":              &s.Pip,
+		"chassis":          &s.Chassis,
+		"bracer":           &s.Bracer,
+		"booster":          &s.Booster,
+		"title":            &s.Title,
+		"tag":              &s.Tag,
+		"banner":           &s.Banner,
+		"medal":            &s.Medal,
+		"goal_fx":          &s.GoalFx,
+		"emissive":         &s.Emissive,
+	}
+}
+
+// DefaultLoadoutSlots returns the loadout every new profile starts with.
+func DefaultLoadoutSlots() Slots {
+	return DefaultServerProfile(EchoUserId{}, "").EquippedCosmetics.Instances.Unified.Slots
+}
+
+// Owned returns the set of cosmetics unlocked in either the arena or combat unlocks.
+func (u *UnlockedCosmetics) Owned() map[string]bool {
+	owned := make(map[string]bool)
+	for _, unlocks := range []interface{}{u.Arena, u.Combat} {
+		data, err := json.Marshal(unlocks)
+		if err != nil {
+			continue
+		}
+		m := make(map[string]bool)
+		if err := json.Unmarshal(data, &m); err != nil {
+			continue
+		}
+		for item, unlocked := range m {
+			if unlocked {
+				owned[item] = true
+			}
+		}
+	}
+	return owned
+}
+
+// ValidateLoadout checks each equipped item against the profile's unlocks and the
+// slot's category, replaces invalid items with the slot default, and returns the
+// corrections that were made. Empty slots are left as they are.
+func (p *ServerProfile) ValidateLoadout() []LoadoutCorrection {
+	owned := p.UnlockedCosmetics.Owned()
+	defaults := DefaultLoadoutSlots()
+	defaultFields := defaults.fields()
+	slotFields := p.EquippedCosmetics.Instances.Unified.Slots.fields()
+
+	var corrections []LoadoutCorrection
+	for _, slot := range loadoutSlotNames {
+		item := *slotFields[slot]
+		if item == "" || item == *defaultFields[slot] {
+			continue
+		}
+
+		reason := ""
+		if !slotAccepts(slot, item) {
+			reason = LoadoutCorrectionWrongCategory
+		} else if !owned[item] {
+			reason = LoadoutCorrectionNotOwned
+		}
+		if reason == "" {
+			continue
+		}
+
+		*slotFields[slot] = *defaultFields[slot]
+		corrections = append(corrections, LoadoutCorrection{
+			Slot:        slot,
+			Item:        item,
+			Replacement: *defaultFields[slot],
+			Reason:      reason,
+		})
+	}
+	return corrections
+}
+
+// slotAccepts reports whether the item belongs to a category allowed in the slot.
+func slotAccepts(slot string, item string) bool {
+	for _, prefix := range loadoutSlotCategories[slot] {
+		if strings.HasPrefix(item, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package game
+
+import "testing"
+
+func TestServerProfile_ValidateLoadout(t *testing.T) {
+	tests := []struct {
+		name        string
+		slot        string
+		item        string
+		unlock      func(p *ServerProfile)
+		expected    string
+		reason      string
+		corrections int
+	}{
+		{"default item", "emote", "emote_blink_smiley_a", nil, "emote_blink_smiley_a", "", 0},
+		{"owned item", "decal", "decal_sheldon_a", nil, "decal_sheldon_a", "", 0},
+		{"owned combat item", "booster", "rwd_booster_s10", nil, "rwd_booster_s10", "", 0},
+		{"not owned", "decal", "decal_rose_a", nil, "decal_default", LoadoutCorrectionNotOwned, 1},
+		{"newly unlocked", "decal", "decal_rose_a", func(p *ServerProfile) { p.UnlockedCosmetics.Arena.DecalRoseA = true }, "decal_rose_a", "", 0},
+		{"wrong category", "decal", "emote_default", nil, "decal_default", LoadoutCorrectionWrongCategory, 1},
+		{"unknown item", "chassis", "rwd_chassis_does_not_exist", nil, "rwd_chassis_body_s11_a", LoadoutCorrectionNotOwned, 1},
+		{"empty slot", "second_emote", "", nil, "", "", 0},
+	}
+
+	for _, tt := range tests {
+		profile := DefaultServerProfile(EchoUserId{PlatformCode: STM, AccountId: 12345}, "Player")
+		if tt.unlock != nil {
+			tt.unlock(&profile)
+		}
+		slots := &profile.EquippedCosmetics.Instances.Unified.Slots
+		*slots.fields()[tt.slot] = tt.item
+
+		corrections := profile.ValidateLoadout()
+
+		if len(corrections) != tt.corrections {
+			t.Fatalf("%s: ValidateLoadout() returned %d corrections, want %d: %v", tt.name, len(corrections), tt.corrections, corrections)
+		}
+		if got := *slots.fields()[tt.slot]; got != tt.expected {
+			t.Errorf("%s: slot %s = %q, want %q", tt.name, tt.slot, got, tt.expected)
+		}
+		if tt.corrections > 0 {
+			c := corrections[0]
+			if c.Slot != tt.slot || c.Item != tt.item || c.Replacement != tt.expected || c.Reason != tt.reason {
+				t.Errorf("%s: correction = %+v", tt.name, c)
+			}
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package game
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// structValidator validates profiles and other game data against their `validate:` tags.
+var structValidator = newStructValidator()
+
+func newStructValidator() *validator.Validate {
+	v := validator.New()
+
+	// Report fields by their JSON names, which are what the game and relays see.
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+
+	if err := v.RegisterValidation("echouserid", isEchoUserIdToken); err != nil {
+		panic(err)
+	}
+	if err := v.RegisterValidation("legalconsent", func(fl validator.FieldLevel) bool {
+		return isLegalConsentKey(fl.Field().String())
+	}); err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// isEchoUserIdToken validates that the field is a valid EchoUserId token (e.g. "OVR-1234").
+func isEchoUserIdToken(fl validator.FieldLevel) bool {
+	echoUserId, err := (&EchoUserId{}).Parse(fl.Field().String())
+	return err == nil && echoUserId.Valid()
+}
+
+// FieldError describes a single field that failed validation.
+type FieldError struct {
+	Field string      `json:"field"` // the JSON path of the field (e.g. "client.legal.eula_version")
+	Rule  string      `json:"rule"`  // the validation rule that failed
+	Param string      `json:"param"` // the rule's parameter, if any
+	Value interface{} `json:"value"` // the rejected value
+}
+
+func (e FieldError) Error() string {
+	if e.Param != "" {
+		return fmt.Sprintf("%s failed %s=%s (value: %v)", e.Field, e.Rule, e.Param, e.Value)
+	}
+	return fmt.Sprintf("%s failed %s (value: %v)", e.Field, e.Rule, e.Value)
+}
+
+// ValidationErrors is the list of fields that failed validation.
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, fieldError := range e {
+		messages = append(messages, fieldError.Error())
+	}
+	return "validation failed: " + strings.Join(messages, "; ")
+}
+
+// validateStruct validates a struct, prefixing field paths with the given root.
+func validateStruct(root string, profile interface{}) error {
+	err := structValidator.Struct(profile)
+	if err == nil {
+		return nil
+	}
+
+	var validationErrors validator.ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		return err
+	}
+
+	result := make(ValidationErrors, 0, len(validationErrors))
+	for _, fieldError := range validationErrors {
+		// Replace the struct name at the start of the namespace with the root.
+		field := fieldError.Namespace()
+		if i := strings.Index(field, "."); i >= 0 {
+			field = field[i+1:]
+		}
+		if root != "" {
+			field = root + "." + field
+		}
+		result = append(result, FieldError{
+			Field: field,
+			Rule:  fieldError.Tag(),
+			Param: fieldError.Param(),
+			Value: fieldError.Value(),
+		})
+	}
+	return result
+}
+
+// Validate checks the client profile against its validation tags.
+// It returns ValidationErrors listing each invalid field.
+func (p *EchoPlayerPreferences) Validate() error {
+	return validateStruct("client", p)
+}
+
+// Validate checks the server profile against its validation tags.
+// It returns ValidationErrors listing each invalid field.
+func (p *ServerProfile) Validate() error {
+	return validateStruct("server", p)
+}
+
+// Validate checks both profiles, returning the combined field errors.
+func (p *GameProfiles) Validate() error {
+	var result ValidationErrors
+	for _, err := range []error{p.Client.Validate(), p.Server.Validate()} {
+		if err == nil {
+			continue
+		}
+		var fieldErrors ValidationErrors
+		if !errors.As(err, &fieldErrors) {
+			return err
+		}
+		result = append(result, fieldErrors...)
+	}
+	if len(result) > 0 {
+		return result
+	}
+	return nil
+}
+
+// Repair resets each field that fails validation to its value in the defaults, keeping the rest of the
+// profiles, and returns the fields that were invalid. A field that is still invalid once reset (e.g. a
+// rule comparing it to a sibling) has its parent reset instead, up to the whole profile.
+// The defaults must be valid, and are not copied: pass profiles that are not used afterwards.
+func (p *GameProfiles) Repair(defaults GameProfiles) (ValidationErrors, error) {
+	var invalid ValidationErrors
+	reset := make(map[string]bool)
+	for {
+		err := p.Validate()
+		if err == nil {
+			return invalid, nil
+		}
+		var fieldErrors ValidationErrors
+		if !errors.As(err, &fieldErrors) {
+			return invalid, err
+		}
+		if invalid == nil {
+			invalid = fieldErrors
+		}
+
+		for _, fieldError := range fieldErrors {
+			path := fieldPath(fieldError.Field)
+			for len(path) > 1 && reset[strings.Join(path, ".")] {
+				path = path[:len(path)-1]
+			}
+			key := strings.Join(path, ".")
+			if reset[key] {
+				return invalid, fmt.Errorf("unable to repair %s: %w", fieldError.Field, err)
+			}
+			reset[key] = true
+			if !resetField(reflect.ValueOf(p).Elem(), reflect.ValueOf(&defaults).Elem(), path) {
+				return invalid, fmt.Errorf("unable to repair %s: %w", fieldError.Field, err)
+			}
+		}
+	}
+}
+
+// fieldPath splits a field error's path into JSON names. An element of a slice or map is replaced
+// by the whole slice or map, e.g. "client.newunlocks[2]" is "client.newunlocks".
+func fieldPath(field string) []string {
+	path := strings.Split(field, ".")
+	for i, name := range path {
+		if j := strings.Index(name, "["); j >= 0 {
+			path[i] = name[:j]
+			return path[:i+1]
+		}
+	}
+	return path
+}
+
+// resetField sets the field at the path of JSON names in dst to its value in src.
+func resetField(dst reflect.Value, src reflect.Value, path []string) bool {
+	for _, name := range path {
+		if dst.Kind() == reflect.Ptr {
+			if dst.IsNil() || src.IsNil() {
+				break
+			}
+			dst, src = dst.Elem(), src.Elem()
+		}
+		if dst.Kind() != reflect.Struct {
+			break
+		}
+		i := jsonFieldIndex(dst.Type(), name)
+		if i < 0 {
+			return false
+		}
+		dst, src = dst.Field(i), src.Field(i)
+	}
+	dst.Set(src)
+	return true
+}
+
+// jsonFieldIndex returns the index of the struct field with the JSON name, or -1.
+func jsonFieldIndex(t reflect.Type, name string) int {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		jsonName := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if jsonName == "" {
+			jsonName = field.Name
+		}
+		if jsonName == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,80 @@
+package game
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGameProfiles_Validate(t *testing.T) {
+	profiles := DefaultGameProfiles(EchoUserId{PlatformCode: OVR_ORG, AccountId: 12345}, "Player")
+	if err := profiles.Validate(); err != nil {
+		t.Fatalf("Validate() failed for default profiles: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(p *GameProfiles)
+		field  string
+		rule   string
+	}{
+		{"short display name", func(p *GameProfiles) { p.Client.DisplayName = "a" }, "client.displayname", "min"},
+		{"bad weapon", func(p *GameProfiles) { p.Client.CombatWeapon = "sword" }, "client.weapon", "oneof"},
+		{"bad weapon arm", func(p *GameProfiles) { p.Client.CombatDominantHand = 2 }, "client.weaponarm", "eq=0|eq=1"},
+		{"bad group", func(p *GameProfiles) { p.Client.Social.Group = "not-a-uuid" }, "client.social.group", "uuid_rfc4122"},
+		{"bad xplatformid", func(p *GameProfiles) { p.Server.EchoUserIdToken = "XYZ-1" }, "server.xplatformid", "echouserid"},
+		{"bad stat operand", func(p *GameProfiles) { p.Server.Statistics.Arena.Goals = DiscreteStatistic{Operand: "mul", Value: 1} }, "server.stats.arena.Goals.op", "oneof"},
+		{"missing stat operand", func(p *GameProfiles) { p.Server.Statistics.Arena.Goals = DiscreteStatistic{Value: 1} }, "server.stats.arena.Goals.op", "required_with"},
+	}
+
+	for _, tt := range tests {
+		profiles := DefaultGameProfiles(EchoUserId{PlatformCode: OVR_ORG, AccountId: 12345}, "Player")
+		tt.modify(&profiles)
+
+		var fieldErrors ValidationErrors
+		if err := profiles.Validate(); !errors.As(err, &fieldErrors) {
+			t.Errorf("%s: Validate() = %v, want ValidationErrors", tt.name, err)
+			continue
+		}
+		if len(fieldErrors) != 1 || fieldErrors[0].Field != tt.field || fieldErrors[0].Rule != tt.rule {
+			t.Errorf("%s: Validate() = %v, want %s failed %s", tt.name, fieldErrors, tt.field, tt.rule)
+		}
+	}
+}
+
+func TestGameProfiles_Repair(t *testing.T) {
+	echoUserId := EchoUserId{PlatformCode: OVR_ORG, AccountId: 12345}
+	profiles := DefaultGameProfiles(echoUserId, "Player")
+	profiles.Client.CombatWeapon = "sword"
+	profiles.Client.TeamName = "Team"
+	profiles.Client.NewUnlocks = []int64{1, -1}
+	profiles.Server.Statistics.Arena.Goals = DiscreteStatistic{Value: 3}
+	profiles.Server.Statistics.Arena.Saves = DiscreteStatistic{Operand: "add", Value: 2}
+
+	invalid, err := profiles.Repair(DefaultGameProfiles(echoUserId, "Player"))
+	if err != nil {
+		t.Fatalf("Repair() error: %v", err)
+	}
+	if len(invalid) != 3 {
+		t.Errorf("Repair() = %v, want the 3 invalid fields", invalid)
+	}
+	if err := profiles.Validate(); err != nil {
+		t.Errorf("Validate() after Repair() = %v, want valid profiles", err)
+	}
+
+	// Only the invalid fields are reset
+	defaults := DefaultGameProfiles(echoUserId, "Player")
+	if profiles.Client.CombatWeapon != defaults.Client.CombatWeapon || len(profiles.Client.NewUnlocks) != len(defaults.Client.NewUnlocks) {
+		t.Errorf("Repair() weapon = %q, new unlocks = %v, want the defaults", profiles.Client.CombatWeapon, profiles.Client.NewUnlocks)
+	}
+	if profiles.Server.Statistics.Arena.Goals != defaults.Server.Statistics.Arena.Goals {
+		t.Errorf("Repair() goals = %v, want the default", profiles.Server.Statistics.Arena.Goals)
+	}
+	if profiles.Client.TeamName != "Team" || profiles.Server.Statistics.Arena.Saves.Value != 2 {
+		t.Errorf("Repair() team name = %q, saves = %v, want them kept", profiles.Client.TeamName, profiles.Server.Statistics.Arena.Saves)
+	}
+
+	// Valid profiles are left as they are
+	if invalid, err := profiles.Repair(defaults); err != nil || len(invalid) != 0 {
+		t.Errorf("Repair() = %v, %v, want nothing to repair", invalid, err)
+	}
+}
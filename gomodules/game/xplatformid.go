@@ -19,8 +19,9 @@ type EchoUserId struct {
 // Constants
 //const xPlatformIdSize = 16
 
+// Valid returns whether the ID is of a known platform (STM through TEN, both included) and has an account.
 func (xpi *EchoUserId) Valid() bool {
-	return xpi.PlatformCode > STM && xpi.PlatformCode < TEN && xpi.AccountId > 0
+	return xpi.PlatformCode >= STM && xpi.PlatformCode <= TEN && xpi.AccountId > 0
 }
 
 // Parse parses a string into a given platform identifier.
@@ -35,8 +36,11 @@ func (xpi *EchoUserId) Parse(s string) (*EchoUserId, error) {
 	platformCodeStr := s[:dashIndex]
 	accountIdStr := s[dashIndex+1:]
 
-	// Determine the platform code.
+	// Determine the platform code. Unknown platforms parse to 0, which no account has.
 	platformCode := PlatformCode(0).Parse(platformCodeStr)
+	if platformCode == 0 {
+		return nil, fmt.Errorf("invalid format: %s", s)
+	}
 
 	// Try to parse the account identifier
 	accountId, err := strconv.ParseUint(accountIdStr, 10, 64)
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// AdminGroupName is the Nakama group whose superadmins and admins may call admin RPCs.
+const AdminGroupName = "Global Admins"
+
+var (
+	adminGroupMu sync.RWMutex
+	adminGroupId string // the ID of the admin group; empty until InitAdminGroup finds it
+)
+
+// InitAdminGroup finds the admin group, creating it if it does not exist. The group is created by the
+// system user and closed, so players can neither create it nor join it; admins are added and promoted
+// from the Nakama console. A group with the name that the system user did not create was made by a
+// player, and is never trusted: until it is removed, admin RPCs are limited to server-to-server calls.
+func InitAdminGroup(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule) error {
+	groups, _, err := nk.GroupsList(ctx, AdminGroupName, "", nil, nil, 10, "")
+	if err != nil {
+		return fmt.Errorf("unable to list groups: %w", err)
+	}
+
+	var group *api.Group
+	for _, g := range groups {
+		if g.GetName() != AdminGroupName {
+			continue
+		}
+		if g.GetCreatorId() != services.SystemUserId {
+			return fmt.Errorf("the %q group %s was created by user %s, not the system user: delete it", AdminGroupName, g.GetId(), g.GetCreatorId())
+		}
+		group = g
+	}
+	if group == nil {
+		group, err = nk.GroupCreate(ctx, services.SystemUserId, AdminGroupName, services.SystemUserId, "", "The admins of the Echo Nakama server", "", false, nil, 100)
+		if err != nil {
+			return fmt.Errorf("unable to create the %q group: %w", AdminGroupName, err)
+		}
+		logger.WithField("groupId", group.GetId()).Info("Created the admin group")
+	}
+
+	adminGroupMu.Lock()
+	defer adminGroupMu.Unlock()
+	adminGroupId = group.GetId()
+	return nil
+}
+
+// requireAdmin returns an error unless the caller may use admin RPCs.
+// Server-to-server calls (made with the runtime HTTP key) carry no user ID and are always allowed.
+// Otherwise the caller must be a superadmin or admin of the admin group set up by InitAdminGroup;
+// another group with the same name is not enough.
+func requireAdmin(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule) error {
+	userId, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	if !ok || userId == "" {
+		return nil
+	}
+
+	adminGroupMu.RLock()
+	groupId := adminGroupId
+	adminGroupMu.RUnlock()
+	if groupId == "" {
+		logger.WithField("userId", userId).Warn("Admin RPC denied, the admin group is not set up")
+		return runtime.NewError("admin permission required", apierror.StatusPermissionDenied)
+	}
+
+	cursor := ""
+	for {
+		groups, next, err := nk.UserGroupsList(ctx, userId, 100, nil, cursor)
+		if err != nil {
+			logger.WithField("err", err).Error("Unable to list user groups")
+			return runtime.NewError("Unable to verify admin permissions", apierror.StatusInternalError)
+		}
+		for _, group := range groups {
+			// Group states: 0 superadmin, 1 admin, 2 member, 3 join request
+			if group.GetGroup().GetId() == groupId && group.GetState().GetValue() <= 1 {
+				return nil
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	logger.WithField("userId", userId).Warn("Admin RPC denied")
+	return runtime.NewError("admin permission required", apierror.StatusPermissionDenied)
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"echonakama/server/services"
+	"echonakama/server/services/nakamatest"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	nk := nakamatest.NewModule()
+	logger := nakamatest.NewLogger(t)
+	ctx := context.Background()
+	adminUserId, _, _, _ := nk.AuthenticateCustom(ctx, "admin", "admin", true)
+	playerUserId, _, _, _ := nk.AuthenticateCustom(ctx, "player", "player", true)
+	asUser := func(userId string) context.Context {
+		return context.WithValue(ctx, runtime.RUNTIME_CTX_USER_ID, userId)
+	}
+
+	if err := InitAdminGroup(ctx, logger, nk); err != nil {
+		t.Fatalf("InitAdminGroup() error: %v", err)
+	}
+	groups, _, _ := nk.GroupsList(ctx, AdminGroupName, "", nil, nil, 10, "")
+	if len(groups) != 1 || groups[0].GetCreatorId() != services.SystemUserId || groups[0].GetOpen().GetValue() {
+		t.Fatalf("GroupsList() = %v, want a closed admin group created by the system user", groups)
+	}
+	if err := InitAdminGroup(ctx, logger, nk); err != nil {
+		t.Fatalf("InitAdminGroup() error on restart: %v", err)
+	}
+	groupId := groups[0].GetId()
+
+	// Server-to-server calls are allowed, players are not
+	if err := requireAdmin(ctx, logger, nk); err != nil {
+		t.Errorf("requireAdmin() server-to-server error: %v", err)
+	}
+	if err := requireAdmin(asUser(playerUserId), logger, nk); err == nil {
+		t.Error("requireAdmin() = nil for a player, want denied")
+	}
+
+	// Members are not admins until promoted
+	nk.GroupUsersAdd(ctx, services.SystemUserId, groupId, []string{adminUserId})
+	if err := requireAdmin(asUser(adminUserId), logger, nk); err == nil {
+		t.Error("requireAdmin() = nil for a member, want denied")
+	}
+	nk.GroupUsersPromote(ctx, services.SystemUserId, groupId, []string{adminUserId})
+	if err := requireAdmin(asUser(adminUserId), logger, nk); err != nil {
+		t.Errorf("requireAdmin() admin error: %v", err)
+	}
+}
+
+func TestRequireAdminGroupCreatedByPlayer(t *testing.T) {
+	nk := nakamatest.NewModule()
+	logger := nakamatest.NewLogger(t)
+	ctx := context.Background()
+	playerUserId, _, _, _ := nk.AuthenticateCustom(ctx, "player", "player", true)
+
+	// A player creates the group first, and makes themselves its superadmin
+	group, err := nk.GroupCreate(ctx, playerUserId, AdminGroupName, playerUserId, "", "", "", true, nil, 100)
+	if err != nil {
+		t.Fatalf("GroupCreate() error: %v", err)
+	}
+	nk.GroupUsersAdd(ctx, playerUserId, group.GetId(), []string{playerUserId})
+	for i := 0; i < 2; i++ {
+		nk.GroupUsersPromote(ctx, playerUserId, group.GetId(), []string{playerUserId})
+	}
+
+	adminGroupId = ""
+	if err := InitAdminGroup(ctx, logger, nk); err == nil {
+		t.Error("InitAdminGroup() = nil, want an error for a group the system user did not create")
+	}
+	if err := requireAdmin(context.WithValue(ctx, runtime.RUNTIME_CTX_USER_ID, playerUserId), logger, nk); err == nil {
+		t.Error("requireAdmin() = nil for the player's group, want denied")
+	}
+	if err := requireAdmin(ctx, logger, nk); err != nil {
+		t.Errorf("requireAdmin() server-to-server error: %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"echonakama/discordbot"
+	"echonakama/server/services/apierror"
+	"encoding/json"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// BotStatusResponse is the status of the Discord bot.
+type BotStatusResponse struct {
+	Healthy bool `json:"healthy"` // whether the bot is connected; logins still work through the REST API while it is not
+	discordbot.Health
+}
+
+// BotStatusRpc returns the status of the Discord bot's gateway connection, for health checks.
+func BotStatusRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string, bot *discordbot.Service) (string, error) {
+	if err := requireAdmin(ctx, logger, nk); err != nil {
+		return "", err
+	}
+
+	health := bot.Health()
+	response, err := json.Marshal(BotStatusResponse{
+		Healthy: health.State == discordbot.StateConnected,
+		Health:  health,
+	})
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+	"echonakama/server/services/channel"
+	"encoding/json"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// GetChannelInfoRpc returns the registered social channels, as the game client expects them.
+func GetChannelInfoRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	channels, err := channel.ListChannels(ctx, nk)
+	if err != nil {
+		logger.WithField("err", err).Error("Unable to list channels")
+		return "", runtime.NewError("Unable to list channels", apierror.StatusInternalError)
+	}
+
+	response, err := json.Marshal(channel.Info(channels))
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
+
+// SetChannelInfoRpc creates or updates each channel in the payload's "group" list. Only admins may set channels.
+// Channels that are not in the list are left as they are.
+func SetChannelInfoRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := requireAdmin(ctx, logger, nk); err != nil {
+		return "", err
+	}
+
+	var request struct {
+		Groups []*channel.Channel `json:"group"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		logger.WithField("err", err).Error("Unable to unmarshal payload")
+		return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	channels := make([]*channel.Channel, 0, len(request.Groups))
+	for _, c := range request.Groups {
+		updated, apiErr := channel.SetChannel(serviceContext, c)
+		if apiErr != nil {
+			return "", rpcError(logger, apiErr, "Unable to set channel")
+		}
+		channels = append(channels, updated)
+	}
+
+	response, err := json.Marshal(map[string]interface{}{"group": channels})
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
+
+// DeleteChannelRpc removes the channel identified by the payload's "channeluuid". Only admins may delete channels.
+func DeleteChannelRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := requireAdmin(ctx, logger, nk); err != nil {
+		return "", err
+	}
+
+	var request struct {
+		ChannelUuid string `json:"channeluuid"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		logger.WithField("err", err).Error("Unable to unmarshal payload")
+		return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
+	}
+	if request.ChannelUuid == "" {
+		return "", runtime.NewError("channeluuid is empty", apierror.StatusInvalidArgument)
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	if apiErr := channel.DeleteChannel(serviceContext, request.ChannelUuid); apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to delete channel")
+	}
+	return `{"success":true}`, nil
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+	"echonakama/server/services/relayconfig"
+	"encoding/json"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// ClientSettingsRequest identifies the client settings an admin RPC operates on.
+type ClientSettingsRequest struct {
+	RelayUserId string          `json:"relay_user_id"` // the relay's user ID, or empty for the global settings
+	Settings    json.RawMessage `json:"settings"`      // the (partial) settings to store, or null to clear them
+	Version     string          `json:"_version"`      // if set, the write fails unless the stored settings still have this version
+}
+
+// ClientSettingsAuditRequest is a page request for the client settings audit log.
+type ClientSettingsAuditRequest struct {
+	Limit  int    `json:"limit"`
+	Cursor string `json:"cursor"`
+}
+
+// GetClientSettingsRpc returns the global client settings, a relay's overrides, and the settings
+// the relay's logins receive. Only admins may read them.
+func GetClientSettingsRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := requireAdmin(ctx, logger, nk); err != nil {
+		return "", err
+	}
+
+	request := ClientSettingsRequest{}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &request); err != nil {
+			logger.WithField("err", err).Error("Unable to unmarshal payload")
+			return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
+		}
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	state, apiErr := relayconfig.GetClientSettings(serviceContext, request.RelayUserId)
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to get client settings")
+	}
+
+	response, err := json.Marshal(state)
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
+
+// SetClientSettingsRpc replaces the global client settings, or a relay's overrides. Only admins may set them.
+// Every change is recorded in the audit log, and applies to the relay's logins from their next login.
+func SetClientSettingsRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := requireAdmin(ctx, logger, nk); err != nil {
+		return "", err
+	}
+
+	request := ClientSettingsRequest{}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		logger.WithField("err", err).Error("Unable to unmarshal payload")
+		return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
+	}
+
+	// Server-to-server calls have no user ID, so they are recorded as the system user
+	adminUserId, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	if !ok || adminUserId == "" {
+		adminUserId = services.SystemUserId
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	version, apiErr := relayconfig.SetClientSettings(serviceContext, request.RelayUserId, request.Settings, request.Version, adminUserId)
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to set client settings")
+	}
+
+	response, err := json.Marshal(map[string]interface{}{"success": true, "version": version})
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
+
+// ListClientSettingsAuditRpc returns a page of the client settings audit log, oldest first. Only admins may read it.
+func ListClientSettingsAuditRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := requireAdmin(ctx, logger, nk); err != nil {
+		return "", err
+	}
+
+	request := ClientSettingsAuditRequest{Limit: 100}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &request); err != nil {
+			logger.WithField("err", err).Error("Unable to unmarshal payload")
+			return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
+		}
+	}
+	if request.Limit < 1 || request.Limit > 100 {
+		return "", runtime.NewError("limit must be between 1 and 100", apierror.StatusInvalidArgument)
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	records, cursor, apiErr := relayconfig.ListClientSettingsAudit(serviceContext, request.Limit, request.Cursor)
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to list client settings audit")
+	}
+
+	response, err := json.Marshal(map[string]interface{}{"records": records, "cursor": cursor})
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
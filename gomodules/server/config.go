@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+	"echonakama/server/services/config"
+	"echonakama/server/services/relayconfig"
+	"encoding/json"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// GetConfigRpc returns the config resource identified by the payload's type and id.
+// The response is the config as the game expects it, with its storage version in "_version".
+func GetConfigRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var request relayconfig.ConfigKey
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		logger.WithField("err", err).Error("Unable to unmarshal payload")
+		return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	config, apiErr := relayconfig.GetConfig(serviceContext, request)
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to get config")
+	}
+	return string(config), nil
+}
+
+// SetConfigRpc validates and stores a config resource. Only admins may set configs.
+// If the payload carries "_version", the write fails unless the stored config still has that version.
+func SetConfigRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := requireAdmin(ctx, logger, nk); err != nil {
+		return "", err
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	version, apiErr := relayconfig.SetConfig(serviceContext, []byte(payload))
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to set config")
+	}
+
+	response, err := json.Marshal(map[string]interface{}{"success": true, "version": version})
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
+
+// GetDocumentRpc returns the document identified by the payload's type and lang.
+// If the document is not available in that language, the closest available language is served.
+func GetDocumentRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string, cfg *config.Config) (string, error) {
+	var request relayconfig.DocumentKey
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		logger.WithField("err", err).Error("Unable to unmarshal payload")
+		return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+		Config:       cfg,
+	}
+	document, apiErr := relayconfig.GetDocument(serviceContext, request)
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to get document")
+	}
+	return string(document), nil
+}
+
+// SetDocumentRpc validates and stores a document. Only admins may set documents.
+// If the payload carries "_version", the write fails unless the stored document still has that version.
+func SetDocumentRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := requireAdmin(ctx, logger, nk); err != nil {
+		return "", err
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	version, apiErr := relayconfig.SetDocument(serviceContext, []byte(payload))
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to set document")
+	}
+
+	response, err := json.Marshal(map[string]interface{}{"success": true, "version": version})
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
+
+// GetAccessControlListRpc returns the access control list applied to logins. Only admins may read it.
+func GetAccessControlListRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := requireAdmin(ctx, logger, nk); err != nil {
+		return "", err
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	acl, apiErr := relayconfig.GetAccessControlList(serviceContext)
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to get access control list")
+	}
+	return string(acl), nil
+}
+
+// SetAccessControlListRpc validates and stores the access control list applied to logins. Only admins may set it.
+// If the payload carries "_version", the write fails unless the stored list still has that version.
+func SetAccessControlListRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := requireAdmin(ctx, logger, nk); err != nil {
+		return "", err
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	version, apiErr := relayconfig.SetAccessControlList(serviceContext, []byte(payload))
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to set access control list")
+	}
+
+	response, err := json.Marshal(map[string]interface{}{"success": true, "version": version})
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
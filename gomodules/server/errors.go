@@ -0,0 +1,32 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+
+	"echonakama/server/services/apierror"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// RpcFunc is the signature of a Nakama RPC.
+type RpcFunc func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error)
+
+// RelayRpc returns the RPC with its errors sent to the relay as structured error JSON,
+// keeping their status codes.
+func RelayRpc(rpc RpcFunc) RpcFunc {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		result, err := rpc(ctx, logger, db, nk, payload)
+		if err != nil {
+			return "", apierror.From(err).Runtime()
+		}
+		return result, nil
+	}
+}
+
+// rpcError logs an error with its cause, and returns it as the structured runtime error sent to the
+// caller. The cause is only logged.
+func rpcError(logger runtime.Logger, apiErr *apierror.Error, message string) error {
+	apiErr.Log(logger, message)
+	return apiErr.Runtime()
+}
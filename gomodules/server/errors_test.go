@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"echonakama/server/services/apierror"
+	"echonakama/server/services/nakamatest"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+func TestRelayRpc(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantCode   int
+		wantReason apierror.Reason
+		wantDetail string
+	}{
+		{"api error", apierror.New(apierror.StatusInvalidArgument, apierror.ReasonLinkRequired, "enter code: ABCD").WithDetail("link_code", "ABCD"), apierror.StatusInvalidArgument, apierror.ReasonLinkRequired, "ABCD"},
+		{"structured error", apierror.New(apierror.StatusFailedPrecondition, apierror.ReasonRelinkRequired, "relink").WithDetail("link_code", "ABCD").Runtime(), apierror.StatusFailedPrecondition, apierror.ReasonRelinkRequired, "ABCD"},
+		{"runtime error", runtime.NewError("relay key revoked", apierror.StatusPermissionDenied), apierror.StatusPermissionDenied, apierror.ReasonPermissionDenied, ""},
+		{"plain error", errors.New("connection reset"), apierror.StatusInternalError, apierror.ReasonInternal, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rpc := RelayRpc(func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+				return "", tt.err
+			})
+			_, err := rpc(context.Background(), nakamatest.NewLogger(t), nil, nil, "")
+			var runtimeErr *runtime.Error
+			if !errors.As(err, &runtimeErr) {
+				t.Fatalf("RelayRpc() error = %T, want *runtime.Error", err)
+			}
+			if runtimeErr.Code != tt.wantCode {
+				t.Errorf("RelayRpc() code = %d, want %d", runtimeErr.Code, tt.wantCode)
+			}
+
+			structured := &apierror.Error{}
+			if err := json.Unmarshal([]byte(runtimeErr.Message), structured); err != nil {
+				t.Fatalf("RelayRpc() message = %q, want structured JSON: %v", runtimeErr.Message, err)
+			}
+			if structured.Code != tt.wantCode || structured.Reason != tt.wantReason || structured.Details["link_code"] != tt.wantDetail {
+				t.Errorf("RelayRpc() error = %+v, want code %d, reason %s", structured, tt.wantCode, tt.wantReason)
+			}
+			if structured.Message == "connection reset" {
+				t.Errorf("RelayRpc() message = %q, want the cause kept out of the message", structured.Message)
+			}
+		})
+	}
+}
+
+func TestRpcError(t *testing.T) {
+	err := rpcError(nakamatest.NewLogger(t), apierror.Internal("error reading relay", errors.New("pq: connection refused")), "Unable to list relays")
+
+	var runtimeErr *runtime.Error
+	if !errors.As(err, &runtimeErr) || runtimeErr.Code != apierror.StatusInternalError {
+		t.Fatalf("rpcError() = %v, want an internal runtime error", err)
+	}
+	if strings.Contains(runtimeErr.Message, "connection refused") {
+		t.Errorf("rpcError() message = %q, want the cause kept out of the message", runtimeErr.Message)
+	}
+
+	// Relay RPCs send the same structured error
+	if apiErr := apierror.From(err); apiErr.Reason != apierror.ReasonInternal || apiErr.Message != "error reading relay" {
+		t.Errorf("From() = %+v, want the structured error", apiErr)
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+	"echonakama/server/services/config"
+	"echonakama/server/services/gameserver"
+	"echonakama/server/services/relay"
+	"encoding/json"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// GameServerSessionsRequest is sent by a relay when the sessions on one of its game servers change.
+type GameServerSessionsRequest struct {
+	ServerId string                `json:"server_id"`
+	Sessions []*gameserver.Session `json:"sessions"`
+}
+
+// RegisterGameServerRpc registers a game server that connected to the calling relay.
+func RegisterGameServerRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	caller, apiErr := relay.RequireRelay(ctx, logger, nk, relay.ScopeGameServer)
+	if apiErr != nil {
+		return "", apiErr
+	}
+
+	request := &gameserver.GameServer{}
+	if err := json.Unmarshal([]byte(payload), request); err != nil {
+		logger.WithField("err", err).Error("Unable to unmarshal payload")
+		return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	server, apiErr := gameserver.RegisterGameServer(serviceContext, caller, request)
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to register game server")
+	}
+
+	response, err := json.Marshal(server)
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
+
+// ReportGameServerSessionsRpc replaces the sessions one of the calling relay's game servers is hosting.
+func ReportGameServerSessionsRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	caller, apiErr := relay.RequireRelay(ctx, logger, nk, relay.ScopeGameServer)
+	if apiErr != nil {
+		return "", apiErr
+	}
+
+	var request GameServerSessionsRequest
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		logger.WithField("err", err).Error("Unable to unmarshal payload")
+		return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	server, apiErr := gameserver.ReportSessions(serviceContext, caller, request.ServerId, request.Sessions)
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to report game server sessions")
+	}
+
+	response, err := json.Marshal(server)
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
+
+// UnregisterGameServerRpc removes one of the calling relay's game servers from the registry.
+func UnregisterGameServerRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	caller, apiErr := relay.RequireRelay(ctx, logger, nk, relay.ScopeGameServer)
+	if apiErr != nil {
+		return "", apiErr
+	}
+
+	var request GameServerSessionsRequest
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		logger.WithField("err", err).Error("Unable to unmarshal payload")
+		return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	if apiErr := gameserver.UnregisterGameServer(serviceContext, caller, request.ServerId); apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to unregister game server")
+	}
+	return `{"success":true}`, nil
+}
+
+// ListGameServersRpc returns the registered game servers passing the payload's filter. Only admins may list them.
+func ListGameServersRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string, cfg *config.Config) (string, error) {
+	if err := requireAdmin(ctx, logger, nk); err != nil {
+		return "", err
+	}
+
+	var filter gameserver.Filter
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &filter); err != nil {
+			logger.WithField("err", err).Error("Unable to unmarshal payload")
+			return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
+		}
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+		Config:       cfg,
+	}
+	servers, apiErr := gameserver.ListGameServers(serviceContext, filter)
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to list game servers")
+	}
+
+	response, err := json.Marshal(map[string]interface{}{"servers": servers})
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
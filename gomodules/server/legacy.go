@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+	"echonakama/server/services/login"
+	"encoding/json"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// ImportLegacyAccountsRequest carries account documents exported from the file-based EchoRelay server.
+type ImportLegacyAccountsRequest struct {
+	DryRun   bool              `json:"dry_run"`  // report what would be imported without writing anything
+	Accounts []json.RawMessage `json:"accounts"` // the account documents, as EchoRelay stored them
+}
+
+// ImportLegacyAccountsRpc imports legacy EchoRelay accounts into placeholder accounts.
+// Players claim them by linking a device with the same EchoUserId.
+// It returns a report of what was (or, for a dry run, would be) imported.
+func ImportLegacyAccountsRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := requireAdmin(ctx, logger, nk); err != nil {
+		return "", err
+	}
+
+	var request ImportLegacyAccountsRequest
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		logger.WithField("err", err).Error("Unable to unmarshal payload")
+		return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
+	}
+	if len(request.Accounts) == 0 {
+		return "", runtime.NewError("accounts is empty", apierror.StatusInvalidArgument)
+	}
+
+	// Server-to-server calls have no user ID, so they are recorded as the system user
+	adminUserId, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	if !ok || adminUserId == "" {
+		adminUserId = services.SystemUserId
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	report, apiErr := login.ImportLegacyAccounts(serviceContext, request.Accounts, request.DryRun, adminUserId)
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to import legacy accounts")
+	}
+
+	response, err := json.Marshal(report)
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
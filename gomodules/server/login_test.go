@@ -0,0 +1,460 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"echonakama/game"
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+	"echonakama/server/services/config"
+	"echonakama/server/services/discord"
+	"echonakama/server/services/discordtest"
+	"echonakama/server/services/login"
+	"echonakama/server/services/metrics"
+	"echonakama/server/services/nakamatest"
+	"echonakama/server/services/ratelimit"
+	"echonakama/server/services/relay"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	testGuildId   = "100000000000000000"
+	testDiscordId = "200000000000000000"
+)
+
+// profileRaceModule runs race right before the first write of a client profile, as a concurrent profile update would.
+type profileRaceModule struct {
+	*nakamatest.Module
+	race func()
+}
+
+func (m *profileRaceModule) StorageWrite(ctx context.Context, writes []*runtime.StorageWrite) ([]*api.StorageObjectAck, error) {
+	for _, write := range writes {
+		if m.race != nil && write.Collection == login.GameProfileStorageCollection && write.Key == login.ClientGameProfileStorageKey {
+			race := m.race
+			m.race = nil
+			race()
+		}
+	}
+	return m.Module.StorageWrite(ctx, writes)
+}
+
+func TestLinkThenLogin(t *testing.T) {
+	nk := nakamatest.NewModule()
+	logger := nakamatest.NewLogger(t)
+	if err := login.RegisterIndexes(nk.Initializer()); err != nil {
+		t.Fatalf("RegisterIndexes() error: %v", err)
+	}
+
+	// The relay, and the player as the Discord sign-in creates them
+	relayUserId, relayUsername, _, err := nk.AuthenticateCustom(context.Background(), "relay-test", "relay-test", true)
+	if err != nil {
+		t.Fatalf("AuthenticateCustom() error: %v", err)
+	}
+	playerUserId, _, _, err := nk.AuthenticateCustom(context.Background(), testDiscordId, testDiscordId, true)
+	if err != nil {
+		t.Fatalf("AuthenticateCustom() error: %v", err)
+	}
+
+	discordClient := discordtest.NewClient()
+	discordClient.AddMember(testGuildId, &discordgo.Member{
+		User: &discordgo.User{ID: testDiscordId, Username: "player"},
+		Nick: "Player",
+	})
+
+	cfg, err := config.Load(map[string]string{
+		"SESSION_ENCRYPTION_KEY":   "key",
+		"DISCORD_CLIENT_ID":        "1180461747180461796",
+		"DISCORD_CLIENT_SECRET":    "secret",
+		"DISCORD_BOT_TOKEN":        "token",
+		"DISCORD_BOT_GUILD":        testGuildId,
+		"LINK_PAGE_URL":            "https://example.com/link",
+		"PLACEHOLDER_EMAIL_DOMAIN": "example.com",
+	})
+	if err != nil {
+		t.Fatalf("config.Load() error: %v", err)
+	}
+
+	ctx := context.WithValue(context.Background(), runtime.RUNTIME_CTX_USER_ID, relayUserId)
+	ctx = context.WithValue(ctx, runtime.RUNTIME_CTX_USERNAME, relayUsername)
+	ctx = context.WithValue(ctx, runtime.RUNTIME_CTX_VARS, map[string]string{relay.RelayIdSessionVar: "test"})
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		NakamaModule: nk,
+		Discord:      discordClient,
+		Config:       cfg,
+	}
+	newRequest := func(password string) *login.LoginRequest {
+		return &login.LoginRequest{
+			Metadata: login.LoginMetadata{
+				DisplayName:     "Player",
+				AppId:           login.QuestAppId,
+				HmdSerialNumber: "HMD-1",
+			},
+			SessionGuid:     uuid.New(),
+			EchoUserId:      *game.NewEchoUserId(game.OVR_ORG, 1234),
+			UserPassword:    password,
+			ClientIpAddress: "203.0.113.1",
+		}
+	}
+
+	// An unlinked device gets a link ticket, and keeps getting the same one
+	_, nkerr := login.ProcessLoginRequest(serviceContext, newRequest(""))
+	if nkerr == nil || nkerr.Reason != apierror.ReasonLinkRequired {
+		t.Fatalf("ProcessLoginRequest() error = %v, want %s", nkerr, apierror.ReasonLinkRequired)
+	}
+	tickets, _, err := nk.StorageList(ctx, "", services.SystemUserId, login.LinkTicketCollection, 10, "")
+	if err != nil || len(tickets) != 1 {
+		t.Fatalf("StorageList() = %d tickets, error = %v, want 1", len(tickets), err)
+	}
+	linkCode := tickets[0].Key
+	if !strings.Contains(nkerr.Message, linkCode) || nkerr.Details["link_code"] != linkCode {
+		t.Errorf("ProcessLoginRequest() error = %q, details = %v, want the link code %s", nkerr.Message, nkerr.Details, linkCode)
+	}
+	if _, nkerr := login.ProcessLoginRequest(serviceContext, newRequest("")); nkerr == nil || nkerr.Details["link_code"] != linkCode {
+		t.Errorf("ProcessLoginRequest() error = %v, want the same link code %s", nkerr, linkCode)
+	}
+
+	// The player enters the code on the linking page
+	if err := LinkAccountDevice(ctx, nk, logger, linkCode, playerUserId); err != nil {
+		t.Fatalf("LinkAccountDevice() error: %v", err)
+	}
+	if tickets, _, _ := nk.StorageList(ctx, "", services.SystemUserId, login.LinkTicketCollection, 10, ""); len(tickets) != 0 {
+		t.Errorf("StorageList() = %d tickets, want the used ticket deleted", len(tickets))
+	}
+
+	// The linked device logs in, setting a password
+	request := newRequest("secret")
+	retry, conflicting := *request, *request
+	conflicting.UserPassword = "other"
+	response, nkerr := login.ProcessLoginRequest(serviceContext, request)
+	if nkerr != nil {
+		t.Fatalf("ProcessLoginRequest() error: %v", nkerr)
+	}
+	if response.GameProfiles.Server.DisplayName != "Player" {
+		t.Errorf("ProcessLoginRequest() display name = %q, want Player", response.GameProfiles.Server.DisplayName)
+	}
+	if response.ProfileVersion == "" {
+		t.Error("ProcessLoginRequest() profile version is empty")
+	}
+	vars, ok := nk.TokenVars(response.NkSessionToken)
+	if !ok || vars["uid"] != playerUserId || vars["sessionGuid"] != response.EchoSessionToken {
+		t.Errorf("ProcessLoginRequest() token vars = %v, want the player and session %s", vars, response.EchoSessionToken)
+	}
+
+	account, err := nk.AccountGetId(ctx, playerUserId)
+	if err != nil {
+		t.Fatalf("AccountGetId() error: %v", err)
+	}
+	if account.User.DisplayName != "Player" || account.Email == "" {
+		t.Errorf("AccountGetId() display name = %q, email = %q, want Player and a placeholder email", account.User.DisplayName, account.Email)
+	}
+	profiles, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: login.GameProfileStorageCollection, Key: login.ClientGameProfileStorageKey, UserID: playerUserId}})
+	if err != nil || len(profiles) != 1 || profiles[0].Version != response.ProfileVersion {
+		t.Errorf("StorageRead() = %v, error = %v, want the client profile at version %s", profiles, err, response.ProfileVersion)
+	}
+
+	// A retry of the login is sent the same response, without writing to storage again
+	replayContext := *serviceContext
+	replayContext.NakamaModule = metrics.InstrumentStorage(nk)
+	replayed, nkerr := login.ProcessLoginRequest(&replayContext, &retry)
+	if nkerr != nil || replayed.NkSessionToken != response.NkSessionToken || replayed.EchoSessionToken != response.EchoSessionToken {
+		t.Errorf("ProcessLoginRequest() = %v, error = %v, want the first response replayed", replayed, nkerr)
+	}
+	if writes := nk.Timings(metrics.StorageLatency, map[string]string{"operation": "write"}); len(writes) != 0 {
+		t.Errorf("ProcessLoginRequest() made %d storage writes on a retry, want none", len(writes))
+	}
+	if _, nkerr := login.ProcessLoginRequest(serviceContext, &conflicting); nkerr == nil || nkerr.Reason != apierror.ReasonConflict {
+		t.Errorf("ProcessLoginRequest() error = %v, want %s for a session GUID reused by another login", nkerr, apierror.ReasonConflict)
+	}
+
+	// The password is now required
+	if _, nkerr := login.ProcessLoginRequest(serviceContext, newRequest("wrong")); nkerr == nil || nkerr.Reason != apierror.ReasonInvalidPassword {
+		t.Errorf("ProcessLoginRequest() error = %v, want %s", nkerr, apierror.ReasonInvalidPassword)
+	}
+	if _, nkerr := login.ProcessLoginRequest(serviceContext, newRequest("secret")); nkerr != nil {
+		t.Errorf("ProcessLoginRequest() error: %v", nkerr)
+	}
+
+	// A stored profile that fails validation has the invalid fields reset, instead of locking the player out
+	profiles, err = nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: login.GameProfileStorageCollection, Key: login.ClientGameProfileStorageKey, UserID: playerUserId}})
+	if err != nil || len(profiles) != 1 {
+		t.Fatalf("StorageRead() = %v, error = %v, want the client profile", profiles, err)
+	}
+	stored := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(profiles[0].Value), &stored); err != nil {
+		t.Fatalf("json.Unmarshal() error: %v", err)
+	}
+	stored["weapon"], stored["teamname"] = "sword", "Team"
+	corrupted, _ := json.Marshal(stored)
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{Collection: login.GameProfileStorageCollection, Key: login.ClientGameProfileStorageKey, UserID: playerUserId, Value: string(corrupted)}}); err != nil {
+		t.Fatalf("StorageWrite() error: %v", err)
+	}
+	repaired, nkerr := login.ProcessLoginRequest(serviceContext, newRequest("secret"))
+	if nkerr != nil {
+		t.Fatalf("ProcessLoginRequest() error: %v", nkerr)
+	}
+	if repaired.GameProfiles.Client.CombatWeapon == "sword" || repaired.GameProfiles.Client.TeamName != "Team" {
+		t.Errorf("ProcessLoginRequest() weapon = %q, team name = %q, want only the invalid weapon reset", repaired.GameProfiles.Client.CombatWeapon, repaired.GameProfiles.Client.TeamName)
+	}
+
+	// A profile update written during the login is not overwritten; the login starts over with it
+	raceContext := *serviceContext
+	raceContext.NakamaModule = &profileRaceModule{Module: nk, race: func() {
+		stored["teamname"] = "Racer"
+		raced, _ := json.Marshal(stored)
+		nk.StorageWrite(ctx, []*runtime.StorageWrite{{Collection: login.GameProfileStorageCollection, Key: login.ClientGameProfileStorageKey, UserID: playerUserId, Value: string(raced)}})
+	}}
+	raced, nkerr := login.ProcessLoginRequest(&raceContext, newRequest("secret"))
+	if nkerr != nil || raced.GameProfiles.Client.TeamName != "Racer" {
+		t.Errorf("ProcessLoginRequest() = %v, error = %v, want the concurrent update kept", raced, nkerr)
+	}
+
+	// So is a revision recorded in the profile history during the login
+	raceContext.NakamaModule = &profileRaceModule{Module: nk, race: func() {
+		writes := []*runtime.StorageWrite{{Collection: login.GameProfileStorageCollection, Key: login.ClientGameProfileStorageKey, UserID: playerUserId, Value: "{}"}}
+		historyWrites, _ := login.ProfileHistoryWrites(ctx, nk, login.ProfileWriterRelay, relayUserId, 0, writes)
+		nk.StorageWrite(ctx, historyWrites)
+	}}
+	if _, nkerr := login.ProcessLoginRequest(&raceContext, newRequest("secret")); nkerr != nil {
+		t.Errorf("ProcessLoginRequest() error = %v, want the login retried after a concurrent history write", nkerr)
+	}
+
+	// A player who left the guild is refused
+	discordClient.RemoveMember(testGuildId, testDiscordId)
+	if _, nkerr := login.ProcessLoginRequest(serviceContext, newRequest("secret")); nkerr == nil || nkerr.Reason != apierror.ReasonNotGuildMember {
+		t.Errorf("ProcessLoginRequest() error = %v, want %s", nkerr, apierror.ReasonNotGuildMember)
+	}
+	discordClient.AddMember(testGuildId, &discordgo.Member{User: &discordgo.User{ID: testDiscordId, Username: "player"}})
+
+	// While Discord is unavailable, the player is told so instead of being let in unchecked
+	discordClient.SetBotError(discord.ErrNotConnected)
+	if _, nkerr := login.ProcessLoginRequest(serviceContext, newRequest("secret")); nkerr == nil || nkerr.Reason != apierror.ReasonDiscordUnavailable {
+		t.Errorf("ProcessLoginRequest() error = %v, want %s", nkerr, apierror.ReasonDiscordUnavailable)
+	}
+	discordClient.SetBotError(nil)
+
+	// An account banned until later is refused, and let in once the ban expires
+	for _, until := range []time.Time{time.Now().Add(time.Hour), time.Now().Add(-time.Hour)} {
+		if err := nk.AccountUpdateId(ctx, playerUserId, "", map[string]interface{}{login.BannedUntilMetadataKey: until.Unix()}, "", "", "", "", ""); err != nil {
+			t.Fatalf("AccountUpdateId() error: %v", err)
+		}
+		_, nkerr := login.ProcessLoginRequest(serviceContext, newRequest("secret"))
+		if banned := until.After(time.Now()); (nkerr != nil && nkerr.Reason == apierror.ReasonAccountBanned) != banned {
+			t.Errorf("ProcessLoginRequest() error = %v, want banned %v until %v", nkerr, banned, until)
+		}
+	}
+
+	// A banned account is refused
+	if err := nk.DisableAccount(playerUserId); err != nil {
+		t.Fatalf("DisableAccount() error: %v", err)
+	}
+	if _, nkerr := login.ProcessLoginRequest(serviceContext, newRequest("secret")); nkerr == nil || nkerr.Reason != apierror.ReasonAccountBanned {
+		t.Errorf("ProcessLoginRequest() error = %v, want %s", nkerr, apierror.ReasonAccountBanned)
+	}
+
+	// The attempts are recorded by relay, platform and outcome
+	tags := metrics.Tags("test", "OVR_ORG")
+	for outcome, want := range map[string]int64{
+		metrics.OutcomeSuccess:                    7,
+		string(apierror.ReasonConflict):           1,
+		string(apierror.ReasonLinkRequired):       2,
+		string(apierror.ReasonInvalidPassword):    1,
+		string(apierror.ReasonNotGuildMember):     1,
+		string(apierror.ReasonDiscordUnavailable): 1,
+		string(apierror.ReasonAccountBanned):      2,
+	} {
+		if got := nk.Counter(metrics.LoginAttempts, metrics.With(tags, "outcome", outcome)); got != want {
+			t.Errorf("Counter(%s, %s) = %d, want %d", metrics.LoginAttempts, outcome, got, want)
+		}
+	}
+	if got := nk.Counter(metrics.LinkTicketsIssued, tags); got != 1 {
+		t.Errorf("Counter(%s) = %d, want 1", metrics.LinkTicketsIssued, got)
+	}
+	if got := nk.Counter(metrics.LinkTicketsRedeemed, tags); got != 1 {
+		t.Errorf("Counter(%s) = %d, want 1", metrics.LinkTicketsRedeemed, got)
+	}
+	if size, ok := nk.Gauge(metrics.ProfileSize, metrics.With(tags, "profile", login.ClientGameProfileStorageKey)); !ok || size == 0 {
+		t.Errorf("Gauge(%s) = %v, %v, want the client profile size", metrics.ProfileSize, size, ok)
+	}
+}
+
+func TestDiscordSignIn(t *testing.T) {
+	nk := nakamatest.NewModule()
+	logger := nakamatest.NewLogger(t)
+	discordClient := discordtest.NewClient()
+	discordClient.AddAuthorization("code", &discord.AccessToken{AccessToken: "access", RefreshToken: "refresh"}, &discordgo.User{ID: testDiscordId, Username: "player"})
+	discordClient.AddAuthorization("again", &discord.AccessToken{AccessToken: "access", RefreshToken: "refresh"}, &discordgo.User{ID: testDiscordId, Username: "player"})
+	limiter := ratelimit.NewLimiter(map[string]ratelimit.Limit{"signin/discord": {Requests: 1, Per: time.Minute}})
+	ctx := context.Background()
+
+	payload := `{"code":"code","oauth_redirect_url":"https://example.com/signin"}`
+	result, err := DiscordSignInRpc(ctx, logger, nil, nk, payload, discordClient, limiter)
+	if err != nil {
+		t.Fatalf("DiscordSignInRpc() error: %v", err)
+	}
+	response := struct {
+		SessionToken    string `json:"sessionToken"`
+		DiscordUsername string `json:"discordUsername"`
+	}{}
+	if err := json.Unmarshal([]byte(result), &response); err != nil {
+		t.Fatalf("json.Unmarshal() error: %v", err)
+	}
+	if response.DiscordUsername != "player" {
+		t.Errorf("DiscordSignInRpc() username = %q, want player", response.DiscordUsername)
+	}
+
+	// The player's Nakama username is their Discord ID
+	users, err := nk.UsersGetUsername(ctx, []string{testDiscordId})
+	if err != nil || len(users) != 1 {
+		t.Fatalf("UsersGetUsername() = %v, error = %v, want the signed in player", users, err)
+	}
+	if users[0].DisplayName != "player" {
+		t.Errorf("UsersGetUsername() display name = %q, want player", users[0].DisplayName)
+	}
+	token, err := login.ReadAccessTokenFromStorage(ctx, logger, nk, users[0].Id, "", "")
+	if err != nil || token == nil || token.AccessToken != "access" {
+		t.Errorf("ReadAccessTokenFromStorage() = %v, error = %v, want the access token", token, err)
+	}
+
+	// The code has been used
+	if _, err := DiscordSignInRpc(ctx, logger, nil, nk, payload, discordClient, limiter); err == nil {
+		t.Error("DiscordSignInRpc() error = nil, want an error for a used code")
+	}
+
+	// The player has signed in too often
+	_, err = DiscordSignInRpc(ctx, logger, nil, nk, `{"code":"again","oauth_redirect_url":"https://example.com/signin"}`, discordClient, limiter)
+	if apiErr := apierror.From(err); apiErr == nil || apiErr.Code != apierror.StatusResourceExhausted {
+		t.Errorf("DiscordSignInRpc() error = %v, want %d", err, apierror.StatusResourceExhausted)
+	}
+}
+
+func TestDiscordSignInCallerLimit(t *testing.T) {
+	nk := nakamatest.NewModule()
+	logger := nakamatest.NewLogger(t)
+	discordClient := discordtest.NewClient()
+	discordClient.AddAuthorization("code", &discord.AccessToken{AccessToken: "access", RefreshToken: "refresh"}, &discordgo.User{ID: testDiscordId, Username: "player"})
+	limiter := ratelimit.NewLimiter(map[string]ratelimit.Limit{"signin/discord/caller": {Requests: 1, Per: time.Minute}})
+	fromIp := func(ip string) context.Context {
+		return context.WithValue(context.Background(), runtime.RUNTIME_CTX_CLIENT_IP, ip)
+	}
+
+	// An invalid code counts against the caller
+	if _, err := DiscordSignInRpc(fromIp("203.0.113.1"), logger, nil, nk, `{"code":"invalid","oauth_redirect_url":"https://example.com/signin"}`, discordClient, limiter); err == nil {
+		t.Fatal("DiscordSignInRpc() error = nil, want an error for an invalid code")
+	}
+
+	// The caller is limited before the code is exchanged, so it can still be used by another caller
+	payload := `{"code":"code","oauth_redirect_url":"https://example.com/signin"}`
+	_, err := DiscordSignInRpc(fromIp("203.0.113.1"), logger, nil, nk, payload, discordClient, limiter)
+	if apiErr := apierror.From(err); apiErr == nil || apiErr.Code != apierror.StatusResourceExhausted {
+		t.Errorf("DiscordSignInRpc() error = %v, want %d", err, apierror.StatusResourceExhausted)
+	}
+	if _, err := DiscordSignInRpc(fromIp("203.0.113.2"), logger, nil, nk, payload, discordClient, limiter); err != nil {
+		t.Errorf("DiscordSignInRpc() error: %v", err)
+	}
+}
+
+func TestLoginRequestRelayLimit(t *testing.T) {
+	nk := nakamatest.NewModule()
+	logger := nakamatest.NewLogger(t)
+	ownerUserId, _, _, _ := nk.AuthenticateCustom(context.Background(), "owner", "owner", true)
+	serviceContext := &services.ServiceContext{Ctx: context.Background(), Logger: logger, NakamaModule: nk}
+	registered, apiErr := relay.SetRelay(serviceContext, &relay.Relay{Id: "test", OwnerUserId: ownerUserId, Enabled: true})
+	if apiErr != nil {
+		t.Fatalf("SetRelay() error: %v", apiErr)
+	}
+	key, _, apiErr := relay.CreateApiKey(serviceContext, "test", []relay.Scope{relay.ScopeLogin}, "test")
+	if apiErr != nil {
+		t.Fatalf("CreateApiKey() error: %v", apiErr)
+	}
+	ctx := context.WithValue(context.Background(), runtime.RUNTIME_CTX_USER_ID, registered.UserId)
+	ctx = context.WithValue(ctx, runtime.RUNTIME_CTX_VARS, map[string]string{relay.RelayIdSessionVar: "test", relay.KeyIdSessionVar: key.Id})
+	limiter := ratelimit.NewLimiter(map[string]ratelimit.Limit{"relay/loginrequest/relay": {Requests: 1, Per: time.Minute}})
+
+	// The relay is limited however the requests vary, even when they are invalid
+	if _, err := LoginRequestRpc(ctx, logger, nil, nk, `{`, nil, nil, limiter); err == nil || apierror.From(err).Code != apierror.StatusInvalidArgument {
+		t.Fatalf("LoginRequestRpc() error = %v, want %d", err, apierror.StatusInvalidArgument)
+	}
+	_, err := LoginRequestRpc(ctx, logger, nil, nk, `{"client_ip_address":"203.0.113.2"}`, nil, nil, limiter)
+	if apiErr := apierror.From(err); apiErr == nil || apiErr.Code != apierror.StatusResourceExhausted {
+		t.Errorf("LoginRequestRpc() error = %v, want %d", err, apierror.StatusResourceExhausted)
+	}
+}
+
+// legacyOutageModule fails the reads of the imported legacy accounts while failing is set.
+type legacyOutageModule struct {
+	*nakamatest.Module
+	failing bool
+}
+
+func (m *legacyOutageModule) StorageRead(ctx context.Context, reads []*runtime.StorageRead) ([]*api.StorageObject, error) {
+	for _, read := range reads {
+		if m.failing && read.Collection == login.LegacyAccountStorageCollection {
+			return nil, errors.New("storage unavailable")
+		}
+	}
+	return m.Module.StorageRead(ctx, reads)
+}
+
+func TestLinkAccountDeviceClaimFails(t *testing.T) {
+	ctx := context.Background()
+	logger := nakamatest.NewLogger(t)
+	nk := &legacyOutageModule{Module: nakamatest.NewModule(), failing: true}
+	playerUserId, _, _, err := nk.AuthenticateCustom(ctx, testDiscordId, testDiscordId, true)
+	if err != nil {
+		t.Fatalf("AuthenticateCustom() error: %v", err)
+	}
+
+	deviceToken := "1369078409873402:OVR-ORG-1234:HMD-1"
+	ticket, _ := json.Marshal(&login.LinkTicket{Code: "ABCDE", DeviceAuthToken: deviceToken, UserIDToken: "OVR-ORG-1234"})
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{Collection: login.LinkTicketCollection, Key: "ABCDE", UserID: services.SystemUserId, Value: string(ticket)}}); err != nil {
+		t.Fatalf("StorageWrite() error: %v", err)
+	}
+
+	// A failed claim leaves the device unlinked and the ticket in place, so the link can be retried
+	if err := LinkAccountDevice(ctx, nk, logger, "ABCDE", playerUserId); err == nil {
+		t.Fatal("LinkAccountDevice() = nil, want the claim error")
+	}
+	if _, _, _, err := nk.AuthenticateDevice(ctx, deviceToken, "", false); err == nil {
+		t.Error("AuthenticateDevice() = nil, want the device unlinked")
+	}
+	if objects, _ := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: login.LinkTicketCollection, Key: "ABCDE", UserID: services.SystemUserId}}); len(objects) != 1 {
+		t.Error("StorageRead() found no link ticket, want it kept")
+	}
+
+	nk.failing = false
+	if err := LinkAccountDevice(ctx, nk, logger, "ABCDE", playerUserId); err != nil {
+		t.Fatalf("LinkAccountDevice() error on retry: %v", err)
+	}
+	if userId, _, _, err := nk.AuthenticateDevice(ctx, deviceToken, "", false); err != nil || userId != playerUserId {
+		t.Errorf("AuthenticateDevice() = %q, %v, want the device linked to the player", userId, err)
+	}
+}
+
+func TestLinkDeviceRpcTokenWithoutUid(t *testing.T) {
+	cfg := &config.Config{SessionEncryptionKey: "key"}
+	limiter := ratelimit.NewLimiter(nil)
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"usn": "player"}).SignedString([]byte(cfg.SessionEncryptionKey))
+	if err != nil {
+		t.Fatalf("SignedString() error: %v", err)
+	}
+
+	payload, _ := json.Marshal(map[string]string{"sessionToken": token, "linkCode": "ABCDE"})
+	_, err = LinkDeviceRpc(context.Background(), nakamatest.NewLogger(t), nil, nakamatest.NewModule(), string(payload), cfg, limiter)
+	if apiErr := apierror.From(err); apiErr == nil || apiErr.Code != apierror.StatusInvalidArgument {
+		t.Errorf("LinkDeviceRpc() error = %v, want %d", err, apierror.StatusInvalidArgument)
+	}
+}
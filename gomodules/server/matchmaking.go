@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+	"echonakama/server/services/config"
+	"echonakama/server/services/matchmaking"
+	"echonakama/server/services/relay"
+	"encoding/json"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// LobbyFindRpc turns a player's lobby find request into a Nakama matchmaker ticket.
+// The relay submits the ticket over the player's realtime session; when the ticket is matched,
+// the player's lobby assignment is sent to that session.
+func LobbyFindRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if _, apiErr := relay.RequireRelay(ctx, logger, nk, relay.ScopeMatchmaking); apiErr != nil {
+		return "", apiErr
+	}
+
+	var request matchmaking.LobbyFindRequest
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		logger.WithField("err", err).Error("Unable to unmarshal payload")
+		return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	ticket, apiErr := matchmaking.FindLobby(serviceContext, &request)
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to find lobby")
+	}
+
+	response, err := json.Marshal(ticket)
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
+
+// LobbyAssignmentRpc returns the last lobby assignment of the payload's "user_id".
+// Relays use it to recover an assignment whose notification they missed.
+func LobbyAssignmentRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if _, apiErr := relay.RequireRelay(ctx, logger, nk, relay.ScopeMatchmaking); apiErr != nil {
+		return "", apiErr
+	}
+
+	var request struct {
+		UserId string `json:"user_id"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		logger.WithField("err", err).Error("Unable to unmarshal payload")
+		return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
+	}
+	if request.UserId == "" {
+		return "", runtime.NewError("user_id is empty", apierror.StatusInvalidArgument)
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	assignment, apiErr := matchmaking.ReadAssignment(serviceContext, request.UserId)
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to read lobby assignment")
+	}
+	if assignment == nil {
+		return "", runtime.NewError("no lobby assignment", apierror.StatusNotFound)
+	}
+
+	response, err := json.Marshal(assignment)
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
+
+// MatchmakerMatched allocates a game server for each group the Nakama matchmaker matches,
+// and sends the assignment to the matched players. Matches are not run by Nakama, so no match ID is returned.
+func MatchmakerMatched(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, entries []runtime.MatchmakerEntry, cfg *config.Config) (string, error) {
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+		Config:       cfg,
+	}
+	if _, apiErr := matchmaking.ProcessMatched(serviceContext, entries); apiErr != nil {
+		apiErr.Log(logger, "matchmaking failed")
+	}
+	return "", nil
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+	"echonakama/server/services/party"
+	"encoding/json"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// PartyRequest identifies the party or player a party RPC operates on.
+type PartyRequest struct {
+	PartyId string `json:"party_id"`
+	Code    string `json:"code"`
+	UserId  string `json:"user_id"`
+}
+
+// partyRpc runs a party operation for the calling player, and returns the party as JSON.
+func partyRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string, operation func(serviceContext *services.ServiceContext, userId string, request PartyRequest) (*party.Party, *apierror.Error)) (string, error) {
+	userId, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	if !ok || userId == "" {
+		return "", runtime.NewError("player must authenticate", apierror.StatusUnauthenticated)
+	}
+
+	var request PartyRequest
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &request); err != nil {
+			logger.WithField("err", err).Error("Unable to unmarshal payload")
+			return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
+		}
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	p, apiErr := operation(serviceContext, userId, request)
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Party operation failed")
+	}
+	if p == nil {
+		return `{"success":true}`, nil
+	}
+
+	response, err := json.Marshal(p)
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
+
+// CreatePartyRpc creates a party led by the calling player.
+func CreatePartyRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return partyRpc(ctx, logger, db, nk, payload, func(serviceContext *services.ServiceContext, userId string, request PartyRequest) (*party.Party, *apierror.Error) {
+		return party.CreateParty(serviceContext, userId)
+	})
+}
+
+// GetPartyRpc returns the calling player's party.
+func GetPartyRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return partyRpc(ctx, logger, db, nk, payload, func(serviceContext *services.ServiceContext, userId string, request PartyRequest) (*party.Party, *apierror.Error) {
+		return party.GetParty(serviceContext, userId)
+	})
+}
+
+// InvitePartyRpc invites the payload's "user_id" to the calling player's party. Only the leader may invite.
+func InvitePartyRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return partyRpc(ctx, logger, db, nk, payload, func(serviceContext *services.ServiceContext, userId string, request PartyRequest) (*party.Party, *apierror.Error) {
+		if request.UserId == "" {
+			return nil, apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, "user_id is empty")
+		}
+		return party.InviteUser(serviceContext, userId, request.UserId)
+	})
+}
+
+// AcceptPartyRpc adds the calling player to the party of the payload's "party_id" (which they must be invited to),
+// or of the payload's "code".
+func AcceptPartyRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return partyRpc(ctx, logger, db, nk, payload, func(serviceContext *services.ServiceContext, userId string, request PartyRequest) (*party.Party, *apierror.Error) {
+		if request.PartyId == "" && request.Code == "" {
+			return nil, apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, "party_id or code is required")
+		}
+		return party.Accept(serviceContext, userId, request.PartyId, request.Code)
+	})
+}
+
+// LeavePartyRpc removes the calling player from their party.
+func LeavePartyRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return partyRpc(ctx, logger, db, nk, payload, func(serviceContext *services.ServiceContext, userId string, request PartyRequest) (*party.Party, *apierror.Error) {
+		return nil, party.Leave(serviceContext, userId)
+	})
+}
+
+// KickPartyRpc removes the payload's "user_id" from the calling player's party. Only the leader may kick.
+func KickPartyRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return partyRpc(ctx, logger, db, nk, payload, func(serviceContext *services.ServiceContext, userId string, request PartyRequest) (*party.Party, *apierror.Error) {
+		if request.UserId == "" {
+			return nil, apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, "user_id is empty")
+		}
+		return party.Kick(serviceContext, userId, request.UserId)
+	})
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+	"echonakama/server/services/login"
+	"encoding/json"
+	"fmt"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// ProfileHistoryRequest identifies a player's client or server profile, and optionally revisions of it.
+type ProfileHistoryRequest struct {
+	UserId   string `json:"user_id"`  // the Nakama user ID of the player
+	Key      string `json:"key"`      // the profile key (client or server)
+	From     int64  `json:"from"`     // the older revision to compare (diff)
+	To       int64  `json:"to"`       // the newer revision to compare (diff)
+	Revision int64  `json:"revision"` // the revision to restore (rollback)
+}
+
+func parseProfileHistoryRequest(logger runtime.Logger, payload string) (*ProfileHistoryRequest, error) {
+	var request ProfileHistoryRequest
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		logger.WithField("err", err).WithField("payload", payload).Error("Unable to unmarshal payload")
+		return nil, runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
+	}
+	if request.UserId == "" {
+		return nil, runtime.NewError("user_id is empty", apierror.StatusInvalidArgument)
+	}
+	if request.Key != login.ClientGameProfileStorageKey && request.Key != login.ServerGameProfileStorageKey {
+		return nil, runtime.NewError(fmt.Sprintf("key must be %q or %q", login.ClientGameProfileStorageKey, login.ServerGameProfileStorageKey), apierror.StatusInvalidArgument)
+	}
+	return &request, nil
+}
+
+// ProfileHistoryRpc lists the stored revisions of a player's profile, without their values.
+func ProfileHistoryRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := requireAdmin(ctx, logger, nk); err != nil {
+		return "", err
+	}
+	request, err := parseProfileHistoryRequest(logger, payload)
+	if err != nil {
+		return "", err
+	}
+
+	revisions, err := login.ListProfileRevisions(ctx, nk, request.UserId, request.Key)
+	if err != nil {
+		logger.WithField("err", err).Error("Unable to list profile revisions")
+		return "", runtime.NewError("Unable to list profile revisions", apierror.StatusInternalError)
+	}
+	for _, revision := range revisions {
+		revision.Value = nil
+	}
+
+	response, err := json.Marshal(map[string]interface{}{"revisions": revisions})
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
+
+// ProfileDiffRpc compares two revisions of a player's profile and returns the changed values.
+func ProfileDiffRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := requireAdmin(ctx, logger, nk); err != nil {
+		return "", err
+	}
+	request, err := parseProfileHistoryRequest(logger, payload)
+	if err != nil {
+		return "", err
+	}
+
+	revisions := make([]*login.ProfileRevision, 0, 2)
+	for _, number := range []int64{request.From, request.To} {
+		revision, err := login.ReadProfileRevision(ctx, nk, request.UserId, request.Key, number)
+		if err != nil {
+			logger.WithField("err", err).Error("Unable to read profile revision")
+			return "", runtime.NewError("Unable to read profile revision", apierror.StatusInternalError)
+		}
+		if revision == nil {
+			return "", runtime.NewError(fmt.Sprintf("revision %d not found", number), apierror.StatusNotFound)
+		}
+		revisions = append(revisions, revision)
+	}
+
+	changes, err := login.DiffProfileRevisions(revisions[0], revisions[1])
+	if err != nil {
+		logger.WithField("err", err).Error("Unable to compare profile revisions")
+		return "", runtime.NewError("Unable to compare profile revisions", apierror.StatusDataLoss)
+	}
+
+	response, err := json.Marshal(map[string]interface{}{"changes": changes})
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
+
+// ProfileRollbackRpc restores a player's profile to a stored revision.
+func ProfileRollbackRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := requireAdmin(ctx, logger, nk); err != nil {
+		return "", err
+	}
+	request, err := parseProfileHistoryRequest(logger, payload)
+	if err != nil {
+		return "", err
+	}
+
+	// Server-to-server calls have no user ID, so they are recorded as the system user
+	adminUserId, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	if !ok || adminUserId == "" {
+		adminUserId = services.SystemUserId
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	revision, apiErr := login.RollbackProfile(serviceContext, request.UserId, request.Key, request.Revision, adminUserId)
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to roll back profile")
+	}
+
+	revision.Value = nil
+	response, err := json.Marshal(map[string]interface{}{"restored": revision})
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
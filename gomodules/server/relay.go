@@ -0,0 +1,250 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+	"echonakama/server/services/config"
+	"echonakama/server/services/relay"
+	"encoding/json"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// RelayAuthenticateRequest is sent by a relay to exchange its API key for a session.
+type RelayAuthenticateRequest struct {
+	RelayId string `json:"relay_id"` // the registered relay's ID
+	ApiKey  string `json:"api_key"`  // the credential issued by admin/relaykeycreate
+	Region  string `json:"region"`   // the region the relay is serving
+}
+
+// RelayKeyRequest identifies a relay's API key, or describes one to create.
+type RelayKeyRequest struct {
+	RelayId string        `json:"relay_id"`
+	KeyId   string        `json:"key_id"`
+	Scopes  []relay.Scope `json:"scopes"`
+	Note    string        `json:"note"`
+}
+
+// RelayAuthenticateRpc exchanges a relay's API key for a session token, which the relay uses to call relay RPCs.
+func RelayAuthenticateRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var request RelayAuthenticateRequest
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		logger.WithField("err", err).Error("Unable to unmarshal payload")
+		return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	token, apiErr := relay.Authenticate(serviceContext, request.RelayId, request.ApiKey, request.Region)
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Relay authentication failed")
+	}
+
+	response, err := json.Marshal(map[string]interface{}{"token": token})
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
+
+// ListRelaysRpc returns the registered relays. Only admins may list relays.
+func ListRelaysRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := requireAdmin(ctx, logger, nk); err != nil {
+		return "", err
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	relays, apiErr := relay.ListRelays(serviceContext)
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to list relays")
+	}
+
+	response, err := json.Marshal(map[string]interface{}{"relays": relays})
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
+
+// SetRelayRpc registers a relay, or updates a registered relay's owner, enabled flag and regions.
+// Only admins may set relays.
+func SetRelayRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := requireAdmin(ctx, logger, nk); err != nil {
+		return "", err
+	}
+
+	request := &relay.Relay{}
+	if err := json.Unmarshal([]byte(payload), request); err != nil {
+		logger.WithField("err", err).Error("Unable to unmarshal payload")
+		return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	updated, apiErr := relay.SetRelay(serviceContext, request)
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to set relay")
+	}
+
+	response, err := json.Marshal(updated)
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
+
+// DeleteRelayRpc removes the relay identified by the payload's "relay_id". Only admins may delete relays.
+func DeleteRelayRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := requireAdmin(ctx, logger, nk); err != nil {
+		return "", err
+	}
+
+	var request RelayKeyRequest
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		logger.WithField("err", err).Error("Unable to unmarshal payload")
+		return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
+	}
+	if request.RelayId == "" {
+		return "", runtime.NewError("relay_id is empty", apierror.StatusInvalidArgument)
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	if apiErr := relay.DeleteRelay(serviceContext, request.RelayId); apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to delete relay")
+	}
+	return `{"success":true}`, nil
+}
+
+// CreateRelayKeyRpc issues an API key with the payload's scopes to a relay. Only admins may create keys.
+// The response carries the credential, which is not stored and cannot be retrieved again.
+func CreateRelayKeyRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := requireAdmin(ctx, logger, nk); err != nil {
+		return "", err
+	}
+
+	var request RelayKeyRequest
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		logger.WithField("err", err).Error("Unable to unmarshal payload")
+		return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	key, credential, apiErr := relay.CreateApiKey(serviceContext, request.RelayId, request.Scopes, request.Note)
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to create relay API key")
+	}
+
+	response, err := json.Marshal(map[string]interface{}{"key_id": key.Id, "scopes": key.Scopes, "api_key": credential})
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
+
+// RevokeRelayKeyRpc revokes a relay's API key. Only admins may revoke keys.
+func RevokeRelayKeyRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := requireAdmin(ctx, logger, nk); err != nil {
+		return "", err
+	}
+
+	var request RelayKeyRequest
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		logger.WithField("err", err).Error("Unable to unmarshal payload")
+		return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+	}
+	if apiErr := relay.RevokeApiKey(serviceContext, request.RelayId, request.KeyId); apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to revoke relay API key")
+	}
+	return `{"success":true}`, nil
+}
+
+// RelayHeartbeatRpc records a relay's heartbeat, keeping it in the registry of online relays.
+// Relays send one on each stats interval; a relay that stops is removed once its presence expires.
+func RelayHeartbeatRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string, cfg *config.Config) (string, error) {
+	caller, apiErr := relay.RequireRelay(ctx, logger, nk, relay.ScopeHeartbeat)
+	if apiErr != nil {
+		return "", apiErr
+	}
+
+	var request relay.Heartbeat
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		logger.WithField("err", err).Error("Unable to unmarshal payload")
+		return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+		Config:       cfg,
+	}
+	presence, apiErr := relay.RecordHeartbeat(serviceContext, caller, &request)
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to record heartbeat")
+	}
+
+	response, err := json.Marshal(presence)
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
+
+// RelayStatusRpc returns the network status: each registered relay, whether it is online,
+// and the peers connected to it. Only admins may read the network status.
+func RelayStatusRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string, cfg *config.Config) (string, error) {
+	if err := requireAdmin(ctx, logger, nk); err != nil {
+		return "", err
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: nk,
+		Config:       cfg,
+	}
+	status, apiErr := relay.GetNetworkStatus(serviceContext)
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Unable to get relay status")
+	}
+
+	response, err := json.Marshal(status)
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling response", err), "Unable to marshal response")
+	}
+	return string(response), nil
+}
@@ -4,94 +4,130 @@ import (
 	"context"
 	"database/sql"
 	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+	"echonakama/server/services/config"
+	"echonakama/server/services/discord"
 	"echonakama/server/services/login"
+	"echonakama/server/services/metrics"
+	"echonakama/server/services/migration"
+	"echonakama/server/services/ratelimit"
+	"echonakama/server/services/relay"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
 
-	"github.com/bwmarrin/discordgo"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/heroiclabs/nakama-common/runtime"
 )
 
-const (
-	// Websocket Error Codes
-	StatusOK                 = 0  // StatusOK indicates a successful operation.
-	StatusCanceled           = 1  // StatusCanceled indicates the operation was canceled.
-	StatusUnknown            = 2  // StatusUnknown indicates an unknown error occurred.
-	StatusInvalidArgument    = 3  // StatusInvalidArgument indicates an invalid argument was provided.
-	StatusDeadlineExceeded   = 4  // StatusDeadlineExceeded indicates the operation exceeded the deadline.
-	StatusNotFound           = 5  // StatusNotFound indicates the requested resource was not found.
-	StatusAlreadyExists      = 6  // StatusAlreadyExists indicates the resource already exists.
-	StatusPermissionDenied   = 7  // StatusPermissionDenied indicates the operation was denied due to insufficient permissions.
-	StatusResourceExhausted  = 8  // StatusResourceExhausted indicates the resource has been exhausted.
-	StatusFailedPrecondition = 9  // StatusFailedPrecondition indicates a precondition for the operation was not met.
-	StatusAborted            = 10 // StatusAborted indicates the operation was aborted.
-	StatusOutOfRange         = 11 // StatusOutOfRange indicates a value is out of range.
-	StatusUnimplemented      = 12 // StatusUnimplemented indicates the operation is not implemented.
-	StatusInternalError      = 13 // StatusInternal indicates an internal server error occurred.
-	StatusUnavailable        = 14 // StatusUnavailable indicates the service is currently unavailable.
-	StatusDataLoss           = 15 // StatusDataLoss indicates a loss of data occurred.
-	StatusUnauthenticated    = 16 // StatusUnauthenticated indicates the request lacks valid authentication credentials.
-)
-
 // Handles the user login request from Echo Relay
 // LoginRequestRpc is a function that handles a login request RPC.
-// It takes a context, logger, database connection, Nakama module, and payload as input.
+// It takes a context, logger, database connection, Nakama module, payload, module configuration, Discord client and rate limiter as input.
 // It returns a string and an error.
 // The payload is expected to be in JSON format and will be parsed into a LoginRequest object.
 // The function creates a ServiceContext object and passes it to the login service for processing.
 // If the login request is successful, it marshals the LoginSuccess object into JSON and returns it as a string.
-// If there is an error during the process, it returns an error with an appropriate message.
-func LoginRequestRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string, discordBot *discordgo.Session) (string, error) {
+// If there is an error during the process, it returns an *apierror.Error, which keeps the reason the login failed.
+func LoginRequestRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string, cfg *config.Config, discordClient discord.Client, limiter *ratelimit.Limiter) (string, error) {
+	// Only registered, enabled relays may log players in
+	caller, apiErr := relay.RequireRelay(ctx, logger, nk, relay.ScopeLogin)
+	if apiErr != nil {
+		return "", apiErr
+	}
+
+	// Limit the logins of each relay, as it reports the client IPs itself
+	if apiErr := limiter.Check("relay/loginrequest/relay", caller.Id); apiErr != nil {
+		apiErr.Log(logger.WithField("relayId", caller.Id), "login rate limited")
+		return "", apiErr
+	}
 
 	// Parse the payload into a LoginRequest object
 	var request login.LoginRequest
 	if err := json.Unmarshal([]byte(payload), &request); err != nil {
 		logger.WithField("err", err).Error("Unable to unmarshal payload")
-		return "", runtime.NewError("Unable to unmarshal payload", StatusInvalidArgument)
+		return "", apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, "Unable to unmarshal payload").Wrap(err)
+	}
+
+	// Limit the logins of each player, by the client IP the relay reports (or of the relay, if it reports none)
+	clientKey := request.ClientIpAddress
+	if clientKey == "" {
+		clientKey = "relay:" + caller.Id
+	}
+	if apiErr := limiter.Check("relay/loginrequest", clientKey); apiErr != nil {
+		apiErr.Log(logger.WithField("relayId", caller.Id), "login rate limited")
+		return "", apiErr
 	}
 	// Create a ServiceContext object to pass to the login service
 	serviceContext := &services.ServiceContext{
 		Ctx:          ctx,
 		Logger:       logger,
 		DbConnection: db,
-		NakamaModule: nk,
-		DiscordBot:   discordBot,
+		NakamaModule: metrics.InstrumentStorage(nk),
+		Discord:      discordClient,
+		Config:       cfg,
 	}
 
 	// Process the login request
-	success, nkerr := login.ProcessLoginRequest(serviceContext, &request)
-	if nkerr != nil {
-		logger.WithField("err", nkerr).Error("login failed")
-
-		return "", runtime.NewError(nkerr.Message, StatusInternalError)
+	success, apiErr := login.ProcessLoginRequest(serviceContext, &request)
+	if apiErr != nil {
+		apiErr.Log(logger.WithField("xplatformid", request.EchoUserId.String()), "login failed")
+		return "", apiErr
 	}
 
 	// Marshal the LoginSuccess object into JSON
 	loginSuccessJson, err := json.Marshal(success)
 	if err != nil {
-		return "", runtime.NewError(fmt.Sprintf("error marshalling LoginSuccess response: %v", err), StatusInternalError)
+		return "", rpcError(logger, apierror.Internal("error marshalling LoginSuccess response", err), "Unable to marshal LoginSuccess response")
 	}
 
 	return string(loginSuccessJson), nil
 }
 
+// ProfileUpdateRpc handles a client profile update from Echo Relay.
+// The payload is parsed into a ProfileUpdateRequest, which carries the changed fields of the client profile.
+// The changes are merged into the stored profile, validated, and written only if the stored version has not changed.
+// It returns the merged profile and its new version as JSON.
+func ProfileUpdateRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if _, apiErr := relay.RequireRelay(ctx, logger, nk, relay.ScopeProfile); apiErr != nil {
+		return "", apiErr
+	}
+
+	var request login.ProfileUpdateRequest
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		logger.WithField("err", err).Error("Unable to unmarshal payload")
+		return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
+	}
+
+	serviceContext := &services.ServiceContext{
+		Ctx:          ctx,
+		Logger:       logger,
+		DbConnection: db,
+		NakamaModule: metrics.InstrumentStorage(nk),
+	}
+
+	response, apiErr := login.ProcessProfileUpdate(serviceContext, &request)
+	if apiErr != nil {
+		return "", rpcError(logger, apiErr, "Profile update failed")
+	}
+
+	responseJson, err := json.Marshal(response)
+	if err != nil {
+		return "", rpcError(logger, apierror.Internal("error marshalling ProfileUpdate response", err), "Unable to marshal ProfileUpdate response")
+	}
+
+	return string(responseJson), nil
+}
+
 // DiscordSignInRpc is a function that handles the Discord sign-in RPC.
-// It takes in the context, logger, database connection, Nakama module, and payload as parameters.
-// The function exchanges the provided code for an access token, creates a Discord client,
+// It takes in the context, logger, database connection, Nakama module, payload, Discord client and rate limiter as parameters.
+// The function exchanges the provided code for an access token,
 // retrieves the Discord user, checks if a user exists with the Discord ID as a Nakama username,
 // creates a user if necessary, gets the account data, relinks the custom ID if necessary,
 // writes the access token to storage, updates the account information, generates a session token,
 // stores the JWT in the user's metadata, and returns the session token and Discord username as a JSON response.
 // If any error occurs during the process, an error message is returned.
-func DiscordSignInRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
-	logger.WithField("payload", payload).Info("DiscordSignInRpc")
-
-	vars, _ := ctx.Value(runtime.RUNTIME_CTX_ENV).(map[string]string)
-	clientId := vars["DISCORD_CLIENT_ID"]
-	clientSecret := vars["DISCORD_CLIENT_SECRET"]
+func DiscordSignInRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string, discordClient discord.Client, limiter *ratelimit.Limiter) (string, error) {
 	nkUserId := ""
 
 	type DiscordSignInRequest struct {
@@ -103,48 +139,57 @@ func DiscordSignInRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk
 	var request DiscordSignInRequest
 	if err := json.Unmarshal([]byte(payload), &request); err != nil {
 		logger.WithField("err", err).WithField("payload", payload).Error("Unable to unmarshal payload")
-		return "", runtime.NewError("Unable to unmarshal payload", StatusInvalidArgument)
+		return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
 	}
 	if request.Code == "" {
 		logger.Error("DiscordSignInRpc: Code is empty")
-		return "", runtime.NewError("Code is empty", StatusInvalidArgument)
+		return "", runtime.NewError("Code is empty", apierror.StatusInvalidArgument)
 	}
 	if request.OAuthRedirectUrl == "" {
 		logger.Error("DiscordSignInRpc: OAuthRedirectUrl is empty")
-		return "", runtime.NewError("OAuthRedirectUrl is empty", StatusInvalidArgument)
+		return "", runtime.NewError("OAuthRedirectUrl is empty", apierror.StatusInvalidArgument)
 	}
 
-	// Exchange the code for an access token
-	accessToken, err := login.ExchangeCodeForAccessToken(logger, request.Code, clientId, clientSecret, request.OAuthRedirectUrl)
-	if err != nil {
-		logger.WithField("err", err).Error("Unable to exchange code for access token")
-		return "", runtime.NewError("Unable to exchange code for access token", StatusInternalError)
+	// Limit the sign-ins of each caller before calling Discord, so invalid codes cannot be sent without limit
+	callerKey := "ip:" + clientIp(ctx)
+	if userId, _ := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string); userId != "" {
+		callerKey = "user:" + userId
+	}
+	if apiErr := limiter.Check("signin/discord/caller", callerKey); apiErr != nil {
+		apiErr.Log(logger.WithField("caller", callerKey), "sign-in rate limited")
+		return "", apiErr.Runtime()
 	}
 
-	// Create a Discord client
-	discord, err := discordgo.New("Bearer " + accessToken.AccessToken)
+	// Exchange the code for an access token
+	accessToken, err := discordClient.ExchangeCode(ctx, request.Code, request.OAuthRedirectUrl)
 	if err != nil {
-		logger.WithField("err", err).Error("Unable to create Discord client")
-		return "", runtime.NewError("Unable to create Discord client", StatusInternalError)
+		logger.WithField("err", err).Error("Unable to exchange code for access token")
+		return "", runtime.NewError("Unable to exchange code for access token", apierror.StatusInternalError)
 	}
 
 	// Get the Discord user
-	user, err := discord.User("@me")
+	user, err := discordClient.CurrentUser(ctx, accessToken.AccessToken)
 	if err != nil {
 		logger.WithField("err", err).Error("Unable to get Discord user")
-		return "", runtime.NewError("Unable to get Discord user", StatusInternalError)
+		return "", runtime.NewError("Unable to get Discord user", apierror.StatusInternalError)
+	}
+
+	// Limit the sign-ins of each Discord user
+	if apiErr := limiter.Check("signin/discord", user.ID); apiErr != nil {
+		apiErr.Log(logger.WithField("discordId", user.ID), "sign-in rate limited")
+		return "", apiErr.Runtime()
 	}
 
 	// check if a user exists with the Discord ID as a Nk username
 	results, err := nk.UsersGetUsername(ctx, []string{user.ID})
 	if err != nil {
-		return "", runtime.NewError("Unable to get user", StatusInternalError)
+		return "", runtime.NewError("Unable to get user", apierror.StatusInternalError)
 	}
 	if len(results) == 0 {
 		// create the user
 		nkUserId, _, _, err = nk.AuthenticateCustom(ctx, user.ID, user.ID, true)
 		if err != nil {
-			return "", runtime.NewError("Unable to create user", StatusInternalError)
+			return "", runtime.NewError("Unable to create user", apierror.StatusInternalError)
 		}
 	} else {
 		nkUserId = results[0].Id
@@ -154,7 +199,7 @@ func DiscordSignInRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk
 	account, err := nk.AccountGetId(ctx, nkUserId)
 	if err != nil {
 		logger.WithField("err", err).Error("Unable to get account")
-		return "", runtime.NewError("Unable to get account", StatusInternalError)
+		return "", runtime.NewError("Unable to get account", apierror.StatusInternalError)
 	}
 
 	// If the customId doesn't match the discord token, relink it
@@ -163,26 +208,26 @@ func DiscordSignInRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk
 		err = nk.LinkCustom(ctx, nkUserId, accessToken.AccessToken)
 		if err != nil {
 			logger.WithField("err", err).Error("Unable to link custom")
-			return "", runtime.NewError("Unable to link custom", StatusInternalError)
+			return "", runtime.NewError("Unable to link custom", apierror.StatusInternalError)
 		}
 	}
 	// Write the access token to storage
 	login.WriteAccessTokenToStorage(ctx, logger, nk, nkUserId, accessToken)
 	if err != nil {
 		logger.WithField("err", err).Error("Unable to write access token to storage")
-		return "", runtime.NewError("Unable to write access token to storage", StatusInternalError)
+		return "", runtime.NewError("Unable to write access token to storage", apierror.StatusInternalError)
 	}
 	logger.WithField("user.Username", user.Username).Info("DiscordSignInRpc: Wrote access token to storage")
 
 	if err := nk.AccountUpdateId(ctx, nkUserId, "", nil, user.Username, "", "", "", ""); err != nil {
-		return "", runtime.NewError("Unable to update account", StatusInternalError)
+		return "", runtime.NewError("Unable to update account", apierror.StatusInternalError)
 	}
 
 	// Generate a session token for the user to use to authenticate for device linking
 	sessionToken, _, err := nk.AuthenticateTokenGenerate(nkUserId, user.ID, time.Now().UTC().Unix()+3600, nil)
 	if err != nil {
 		logger.WithField("err", err).Error("Unable to generate session token")
-		return "", runtime.NewError("Unable to generate session token", StatusInternalError)
+		return "", runtime.NewError("Unable to generate session token", apierror.StatusInternalError)
 	}
 
 	// store the jwt in the user's metadata so we can verify it later
@@ -199,26 +244,26 @@ func DiscordSignInRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk
 	// Marshal the Discord Token object into JSON
 	responseJson, err := json.Marshal(response)
 	if err != nil {
-		return "", runtime.NewError(fmt.Sprintf("error marshalling LoginSuccess response: %v", err), StatusInternalError)
+		return "", rpcError(logger, apierror.Internal("error marshalling LoginSuccess response", err), "Unable to marshal LoginSuccess response")
 	}
 
 	return string(responseJson), nil
 }
 
 // LinkDeviceRpc is a function that handles the linking of a device to a user account.
-// It takes in the context, logger, database connection, Nakama module, and payload as parameters.
+// It takes in the context, logger, database connection, Nakama module, payload, module configuration and rate limiter as parameters.
 // The payload should be a JSON string containing the session token and link code.
 // It returns an empty string and an error.
 // The function performs the following steps:
 // 1. Unmarshalls the payload to extract the session token and link code.
 // 2. Validates the session token and retrieves the UID from it.
-// 3. Retrieves the link ticket from storage using the link code.
-// 4. Verifies the session token using the link ticket's device auth token.
-// 5. Retrieves the user account using the UID.
-// 6. Links the device to the user account.
-// 7. Deletes the link ticket from storage.
-func LinkDeviceRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
-	vars, _ := ctx.Value(runtime.RUNTIME_CTX_ENV).(map[string]string)
+// 3. Refuses the request if the user has made too many link attempts.
+// 4. Retrieves the link ticket from storage using the link code.
+// 5. Verifies the session token using the link ticket's device auth token.
+// 6. Retrieves the user account using the UID.
+// 7. Links the device to the user account.
+// 8. Deletes the link ticket from storage.
+func LinkDeviceRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string, cfg *config.Config, limiter *ratelimit.Limiter) (string, error) {
 	// unmarshall the payload
 	type LinkDeviceRequest struct {
 		SessionToken string `json:"sessionToken"`
@@ -227,26 +272,37 @@ func LinkDeviceRpc(ctx context.Context, logger runtime.Logger, db *sql.DB, nk ru
 	var request LinkDeviceRequest
 	if err := json.Unmarshal([]byte(payload), &request); err != nil {
 		logger.WithField("err", err).WithField("payload", payload).Error("Unable to unmarshal payload")
-		return "", runtime.NewError("Unable to unmarshal payload", StatusInvalidArgument)
+		return "", runtime.NewError("Unable to unmarshal payload", apierror.StatusInvalidArgument)
 	}
 	if request.SessionToken == "" {
 		logger.Error("linkDeviceRpc: SessionToken is empty")
-		return "", runtime.NewError("SessionToken is empty", StatusInvalidArgument)
+		return "", runtime.NewError("SessionToken is empty", apierror.StatusInvalidArgument)
 	}
 	if request.LinkCode == "" {
 		logger.Error("linkDeviceRpc: LinkCode is empty")
-		return "", runtime.NewError("LinkCode is empty", StatusInvalidArgument)
+		return "", runtime.NewError("LinkCode is empty", apierror.StatusInvalidArgument)
 	}
 
 	// verify the sessionToken. It's a JWT signed by the server.
 	// pull the uid out of it
 	logger.WithField("sessionToken", request.SessionToken).Info("Verifying session token")
-	token, err := verifySignedJwt(request.SessionToken, []byte(vars["SESSION_ENCRYPTION_KEY"]))
+	token, err := verifySignedJwt(request.SessionToken, []byte(cfg.SessionEncryptionKey))
 	if err != nil {
 		logger.WithField("err", err).Error("Unable to verify session token")
-		return "", runtime.NewError("Unable to verify session token", StatusInternalError)
+		return "", runtime.NewError("Unable to verify session token", apierror.StatusInternalError)
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	uid, ok := claims["uid"].(string)
+	if !ok || uid == "" {
+		logger.Error("linkDeviceRpc: session token has no uid")
+		return "", runtime.NewError("Session token has no uid", apierror.StatusInvalidArgument)
+	}
+
+	// Limit the link attempts of each user, so link codes cannot be guessed
+	if apiErr := limiter.Check("link/device", uid); apiErr != nil {
+		apiErr.Log(logger.WithField("uid", uid), "link rate limited")
+		return "", apiErr.Runtime()
 	}
-	uid := token.Claims.(jwt.MapClaims)["uid"].(string)
 
 	if err := LinkAccountDevice(ctx, nk, logger, request.LinkCode, uid); err != nil {
 		return "", err
@@ -272,47 +328,73 @@ func LinkAccountDevice(ctx context.Context, nk runtime.NakamaModule, logger runt
 		{
 			Collection: login.LinkTicketCollection,
 			Key:        linkCode,
-			UserID:     login.SystemUserId,
+			UserID:     services.SystemUserId,
 		},
 	})
 	if err != nil {
 		logger.WithField("err", err).Error("Unable to read link ticket from storage")
-		return runtime.NewError("Unable to read link ticket from storage", StatusInternalError)
+		return runtime.NewError("Unable to read link ticket from storage", apierror.StatusInternalError)
 	}
 	if len(objects) == 0 {
 		logger.WithField("linkCode", linkCode).Error("Unable to find link ticket")
-		return runtime.NewError("Unable to find link ticket", StatusNotFound)
+		return runtime.NewError("Unable to find link ticket", apierror.StatusNotFound)
+	}
+	if err := migration.ApplyObject(objects[0]); err != nil {
+		logger.WithField("err", err).Error("Unable to migrate link ticket")
+		return runtime.NewError("Unable to migrate link ticket", apierror.StatusInternalError)
 	}
 	var linkTicket login.LinkTicket
 	if err := json.Unmarshal([]byte(objects[0].Value), &linkTicket); err != nil {
 		logger.WithField("err", err).Error("Unable to unmarshal link ticket")
-		return runtime.NewError("Unable to unmarshal link ticket", StatusInternalError)
+		return runtime.NewError("Unable to unmarshal link ticket", apierror.StatusInternalError)
 	}
 
 	account, err := nk.AccountGetId(ctx, uid)
 	if err != nil {
 		logger.WithField("err", err).Error("Unable to get account")
-		return runtime.NewError("Unable to get account", StatusInternalError)
+		return runtime.NewError("Unable to get account", apierror.StatusInternalError)
+	}
+
+	// Move any imported legacy account with the same EchoUserId to the player. This is done before the
+	// device is linked, so a failed claim leaves the ticket to be retried; a claimed account is not claimed again
+	if err := login.ClaimLegacyAccount(ctx, logger, nk, linkTicket.UserIDToken, account.GetUser().GetId()); errors.Is(err, login.ErrLegacyAccountLocked) {
+		logger.WithField("xplatformid", linkTicket.UserIDToken).Warn("Refused to claim a locked legacy account")
+		return runtime.NewError("This account is locked, ask an admin to unlock it", apierror.StatusPermissionDenied)
+	} else if err != nil {
+		logger.WithField("err", err).Error("Unable to claim legacy account")
+		return runtime.NewError("Unable to claim legacy account", apierror.StatusInternalError)
 	}
 
 	if err := nk.LinkDevice(ctx, account.GetUser().GetId(), linkTicket.DeviceAuthToken); err != nil {
 		logger.WithField("err", err).Error("Unable to link device")
-		return runtime.NewError("Unable to link device", StatusInternalError)
+		return runtime.NewError("Unable to link device", apierror.StatusInternalError)
 	}
 
 	if err := nk.StorageDelete(ctx, []*runtime.StorageDelete{
 		{
 			Collection: login.LinkTicketCollection,
 			Key:        linkCode,
-			UserID:     login.SystemUserId,
+			UserID:     services.SystemUserId,
 		},
 	}); err != nil {
 		logger.WithField("err", err).Error("Unable to delete link ticket")
-		return runtime.NewError("Unable to delete link ticket", StatusInternalError)
+		return runtime.NewError("Unable to delete link ticket", apierror.StatusInternalError)
+	}
+
+	platform := ""
+	if linkTicket.LoginRequest != nil {
+		platform = linkTicket.LoginRequest.EchoUserId.PlatformCode.String()
 	}
+	nk.MetricsCounterAdd(metrics.LinkTicketsRedeemed, metrics.Tags(linkTicket.RelayId, platform), 1)
 	return nil
 }
 
+// clientIp returns the IP address of the client that made the request.
+func clientIp(ctx context.Context) string {
+	ip, _ := ctx.Value(runtime.RUNTIME_CTX_CLIENT_IP).(string)
+	return ip
+}
+
 // verifyJWT parses and verifies a JWT token using the provided key function.
 // It returns the parsed token if it is valid, otherwise it returns an error.
 // Nakama JWT's are signed by the `session.session_encryption_key` in the Nakama config.
@@ -0,0 +1,178 @@
+// Package apierror is the error model of the RPCs. An error carries a gRPC status code, a stable
+// reason the relay can act on, a message that is safe to show the player, and a cause for the logs.
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// Websocket Error Codes
+	StatusOK                 = 0  // StatusOK indicates a successful operation.
+	StatusCanceled           = 1  // StatusCanceled indicates the operation was canceled.
+	StatusUnknown            = 2  // StatusUnknown indicates an unknown error occurred.
+	StatusInvalidArgument    = 3  // StatusInvalidArgument indicates an invalid argument was provided.
+	StatusDeadlineExceeded   = 4  // StatusDeadlineExceeded indicates the operation exceeded the deadline.
+	StatusNotFound           = 5  // StatusNotFound indicates the requested resource was not found.
+	StatusAlreadyExists      = 6  // StatusAlreadyExists indicates the resource already exists.
+	StatusPermissionDenied   = 7  // StatusPermissionDenied indicates the operation was denied due to insufficient permissions.
+	StatusResourceExhausted  = 8  // StatusResourceExhausted indicates the resource has been exhausted.
+	StatusFailedPrecondition = 9  // StatusFailedPrecondition indicates a precondition for the operation was not met.
+	StatusAborted            = 10 // StatusAborted indicates the operation was aborted.
+	StatusOutOfRange         = 11 // StatusOutOfRange indicates a value is out of range.
+	StatusUnimplemented      = 12 // StatusUnimplemented indicates the operation is not implemented.
+	StatusInternalError      = 13 // StatusInternal indicates an internal server error occurred.
+	StatusUnavailable        = 14 // StatusUnavailable indicates the service is currently unavailable.
+	StatusDataLoss           = 15 // StatusDataLoss indicates a loss of data occurred.
+	StatusUnauthenticated    = 16 // StatusUnauthenticated indicates the request lacks valid authentication credentials.
+)
+
+// Reason is a stable, machine-readable error reason. Reasons are part of the relay API: add new
+// ones rather than renaming existing ones.
+type Reason string
+
+const (
+	ReasonUnknown          Reason = "unknown"
+	ReasonInvalidRequest   Reason = "invalid_request"
+	ReasonUnauthenticated  Reason = "unauthenticated"
+	ReasonPermissionDenied Reason = "permission_denied"
+	ReasonNotFound         Reason = "not_found"
+	ReasonConflict         Reason = "conflict"
+	ReasonUnavailable      Reason = "unavailable"
+	ReasonInternal         Reason = "internal"
+	ReasonRateLimited      Reason = "rate_limited" // the caller must wait before trying again
+
+	ReasonAccessDenied       Reason = "access_denied"       // the login is barred by the access control list
+	ReasonLinkRequired       Reason = "link_required"       // the device must be linked with the link code
+	ReasonRelinkRequired     Reason = "relink_required"     // the account must be linked to Discord again
+	ReasonAccountBanned      Reason = "account_banned"      // the account is disabled
+	ReasonInvalidPassword    Reason = "invalid_password"    // the password does not match the account's
+	ReasonNotGuildMember     Reason = "not_guild_member"    // the player is not a member of the guild
+	ReasonDiscordUnavailable Reason = "discord_unavailable" // the player's guild membership cannot be checked until Discord is reachable
+)
+
+// Error is an RPC error.
+type Error struct {
+	Code    int               `json:"code"`              // the gRPC status code
+	Reason  Reason            `json:"reason"`            // the machine-readable reason
+	Message string            `json:"message"`           // the message for the player
+	Details map[string]string `json:"details,omitempty"` // machine-readable values, such as a link code
+	Cause   error             `json:"-"`                 // the underlying error, for the logs only
+}
+
+// New returns an error with a player-facing message.
+func New(code int, reason Reason, message string) *Error {
+	return &Error{Code: code, Reason: reason, Message: message}
+}
+
+// Internal returns an internal error. The cause is logged, but not shown to the player.
+func Internal(message string, cause error) *Error {
+	return New(StatusInternalError, ReasonInternal, message).Wrap(cause)
+}
+
+// Wrap sets the underlying error.
+func (e *Error) Wrap(cause error) *Error {
+	e.Cause = cause
+	return e
+}
+
+// WithDetail adds a machine-readable value.
+func (e *Error) WithDetail(key string, value string) *Error {
+	if e.Details == nil {
+		e.Details = make(map[string]string)
+	}
+	e.Details[key] = value
+	return e
+}
+
+// Error returns the log-facing message, including the cause.
+func (e *Error) Error() string {
+	if e.Cause != nil {
+		return string(e.Reason) + ": " + e.Message + ": " + e.Cause.Error()
+	}
+	return string(e.Reason) + ": " + e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Cause
+}
+
+// Is reports whether the target is an Error with the same reason.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Reason == e.Reason
+}
+
+// JSON returns the structured error sent to the client.
+func (e *Error) JSON() string {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return `{"code":13,"reason":"internal","message":"error marshalling error"}`
+	}
+	return string(data)
+}
+
+// Runtime returns the error as a runtime error, keeping the status code, with the structured
+// error as its message.
+func (e *Error) Runtime() *runtime.Error {
+	return runtime.NewError(e.JSON(), e.Code)
+}
+
+// Log logs the error with its reason, code and cause.
+func (e *Error) Log(logger runtime.Logger, message string) {
+	logger = logger.WithField("reason", e.Reason).WithField("code", e.Code)
+	if e.Cause != nil {
+		logger = logger.WithField("err", e.Cause)
+	}
+	if e.Code == StatusInternalError || e.Code == StatusUnknown || e.Code == StatusDataLoss {
+		logger.Error("%s: %s", message, e.Message)
+	} else {
+		logger.Warn("%s: %s", message, e.Message)
+	}
+}
+
+// codeReasons are the reasons of errors that only have a status code.
+var codeReasons = map[int]Reason{
+	StatusInvalidArgument:    ReasonInvalidRequest,
+	StatusOutOfRange:         ReasonInvalidRequest,
+	StatusUnauthenticated:    ReasonUnauthenticated,
+	StatusPermissionDenied:   ReasonPermissionDenied,
+	StatusNotFound:           ReasonNotFound,
+	StatusAlreadyExists:      ReasonConflict,
+	StatusAborted:            ReasonConflict,
+	StatusFailedPrecondition: ReasonConflict,
+	StatusUnavailable:        ReasonUnavailable,
+	StatusResourceExhausted:  ReasonUnavailable,
+	StatusInternalError:      ReasonInternal,
+	StatusDataLoss:           ReasonInternal,
+}
+
+// From returns err as an Error. A runtime error made by Runtime is parsed back; any other runtime
+// error keeps its code and message, and is given the reason of its code. Any other error is an
+// internal error.
+func From(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	var runtimeErr *runtime.Error
+	if errors.As(err, &runtimeErr) {
+		structured := &Error{}
+		if json.Unmarshal([]byte(runtimeErr.Message), structured) == nil && structured.Reason != "" {
+			structured.Code = runtimeErr.Code
+			return structured
+		}
+		reason, ok := codeReasons[runtimeErr.Code]
+		if !ok {
+			reason = ReasonUnknown
+		}
+		return New(runtimeErr.Code, reason, runtimeErr.Message)
+	}
+	return Internal("internal error", err)
+}
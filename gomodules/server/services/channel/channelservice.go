@@ -0,0 +1,353 @@
+package channel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"echonakama/game"
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// The maximum number of members of a channel's Nakama group
+	ChannelMaxMembers = 1000000
+
+	// The registry is stored under the system user; each player's preference under the player
+	ChannelStorageCollection = "Channel"
+	RegistryStorageKey       = "registry"
+	PreferenceStorageKey     = "preference"
+)
+
+// Channel is a social channel in the registry. Each channel is backed by a closed Nakama group
+// created by the system user, whose members are the players assigned to it.
+type Channel struct {
+	game.ChannelGroup
+	Lang           string   `json:"lang"`             // the language spoken in the channel (e.g. en)
+	DiscordRoleIds []string `json:"discord_role_ids"` // players with one of these Discord roles are assigned to the channel
+	Default        bool     `json:"default"`          // players with no preference or matching role are assigned to the channel
+	GroupId        string   `json:"group_id"`         // the Nakama group that backs the channel (set by the registry)
+}
+
+// Validate checks the channel's game fields and language.
+func (c *Channel) Validate() error {
+	if err := c.ChannelGroup.Validate(); err != nil {
+		return err
+	}
+	if len(c.Lang) > 16 {
+		return fmt.Errorf("invalid lang: %q", c.Lang)
+	}
+	return nil
+}
+
+// Metadata returns the channel as Nakama group metadata, so it shows in the console; the registry is authoritative.
+func (c *Channel) Metadata() (map[string]interface{}, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	metadata := make(map[string]interface{})
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, err
+	}
+	delete(metadata, "group_id")
+	return metadata, nil
+}
+
+// registry lists the channels, and the groups that back them.
+type registry struct {
+	Channels []*Channel `json:"channels"`
+}
+
+// preference is the channel a player chose in the game.
+type preference struct {
+	ChannelUuid string `json:"channel_uuid"`
+}
+
+// readRegistry returns the registered channels, ordered by priority, and the registry's storage version
+// ("*" if there is none). If userId is set, it also returns the channel that player chose, or "" if none.
+func readRegistry(ctx context.Context, nk runtime.NakamaModule, userId string) ([]*Channel, string, string, error) {
+	reads := []*runtime.StorageRead{{
+		Collection: ChannelStorageCollection,
+		Key:        RegistryStorageKey,
+		UserID:     services.SystemUserId,
+	}}
+	if userId != "" {
+		reads = append(reads, &runtime.StorageRead{
+			Collection: ChannelStorageCollection,
+			Key:        PreferenceStorageKey,
+			UserID:     userId,
+		})
+	}
+	objects, err := nk.StorageRead(ctx, reads)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	channels := make([]*Channel, 0)
+	version := "*"
+	chosen := ""
+	for _, object := range objects {
+		switch object.Key {
+		case RegistryStorageKey:
+			var r registry
+			if err := json.Unmarshal([]byte(object.Value), &r); err != nil {
+				return nil, "", "", fmt.Errorf("error unmarshaling channel registry: %w", err)
+			}
+			channels = append(channels, r.Channels...)
+			version = object.Version
+		case PreferenceStorageKey:
+			var p preference
+			if err := json.Unmarshal([]byte(object.Value), &p); err != nil {
+				return nil, "", "", fmt.Errorf("error unmarshaling channel preference: %w", err)
+			}
+			chosen = p.ChannelUuid
+		}
+	}
+
+	sort.SliceStable(channels, func(i, j int) bool {
+		return channels[i].Priority < channels[j].Priority
+	})
+	return channels, version, chosen, nil
+}
+
+// writeRegistry writes the registered channels, if the registry still has the version read.
+func writeRegistry(ctx context.Context, nk runtime.NakamaModule, channels []*Channel, version string) error {
+	data, err := json.Marshal(registry{Channels: channels})
+	if err != nil {
+		return err
+	}
+	_, err = nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      ChannelStorageCollection,
+		Key:             RegistryStorageKey,
+		UserID:          services.SystemUserId,
+		Value:           string(data),
+		Version:         version,
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}})
+	return err
+}
+
+// PreferenceWrite returns the write that records the channel a player chose in the game.
+// The player keeps the channel across logins while it is registered, whatever their Discord roles.
+func PreferenceWrite(userId string, channelUuid string) (*runtime.StorageWrite, error) {
+	data, err := json.Marshal(preference{ChannelUuid: strings.ToUpper(channelUuid)})
+	if err != nil {
+		return nil, err
+	}
+	return &runtime.StorageWrite{
+		Collection:      ChannelStorageCollection,
+		Key:             PreferenceStorageKey,
+		UserID:          userId,
+		Value:           string(data),
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}, nil
+}
+
+// ListChannels returns the registered channels, ordered by priority.
+func ListChannels(ctx context.Context, nk runtime.NakamaModule) ([]*Channel, error) {
+	channels, _, _, err := readRegistry(ctx, nk, "")
+	return channels, err
+}
+
+// Info returns the channels as the game client expects them.
+func Info(channels []*Channel) game.ChannelInfo {
+	info := game.ChannelInfo{Groups: make([]game.ChannelGroup, 0, len(channels))}
+	for _, channel := range channels {
+		info.Groups = append(info.Groups, channel.ChannelGroup)
+	}
+	return info
+}
+
+// SetChannel creates or updates a channel, and its Nakama group.
+func SetChannel(serviceContext *services.ServiceContext, channel *Channel) (*Channel, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	logger := serviceContext.Logger
+	nk := serviceContext.NakamaModule
+
+	// The game displays channel UUIDs in upper case
+	channel.ChannelUuid = strings.ToUpper(channel.ChannelUuid)
+	if err := channel.Validate(); err != nil {
+		return nil, apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, err.Error())
+	}
+	if channel.DiscordRoleIds == nil {
+		channel.DiscordRoleIds = []string{}
+	}
+
+	channels, version, _, err := readRegistry(ctx, nk, "")
+	if err != nil {
+		return nil, apierror.Internal("error reading channels", err)
+	}
+	metadata, err := channel.Metadata()
+	if err != nil {
+		return nil, apierror.Internal("error marshaling channel", err)
+	}
+
+	created := true
+	for i, existing := range channels {
+		if existing.ChannelUuid != channel.ChannelUuid {
+			continue
+		}
+		if err := nk.GroupUpdate(ctx, existing.GroupId, services.SystemUserId, channel.Name, services.SystemUserId, channel.Lang, channel.Description, "", false, metadata, ChannelMaxMembers); err != nil {
+			return nil, apierror.Internal("error updating channel group", err)
+		}
+		channel.GroupId = existing.GroupId
+		channels[i] = channel
+		created = false
+		break
+	}
+	if created {
+		// The group is closed, so players can only join it by being assigned to the channel
+		group, err := nk.GroupCreate(ctx, services.SystemUserId, channel.Name, services.SystemUserId, channel.Lang, channel.Description, "", false, metadata, ChannelMaxMembers)
+		if err != nil {
+			return nil, apierror.Internal("error creating channel group", err)
+		}
+		channel.GroupId = group.GetId()
+		channels = append(channels, channel)
+	}
+
+	if err := writeRegistry(ctx, nk, channels, version); err != nil {
+		if created {
+			if err := nk.GroupDelete(ctx, channel.GroupId); err != nil {
+				logger.WithField("err", err).WithField("groupId", channel.GroupId).Warn("Unable to delete the group of an unregistered channel.")
+			}
+		}
+		if errors.Is(err, runtime.ErrStorageRejectedVersion) {
+			return nil, apierror.New(apierror.StatusAborted, apierror.ReasonConflict, "the channels were changed concurrently, try again")
+		}
+		return nil, apierror.Internal("error writing channels", err)
+	}
+
+	if created {
+		logger.WithField("channel", channel.ChannelUuid).Info("Channel created.")
+	} else {
+		logger.WithField("channel", channel.ChannelUuid).Info("Channel updated.")
+	}
+	return channel, nil
+}
+
+// DeleteChannel removes a channel, and its Nakama group.
+// Players in the channel are assigned to another channel on their next login.
+func DeleteChannel(serviceContext *services.ServiceContext, channelUuid string) *apierror.Error {
+	ctx := serviceContext.Ctx
+	logger := serviceContext.Logger
+	nk := serviceContext.NakamaModule
+
+	channels, version, _, err := readRegistry(ctx, nk, "")
+	if err != nil {
+		return apierror.Internal("error reading channels", err)
+	}
+	for i, channel := range channels {
+		if channel.ChannelUuid != strings.ToUpper(channelUuid) {
+			continue
+		}
+		// Unregister the channel first, so its group is never in use once it is deleted
+		remaining := append(channels[:i:i], channels[i+1:]...)
+		if err := writeRegistry(ctx, nk, remaining, version); err != nil {
+			if errors.Is(err, runtime.ErrStorageRejectedVersion) {
+				return apierror.New(apierror.StatusAborted, apierror.ReasonConflict, "the channels were changed concurrently, try again")
+			}
+			return apierror.Internal("error writing channels", err)
+		}
+		if err := nk.GroupDelete(ctx, channel.GroupId); err != nil {
+			return apierror.Internal("error deleting channel group", err)
+		}
+		logger.WithField("channel", channel.ChannelUuid).Info("Channel deleted.")
+		return nil
+	}
+	return apierror.New(apierror.StatusNotFound, apierror.ReasonNotFound, fmt.Sprintf("channel not found: %q", channelUuid))
+}
+
+// SelectChannel picks the channel for a player. The channel the player chose in the game
+// is kept if it is registered. Otherwise the first channel matching one of their Discord
+// roles is used, then the first default channel.
+// Channels must be ordered by priority. It returns nil if no channel applies.
+func SelectChannel(channels []*Channel, preference string, roleIds []string) *Channel {
+	for _, channel := range channels {
+		if preference != "" && strings.EqualFold(channel.ChannelUuid, preference) {
+			return channel
+		}
+	}
+
+	roles := make(map[string]bool, len(roleIds))
+	for _, roleId := range roleIds {
+		roles[roleId] = true
+	}
+	for _, channel := range channels {
+		for _, roleId := range channel.DiscordRoleIds {
+			if roles[roleId] {
+				return channel
+			}
+		}
+	}
+
+	for _, channel := range channels {
+		if channel.Default {
+			return channel
+		}
+	}
+	return nil
+}
+
+// AssignChannel selects the channel for a player, by the channel they chose in the game or their Discord roles,
+// and makes the player a member of its group (and of no other channel's group).
+// It returns nil if no channels are registered.
+func AssignChannel(serviceContext *services.ServiceContext, userId string, roleIds []string) (*Channel, error) {
+	ctx := serviceContext.Ctx
+	nk := serviceContext.NakamaModule
+
+	channels, _, chosen, err := readRegistry(ctx, nk, userId)
+	if err != nil {
+		return nil, err
+	}
+	selected := SelectChannel(channels, chosen, roleIds)
+	if selected == nil {
+		return nil, nil
+	}
+	channelGroups := make(map[string]bool, len(channels))
+	for _, channel := range channels {
+		channelGroups[channel.GroupId] = true
+	}
+
+	// Find the channel groups the player is already in
+	member := false
+	cursor := ""
+	for {
+		groups, next, err := nk.UserGroupsList(ctx, userId, 100, nil, cursor)
+		if err != nil {
+			return nil, err
+		}
+		for _, userGroup := range groups {
+			groupId := userGroup.GetGroup().GetId()
+			if !channelGroups[groupId] {
+				continue
+			}
+			if groupId == selected.GroupId {
+				member = true
+				continue
+			}
+			if err := nk.GroupUsersKick(ctx, services.SystemUserId, groupId, []string{userId}); err != nil {
+				return nil, err
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if !member {
+		if err := nk.GroupUsersAdd(ctx, services.SystemUserId, selected.GroupId, []string{userId}); err != nil {
+			return nil, err
+		}
+	}
+	return selected, nil
+}
@@ -0,0 +1,146 @@
+package channel
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"echonakama/game"
+	"echonakama/server/services"
+	"echonakama/server/services/nakamatest"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+func testChannel(uuid string, priority int64, roleIds []string, isDefault bool) *Channel {
+	return &Channel{
+		ChannelGroup:   game.ChannelGroup{ChannelUuid: uuid, Name: uuid, Priority: priority},
+		DiscordRoleIds: roleIds,
+		Default:        isDefault,
+	}
+}
+
+func TestSelectChannel(t *testing.T) {
+	channels := []*Channel{
+		testChannel("A", 0, nil, false),
+		testChannel("B", 1, []string{"role1"}, false),
+		testChannel("C", 2, []string{"role1", "role2"}, true),
+	}
+
+	tests := []struct {
+		name       string
+		channels   []*Channel
+		preference string
+		roleIds    []string
+		want       string
+	}{
+		{"preference", channels, "A", []string{"role1"}, "A"},
+		{"preference any case", channels, "a", nil, "A"},
+		{"unregistered preference uses role", channels, "Z", []string{"role2"}, "C"},
+		{"first role match by priority", channels, "", []string{"role2", "role1"}, "B"},
+		{"default", channels, "", []string{"other"}, "C"},
+		{"no default", channels[:2], "", nil, ""},
+		{"no channels", nil, "A", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SelectChannel(tt.channels, tt.preference, tt.roleIds)
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("SelectChannel() = %q, want nil", got.ChannelUuid)
+				}
+				return
+			}
+			if got == nil || got.ChannelUuid != tt.want {
+				t.Errorf("SelectChannel() = %v, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Channel UUIDs, as the game displays them
+const (
+	channelA = "6F1C2A8E-3B4D-4E5F-9A6B-7C8D9E0F1A2B"
+	channelB = "2B3C4D5E-6F70-4182-93A4-B5C6D7E8F901"
+	channelC = "90DD4DB5-B5DD-4655-839E-FDBE5F4BC0BF"
+	channelZ = "0A1B2C3D-4E5F-4061-8273-94A5B6C7D8E9"
+)
+
+func TestAssignChannel(t *testing.T) {
+	nk := nakamatest.NewModule()
+	ctx := context.Background()
+	serviceContext := &services.ServiceContext{Ctx: ctx, Logger: nakamatest.NewLogger(t), NakamaModule: nk}
+
+	for _, c := range []*Channel{
+		testChannel(strings.ToLower(channelA), 0, nil, false),
+		testChannel(channelB, 1, []string{"role1"}, false),
+		testChannel(channelC, 2, nil, true),
+	} {
+		if _, apiErr := SetChannel(serviceContext, c); apiErr != nil {
+			t.Fatalf("SetChannel() error: %v", apiErr)
+		}
+	}
+	channels, err := ListChannels(ctx, nk)
+	if err != nil || len(channels) != 3 {
+		t.Fatalf("ListChannels() = %v, error = %v, want 3 channels", channels, err)
+	}
+	groupIds := make(map[string]string)
+	for _, c := range channels {
+		groups, _, _ := nk.GroupsList(ctx, c.Name, "", nil, nil, 1, "")
+		if len(groups) != 1 || groups[0].GetId() != c.GroupId || groups[0].GetOpen().GetValue() || groups[0].GetCreatorId() != services.SystemUserId {
+			t.Errorf("GroupsList(%q) = %v, want a closed group created by the system user", c.Name, groups)
+		}
+		groupIds[c.ChannelUuid] = c.GroupId
+	}
+
+	// A group that is not in the registry is not a channel, even if it looks like one
+	metadata, _ := testChannel(channelZ, -1, []string{"role1"}, true).Metadata()
+	foreign, err := nk.GroupCreate(ctx, "player", "Player channel", "player", "", "", "", true, metadata, 10)
+	if err != nil {
+		t.Fatalf("GroupCreate() error: %v", err)
+	}
+
+	userId, _, _, err := nk.AuthenticateDevice(ctx, "device", "player", true)
+	if err != nil {
+		t.Fatalf("AuthenticateDevice() error: %v", err)
+	}
+	if err := nk.GroupUsersAdd(ctx, "player", foreign.GetId(), []string{userId}); err != nil {
+		t.Fatalf("GroupUsersAdd() error: %v", err)
+	}
+	assign := func(roleIds []string, want string) {
+		t.Helper()
+		selected, err := AssignChannel(serviceContext, userId, roleIds)
+		if err != nil || selected == nil || selected.ChannelUuid != want {
+			t.Fatalf("AssignChannel() = %v, error = %v, want %q", selected, err, want)
+		}
+		groups, _, _ := nk.UserGroupsList(ctx, userId, 100, nil, "")
+		member := make(map[string]bool)
+		for _, g := range groups {
+			member[g.GetGroup().GetId()] = true
+		}
+		if len(groups) != 2 || !member[groupIds[want]] || !member[foreign.GetId()] {
+			t.Errorf("UserGroupsList() = %v, want only the %q channel's group and the other group", groups, want)
+		}
+	}
+
+	// The assigned channel follows the player's roles, as they change
+	assign([]string{"role1"}, channelB)
+	assign(nil, channelC)
+
+	// The channel the player chose is kept, whatever their roles
+	write, err := PreferenceWrite(userId, strings.ToLower(channelA))
+	if err != nil {
+		t.Fatalf("PreferenceWrite() error: %v", err)
+	}
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{write}); err != nil {
+		t.Fatalf("StorageWrite() error: %v", err)
+	}
+	assign([]string{"role1"}, channelA)
+
+	// Once the chosen channel is deleted, the player is assigned by their roles again
+	if apiErr := DeleteChannel(serviceContext, strings.ToLower(channelA)); apiErr != nil {
+		t.Fatalf("DeleteChannel() error: %v", apiErr)
+	}
+	assign([]string{"role1"}, channelB)
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"echonakama/server/services/discord"
+	"echonakama/server/services/ratelimit"
+)
+
+const (
+	// The defaults of the optional settings
+	DefaultPlaceholderEmailDomain   = "echonakama.invalid"
+	DefaultDocumentFallbackLanguage = "en"
+	DefaultRelayPresenceTTL         = 60 * time.Second
+)
+
+// Config is the module configuration. It is read from the runtime environment once, when the module starts.
+type Config struct {
+	SessionEncryptionKey     string        // SESSION_ENCRYPTION_KEY: verifies the session tokens of the link page (required)
+	DiscordClientId          string        // DISCORD_CLIENT_ID: the OAuth2 application ID (required)
+	DiscordClientSecret      string        // DISCORD_CLIENT_SECRET: the OAuth2 application secret (required)
+	DiscordBotToken          string        // DISCORD_BOT_TOKEN: the token the bot connects with (required)
+	DiscordBotGuild          string        // DISCORD_BOT_GUILD: the guild players must be a member of to log in (required)
+	DiscordApiUrl            string        // DISCORD_API_URL: the Discord API base URL
+	LinkPageUrl              string        // LINK_PAGE_URL: where players enter their link code (required)
+	PlaceholderEmailDomain   string        // PLACEHOLDER_EMAIL_DOMAIN: the domain of the emails that hold game passwords
+	DocumentFallbackLanguage string        // DOCUMENT_FALLBACK_LANGUAGE: served when a document is missing in the requested language
+	RelayPresenceTTL         time.Duration // RELAY_PRESENCE_TTL: how long (in seconds) a relay is online after its last heartbeat
+
+	// RATE_LIMITS: the request limits of each RPC, overriding the defaults (e.g. "relay/loginrequest=60/1m,link/device=off")
+	RateLimits map[string]ratelimit.Limit
+}
+
+// Load reads the configuration from the runtime environment, applying the defaults of the optional settings.
+// The error lists every setting that is missing or invalid.
+func Load(vars map[string]string) (*Config, error) {
+	problems := make([]string, 0)
+	required := func(name string) string {
+		value := strings.TrimSpace(vars[name])
+		if value == "" {
+			problems = append(problems, fmt.Sprintf("%s is required", name))
+		}
+		return value
+	}
+	optional := func(name string, fallback string) string {
+		if value := strings.TrimSpace(vars[name]); value != "" {
+			return value
+		}
+		return fallback
+	}
+
+	config := &Config{
+		SessionEncryptionKey:     required("SESSION_ENCRYPTION_KEY"),
+		DiscordClientId:          required("DISCORD_CLIENT_ID"),
+		DiscordClientSecret:      required("DISCORD_CLIENT_SECRET"),
+		DiscordBotToken:          required("DISCORD_BOT_TOKEN"),
+		DiscordBotGuild:          required("DISCORD_BOT_GUILD"),
+		DiscordApiUrl:            optional("DISCORD_API_URL", discord.DefaultBaseURL),
+		LinkPageUrl:              required("LINK_PAGE_URL"),
+		PlaceholderEmailDomain:   optional("PLACEHOLDER_EMAIL_DOMAIN", DefaultPlaceholderEmailDomain),
+		DocumentFallbackLanguage: optional("DOCUMENT_FALLBACK_LANGUAGE", DefaultDocumentFallbackLanguage),
+		RelayPresenceTTL:         DefaultRelayPresenceTTL,
+	}
+
+	if config.DiscordBotGuild != "" {
+		if _, err := strconv.ParseUint(config.DiscordBotGuild, 10, 64); err != nil {
+			problems = append(problems, fmt.Sprintf("DISCORD_BOT_GUILD is not a Discord ID: %q", config.DiscordBotGuild))
+		}
+	}
+	if err := validateUrl(config.DiscordApiUrl); err != nil {
+		problems = append(problems, fmt.Sprintf("DISCORD_API_URL %v", err))
+	}
+	if config.LinkPageUrl != "" {
+		if err := validateUrl(config.LinkPageUrl); err != nil {
+			problems = append(problems, fmt.Sprintf("LINK_PAGE_URL %v", err))
+		}
+	}
+	if strings.ContainsAny(config.PlaceholderEmailDomain, "@ ") || !strings.Contains(config.PlaceholderEmailDomain, ".") {
+		problems = append(problems, fmt.Sprintf("PLACEHOLDER_EMAIL_DOMAIN is not a domain: %q", config.PlaceholderEmailDomain))
+	}
+	if value := strings.TrimSpace(vars["RELAY_PRESENCE_TTL"]); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			problems = append(problems, fmt.Sprintf("RELAY_PRESENCE_TTL is not a positive number of seconds: %q", value))
+		} else {
+			config.RelayPresenceTTL = time.Duration(seconds) * time.Second
+		}
+	}
+
+	rateLimits, err := ratelimit.ParseLimits(vars["RATE_LIMITS"])
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("RATE_LIMITS %v", err))
+	}
+	config.RateLimits = rateLimits
+
+	if len(problems) > 0 {
+		return nil, errors.New("invalid module configuration: " + strings.Join(problems, "; "))
+	}
+	return config, nil
+}
+
+// validateUrl checks that the value is an absolute http(s) URL.
+func validateUrl(value string) error {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("is not an http(s) URL: %q", value)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"echonakama/server/services/discord"
+	"echonakama/server/services/ratelimit"
+)
+
+func validVars() map[string]string {
+	return map[string]string{
+		"SESSION_ENCRYPTION_KEY": "key",
+		"DISCORD_CLIENT_ID":      "1180461747180461796",
+		"DISCORD_CLIENT_SECRET":  "secret",
+		"DISCORD_BOT_TOKEN":      "token",
+		"DISCORD_BOT_GUILD":      "779349159852769310",
+		"LINK_PAGE_URL":          "http://localhost:3000/link",
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	config, err := Load(validVars())
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if config.DiscordBotGuild != "779349159852769310" || config.LinkPageUrl != "http://localhost:3000/link" {
+		t.Errorf("Load() = %+v, want the environment values", config)
+	}
+	if config.DiscordApiUrl != discord.DefaultBaseURL {
+		t.Errorf("Load() DiscordApiUrl = %q, want %q", config.DiscordApiUrl, discord.DefaultBaseURL)
+	}
+	if config.PlaceholderEmailDomain != DefaultPlaceholderEmailDomain {
+		t.Errorf("Load() PlaceholderEmailDomain = %q, want %q", config.PlaceholderEmailDomain, DefaultPlaceholderEmailDomain)
+	}
+	if config.DocumentFallbackLanguage != DefaultDocumentFallbackLanguage {
+		t.Errorf("Load() DocumentFallbackLanguage = %q, want %q", config.DocumentFallbackLanguage, DefaultDocumentFallbackLanguage)
+	}
+	if config.RelayPresenceTTL != DefaultRelayPresenceTTL {
+		t.Errorf("Load() RelayPresenceTTL = %v, want %v", config.RelayPresenceTTL, DefaultRelayPresenceTTL)
+	}
+	if !reflect.DeepEqual(config.RateLimits, ratelimit.DefaultLimits) {
+		t.Errorf("Load() RateLimits = %v, want %v", config.RateLimits, ratelimit.DefaultLimits)
+	}
+}
+
+func TestLoadOptional(t *testing.T) {
+	vars := validVars()
+	vars["DISCORD_API_URL"] = "http://localhost:8080/api/v10"
+	vars["PLACEHOLDER_EMAIL_DOMAIN"] = "example.com"
+	vars["DOCUMENT_FALLBACK_LANGUAGE"] = "de"
+	vars["RELAY_PRESENCE_TTL"] = "30"
+	vars["RATE_LIMITS"] = "link/device=5/1m"
+
+	config, err := Load(vars)
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if config.DiscordApiUrl != "http://localhost:8080/api/v10" || config.PlaceholderEmailDomain != "example.com" ||
+		config.DocumentFallbackLanguage != "de" || config.RelayPresenceTTL != 30*time.Second ||
+		config.RateLimits["link/device"] != (ratelimit.Limit{Requests: 5, Per: time.Minute}) {
+		t.Errorf("Load() = %+v, want the environment values", config)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		value string
+	}{
+		{"missing session key", "SESSION_ENCRYPTION_KEY", ""},
+		{"missing bot token", "DISCORD_BOT_TOKEN", " "},
+		{"missing bot guild", "DISCORD_BOT_GUILD", ""},
+		{"guild not an id", "DISCORD_BOT_GUILD", "echo"},
+		{"missing link page", "LINK_PAGE_URL", ""},
+		{"relative link page", "LINK_PAGE_URL", "/link"},
+		{"api url not http", "DISCORD_API_URL", "ftp://discord.com"},
+		{"email domain with @", "PLACEHOLDER_EMAIL_DOMAIN", "user@example.com"},
+		{"ttl not a number", "RELAY_PRESENCE_TTL", "1m"},
+		{"ttl not positive", "RELAY_PRESENCE_TTL", "0"},
+		{"invalid rate limit", "RATE_LIMITS", "link/device=5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vars := validVars()
+			vars[tt.key] = tt.value
+			if _, err := Load(vars); err == nil || !strings.Contains(err.Error(), tt.key) {
+				t.Errorf("Load() error = %v, want an error naming %s", err, tt.key)
+			}
+		})
+	}
+}
+
+func TestLoadListsEveryProblem(t *testing.T) {
+	_, err := Load(map[string]string{"LINK_PAGE_URL": "localhost"})
+	if err == nil {
+		t.Fatal("Load() error = nil, want an error")
+	}
+	for _, key := range []string{"SESSION_ENCRYPTION_KEY", "DISCORD_CLIENT_ID", "DISCORD_CLIENT_SECRET", "DISCORD_BOT_TOKEN", "DISCORD_BOT_GUILD", "LINK_PAGE_URL"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("Load() error = %q, want it to name %s", err, key)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Package discord is the Discord API, as the services use it.
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"golang.org/x/oauth2"
+)
+
+// DefaultBaseURL is the Discord API the client uses unless configured otherwise.
+const DefaultBaseURL = "https://discord.com/api/v10"
+
+var (
+	ErrNotFound     = errors.New("discord resource not found")
+	ErrNotConnected = errors.New("discord bot is not connected")
+)
+
+// Client is the subset of the Discord API the services use.
+type Client interface {
+	// GuildMember returns a member of a guild, using the bot's credentials.
+	GuildMember(guildId string, userId string) (*discordgo.Member, error)
+	// InteractionRespond responds to an interaction the bot received.
+	InteractionRespond(interaction *discordgo.Interaction, response *discordgo.InteractionResponse) error
+	// ExchangeCode exchanges an OAuth2 authorization code for an access token.
+	ExchangeCode(ctx context.Context, code string, redirectUrl string) (*AccessToken, error)
+	// RefreshToken exchanges a token's refresh token for a new access token.
+	RefreshToken(ctx context.Context, token *AccessToken) (*AccessToken, error)
+	// CurrentUser returns the user an access token was issued to.
+	CurrentUser(ctx context.Context, accessToken string) (*discordgo.User, error)
+}
+
+// AccessToken is a Discord OAuth2 access token.
+type AccessToken struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	Scope        string `json:"scope"`
+}
+
+func (t *AccessToken) Marshal() ([]byte, error) {
+	return json.Marshal(t)
+}
+
+func UnmarshalAccessToken(data []byte) (AccessToken, error) {
+	r := AccessToken{}
+
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+// APIClient is a Client for the Discord REST API. Bot requests go through the bot's session,
+// so they share its rate limits; OAuth2 requests use the HTTP client.
+type APIClient struct {
+	BaseURL      string
+	ClientId     string
+	ClientSecret string
+	HTTPClient   *http.Client
+	Bot          *discordgo.Session // nil if the bot is not running
+}
+
+// NewClient returns a client for the Discord API at baseUrl (DefaultBaseURL if empty).
+func NewClient(baseUrl string, clientId string, clientSecret string, bot *discordgo.Session) *APIClient {
+	if baseUrl == "" {
+		baseUrl = DefaultBaseURL
+	}
+	return &APIClient{
+		BaseURL:      strings.TrimSuffix(baseUrl, "/"),
+		ClientId:     clientId,
+		ClientSecret: clientSecret,
+		HTTPClient:   &http.Client{Timeout: 10 * time.Second},
+		Bot:          bot,
+	}
+}
+
+// botRequest makes a request with the bot's session, mapping "not found" responses to ErrNotFound.
+func (c *APIClient) botRequest(method string, path string, data interface{}, bucket string) ([]byte, error) {
+	if c.Bot == nil {
+		return nil, ErrNotConnected
+	}
+	body, err := c.Bot.RequestWithBucketID(method, c.BaseURL+path, data, c.BaseURL+bucket)
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Response != nil && restErr.Response.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+	return body, err
+}
+
+func (c *APIClient) GuildMember(guildId string, userId string) (*discordgo.Member, error) {
+	body, err := c.botRequest(http.MethodGet, "/guilds/"+guildId+"/members/"+userId, nil, "/guilds/"+guildId+"/members/")
+	if err != nil {
+		return nil, err
+	}
+	member := &discordgo.Member{}
+	if err := json.Unmarshal(body, member); err != nil {
+		return nil, err
+	}
+	// The returned member doesn't have the guild ID
+	member.GuildID = guildId
+	return member, nil
+}
+
+func (c *APIClient) InteractionRespond(interaction *discordgo.Interaction, response *discordgo.InteractionResponse) error {
+	path := "/interactions/" + interaction.ID + "/" + interaction.Token + "/callback"
+	_, err := c.botRequest(http.MethodPost, path, response, path)
+	return err
+}
+
+func (c *APIClient) oauthConfig(redirectUrl string) *oauth2.Config {
+	return &oauth2.Config{
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   c.BaseURL + "/oauth2/authorize",
+			TokenURL:  c.BaseURL + "/oauth2/token",
+			AuthStyle: oauth2.AuthStyleInParams,
+		},
+		Scopes:       []string{"identify"},
+		RedirectURL:  redirectUrl,
+		ClientID:     c.ClientId,
+		ClientSecret: c.ClientSecret,
+	}
+}
+
+func (c *APIClient) ExchangeCode(ctx context.Context, code string, redirectUrl string) (*AccessToken, error) {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, c.HTTPClient)
+	token, err := c.oauthConfig(redirectUrl).Exchange(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	accessToken := &AccessToken{
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		TokenType:    token.TokenType,
+	}
+	if !token.Expiry.IsZero() {
+		accessToken.ExpiresIn = int(time.Until(token.Expiry).Seconds())
+	}
+	if scope, ok := token.Extra("scope").(string); ok {
+		accessToken.Scope = scope
+	}
+	return accessToken, nil
+}
+
+func (c *APIClient) RefreshToken(ctx context.Context, token *AccessToken) (*AccessToken, error) {
+	data := url.Values{}
+	data.Set("grant_type", "refresh_token")
+	data.Set("refresh_token", token.RefreshToken)
+	data.Set("client_id", c.ClientId)
+	data.Set("client_secret", c.ClientSecret)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/oauth2/token", strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discord refresh failed: %s", resp.Status)
+	}
+
+	refreshed := &AccessToken{}
+	if err := json.NewDecoder(resp.Body).Decode(refreshed); err != nil {
+		return nil, err
+	}
+	return refreshed, nil
+}
+
+func (c *APIClient) CurrentUser(ctx context.Context, accessToken string) (*discordgo.User, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/users/@me", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discord user lookup failed: %s", resp.Status)
+	}
+
+	user := &discordgo.User{}
+	if err := json.NewDecoder(resp.Body).Decode(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
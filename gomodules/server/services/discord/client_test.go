@@ -0,0 +1,117 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// newTestServer returns a Discord API with one guild member, one authorization code and one user.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	writeJSON := func(w http.ResponseWriter, status int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/guilds/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/guilds/guild/members/member" || r.Header.Get("Authorization") != "Bot token" {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": "Unknown Member", "code": 10007})
+			return
+		}
+		writeJSON(w, http.StatusOK, &discordgo.Member{User: &discordgo.User{ID: "member"}, Nick: "Nick"})
+	})
+	mux.HandleFunc("/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("client_id") != "client" || r.Form.Get("client_secret") != "secret" {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+			return
+		}
+		switch {
+		case r.Form.Get("grant_type") == "authorization_code" && r.Form.Get("code") == "code":
+			writeJSON(w, http.StatusOK, map[string]interface{}{"access_token": "access", "refresh_token": "refresh", "token_type": "Bearer", "expires_in": 604800, "scope": "identify"})
+		case r.Form.Get("grant_type") == "refresh_token" && r.Form.Get("refresh_token") == "refresh":
+			writeJSON(w, http.StatusOK, map[string]interface{}{"access_token": "access2", "refresh_token": "refresh2", "token_type": "Bearer", "expires_in": 604800, "scope": "identify"})
+		default:
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		}
+	})
+	mux.HandleFunc("/users/@me", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" {
+			writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"message": "401: Unauthorized", "code": 0})
+			return
+		}
+		writeJSON(w, http.StatusOK, &discordgo.User{ID: "member", Username: "player"})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGuildMember(t *testing.T) {
+	server := newTestServer(t)
+	bot, err := discordgo.New("Bot token")
+	if err != nil {
+		t.Fatalf("discordgo.New() error: %v", err)
+	}
+	client := NewClient(server.URL, "client", "secret", bot)
+
+	member, err := client.GuildMember("guild", "member")
+	if err != nil {
+		t.Fatalf("GuildMember() error: %v", err)
+	}
+	if member.Nick != "Nick" || member.GuildID != "guild" {
+		t.Errorf("GuildMember() = %+v, want Nick of guild", member)
+	}
+	if _, err := client.GuildMember("guild", "other"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GuildMember() error = %v, want %v", err, ErrNotFound)
+	}
+	if _, err := NewClient(server.URL, "client", "secret", nil).GuildMember("guild", "member"); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("GuildMember() error = %v, want %v", err, ErrNotConnected)
+	}
+}
+
+func TestOAuth(t *testing.T) {
+	server := newTestServer(t)
+	client := NewClient(server.URL+"/", "client", "secret", nil)
+	ctx := context.Background()
+
+	token, err := client.ExchangeCode(ctx, "code", "https://example.com/signin")
+	if err != nil {
+		t.Fatalf("ExchangeCode() error: %v", err)
+	}
+	if token.AccessToken != "access" || token.RefreshToken != "refresh" || token.Scope != "identify" {
+		t.Errorf("ExchangeCode() = %+v, want the access token", token)
+	}
+	if _, err := client.ExchangeCode(ctx, "other", "https://example.com/signin"); err == nil {
+		t.Error("ExchangeCode() error = nil, want an error for an invalid code")
+	}
+
+	user, err := client.CurrentUser(ctx, token.AccessToken)
+	if err != nil {
+		t.Fatalf("CurrentUser() error: %v", err)
+	}
+	if user.ID != "member" {
+		t.Errorf("CurrentUser() = %s, want member", user.ID)
+	}
+	if _, err := client.CurrentUser(ctx, "other"); err == nil {
+		t.Error("CurrentUser() error = nil, want an error for an invalid token")
+	}
+
+	refreshed, err := client.RefreshToken(ctx, token)
+	if err != nil {
+		t.Fatalf("RefreshToken() error: %v", err)
+	}
+	if refreshed.AccessToken != "access2" || refreshed.RefreshToken != "refresh2" {
+		t.Errorf("RefreshToken() = %+v, want the refreshed token", refreshed)
+	}
+	if _, err := client.RefreshToken(ctx, refreshed); err == nil {
+		t.Error("RefreshToken() error = nil, want an error for an invalid refresh token")
+	}
+}
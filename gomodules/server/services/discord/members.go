@@ -0,0 +1,225 @@
+package discord
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// DefaultMemberTimeout is how long a guild member lookup waits for the REST API.
+	DefaultMemberTimeout = 2 * time.Second
+	// DefaultMemberMaxAge is how long a cached member is served without the gateway keeping it up to date.
+	DefaultMemberMaxAge = 5 * time.Minute
+)
+
+var ErrTimeout = errors.New("discord request timed out")
+
+// cachedMember is a guild member, and when it was last known to be current.
+type cachedMember struct {
+	member  *discordgo.Member
+	updated time.Time
+}
+
+// MemberCache is a Client that serves the members of the cached guilds from memory. The bot's gateway
+// events keep the cache up to date, so while the bot is connected, members are served without a request.
+// Other members are requested from the REST API, and if the API fails, the last known copy is served.
+type MemberCache struct {
+	Client                // the client for the other requests, and the members that are not cached
+	Timeout time.Duration // how long a member request waits for the REST API
+	MaxAge  time.Duration // how long a member is served while the gateway is disconnected, before it is requested again
+
+	mu        sync.RWMutex
+	connected bool                                // whether the gateway is keeping the cache up to date
+	guilds    map[string]map[string]*cachedMember // members by user ID, by guild ID
+	now       func() time.Time
+}
+
+// NewMemberCache returns a cache of the members of the guilds, in front of the client.
+func NewMemberCache(client Client, guildIds ...string) *MemberCache {
+	cache := &MemberCache{
+		Client:  client,
+		Timeout: DefaultMemberTimeout,
+		MaxAge:  DefaultMemberMaxAge,
+		guilds:  make(map[string]map[string]*cachedMember, len(guildIds)),
+		now:     time.Now,
+	}
+	for _, guildId := range guildIds {
+		cache.guilds[guildId] = make(map[string]*cachedMember)
+	}
+	return cache
+}
+
+// AddHandlers keeps the cache up to date with the session's gateway events.
+// The guilds' members are requested when the bot joins them, and updated as they change. A new gateway
+// session (one that is not resumed) may have missed events, so the members cached before it are dropped.
+func (c *MemberCache) AddHandlers(session *discordgo.Session, logger runtime.Logger) {
+	session.AddHandler(func(s *discordgo.Session, ready *discordgo.Ready) {
+		c.reset()
+		c.setConnected(true)
+	})
+	session.AddHandler(func(s *discordgo.Session, resumed *discordgo.Resumed) {
+		c.setConnected(true)
+	})
+	session.AddHandler(func(s *discordgo.Session, disconnect *discordgo.Disconnect) {
+		c.setConnected(false)
+	})
+	session.AddHandler(func(s *discordgo.Session, guild *discordgo.GuildCreate) {
+		if !c.cached(guild.ID) {
+			return
+		}
+		c.reset(guild.ID)
+		c.store(guild.ID, guild.Members...)
+		// The guild only comes with some of its members; the rest arrive in chunks
+		if err := s.RequestGuildMembers(guild.ID, "", 0, "", false); err != nil {
+			logger.WithField("err", err).WithField("guildId", guild.ID).Warn("Unable to request the guild members")
+		}
+	})
+	session.AddHandler(func(s *discordgo.Session, chunk *discordgo.GuildMembersChunk) {
+		c.store(chunk.GuildID, chunk.Members...)
+		if chunk.ChunkIndex == chunk.ChunkCount-1 {
+			logger.WithField("guildId", chunk.GuildID).Info("Cached the guild members")
+		}
+	})
+	session.AddHandler(func(s *discordgo.Session, add *discordgo.GuildMemberAdd) {
+		c.store(add.GuildID, add.Member)
+	})
+	session.AddHandler(func(s *discordgo.Session, update *discordgo.GuildMemberUpdate) {
+		c.store(update.GuildID, update.Member)
+	})
+	session.AddHandler(func(s *discordgo.Session, remove *discordgo.GuildMemberRemove) {
+		if remove.User != nil {
+			c.forget(remove.GuildID, remove.User.ID)
+		}
+	})
+}
+
+// GuildMember returns a member of a guild. Members of cached guilds are served from the cache while it is
+// current; otherwise they are requested, waiting up to the timeout. If the request fails, the last known
+// copy of the member is returned, so logins are not blocked by a Discord outage.
+func (c *MemberCache) GuildMember(guildId string, userId string) (*discordgo.Member, error) {
+	if !c.cached(guildId) {
+		return c.Client.GuildMember(guildId, userId)
+	}
+
+	cached, current := c.load(guildId, userId)
+	if current {
+		return copyMember(cached.member), nil
+	}
+
+	member, err := c.request(guildId, userId)
+	switch {
+	case err == nil:
+		return copyMember(member), nil
+	case errors.Is(err, ErrNotFound):
+		c.forget(guildId, userId)
+		return nil, err
+	case cached != nil:
+		return copyMember(cached.member), nil // the last known good copy
+	default:
+		return nil, err
+	}
+}
+
+// request requests a member from the REST API, waiting up to the timeout.
+// A member that arrives after the timeout is still cached.
+func (c *MemberCache) request(guildId string, userId string) (*discordgo.Member, error) {
+	type result struct {
+		member *discordgo.Member
+		err    error
+	}
+	results := make(chan result, 1)
+	go func() {
+		member, err := c.Client.GuildMember(guildId, userId)
+		if err == nil {
+			c.store(guildId, member)
+		}
+		results <- result{member, err}
+	}()
+
+	select {
+	case r := <-results:
+		return r.member, r.err
+	case <-time.After(c.Timeout):
+		return nil, fmt.Errorf("%w: guild member %s after %v", ErrTimeout, userId, c.Timeout)
+	}
+}
+
+func (c *MemberCache) setConnected(connected bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected = connected
+}
+
+func (c *MemberCache) cached(guildId string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.guilds[guildId]
+	return ok
+}
+
+// load returns the cached member, and whether it is current.
+func (c *MemberCache) load(guildId string, userId string) (*cachedMember, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	cached, ok := c.guilds[guildId][userId]
+	if !ok {
+		return nil, false
+	}
+	return cached, c.connected || c.now().Sub(cached.updated) < c.MaxAge
+}
+
+// reset drops the cached members of the guilds, or of every cached guild if none are given.
+func (c *MemberCache) reset(guildIds ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(guildIds) == 0 {
+		for guildId := range c.guilds {
+			guildIds = append(guildIds, guildId)
+		}
+	}
+	for _, guildId := range guildIds {
+		if _, ok := c.guilds[guildId]; ok {
+			c.guilds[guildId] = make(map[string]*cachedMember)
+		}
+	}
+}
+
+func (c *MemberCache) store(guildId string, members ...*discordgo.Member) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	guild, ok := c.guilds[guildId]
+	if !ok {
+		return
+	}
+	now := c.now()
+	for _, member := range members {
+		if member == nil || member.User == nil {
+			continue
+		}
+		member = copyMember(member)
+		member.GuildID = guildId
+		guild[member.User.ID] = &cachedMember{member: member, updated: now}
+	}
+}
+
+func (c *MemberCache) forget(guildId string, userId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.guilds[guildId], userId)
+}
+
+// copyMember copies the member, so the cached copy cannot be changed by its callers.
+func copyMember(member *discordgo.Member) *discordgo.Member {
+	copied := *member
+	if member.User != nil {
+		user := *member.User
+		copied.User = &user
+	}
+	copied.Roles = append([]string(nil), member.Roles...)
+	return &copied
+}
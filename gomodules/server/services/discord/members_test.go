@@ -0,0 +1,181 @@
+package discord
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// memberClient is a Client whose guild member requests return err, or the member if err is nil.
+type memberClient struct {
+	Client
+	mu       sync.Mutex
+	member   *discordgo.Member
+	err      error
+	delay    time.Duration
+	requests int
+}
+
+func (c *memberClient) GuildMember(guildId string, userId string) (*discordgo.Member, error) {
+	c.mu.Lock()
+	c.requests++
+	member, err, delay := c.member, c.err, c.delay
+	c.mu.Unlock()
+	time.Sleep(delay)
+	if err != nil {
+		return nil, err
+	}
+	return member, nil
+}
+
+func (c *memberClient) set(member *discordgo.Member, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.member, c.err = member, err
+}
+
+func newMember(userId string, roles ...string) *discordgo.Member {
+	return &discordgo.Member{User: &discordgo.User{ID: userId}, Roles: roles}
+}
+
+func TestMemberCacheConnected(t *testing.T) {
+	now := time.Unix(0, 0)
+	client := &memberClient{err: errors.New("discord is down")}
+	cache := NewMemberCache(client, "guild")
+	cache.now = func() time.Time { return now }
+	cache.setConnected(true)
+	cache.store("guild", newMember("a", "role"))
+
+	member, err := cache.GuildMember("guild", "a")
+	if err != nil || member.User.ID != "a" || member.GuildID != "guild" || client.requests != 0 {
+		t.Fatalf("GuildMember() = %v, %v after %d requests, want the cached member without a request", member, err, client.requests)
+	}
+
+	// Callers cannot change the cached copy
+	member.Roles[0] = "changed"
+	if member, _ := cache.GuildMember("guild", "a"); member.Roles[0] != "role" {
+		t.Errorf("GuildMember() roles = %v, want the cached copy unchanged", member.Roles)
+	}
+
+	// The gateway keeps the member up to date, however old it is
+	now = now.Add(2 * DefaultMemberMaxAge)
+	if _, err := cache.GuildMember("guild", "a"); err != nil || client.requests != 0 {
+		t.Errorf("GuildMember() error = %v after %d requests, want the cached member without a request", err, client.requests)
+	}
+
+	// Once the gateway disconnects, the old member is requested again, and the last known copy served
+	cache.setConnected(false)
+	if _, err := cache.GuildMember("guild", "a"); err != nil || client.requests != 1 {
+		t.Errorf("GuildMember() error = %v after %d requests, want the last known copy after a request", err, client.requests)
+	}
+
+	// A removed member is requested again
+	cache.forget("guild", "a")
+	if _, err := cache.GuildMember("guild", "a"); err == nil || client.requests != 2 {
+		t.Errorf("GuildMember() error = %v after %d requests, want the request's error", err, client.requests)
+	}
+}
+
+func TestMemberCacheMiss(t *testing.T) {
+	client := &memberClient{member: newMember("a")}
+	cache := NewMemberCache(client, "guild")
+	cache.setConnected(true)
+
+	if member, err := cache.GuildMember("guild", "a"); err != nil || member.User.ID != "a" {
+		t.Fatalf("GuildMember() = %v, %v, want the requested member", member, err)
+	}
+	if _, err := cache.GuildMember("guild", "a"); err != nil || client.requests != 1 {
+		t.Errorf("GuildMember() error = %v after %d requests, want the requested member cached", err, client.requests)
+	}
+
+	// Members of other guilds are not cached
+	cache.GuildMember("other", "a")
+	cache.GuildMember("other", "a")
+	if client.requests != 3 {
+		t.Errorf("GuildMember() made %d requests, want other guilds requested each time", client.requests)
+	}
+}
+
+func TestMemberCacheReset(t *testing.T) {
+	client := &memberClient{err: ErrNotFound}
+	cache := NewMemberCache(client, "guild", "other")
+	cache.setConnected(true)
+	cache.store("guild", newMember("a"))
+	cache.store("other", newMember("b"))
+
+	// A kicked member is not served from before a new gateway session
+	cache.reset("guild")
+	if _, err := cache.GuildMember("guild", "a"); !errors.Is(err, ErrNotFound) || client.requests != 1 {
+		t.Errorf("GuildMember() error = %v after %d requests, want the member requested again", err, client.requests)
+	}
+	if cached, _ := cache.load("other", "b"); cached == nil {
+		t.Error("load() = nil, want the members of the other guild kept")
+	}
+
+	// Every guild is reset when none is given, and they are still cached
+	cache.reset()
+	if cached, _ := cache.load("other", "b"); cached != nil || !cache.cached("other") {
+		t.Errorf("load() = %v, cached() = %v, want the guild cached without its members", cached, cache.cached("other"))
+	}
+}
+
+func TestMemberCacheDisconnected(t *testing.T) {
+	now := time.Unix(0, 0)
+	client := &memberClient{member: newMember("a", "updated")}
+	cache := NewMemberCache(client, "guild")
+	cache.now = func() time.Time { return now }
+	cache.store("guild", newMember("a", "cached"))
+
+	// A recent member is served while the gateway is disconnected
+	if member, _ := cache.GuildMember("guild", "a"); member.Roles[0] != "cached" || client.requests != 0 {
+		t.Errorf("GuildMember() roles = %v after %d requests, want the cached member", member.Roles, client.requests)
+	}
+
+	// An old member is requested again
+	now = now.Add(DefaultMemberMaxAge)
+	if member, _ := cache.GuildMember("guild", "a"); member.Roles[0] != "updated" || client.requests != 1 {
+		t.Errorf("GuildMember() roles = %v after %d requests, want the requested member", member.Roles, client.requests)
+	}
+
+	// During an outage, the last known good copy is served
+	now = now.Add(DefaultMemberMaxAge)
+	client.set(nil, errors.New("discord is down"))
+	if member, err := cache.GuildMember("guild", "a"); err != nil || member.Roles[0] != "updated" {
+		t.Errorf("GuildMember() = %v, %v, want the last known good copy", member, err)
+	}
+
+	// A member who left is forgotten
+	client.set(nil, ErrNotFound)
+	if _, err := cache.GuildMember("guild", "a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GuildMember() error = %v, want %v", err, ErrNotFound)
+	}
+	client.set(nil, errors.New("discord is down"))
+	if _, err := cache.GuildMember("guild", "a"); err == nil {
+		t.Error("GuildMember() error = nil, want the member forgotten")
+	}
+}
+
+func TestMemberCacheTimeout(t *testing.T) {
+	client := &memberClient{member: newMember("a"), delay: 50 * time.Millisecond}
+	cache := NewMemberCache(client, "guild")
+	cache.Timeout = time.Millisecond
+
+	if _, err := cache.GuildMember("guild", "a"); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("GuildMember() error = %v, want %v", err, ErrTimeout)
+	}
+
+	// The late response is cached
+	deadline := time.Now().Add(time.Second)
+	for {
+		if cached, _ := cache.load("guild", "a"); cached != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("load() = nil, want the late response cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,153 @@
+// Package discordtest provides a scripted discord.Client for testing offline.
+package discordtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"echonakama/server/services/discord"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var ErrInvalidGrant = errors.New("invalid_grant")
+
+// Response is an interaction response the bot sent.
+type Response struct {
+	Interaction *discordgo.Interaction
+	Response    *discordgo.InteractionResponse
+}
+
+// Client is a discord.Client that serves scripted guild members, authorization codes and users.
+type Client struct {
+	mu        sync.Mutex
+	members   map[string]map[string]*discordgo.Member
+	codes     map[string]*discord.AccessToken
+	refreshes map[string]*discord.AccessToken
+	users     map[string]*discordgo.User
+	responses []Response
+	botErr    error // returned by the bot requests, if set
+}
+
+var _ discord.Client = (*Client)(nil)
+
+// NewClient returns a client with nothing scripted.
+func NewClient() *Client {
+	return &Client{
+		members:   make(map[string]map[string]*discordgo.Member),
+		codes:     make(map[string]*discord.AccessToken),
+		refreshes: make(map[string]*discord.AccessToken),
+		users:     make(map[string]*discordgo.User),
+	}
+}
+
+// AddMember adds a member to a guild.
+func (c *Client) AddMember(guildId string, member *discordgo.Member) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.members[guildId] == nil {
+		c.members[guildId] = make(map[string]*discordgo.Member)
+	}
+	c.members[guildId][member.User.ID] = member
+}
+
+// RemoveMember removes a member from a guild.
+func (c *Client) RemoveMember(guildId string, userId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.members[guildId], userId)
+}
+
+// SetBotError makes the bot requests fail with err, as they do while Discord or the bot is unavailable.
+// A nil err restores them.
+func (c *Client) SetBotError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.botErr = err
+}
+
+// AddAuthorization scripts an OAuth2 authorization: the code exchanges for the token, which
+// belongs to the user.
+func (c *Client) AddAuthorization(code string, token *discord.AccessToken, user *discordgo.User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.codes[code] = token
+	c.users[token.AccessToken] = user
+}
+
+// AddRefresh scripts a refresh: the token's refresh token exchanges for the refreshed token,
+// which belongs to the same user.
+func (c *Client) AddRefresh(token *discord.AccessToken, refreshed *discord.AccessToken) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refreshes[token.RefreshToken] = refreshed
+	c.users[refreshed.AccessToken] = c.users[token.AccessToken]
+}
+
+// Responses returns the interaction responses the bot sent.
+func (c *Client) Responses() []Response {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Response(nil), c.responses...)
+}
+
+func (c *Client) GuildMember(guildId string, userId string) (*discordgo.Member, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.botErr != nil {
+		return nil, c.botErr
+	}
+	member, ok := c.members[guildId][userId]
+	if !ok {
+		return nil, fmt.Errorf("%w: member %s of guild %s", discord.ErrNotFound, userId, guildId)
+	}
+	m := *member
+	m.GuildID = guildId
+	return &m, nil
+}
+
+func (c *Client) InteractionRespond(interaction *discordgo.Interaction, response *discordgo.InteractionResponse) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.responses = append(c.responses, Response{Interaction: interaction, Response: response})
+	return nil
+}
+
+// ExchangeCode exchanges a code once, as Discord does.
+func (c *Client) ExchangeCode(ctx context.Context, code string, redirectUrl string) (*discord.AccessToken, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	token, ok := c.codes[code]
+	if !ok {
+		return nil, ErrInvalidGrant
+	}
+	delete(c.codes, code)
+	t := *token
+	return &t, nil
+}
+
+// RefreshToken refreshes a token once, as Discord does.
+func (c *Client) RefreshToken(ctx context.Context, token *discord.AccessToken) (*discord.AccessToken, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	refreshed, ok := c.refreshes[token.RefreshToken]
+	if !ok {
+		return nil, ErrInvalidGrant
+	}
+	delete(c.refreshes, token.RefreshToken)
+	t := *refreshed
+	return &t, nil
+}
+
+func (c *Client) CurrentUser(ctx context.Context, accessToken string) (*discordgo.User, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	user, ok := c.users[accessToken]
+	if !ok {
+		return nil, errors.New("discord user lookup failed: 401 Unauthorized")
+	}
+	u := *user
+	return &u, nil
+}
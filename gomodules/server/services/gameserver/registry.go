@@ -0,0 +1,360 @@
+package gameserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"echonakama/game"
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+	"echonakama/server/services/relay"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	GameServerStorageCollection = "GameServer:registry"
+
+	// How long a reserved session is kept without the relay reporting it
+	ReservationTimeout = 2 * time.Minute
+)
+
+// Endpoint is the address game clients connect to a game server on.
+type Endpoint struct {
+	ExternalIp string `json:"external_ip"`
+	InternalIp string `json:"internal_ip"` // the address on the relay's network (optional)
+	Port       int    `json:"port"`
+}
+
+// Session is a game session hosted on a game server.
+type Session struct {
+	SessionId   string        `json:"session_id"`            // the lobby session GUID
+	Mode        game.GameMode `json:"mode"`                  // the session's game mode
+	PlayerCount int           `json:"player_count"`          // the number of players in the session
+	MaxPlayers  int           `json:"max_players"`           // the number of players the session can hold
+	ReservedAt  int64         `json:"reserved_at,omitempty"` // when matchmaking reserved the session, until the relay reports it (set by the registry)
+}
+
+// GameServer is a dedicated EchoVR server, registered through its relay.
+type GameServer struct {
+	ServerId     string          `json:"server_id"` // the server's ID, unique within its relay
+	RelayId      string          `json:"relay_id"`  // the relay the server registered through (set by the registry)
+	Endpoint     Endpoint        `json:"endpoint"`
+	Region       string          `json:"region"`
+	Modes        []game.GameMode `json:"modes"`    // the game modes the server can host
+	Capacity     int             `json:"capacity"` // the number of sessions the server can host at once
+	Sessions     []*Session      `json:"sessions"` // the sessions the server is hosting
+	RegisteredAt int64           `json:"registered_at"`
+	UpdatedAt    int64           `json:"updated_at"`
+}
+
+// Key returns the server's key in the registry.
+func (s *GameServer) Key() string {
+	return s.RelayId + ":" + s.ServerId
+}
+
+// Validate checks the server's endpoint, region, modes, capacity and sessions.
+func (s *GameServer) Validate() error {
+	if s.ServerId == "" || len(s.ServerId) > 64 {
+		return fmt.Errorf("invalid server_id: %q", s.ServerId)
+	}
+	if net.ParseIP(s.Endpoint.ExternalIp) == nil {
+		return fmt.Errorf("invalid external_ip: %q", s.Endpoint.ExternalIp)
+	}
+	if s.Endpoint.InternalIp != "" && net.ParseIP(s.Endpoint.InternalIp) == nil {
+		return fmt.Errorf("invalid internal_ip: %q", s.Endpoint.InternalIp)
+	}
+	if s.Endpoint.Port < 1 || s.Endpoint.Port > 65535 {
+		return fmt.Errorf("invalid port: %d", s.Endpoint.Port)
+	}
+	if s.Region == "" {
+		return errors.New("region is empty")
+	}
+	if len(s.Modes) == 0 {
+		return errors.New("modes is empty")
+	}
+	for _, mode := range s.Modes {
+		if !mode.IsValid() {
+			return fmt.Errorf("invalid mode: %q", mode)
+		}
+	}
+	if s.Capacity < 1 {
+		return fmt.Errorf("invalid capacity: %d", s.Capacity)
+	}
+	return s.validateSessions(s.Sessions)
+}
+
+func (s *GameServer) validateSessions(sessions []*Session) error {
+	if len(sessions) > s.Capacity {
+		return fmt.Errorf("%d sessions exceed the server's capacity of %d", len(sessions), s.Capacity)
+	}
+	for _, session := range sessions {
+		if session.SessionId == "" {
+			return errors.New("session_id is empty")
+		}
+		if !s.Supports(session.Mode) {
+			return fmt.Errorf("session %s: the server does not host %q", session.SessionId, session.Mode)
+		}
+		if session.PlayerCount < 0 || session.MaxPlayers < 0 || (session.MaxPlayers > 0 && session.PlayerCount > session.MaxPlayers) {
+			return fmt.Errorf("session %s: invalid player count %d/%d", session.SessionId, session.PlayerCount, session.MaxPlayers)
+		}
+	}
+	return nil
+}
+
+// Supports returns true if the server can host the mode.
+func (s *GameServer) Supports(mode game.GameMode) bool {
+	for _, m := range s.Modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// Available returns true if the server can host another session.
+func (s *GameServer) Available() bool {
+	return len(s.Sessions) < s.Capacity
+}
+
+// Filter selects game servers from the registry.
+type Filter struct {
+	Region    string        `json:"region"`    // only servers in the region (empty for any)
+	Mode      game.GameMode `json:"mode"`      // only servers that can host the mode (empty for any)
+	Available bool          `json:"available"` // only servers that can host another session
+}
+
+// Matches returns true if the server passes the filter.
+func (f Filter) Matches(server *GameServer) bool {
+	if f.Region != "" && !strings.EqualFold(server.Region, f.Region) {
+		return false
+	}
+	if f.Mode != "" && !server.Supports(f.Mode) {
+		return false
+	}
+	if f.Available && !server.Available() {
+		return false
+	}
+	return true
+}
+
+// readGameServer returns the registered server and its storage version, or nil if it is not registered.
+func readGameServer(serviceContext *services.ServiceContext, key string) (*GameServer, string, error) {
+	objects, err := serviceContext.NakamaModule.StorageRead(serviceContext.Ctx, []*runtime.StorageRead{{
+		Collection: GameServerStorageCollection,
+		Key:        key,
+		UserID:     services.SystemUserId,
+	}})
+	if err != nil {
+		return nil, "", err
+	}
+	if len(objects) == 0 {
+		return nil, "", nil
+	}
+	server := &GameServer{}
+	if err := json.Unmarshal([]byte(objects[0].Value), server); err != nil {
+		return nil, "", err
+	}
+	return server, objects[0].Version, nil
+}
+
+// writeGameServer stores the server, if the stored server still has the version.
+func writeGameServer(serviceContext *services.ServiceContext, server *GameServer, version string) *apierror.Error {
+
+	server.UpdatedAt = time.Now().UTC().Unix()
+	data, err := json.Marshal(server)
+	if err != nil {
+		return apierror.Internal("error marshaling game server", err)
+	}
+	if _, err := serviceContext.NakamaModule.StorageWrite(serviceContext.Ctx, []*runtime.StorageWrite{{
+		Collection:      GameServerStorageCollection,
+		Key:             server.Key(),
+		UserID:          services.SystemUserId,
+		Value:           string(data),
+		Version:         version,
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}}); err != nil {
+		if errors.Is(err, runtime.ErrStorageRejectedVersion) {
+			return apierror.New(apierror.StatusAborted, apierror.ReasonConflict, "game server was modified concurrently")
+		}
+		return apierror.Internal("error writing game server", err)
+	}
+	return nil
+}
+
+// RegisterGameServer registers a game server for the relay, replacing any previous registration
+// with the same ID. The server's region must be one the relay may serve.
+func RegisterGameServer(serviceContext *services.ServiceContext, caller *relay.Relay, server *GameServer) (*GameServer, *apierror.Error) {
+	logger := serviceContext.Logger
+
+	server.RelayId = caller.Id
+	if server.Sessions == nil {
+		server.Sessions = []*Session{}
+	}
+	if err := server.Validate(); err != nil {
+		return nil, apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, err.Error())
+	}
+	if !caller.AllowsRegion(server.Region) {
+		return nil, apierror.New(apierror.StatusPermissionDenied, apierror.ReasonPermissionDenied, fmt.Sprintf("relay %s may not serve region %q", caller.Id, server.Region))
+	}
+
+	server.RegisteredAt = time.Now().UTC().Unix()
+	if apiErr := writeGameServer(serviceContext, server, ""); apiErr != nil {
+		return nil, apiErr
+	}
+	logger.WithField("relayId", caller.Id).WithField("serverId", server.ServerId).Info("Game server registered.")
+	return server, nil
+}
+
+// ReportSessions replaces the sessions a relay's game server is hosting. Sessions reserved by matchmaking
+// that the relay has not reported yet are kept until ReservationTimeout, so a report sent before the relay
+// learned of a reservation does not free its slot.
+func ReportSessions(serviceContext *services.ServiceContext, caller *relay.Relay, serverId string, sessions []*Session) (*GameServer, *apierror.Error) {
+
+	server, version, err := readGameServer(serviceContext, caller.Id+":"+serverId)
+	if err != nil {
+		return nil, apierror.Internal("error reading game server", err)
+	}
+	if server == nil {
+		return nil, apierror.New(apierror.StatusNotFound, apierror.ReasonNotFound, fmt.Sprintf("game server not registered: %q", serverId))
+	}
+
+	if sessions == nil {
+		sessions = []*Session{}
+	}
+	for _, session := range sessions {
+		session.ReservedAt = 0
+	}
+	if err := server.validateSessions(sessions); err != nil {
+		return nil, apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, err.Error())
+	}
+	server.Sessions = append(sessions, pendingReservations(server.Sessions, sessions, time.Now())...)
+	if apiErr := writeGameServer(serviceContext, server, version); apiErr != nil {
+		return nil, apiErr
+	}
+	return server, nil
+}
+
+// pendingReservations returns the reserved sessions that are not reported, and have not timed out.
+func pendingReservations(stored []*Session, reported []*Session, now time.Time) []*Session {
+	reportedIds := make(map[string]bool, len(reported))
+	for _, session := range reported {
+		reportedIds[strings.ToUpper(session.SessionId)] = true
+	}
+	pending := make([]*Session, 0)
+	for _, session := range stored {
+		if session.ReservedAt == 0 || reportedIds[strings.ToUpper(session.SessionId)] || now.Sub(time.Unix(session.ReservedAt, 0)) > ReservationTimeout {
+			continue
+		}
+		pending = append(pending, session)
+	}
+	return pending
+}
+
+// UnregisterGameServer removes a relay's game server from the registry.
+func UnregisterGameServer(serviceContext *services.ServiceContext, caller *relay.Relay, serverId string) *apierror.Error {
+	logger := serviceContext.Logger
+
+	if err := serviceContext.NakamaModule.StorageDelete(serviceContext.Ctx, []*runtime.StorageDelete{{
+		Collection: GameServerStorageCollection,
+		Key:        caller.Id + ":" + serverId,
+		UserID:     services.SystemUserId,
+	}}); err != nil {
+		return apierror.Internal("error unregistering game server", err)
+	}
+	logger.WithField("relayId", caller.Id).WithField("serverId", serverId).Info("Game server unregistered.")
+	return nil
+}
+
+// ListGameServers returns the registered game servers that pass the filter, least loaded first.
+// Only servers whose relay is online are listed; the servers of relays that went offline are removed.
+func ListGameServers(serviceContext *services.ServiceContext, filter Filter) ([]*GameServer, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	logger := serviceContext.Logger
+	nk := serviceContext.NakamaModule
+
+	presences, apiErr := relay.ListPresences(serviceContext)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	servers := make([]*GameServer, 0)
+	orphaned := make([]*runtime.StorageDelete, 0)
+	cursor := ""
+	for {
+		objects, next, err := nk.StorageList(ctx, "", services.SystemUserId, GameServerStorageCollection, 100, cursor)
+		if err != nil {
+			return nil, apierror.Internal("error listing game servers", err)
+		}
+		for _, object := range objects {
+			server := &GameServer{}
+			if err := json.Unmarshal([]byte(object.Value), server); err != nil || presences[server.RelayId] == nil {
+				orphaned = append(orphaned, &runtime.StorageDelete{
+					Collection: GameServerStorageCollection,
+					Key:        object.Key,
+					UserID:     services.SystemUserId,
+					Version:    object.Version,
+				})
+				continue
+			}
+			if filter.Matches(server) {
+				servers = append(servers, server)
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	for _, object := range orphaned {
+		if err := nk.StorageDelete(ctx, []*runtime.StorageDelete{object}); err != nil {
+			logger.WithField("err", err).WithField("key", object.Key).Debug("Orphaned game server was not removed.")
+			continue
+		}
+		logger.WithField("key", object.Key).Info("Game server removed with its relay.")
+	}
+
+	SortByLoad(servers)
+	return servers, nil
+}
+
+// SortByLoad orders servers by their number of sessions, then by key.
+func SortByLoad(servers []*GameServer) {
+	sort.SliceStable(servers, func(i, j int) bool {
+		if len(servers[i].Sessions) != len(servers[j].Sessions) {
+			return len(servers[i].Sessions) < len(servers[j].Sessions)
+		}
+		return servers[i].Key() < servers[j].Key()
+	})
+}
+
+// ReserveSession adds a session to a registered game server, if the server is still available and hosts
+// the session's mode. The session is pending until the relay reports it (see ReportSessions).
+// The write is conditional, so a concurrent reservation makes it fail with apierror.StatusAborted.
+func ReserveSession(serviceContext *services.ServiceContext, key string, session *Session) (*GameServer, *apierror.Error) {
+
+	server, version, err := readGameServer(serviceContext, key)
+	if err != nil {
+		return nil, apierror.Internal("error reading game server", err)
+	}
+	if server == nil {
+		return nil, apierror.New(apierror.StatusNotFound, apierror.ReasonNotFound, fmt.Sprintf("game server not registered: %q", key))
+	}
+	if !server.Available() || !server.Supports(session.Mode) {
+		return nil, apierror.New(apierror.StatusResourceExhausted, apierror.ReasonUnavailable, fmt.Sprintf("game server %s cannot host a %s session", key, session.Mode))
+	}
+
+	session.ReservedAt = time.Now().UTC().Unix()
+	server.Sessions = append(server.Sessions, session)
+	if apiErr := writeGameServer(serviceContext, server, version); apiErr != nil {
+		return nil, apiErr
+	}
+	return server, nil
+}
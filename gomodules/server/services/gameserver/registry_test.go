@@ -0,0 +1,119 @@
+package gameserver
+
+import (
+	"testing"
+	"time"
+
+	"echonakama/game"
+)
+
+func testGameServer() *GameServer {
+	return &GameServer{
+		ServerId: "1",
+		RelayId:  "relay-1",
+		Endpoint: Endpoint{ExternalIp: "203.0.113.10", Port: 6792},
+		Region:   "us-east",
+		Modes:    []game.GameMode{game.ModeArena, game.ModeSocial},
+		Capacity: 1,
+		Sessions: []*Session{},
+	}
+}
+
+func TestGameServerValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(s *GameServer)
+		wantErr bool
+	}{
+		{"valid", func(s *GameServer) {}, false},
+		{"no server id", func(s *GameServer) { s.ServerId = "" }, true},
+		{"bad ip", func(s *GameServer) { s.Endpoint.ExternalIp = "example.com" }, true},
+		{"bad port", func(s *GameServer) { s.Endpoint.Port = 70000 }, true},
+		{"no region", func(s *GameServer) { s.Region = "" }, true},
+		{"unknown mode", func(s *GameServer) { s.Modes = []game.GameMode{"echo_soccer"} }, true},
+		{"no capacity", func(s *GameServer) { s.Capacity = 0 }, true},
+		{"session", func(s *GameServer) {
+			s.Sessions = []*Session{{SessionId: "a", Mode: game.ModeArena, PlayerCount: 4, MaxPlayers: 8}}
+		}, false},
+		{"session mode not hosted", func(s *GameServer) {
+			s.Sessions = []*Session{{SessionId: "a", Mode: game.ModeCombat}}
+		}, true},
+		{"sessions over capacity", func(s *GameServer) {
+			s.Sessions = []*Session{{SessionId: "a", Mode: game.ModeArena}, {SessionId: "b", Mode: game.ModeArena}}
+		}, true},
+		{"too many players", func(s *GameServer) {
+			s.Sessions = []*Session{{SessionId: "a", Mode: game.ModeArena, PlayerCount: 9, MaxPlayers: 8}}
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := testGameServer()
+			tt.modify(server)
+			if err := server.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFilterMatches(t *testing.T) {
+	idle := testGameServer()
+	busy := testGameServer()
+	busy.Sessions = []*Session{{SessionId: "a", Mode: game.ModeArena}}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		server *GameServer
+		want   bool
+	}{
+		{"any", Filter{}, busy, true},
+		{"region any case", Filter{Region: "US-EAST"}, idle, true},
+		{"other region", Filter{Region: "eu-west"}, idle, false},
+		{"mode", Filter{Mode: game.ModeSocial}, idle, true},
+		{"mode not hosted", Filter{Mode: game.ModeCombat}, idle, false},
+		{"available", Filter{Available: true}, idle, true},
+		{"full", Filter{Available: true}, busy, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Matches(tt.server); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSortByLoad(t *testing.T) {
+	a := testGameServer()
+	a.ServerId, a.Capacity = "a", 2
+	a.Sessions = []*Session{{SessionId: "1", Mode: game.ModeArena}}
+	b := testGameServer()
+	b.ServerId = "b"
+	c := testGameServer()
+	c.ServerId = "c"
+
+	servers := []*GameServer{a, c, b}
+	SortByLoad(servers)
+	if servers[0] != b || servers[1] != c || servers[2] != a {
+		t.Errorf("SortByLoad() = %s, %s, %s, want b, c, a", servers[0].ServerId, servers[1].ServerId, servers[2].ServerId)
+	}
+}
+
+func TestPendingReservations(t *testing.T) {
+	now := time.Now()
+	stored := []*Session{
+		{SessionId: "REPORTED", ReservedAt: now.Unix()},
+		{SessionId: "PENDING", ReservedAt: now.Unix()},
+		{SessionId: "EXPIRED", ReservedAt: now.Add(-ReservationTimeout - time.Second).Unix()},
+		{SessionId: "ENDED"},
+	}
+	reported := []*Session{{SessionId: "reported"}}
+
+	pending := pendingReservations(stored, reported, now)
+	if len(pending) != 1 || pending[0].SessionId != "PENDING" {
+		t.Errorf("pendingReservations() = %v, want only the pending reservation", pending)
+	}
+}
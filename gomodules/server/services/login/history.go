@@ -0,0 +1,323 @@
+package login
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"echonakama/game"
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	ProfileHistoryStorageCollection = "Profile:history"
+	ProfileHistoryMaxRevisions      = 20 // the number of revisions kept for each profile
+
+	// The writers recorded in the profile history
+	ProfileWriterLogin  = "login"
+	ProfileWriterRelay  = "relay"
+	ProfileWriterAdmin  = "admin"
+	ProfileWriterImport = "import"
+)
+
+// ProfileRevision is a copy of a client or server profile as it was written.
+type ProfileRevision struct {
+	Revision     int64           `json:"revision"`        // increases by one with each write of the profile
+	Key          string          `json:"key"`             // the profile storage key (client or server)
+	Writer       string          `json:"writer"`          // what wrote the profile (login, relay, admin)
+	WriterUserId string          `json:"writer_user_id"`  // the Nakama user that made the write
+	Timestamp    int64           `json:"timestamp"`       // when the profile was written
+	Value        json.RawMessage `json:"value,omitempty"` // the profile that was written
+}
+
+// ProfileChange is a single difference between two profile revisions.
+type ProfileChange struct {
+	Path string      `json:"path"`          // the JSON path of the changed value
+	Old  interface{} `json:"old,omitempty"` // the value in the older revision (absent if added)
+	New  interface{} `json:"new,omitempty"` // the value in the newer revision (absent if removed)
+}
+
+// profileHistoryHead tracks the latest revision number of a profile.
+type profileHistoryHead struct {
+	Revision int64 `json:"revision"`
+}
+
+func profileHistoryHeadKey(key string) string {
+	return key + "_head"
+}
+
+// Revisions are stored in a ring, so the oldest is overwritten once the limit is reached.
+func profileRevisionKey(key string, revision int64) string {
+	return fmt.Sprintf("%s_%03d", key, revision%ProfileHistoryMaxRevisions)
+}
+
+// ProfileHistoryWrites returns the storage writes that record each game profile in writes as a new revision.
+// They must be written in the same StorageWrite call as the profiles, so both succeed or fail together.
+func ProfileHistoryWrites(ctx context.Context, nk runtime.NakamaModule, writer string, writerUserId string, timestamp int64, writes []*runtime.StorageWrite) ([]*runtime.StorageWrite, error) {
+	var profileWrites []*runtime.StorageWrite
+	var reads []*runtime.StorageRead
+	for _, write := range writes {
+		if write.Collection != GameProfileStorageCollection {
+			continue
+		}
+		profileWrites = append(profileWrites, write)
+		reads = append(reads, &runtime.StorageRead{
+			Collection: ProfileHistoryStorageCollection,
+			Key:        profileHistoryHeadKey(write.Key),
+			UserID:     write.UserID,
+		})
+	}
+	if len(profileWrites) == 0 {
+		return nil, nil
+	}
+
+	objects, err := nk.StorageRead(ctx, reads)
+	if err != nil {
+		return nil, err
+	}
+
+	historyWrites := make([]*runtime.StorageWrite, 0, len(profileWrites)*2)
+	for _, write := range profileWrites {
+		head := profileHistoryHead{}
+		headVersion := "*" // the head must not exist yet
+		for _, object := range objects {
+			if object.UserId == write.UserID && object.Key == profileHistoryHeadKey(write.Key) {
+				if err := json.Unmarshal([]byte(object.Value), &head); err != nil {
+					return nil, err
+				}
+				headVersion = object.Version
+			}
+		}
+		head.Revision++
+
+		revisionJson, err := json.Marshal(ProfileRevision{
+			Revision:     head.Revision,
+			Key:          write.Key,
+			Writer:       writer,
+			WriterUserId: writerUserId,
+			Timestamp:    timestamp,
+			Value:        json.RawMessage(write.Value),
+		})
+		if err != nil {
+			return nil, err
+		}
+		headJson, err := json.Marshal(head)
+		if err != nil {
+			return nil, err
+		}
+
+		historyWrites = append(historyWrites, &runtime.StorageWrite{
+			Collection:      ProfileHistoryStorageCollection,
+			Key:             profileRevisionKey(write.Key, head.Revision),
+			UserID:          write.UserID,
+			Value:           string(revisionJson),
+			PermissionRead:  0,
+			PermissionWrite: 0,
+		}, &runtime.StorageWrite{
+			Collection:      ProfileHistoryStorageCollection,
+			Key:             profileHistoryHeadKey(write.Key),
+			UserID:          write.UserID,
+			Value:           string(headJson),
+			PermissionRead:  0,
+			PermissionWrite: 0,
+			Version:         headVersion, // fail if another write recorded a revision first
+		})
+	}
+	return historyWrites, nil
+}
+
+// ListProfileRevisions returns the stored revisions of a profile, newest first.
+func ListProfileRevisions(ctx context.Context, nk runtime.NakamaModule, userId string, key string) ([]*ProfileRevision, error) {
+	reads := make([]*runtime.StorageRead, 0, ProfileHistoryMaxRevisions)
+	for i := int64(0); i < ProfileHistoryMaxRevisions; i++ {
+		reads = append(reads, &runtime.StorageRead{
+			Collection: ProfileHistoryStorageCollection,
+			Key:        profileRevisionKey(key, i),
+			UserID:     userId,
+		})
+	}
+	objects, err := nk.StorageRead(ctx, reads)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make([]*ProfileRevision, 0, len(objects))
+	for _, object := range objects {
+		revision := &ProfileRevision{}
+		if err := json.Unmarshal([]byte(object.Value), revision); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Revision > revisions[j].Revision
+	})
+	return revisions, nil
+}
+
+// ReadProfileRevision returns a single revision of a profile, or nil if it is no longer kept.
+func ReadProfileRevision(ctx context.Context, nk runtime.NakamaModule, userId string, key string, revision int64) (*ProfileRevision, error) {
+	if revision < 1 {
+		return nil, nil
+	}
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+		Collection: ProfileHistoryStorageCollection,
+		Key:        profileRevisionKey(key, revision),
+		UserID:     userId,
+	}})
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 {
+		return nil, nil
+	}
+
+	result := &ProfileRevision{}
+	if err := json.Unmarshal([]byte(objects[0].Value), result); err != nil {
+		return nil, err
+	}
+	// The slot may have been reused by a newer revision
+	if result.Revision != revision {
+		return nil, nil
+	}
+	return result, nil
+}
+
+// DiffProfileRevisions returns the values that changed between two revisions, ordered by path.
+func DiffProfileRevisions(from *ProfileRevision, to *ProfileRevision) ([]ProfileChange, error) {
+	var a, b interface{}
+	if err := json.Unmarshal(from.Value, &a); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(to.Value, &b); err != nil {
+		return nil, err
+	}
+
+	changes := []ProfileChange{}
+	diffJSON("", a, b, &changes)
+	return changes, nil
+}
+
+// diffJSON appends the differences between two decoded JSON values to changes.
+func diffJSON(path string, a interface{}, b interface{}, changes *[]ProfileChange) {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, found := av[k]; !found {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			diffJSON(joinJSONPath(path, k), av[k], bv[k], changes)
+		}
+		return
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(av) || i < len(bv); i++ {
+			var ai, bi interface{}
+			if i < len(av) {
+				ai = av[i]
+			}
+			if i < len(bv) {
+				bi = bv[i]
+			}
+			diffJSON(joinJSONPath(path, strconv.Itoa(i)), ai, bi, changes)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		*changes = append(*changes, ProfileChange{Path: path, Old: a, New: b})
+	}
+}
+
+func joinJSONPath(path string, element string) string {
+	if path == "" {
+		return element
+	}
+	return path + "." + element
+}
+
+// RollbackProfile restores a player's client or server profile to a stored revision.
+// The restored profile is validated, written over the current one, and recorded as a new revision.
+func RollbackProfile(serviceContext *services.ServiceContext, userId string, key string, revision int64, adminUserId string) (*ProfileRevision, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	logger := serviceContext.Logger
+	nk := serviceContext.NakamaModule
+
+	stored, err := ReadProfileRevision(ctx, nk, userId, key, revision)
+	if err != nil {
+		return nil, apierror.Internal("error reading profile revision", err)
+	}
+	if stored == nil {
+		return nil, apierror.New(apierror.StatusNotFound, apierror.ReasonNotFound, fmt.Sprintf("revision %d of %s profile not found", revision, key))
+	}
+
+	// The revision must still be a valid profile
+	var profile interface{ Validate() error }
+	switch key {
+	case ClientGameProfileStorageKey:
+		profile = &game.EchoPlayerPreferences{}
+	case ServerGameProfileStorageKey:
+		profile = &game.ServerProfile{}
+	default:
+		return nil, apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, fmt.Sprintf("invalid profile key: %q", key))
+	}
+	if err := json.Unmarshal(stored.Value, profile); err != nil {
+		return nil, apierror.New(apierror.StatusDataLoss, apierror.ReasonInternal, "error unmarshaling profile revision").Wrap(err)
+	}
+	if err := profile.Validate(); err != nil {
+		return nil, apierror.New(apierror.StatusFailedPrecondition, apierror.ReasonConflict, err.Error())
+	}
+
+	// Only overwrite the profile that was read
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+		Collection: GameProfileStorageCollection,
+		Key:        key,
+		UserID:     userId,
+	}})
+	if err != nil {
+		return nil, apierror.Internal("error reading profile", err)
+	}
+	version := "*"
+	if len(objects) > 0 {
+		version = objects[0].Version
+	}
+
+	timestamp := time.Now().UTC().Unix()
+	writes := []*runtime.StorageWrite{gameProfileStorageObject(userId, key, string(stored.Value), version)}
+	historyWrites, err := ProfileHistoryWrites(ctx, nk, ProfileWriterAdmin, adminUserId, timestamp, writes)
+	if err != nil {
+		return nil, apierror.Internal("error preparing profile history", err)
+	}
+
+	if _, err := nk.StorageWrite(ctx, append(writes, historyWrites...)); err != nil {
+		if errors.Is(err, runtime.ErrStorageRejectedVersion) {
+			return nil, apierror.New(apierror.StatusAborted, apierror.ReasonConflict, "profile was modified concurrently")
+		}
+		return nil, apierror.Internal("error writing profile", err)
+	}
+
+	logger.WithField("userId", userId).WithField("key", key).WithField("revision", revision).Info("Rolled back profile.")
+	return stored, nil
+}
@@ -0,0 +1,45 @@
+package login
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDiffProfileRevisions(t *testing.T) {
+	from := &ProfileRevision{Value: json.RawMessage(`{"weapon":"scout","legal":{"eula_version":1},"mute":{"users":["a"]},"teamname":"x"}`)}
+	to := &ProfileRevision{Value: json.RawMessage(`{"weapon":"rocket","legal":{"eula_version":1},"mute":{"users":["a","b"]},"grenade":"det"}`)}
+
+	changes, err := DiffProfileRevisions(from, to)
+	if err != nil {
+		t.Fatalf("DiffProfileRevisions() error: %v", err)
+	}
+
+	expected := []ProfileChange{
+		{Path: "grenade", Old: nil, New: "det"},
+		{Path: "mute.users.1", Old: nil, New: "b"},
+		{Path: "teamname", Old: "x", New: nil},
+		{Path: "weapon", Old: "scout", New: "rocket"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("DiffProfileRevisions() = %v, want %v", changes, expected)
+	}
+}
+
+func TestProfileRevisionKey(t *testing.T) {
+	tests := []struct {
+		revision int64
+		key      string
+	}{
+		{1, "client_001"},
+		{19, "client_019"},
+		{20, "client_000"},
+		{21, "client_001"},
+	}
+
+	for _, tt := range tests {
+		if got := profileRevisionKey(ClientGameProfileStorageKey, tt.revision); got != tt.key {
+			t.Errorf("profileRevisionKey(%d) = %s, want %s", tt.revision, got, tt.key)
+		}
+	}
+}
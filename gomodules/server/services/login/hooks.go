@@ -4,8 +4,12 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"strings"
+
+	"echonakama/server/services/apierror"
+	"echonakama/server/services/config"
+	"echonakama/server/services/discord"
 
-	"github.com/bwmarrin/discordgo"
 	"github.com/heroiclabs/nakama-common/api"
 	"github.com/heroiclabs/nakama-common/runtime"
 )
@@ -39,85 +43,100 @@ func RegisterIndexes(initializer runtime.Initializer) error {
 	return nil
 }
 
-func BeforeAuthenticateCustom(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.AuthenticateCustomRequest) (*api.AuthenticateCustomRequest, error) {
-	// Get third-party API URL from the runtime context
-	vars, _ := ctx.Value(runtime.RUNTIME_CTX_ENV).(map[string]string)
-
-	// Parse the auth token into a DiscordAccessToken
-	discordAccessToken := &DiscordAccessToken{}
-
-	// Refresh the access token
-	if err := discordAccessToken.Refresh(vars["DISCORD_CLIENT_ID"], vars["DISCORD_CLIENT_SECRET"]); err != nil {
-		logger.Warn("error refreshing DiscordAccessToken: %v", err)
-		return in, runtime.NewError("error refreshing DiscordAccessToken", 13)
+// BeforeAuthenticateDevice refuses the device IDs of the imported legacy accounts. Only the server may
+// authenticate with them; otherwise any client could log in as an imported account.
+func BeforeAuthenticateDevice(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.AuthenticateDeviceRequest) (*api.AuthenticateDeviceRequest, error) {
+	if strings.HasPrefix(in.GetAccount().GetId(), LegacyDeviceIdPrefix) {
+		logger.WithField("deviceId", in.GetAccount().GetId()).Warn("Refused a legacy device ID")
+		return nil, apierror.New(apierror.StatusPermissionDenied, apierror.ReasonPermissionDenied, "device ID is reserved").Runtime()
 	}
+	return in, nil
+}
 
+// BeforeLinkDevice refuses the device IDs of the imported legacy accounts, so a player cannot link one
+// to their own account before it is imported, and be handed the imported profiles.
+func BeforeLinkDevice(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.AccountDevice) (*api.AccountDevice, error) {
+	if strings.HasPrefix(in.GetId(), LegacyDeviceIdPrefix) {
+		logger.WithField("deviceId", in.GetId()).Warn("Refused a legacy device ID")
+		return nil, apierror.New(apierror.StatusPermissionDenied, apierror.ReasonPermissionDenied, "device ID is reserved").Runtime()
+	}
 	return in, nil
 }
 
-// Update the user's Nakama account after authenticating
-func AfterAuthenticateCustom(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, out *api.Session, in *api.AuthenticateCustomRequest) error {
-	logger.Info("Updating Nakama user after authentication")
-	vars, _ := ctx.Value(runtime.RUNTIME_CTX_ENV).(map[string]string)
+// BeforeAuthenticateCustom returns the hook that refreshes the player's Discord access token.
+func BeforeAuthenticateCustom(discordClient discord.Client) func(context.Context, runtime.Logger, *sql.DB, runtime.NakamaModule, *api.AuthenticateCustomRequest) (*api.AuthenticateCustomRequest, error) {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.AuthenticateCustomRequest) (*api.AuthenticateCustomRequest, error) {
+		// Parse the auth token into a DiscordAccessToken
+		discordAccessToken := &discord.AccessToken{}
 
-	// Get the Nakama user ID from the runtime context
-	nakamaUserId, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
-	if !ok {
-		return runtime.NewError("error getting userId", 13)
-	}
-	// Get the Nakama Account
-	nakamaAccount, err := nk.AccountGetId(ctx, nakamaUserId)
-	if err != nil {
-		logger.Warn("error getting nakama user: %v", err)
-		return runtime.NewError("error getting nakama user", 13)
+		// Refresh the access token
+		if _, err := discordClient.RefreshToken(ctx, discordAccessToken); err != nil {
+			logger.Warn("error refreshing DiscordAccessToken: %v", err)
+			return in, runtime.NewError("error refreshing DiscordAccessToken", 13)
+		}
+
+		return in, nil
 	}
+}
 
-	// Parse the auth token into a DiscordAccessToken
-	discordAccessToken := &DiscordAccessToken{}
+// AfterAuthenticateCustom returns the hook that updates the player's Nakama account from Discord after authenticating.
+func AfterAuthenticateCustom(cfg *config.Config, discordClient discord.Client) func(context.Context, runtime.Logger, *sql.DB, runtime.NakamaModule, *api.Session, *api.AuthenticateCustomRequest) error {
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, out *api.Session, in *api.AuthenticateCustomRequest) error {
+		logger.Info("Updating Nakama user after authentication")
 
-	// Get the Discord user
-	discord, err := discordgo.New("Bearer " + discordAccessToken.AccessToken)
-	if err != nil {
-		logger.Warn("error creating discord session: %v", err)
-		return runtime.NewError("error creating discord session", 13)
-	}
-	defer discord.Close()
-	discordUser, err := discord.User("@me")
-	if err != nil {
-		logger.Warn("error getting discord user: %v", err)
-		return runtime.NewError("error getting discord user", 13)
-	}
+		// Get the Nakama user ID from the runtime context
+		nakamaUserId, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return runtime.NewError("error getting userId", 13)
+		}
+		// Get the Nakama Account
+		nakamaAccount, err := nk.AccountGetId(ctx, nakamaUserId)
+		if err != nil {
+			logger.Warn("error getting nakama user: %v", err)
+			return runtime.NewError("error getting nakama user", 13)
+		}
 
-	// Get the Discord guildMember
-	guildMember, err := discord.GuildMember(vars["DISCORD_GUILD_ID"], discordUser.ID)
-	if err != nil {
-		logger.Warn("error getting discord member: %v", err)
-		return runtime.NewError("error getting discord member", 13)
-	}
+		// Parse the auth token into a DiscordAccessToken
+		discordAccessToken := &discord.AccessToken{}
 
-	// Construct the user info from the discord user and guildMember
-	avatarUrl := fmt.Sprintf("https://cdn.discordapp.com/avatars/%s/%s.png", discordUser.ID, discordUser.Avatar)
-	locale := discordUser.Locale
+		// Get the Discord user
+		discordUser, err := discordClient.CurrentUser(ctx, discordAccessToken.AccessToken)
+		if err != nil {
+			logger.Warn("error getting discord user: %v", err)
+			return runtime.NewError("error getting discord user", 13)
+		}
 
-	displayName := DetermineDisplayName(nakamaAccount, discordUser, guildMember)
-	// Check if the displayName matches an existing nakama username
-	// If it does, throw a warning and set the displayName to the discord username
-	// This is to prevent duplicate displayNames
-	users, err := nk.UsersGetUsername(ctx, []string{displayName})
-	if err != nil {
-		logger.WithField("err", err).Error("Users get username error.")
-	} else {
-		if len(users) > 0 {
-			logger.Warn("displayName: %s already exists as a username. Setting displayName to discord username: %s", displayName, discordUser.Username)
-			displayName = discordUser.Username
+		// Get the Discord guildMember
+		guildMember, err := discordClient.GuildMember(cfg.DiscordBotGuild, discordUser.ID)
+		if err != nil {
+			logger.Warn("error getting discord member: %v", err)
+			return runtime.NewError("error getting discord member", 13)
+		}
+
+		// Construct the user info from the discord user and guildMember
+		avatarUrl := fmt.Sprintf("https://cdn.discordapp.com/avatars/%s/%s.png", discordUser.ID, discordUser.Avatar)
+		locale := discordUser.Locale
+
+		displayName := DetermineDisplayName(nakamaAccount, discordUser, guildMember)
+		// Check if the displayName matches an existing nakama username
+		// If it does, throw a warning and set the displayName to the discord username
+		// This is to prevent duplicate displayNames
+		users, err := nk.UsersGetUsername(ctx, []string{displayName})
+		if err != nil {
+			logger.WithField("err", err).Error("Users get username error.")
+		} else {
+			if len(users) > 0 {
+				logger.Warn("displayName: %s already exists as a username. Setting displayName to discord username: %s", displayName, discordUser.Username)
+				displayName = discordUser.Username
+			}
 		}
-	}
 
-	// Update the Nakama user
-	logger.Info("Updating Nakama user: %v with displayName: %v", nakamaUserId, displayName)
-	if err := nk.AccountUpdateId(ctx, nakamaUserId, "", nil, displayName, "", "", locale, avatarUrl); err != nil {
-		logger.Warn("error updating nakama user: %v", err)
-		return runtime.NewError("error updating nakama user", 13)
+		// Update the Nakama user
+		logger.Info("Updating Nakama user: %v with displayName: %v", nakamaUserId, displayName)
+		if err := nk.AccountUpdateId(ctx, nakamaUserId, "", nil, displayName, "", "", locale, avatarUrl); err != nil {
+			logger.Warn("error updating nakama user: %v", err)
+			return runtime.NewError("error updating nakama user", 13)
+		}
+		return nil
 	}
-	return nil
 }
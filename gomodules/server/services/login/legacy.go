@@ -0,0 +1,494 @@
+package login
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"echonakama/game"
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	LegacyAccountStorageCollection = "Import:legacyAccount"
+
+	// The placeholder accounts are authenticated with device IDs that the BeforeAuthenticateDevice and
+	// BeforeLinkDevice hooks refuse, so only the server can use them.
+	LegacyDeviceIdPrefix = "legacy:"
+	LegacyUsernamePrefix = "legacy-"
+
+	// The actions reported for each imported account
+	LegacyImportCreate = "create"
+	LegacyImportUpdate = "update"
+	LegacyImportSkip   = "skip"
+	LegacyImportFailed = "failed"
+
+	// BannedUntilMetadataKey is the account metadata key of the time (in Unix seconds) an account is banned until
+	BannedUntilMetadataKey = "banned_until"
+)
+
+// ErrLegacyAccountLocked is returned when a legacy account with a password is claimed. The link does not carry the
+// password, so a locked account cannot be claimed until an admin imports it again without its lock.
+var ErrLegacyAccountLocked = errors.New("legacy account is locked")
+
+// LegacyAccount is an account document from the file-based EchoRelay server.
+type LegacyAccount struct {
+	Profile struct {
+		Client game.EchoPlayerPreferences `json:"client"`
+		Server game.ServerProfile         `json:"server"`
+	} `json:"profile"`
+	IsModerator     bool   `json:"is_moderator"`
+	AccountLockHash string `json:"account_lock_hash"`
+	AccountLockSalt string `json:"account_lock_salt"`
+	BannedUntil     string `json:"banned_until"`
+}
+
+// BanExpiry returns when the legacy ban expires, or the zero time if the account is not banned.
+// EchoRelay writes the time as RFC 3339, or without a time zone for UTC.
+func (a *LegacyAccount) BanExpiry() (time.Time, error) {
+	return parseLegacyTime(a.BannedUntil)
+}
+
+func parseLegacyTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02T15:04:05.9999999", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid banned_until: %q", value)
+	}
+	return t, nil
+}
+
+// GameProfiles maps the legacy account onto the game profiles and the EchoUserId they belong to.
+// Equipped cosmetics the player does not own are reset, and the corrections returned.
+func (a *LegacyAccount) GameProfiles() (*game.EchoUserId, *game.GameProfiles, []game.LoadoutCorrection, error) {
+	token := a.Profile.Server.EchoUserIdToken
+	if token == "" {
+		token = a.Profile.Client.EchoUserIdToken
+	}
+	if token == "" {
+		return nil, nil, nil, errors.New("profile has no xplatformid")
+	}
+	echoUserId, err := (&game.EchoUserId{}).Parse(token)
+	if err != nil || !echoUserId.Valid() {
+		return nil, nil, nil, fmt.Errorf("invalid xplatformid: %q", token)
+	}
+	if a.Profile.Client.EchoUserIdToken != "" && a.Profile.Client.EchoUserIdToken != token {
+		return nil, nil, nil, fmt.Errorf("client xplatformid %q does not match server xplatformid %q", a.Profile.Client.EchoUserIdToken, token)
+	}
+
+	profiles := &game.GameProfiles{
+		Client: a.Profile.Client,
+		Server: a.Profile.Server,
+	}
+	profiles.Client.EchoUserIdToken = echoUserId.String()
+	profiles.Server.EchoUserIdToken = echoUserId.String()
+
+	// The server profile's display name is the one other players saw
+	if profiles.Server.DisplayName == "" {
+		profiles.Server.DisplayName = profiles.Client.DisplayName
+	}
+	profiles.Client.DisplayName = profiles.Server.DisplayName
+
+	corrections := profiles.Server.ValidateLoadout()
+	if err := profiles.Validate(); err != nil {
+		return nil, nil, nil, err
+	}
+	return echoUserId, profiles, corrections, nil
+}
+
+// LegacyAccountRecord tracks an imported legacy account until a player claims it.
+type LegacyAccountRecord struct {
+	EchoUserIdToken   string `json:"game_user_id_token"`           // the xplatform ID of the legacy account
+	PlaceholderUserId string `json:"placeholder_user_id"`          // the Nakama user that holds the imported profiles
+	IsModerator       bool   `json:"is_moderator"`                 // the legacy moderator flag
+	BannedUntil       string `json:"banned_until,omitempty"`       // the legacy ban expiry
+	HasAccountLock    bool   `json:"has_account_lock"`             // the legacy account had a password set
+	AccountLockHash   string `json:"account_lock_hash,omitempty"`  // the legacy password hash
+	AccountLockSalt   string `json:"account_lock_salt,omitempty"`  // the legacy password salt
+	ImportedAt        int64  `json:"imported_at"`                  // when the account was last imported
+	ClaimedByUserId   string `json:"claimed_by_user_id,omitempty"` // the Nakama user that claimed the account
+	ClaimedAt         int64  `json:"claimed_at,omitempty"`         // when the account was claimed
+}
+
+func (r *LegacyAccountRecord) StorageObject(version string) (*runtime.StorageWrite, error) {
+	recordJson, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &runtime.StorageWrite{
+		Collection:      LegacyAccountStorageCollection,
+		Key:             r.EchoUserIdToken,
+		UserID:          services.SystemUserId,
+		Value:           string(recordJson),
+		PermissionRead:  0,
+		PermissionWrite: 0,
+		Version:         version,
+	}, nil
+}
+
+// LegacyImportResult reports what the import did (or would do) with a single legacy account.
+type LegacyImportResult struct {
+	Index             int                      `json:"index"`                         // the position of the document in the request
+	EchoUserIdToken   string                   `json:"game_user_id_token,omitempty"`  // the xplatform ID of the account
+	DisplayName       string                   `json:"display_name,omitempty"`        // the display name of the account
+	Action            string                   `json:"action"`                        // create, update, skip or failed
+	Reason            string                   `json:"reason,omitempty"`              // why the account was skipped or failed
+	Corrections       []game.LoadoutCorrection `json:"loadout_corrections,omitempty"` // the equipped cosmetics that were reset
+	PlaceholderUserId string                   `json:"placeholder_user_id,omitempty"` // the Nakama user that holds the profiles
+}
+
+// LegacyImportReport summarizes an import of legacy accounts.
+type LegacyImportReport struct {
+	DryRun  bool                 `json:"dry_run"`
+	Created int                  `json:"created"`
+	Updated int                  `json:"updated"`
+	Skipped int                  `json:"skipped"`
+	Failed  int                  `json:"failed"`
+	Results []LegacyImportResult `json:"results"`
+}
+
+func (r *LegacyImportReport) add(result LegacyImportResult) {
+	switch result.Action {
+	case LegacyImportCreate:
+		r.Created++
+	case LegacyImportUpdate:
+		r.Updated++
+	case LegacyImportSkip:
+		r.Skipped++
+	case LegacyImportFailed:
+		r.Failed++
+	}
+	r.Results = append(r.Results, result)
+}
+
+// ImportLegacyAccounts imports account documents from the file-based EchoRelay server.
+// Each account's profiles are written to a placeholder Nakama account, which is claimed
+// when a player links a device with the same EchoUserId. Accounts that have been claimed are skipped.
+// With dryRun set, the documents are checked and reported, but nothing is written.
+func ImportLegacyAccounts(serviceContext *services.ServiceContext, documents []json.RawMessage, dryRun bool, adminUserId string) (*LegacyImportReport, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	logger := serviceContext.Logger
+	nk := serviceContext.NakamaModule
+
+	type importable struct {
+		result   LegacyImportResult
+		account  *LegacyAccount
+		profiles *game.GameProfiles
+	}
+
+	report := &LegacyImportReport{DryRun: dryRun, Results: []LegacyImportResult{}}
+	accounts := make([]*importable, 0, len(documents))
+	seen := make(map[string]bool, len(documents))
+	reads := make([]*runtime.StorageRead, 0, len(documents))
+
+	for i, document := range documents {
+		result := LegacyImportResult{Index: i, Action: LegacyImportSkip}
+
+		account := &LegacyAccount{}
+		if err := json.Unmarshal(document, account); err != nil {
+			result.Reason = fmt.Sprintf("invalid account document: %v", err)
+			report.add(result)
+			continue
+		}
+		echoUserId, profiles, corrections, err := account.GameProfiles()
+		if err != nil {
+			result.Reason = err.Error()
+			report.add(result)
+			continue
+		}
+		result.EchoUserIdToken = echoUserId.String()
+		result.DisplayName = profiles.Server.DisplayName
+		result.Corrections = corrections
+		if _, err := account.BanExpiry(); err != nil {
+			result.Reason = err.Error()
+			report.add(result)
+			continue
+		}
+
+		if seen[result.EchoUserIdToken] {
+			result.Reason = "duplicate of an earlier document"
+			report.add(result)
+			continue
+		}
+		seen[result.EchoUserIdToken] = true
+
+		accounts = append(accounts, &importable{result, account, profiles})
+		reads = append(reads, &runtime.StorageRead{
+			Collection: LegacyAccountStorageCollection,
+			Key:        result.EchoUserIdToken,
+			UserID:     services.SystemUserId,
+		})
+	}
+
+	// Find the accounts that were imported before
+	records := make(map[string]*api.StorageObject, len(reads))
+	if len(reads) > 0 {
+		objects, err := nk.StorageRead(ctx, reads)
+		if err != nil {
+			return nil, apierror.Internal("error reading legacy account records", err)
+		}
+		for _, object := range objects {
+			records[object.Key] = object
+		}
+	}
+
+	timestamp := time.Now().UTC().Unix()
+	for _, a := range accounts {
+		result := a.result
+		record := &LegacyAccountRecord{}
+		version := "*" // the record must not exist yet
+
+		result.Action = LegacyImportCreate
+		if object, found := records[result.EchoUserIdToken]; found {
+			if err := json.Unmarshal([]byte(object.Value), record); err != nil {
+				result.Action = LegacyImportFailed
+				result.Reason = fmt.Sprintf("error unmarshaling legacy account record: %v", err)
+				report.add(result)
+				continue
+			}
+			if record.ClaimedByUserId != "" {
+				result.Action = LegacyImportSkip
+				result.Reason = "claimed by " + record.ClaimedByUserId
+				report.add(result)
+				continue
+			}
+			result.Action = LegacyImportUpdate
+			result.PlaceholderUserId = record.PlaceholderUserId
+			version = object.Version
+		}
+
+		if !dryRun {
+			placeholderUserId, err := writeLegacyAccount(ctx, nk, a.account, a.profiles, record, version, timestamp, adminUserId)
+			if err != nil {
+				logger.WithField("err", err).WithField("xplatformid", result.EchoUserIdToken).Error("error importing legacy account.")
+				result.Action = LegacyImportFailed
+				result.Reason = err.Error()
+			}
+			result.PlaceholderUserId = placeholderUserId
+		}
+		report.add(result)
+	}
+
+	logger.WithField("dryRun", dryRun).Info("Imported legacy accounts: %d created, %d updated, %d skipped, %d failed.", report.Created, report.Updated, report.Skipped, report.Failed)
+	return report, nil
+}
+
+// writeLegacyAccount writes the profiles to the account's placeholder user, creating it if needed.
+func writeLegacyAccount(ctx context.Context, nk runtime.NakamaModule, account *LegacyAccount, profiles *game.GameProfiles, record *LegacyAccountRecord, version string, timestamp int64, adminUserId string) (string, error) {
+	token := profiles.Server.EchoUserIdToken
+	placeholderUserId, _, _, err := nk.AuthenticateDevice(ctx, LegacyDeviceIdPrefix+token, LegacyUsernamePrefix+token, true)
+	if err != nil {
+		return "", fmt.Errorf("error creating placeholder account: %v", err)
+	}
+	if err := nk.AccountUpdateId(ctx, placeholderUserId, "", nil, profiles.Server.DisplayName, "", "", "", ""); err != nil {
+		return placeholderUserId, fmt.Errorf("error updating placeholder account: %v", err)
+	}
+
+	echoUserId, _ := (&game.EchoUserId{}).Parse(token)
+	loginRequestJson, err := json.Marshal(LoginRequest{
+		EchoUserId: *echoUserId,
+		Metadata:   LoginMetadata{DisplayName: profiles.Server.DisplayName},
+	})
+	if err != nil {
+		return placeholderUserId, err
+	}
+	clientProfileJson, err := json.Marshal(profiles.Client)
+	if err != nil {
+		return placeholderUserId, err
+	}
+	serverProfileJson, err := json.Marshal(profiles.Server)
+	if err != nil {
+		return placeholderUserId, err
+	}
+
+	writes := []*runtime.StorageWrite{
+		{
+			Collection:      XPlatformIdStorageCollection,
+			Key:             token,
+			UserID:          placeholderUserId,
+			Value:           string(loginRequestJson),
+			PermissionRead:  0,
+			PermissionWrite: 0,
+		},
+		gameProfileStorageObject(placeholderUserId, ClientGameProfileStorageKey, string(clientProfileJson), ""),
+		gameProfileStorageObject(placeholderUserId, ServerGameProfileStorageKey, string(serverProfileJson), ""),
+	}
+	historyWrites, err := ProfileHistoryWrites(ctx, nk, ProfileWriterImport, adminUserId, timestamp, writes)
+	if err != nil {
+		return placeholderUserId, fmt.Errorf("error preparing profile history: %v", err)
+	}
+
+	record.EchoUserIdToken = token
+	record.PlaceholderUserId = placeholderUserId
+	record.IsModerator = account.IsModerator
+	record.BannedUntil = account.BannedUntil
+	record.HasAccountLock = account.AccountLockHash != ""
+	record.AccountLockHash = account.AccountLockHash
+	record.AccountLockSalt = account.AccountLockSalt
+	record.ImportedAt = timestamp
+	recordObject, err := record.StorageObject(version)
+	if err != nil {
+		return placeholderUserId, err
+	}
+
+	if _, err := nk.StorageWrite(ctx, append(append(writes, historyWrites...), recordObject)); err != nil {
+		if errors.Is(err, runtime.ErrStorageRejectedVersion) {
+			return placeholderUserId, errors.New("legacy account was imported or claimed concurrently")
+		}
+		return placeholderUserId, fmt.Errorf("error writing legacy account: %v", err)
+	}
+	return placeholderUserId, nil
+}
+
+// ClaimLegacyAccount moves an imported legacy account to the player that linked a device with its EchoUserId.
+// Profiles the player already has are kept; the rest are copied from the placeholder, which is then deleted.
+// A legacy ban that has not expired is applied to the player. It does nothing if there is no unclaimed legacy
+// account for the EchoUserId, and returns ErrLegacyAccountLocked if the account is locked.
+func ClaimLegacyAccount(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, userIdToken string, userId string) error {
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+		Collection: LegacyAccountStorageCollection,
+		Key:        userIdToken,
+		UserID:     services.SystemUserId,
+	}})
+	if err != nil {
+		return fmt.Errorf("error reading legacy account record: %v", err)
+	}
+	if len(objects) == 0 {
+		return nil
+	}
+	recordVersion := objects[0].Version
+	record := &LegacyAccountRecord{}
+	if err := json.Unmarshal([]byte(objects[0].Value), record); err != nil {
+		return fmt.Errorf("error unmarshaling legacy account record: %v", err)
+	}
+	if record.ClaimedByUserId != "" {
+		return nil
+	}
+	if record.HasAccountLock {
+		return ErrLegacyAccountLocked
+	}
+
+	// The ban is applied first, so a failure leaves the account to be claimed again
+	bannedUntil, err := parseLegacyTime(record.BannedUntil)
+	if err != nil {
+		return err
+	}
+	if bannedUntil.After(time.Now()) {
+		if err := setBannedUntil(ctx, nk, userId, bannedUntil); err != nil {
+			return fmt.Errorf("error applying legacy ban: %v", err)
+		}
+	}
+
+	// Read the imported objects, and the claiming player's own
+	reads := make([]*runtime.StorageRead, 0, 6)
+	for _, owner := range []string{record.PlaceholderUserId, userId} {
+		reads = append(reads, &runtime.StorageRead{
+			Collection: XPlatformIdStorageCollection,
+			Key:        userIdToken,
+			UserID:     owner,
+		}, &runtime.StorageRead{
+			Collection: GameProfileStorageCollection,
+			Key:        ClientGameProfileStorageKey,
+			UserID:     owner,
+		}, &runtime.StorageRead{
+			Collection: GameProfileStorageCollection,
+			Key:        ServerGameProfileStorageKey,
+			UserID:     owner,
+		})
+	}
+	objects, err = nk.StorageRead(ctx, reads)
+	if err != nil {
+		return fmt.Errorf("error reading legacy account: %v", err)
+	}
+
+	existing := make(map[string]bool)
+	for _, object := range objects {
+		if object.UserId == userId {
+			existing[object.Collection+"/"+object.Key] = true
+		}
+	}
+
+	writes := make([]*runtime.StorageWrite, 0, 3)
+	for _, object := range objects {
+		if object.UserId != record.PlaceholderUserId || existing[object.Collection+"/"+object.Key] {
+			continue
+		}
+		if object.Collection == GameProfileStorageCollection {
+			writes = append(writes, gameProfileStorageObject(userId, object.Key, object.Value, "*"))
+			continue
+		}
+		writes = append(writes, &runtime.StorageWrite{
+			Collection:      object.Collection,
+			Key:             object.Key,
+			UserID:          userId,
+			Value:           object.Value,
+			PermissionRead:  0,
+			PermissionWrite: 0,
+			Version:         "*",
+		})
+	}
+
+	timestamp := time.Now().UTC().Unix()
+	historyWrites, err := ProfileHistoryWrites(ctx, nk, ProfileWriterImport, userId, timestamp, writes)
+	if err != nil {
+		return fmt.Errorf("error preparing profile history: %v", err)
+	}
+
+	record.ClaimedByUserId = userId
+	record.ClaimedAt = timestamp
+	recordObject, err := record.StorageObject(recordVersion)
+	if err != nil {
+		return err
+	}
+
+	if _, err := nk.StorageWrite(ctx, append(append(writes, historyWrites...), recordObject)); err != nil {
+		return fmt.Errorf("error writing claimed legacy account: %v", err)
+	}
+
+	// The placeholder is no longer needed once its profiles have been copied
+	if err := nk.AccountDeleteId(ctx, record.PlaceholderUserId, false); err != nil {
+		logger.WithField("err", err).WithField("placeholderUserId", record.PlaceholderUserId).Warn("error deleting legacy placeholder account.")
+	}
+
+	logger.WithField("xplatformid", userIdToken).WithField("userId", userId).WithField("copied", len(writes)).Info("Claimed legacy account.")
+	return nil
+}
+
+// setBannedUntil bans the account until the time, keeping the rest of its metadata.
+func setBannedUntil(ctx context.Context, nk runtime.NakamaModule, userId string, until time.Time) error {
+	account, err := nk.AccountGetId(ctx, userId)
+	if err != nil {
+		return err
+	}
+	metadata := make(map[string]interface{})
+	if account.GetUser().GetMetadata() != "" {
+		if err := json.Unmarshal([]byte(account.GetUser().GetMetadata()), &metadata); err != nil {
+			return err
+		}
+	}
+	metadata[BannedUntilMetadataKey] = until.Unix()
+	return nk.AccountUpdateId(ctx, userId, "", metadata, "", "", "", "", "")
+}
+
+// BannedUntil returns the time the account is banned until, or the zero time if it is not.
+func BannedUntil(account *api.Account) time.Time {
+	metadata := struct {
+		BannedUntil int64 `json:"banned_until"`
+	}{}
+	if err := json.Unmarshal([]byte(account.GetUser().GetMetadata()), &metadata); err != nil || metadata.BannedUntil == 0 {
+		return time.Time{}
+	}
+	return time.Unix(metadata.BannedUntil, 0)
+}
@@ -0,0 +1,147 @@
+package login
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"echonakama/game"
+	"echonakama/server/services"
+	"echonakama/server/services/nakamatest"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+func legacyAccountDocument(t *testing.T, modify func(profiles *game.GameProfiles)) []byte {
+	t.Helper()
+	echoUserId := game.NewEchoUserId(game.OVR_ORG, 1234)
+	profiles := game.DefaultGameProfiles(*echoUserId, "Player")
+	modify(&profiles)
+
+	document, err := json.Marshal(map[string]interface{}{
+		"profile":           map[string]interface{}{"client": profiles.Client, "server": profiles.Server},
+		"is_moderator":      false,
+		"banned_until":      nil,
+		"account_lock_hash": nil,
+		"account_lock_salt": nil,
+	})
+	if err != nil {
+		t.Fatalf("json.Marshal() error: %v", err)
+	}
+	return document
+}
+
+func TestLegacyAccountGameProfiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(profiles *game.GameProfiles)
+		wantErr bool
+	}{
+		{"valid", func(p *game.GameProfiles) {}, false},
+		{"client display name", func(p *game.GameProfiles) { p.Server.DisplayName = "" }, false},
+		{"client id only", func(p *game.GameProfiles) { p.Server.EchoUserIdToken = "" }, false},
+		{"no id", func(p *game.GameProfiles) { p.Server.EchoUserIdToken = ""; p.Client.EchoUserIdToken = "" }, true},
+		{"invalid id", func(p *game.GameProfiles) { p.Server.EchoUserIdToken = "INVALID-1" }, true},
+		{"mismatched ids", func(p *game.GameProfiles) { p.Client.EchoUserIdToken = "OVR_ORG-5678" }, true},
+		{"invalid profile", func(p *game.GameProfiles) { p.Server.DisplayName = "x"; p.Client.DisplayName = "x" }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			account := &LegacyAccount{}
+			if err := json.Unmarshal(legacyAccountDocument(t, tt.modify), account); err != nil {
+				t.Fatalf("json.Unmarshal() error: %v", err)
+			}
+
+			echoUserId, profiles, _, err := account.GameProfiles()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GameProfiles() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if echoUserId.String() != "OVR_ORG-1234" {
+				t.Errorf("GameProfiles() echoUserId = %s, want OVR_ORG-1234", echoUserId.String())
+			}
+			if profiles.Client.EchoUserIdToken != "OVR_ORG-1234" || profiles.Server.EchoUserIdToken != "OVR_ORG-1234" {
+				t.Errorf("GameProfiles() xplatformid = %q/%q, want OVR_ORG-1234", profiles.Client.EchoUserIdToken, profiles.Server.EchoUserIdToken)
+			}
+			if profiles.Client.DisplayName != "Player" || profiles.Server.DisplayName != "Player" {
+				t.Errorf("GameProfiles() display name = %q/%q, want Player", profiles.Client.DisplayName, profiles.Server.DisplayName)
+			}
+		})
+	}
+}
+
+func TestClaimLegacyAccountLockAndBan(t *testing.T) {
+	nk := nakamatest.NewModule()
+	logger := nakamatest.NewLogger(t)
+	ctx := context.Background()
+	serviceContext := &services.ServiceContext{Ctx: ctx, Logger: logger, NakamaModule: nk}
+	playerUserId, _, _, _ := nk.AuthenticateCustom(ctx, "123456789012345678", "player", true)
+	bannedUntil := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	importAccount := func(fields map[string]interface{}) *LegacyImportReport {
+		document := map[string]interface{}{}
+		json.Unmarshal(legacyAccountDocument(t, func(*game.GameProfiles) {}), &document)
+		for field, value := range fields {
+			document[field] = value
+		}
+		data, _ := json.Marshal(document)
+		report, apiErr := ImportLegacyAccounts(serviceContext, []json.RawMessage{data}, false, "admin")
+		if apiErr != nil {
+			t.Fatalf("ImportLegacyAccounts() error: %v", apiErr)
+		}
+		return report
+	}
+
+	// A ban that cannot be read is not imported
+	if report := importAccount(map[string]interface{}{"banned_until": "soon"}); report.Skipped != 1 {
+		t.Errorf("ImportLegacyAccounts() = %+v, want the account skipped", report)
+	}
+
+	// A locked account is not claimed without its password
+	importAccount(map[string]interface{}{"account_lock_hash": "hash", "account_lock_salt": "salt", "banned_until": bannedUntil.Format(time.RFC3339)})
+	if err := ClaimLegacyAccount(ctx, logger, nk, "OVR_ORG-1234", playerUserId); !errors.Is(err, ErrLegacyAccountLocked) {
+		t.Fatalf("ClaimLegacyAccount() error = %v, want %v", err, ErrLegacyAccountLocked)
+	}
+	if objects, _ := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: GameProfileStorageCollection, Key: ClientGameProfileStorageKey, UserID: playerUserId}}); len(objects) != 0 {
+		t.Errorf("StorageRead() = %v, want no profiles copied", objects)
+	}
+
+	// Once imported without the lock, it is claimed, and the ban comes with it
+	importAccount(map[string]interface{}{"banned_until": bannedUntil.Format("2006-01-02T15:04:05.9999999")})
+	if err := ClaimLegacyAccount(ctx, logger, nk, "OVR_ORG-1234", playerUserId); err != nil {
+		t.Fatalf("ClaimLegacyAccount() error: %v", err)
+	}
+	account, err := nk.AccountGetId(ctx, playerUserId)
+	if err != nil {
+		t.Fatalf("AccountGetId() error: %v", err)
+	}
+	if got := BannedUntil(account); !got.Equal(bannedUntil) {
+		t.Errorf("BannedUntil() = %v, want %v", got, bannedUntil)
+	}
+}
+
+func TestLegacyDeviceHooks(t *testing.T) {
+	ctx := context.Background()
+	logger := nakamatest.NewLogger(t)
+
+	if _, err := BeforeAuthenticateDevice(ctx, logger, nil, nil, &api.AuthenticateDeviceRequest{Account: &api.AccountDevice{Id: LegacyDeviceIdPrefix + "OVR-ORG-1234"}}); err == nil {
+		t.Error("BeforeAuthenticateDevice() = nil, want a legacy device ID refused")
+	}
+	if _, err := BeforeLinkDevice(ctx, logger, nil, nil, &api.AccountDevice{Id: LegacyDeviceIdPrefix + "OVR-ORG-1234"}); err == nil {
+		t.Error("BeforeLinkDevice() = nil, want a legacy device ID refused")
+	}
+
+	device := &api.AccountDevice{Id: "1369078409873402:OVR-ORG-1234:HMD-1"}
+	if in, err := BeforeAuthenticateDevice(ctx, logger, nil, nil, &api.AuthenticateDeviceRequest{Account: device}); err != nil || in == nil {
+		t.Errorf("BeforeAuthenticateDevice() = %v, %v, want a game device ID allowed", in, err)
+	}
+	if in, err := BeforeLinkDevice(ctx, logger, nil, nil, device); err != nil || in != device {
+		t.Errorf("BeforeLinkDevice() = %v, %v, want a game device ID allowed", in, err)
+	}
+}
@@ -2,6 +2,7 @@ package login
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
 	"regexp"
@@ -9,61 +10,62 @@ import (
 
 	"echonakama/game"
 	"echonakama/server/services"
-
+	"echonakama/server/services/apierror"
+	"echonakama/server/services/channel"
+	"echonakama/server/services/discord"
+	"echonakama/server/services/metrics"
+	"echonakama/server/services/migration"
+	"echonakama/server/services/relayconfig"
+
+	"github.com/bwmarrin/discordgo"
 	"github.com/google/uuid"
 	"github.com/heroiclabs/nakama-common/api"
 	"github.com/heroiclabs/nakama-common/runtime"
 )
 
 const (
-	SystemUserId = "00000000-0000-0000-0000-000000000000"
-
 	PasswordURLParam          = "password"
 	HMDSerialOverrideURLParam = "hmdserial"
 
-	LinkTicketCollection                = "Login:linkTicket"
-	LinkTicketIndex                     = "Index_" + LinkTicketCollection
-	DiscordAccessTokenCollection        = "Login:discordAccessToken"
-	DiscordAccessTokenKey               = "accessToken"
-	GameClientSettingsStorageCollection = "Login:gameSettings"
-	GameClientSettingsStorageKey        = "gameSettings"
-	GameProfileStorageCollection        = "Profile"
-	ServerGameProfileStorageKey         = "server"
-	ClientGameProfileStorageKey         = "client"
-	XPlatformIdStorageCollection        = "XPlatformId"
-	IpAddressIndex                      = "Index_" + XPlatformIdStorageCollection
+	LinkTicketCollection               = "Login:linkTicket"
+	LinkTicketIndex                    = "Index_" + LinkTicketCollection
+	DiscordAccessTokenCollection       = "Login:discordAccessToken"
+	DiscordAccessTokenKey              = "accessToken"
+	GameProfileStorageCollection       = "Profile"
+	ServerGameProfileStorageKey        = "server"
+	ClientGameProfileStorageKey        = "client"
+	LoadoutCorrectionStorageCollection = "Profile:loadoutCorrections"
+	XPlatformIdStorageCollection       = "XPlatformId"
+	IpAddressIndex                     = "Index_" + XPlatformIdStorageCollection
+
+	// How often a login writes the profiles, when they change while it does
+	loginWriteAttempts = 3
 
 	// The Application ID for Echo VR
 	NoOvrAppId = 0
 	QuestAppId = 2215004568539258
 	PcvrAppId  = 1369078409873402
-
-	// Websocket Error Codes
-	StatusOK                 = 0  // StatusOK indicates a successful operation.
-	StatusCanceled           = 1  // StatusCanceled indicates the operation was canceled.
-	StatusUnknown            = 2  // StatusUnknown indicates an unknown error occurred.
-	StatusInvalidArgument    = 3  // StatusInvalidArgument indicates an invalid argument was provided.
-	StatusDeadlineExceeded   = 4  // StatusDeadlineExceeded indicates the operation exceeded the deadline.
-	StatusNotFound           = 5  // StatusNotFound indicates the requested resource was not found.
-	StatusAlreadyExists      = 6  // StatusAlreadyExists indicates the resource already exists.
-	StatusPermissionDenied   = 7  // StatusPermissionDenied indicates the operation was denied due to insufficient permissions.
-	StatusResourceExhausted  = 8  // StatusResourceExhausted indicates the resource has been exhausted.
-	StatusFailedPrecondition = 9  // StatusFailedPrecondition indicates a precondition for the operation was not met.
-	StatusAborted            = 10 // StatusAborted indicates the operation was aborted.
-	StatusOutOfRange         = 11 // StatusOutOfRange indicates a value is out of range.
-	StatusUnimplemented      = 12 // StatusUnimplemented indicates the operation is not implemented.
-	StatusInternalError      = 13 // StatusInternal indicates an internal server error occurred.
-	StatusUnavailable        = 14 // StatusUnavailable indicates the service is currently unavailable.
-	StatusDataLoss           = 15 // StatusDataLoss indicates a loss of data occurred.
-	StatusUnauthenticated    = 16 // StatusUnauthenticated indicates the request lacks valid authentication credentials.
 )
 
 // ProcessLoginRequest processes a login request and returns the login success response or an error.
-// It returns a string representing the login success response and a *runtime.Error object if there is an error.
-func ProcessLoginRequest(serviceContext *services.ServiceContext, request *LoginRequest) (*LoginSuccessResponse, *runtime.Error) {
+// It returns a string representing the login success response and an *apierror.Error if there is an error.
+// The attempt is recorded in the login metrics, by its outcome.
+func ProcessLoginRequest(serviceContext *services.ServiceContext, request *LoginRequest) (*LoginSuccessResponse, *apierror.Error) {
+	start := time.Now()
+	response, apiErr := processLoginRequest(serviceContext, request)
+
+	outcome := metrics.OutcomeSuccess
+	if apiErr != nil {
+		outcome = string(apiErr.Reason)
+	}
+	tags := metrics.Tags(metrics.RelayId(serviceContext.Ctx), request.EchoUserId.PlatformCode.String())
+	metrics.RecordLogin(serviceContext.NakamaModule, tags, outcome, time.Since(start))
+	return response, apiErr
+}
+
+func processLoginRequest(serviceContext *services.ServiceContext, request *LoginRequest) (*LoginSuccessResponse, *apierror.Error) {
 	ctx := serviceContext.Ctx
 	logger := serviceContext.Logger
-	nk := serviceContext.NakamaModule
 
 	// immediately strip the password out of the requests to avoid
 	// displaying it in the logs
@@ -76,24 +78,55 @@ func ProcessLoginRequest(serviceContext *services.ServiceContext, request *Login
 	}
 	relayNkUserID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
 	if !ok {
-		return nil, runtime.NewError("relay must authenticate", StatusUnauthenticated)
+		return nil, apierror.New(apierror.StatusUnauthenticated, apierror.ReasonUnauthenticated, "relay must authenticate")
 	}
 
 	relayUserName, ok := ctx.Value(runtime.RUNTIME_CTX_USERNAME).(string)
 	if !ok {
-		return nil, runtime.NewError("relay must authenticate", StatusUnauthenticated)
+		return nil, apierror.New(apierror.StatusUnauthenticated, apierror.ReasonUnauthenticated, "relay must authenticate")
 	}
 
 	logger.WithField("relayUserName", relayUserName).Debug("Processing login request for user %s on relay %s", request.EchoUserId, relayNkUserID)
 
-	account, nkerr := authenticateAccountDevice(serviceContext, request, authPassword)
-	if nkerr != nil {
-		logger.WithField("nkerr", nkerr).Error("authentication errored.")
-		return nil, nkerr
+	// A relay retrying a login is sent the response of the first attempt, keyed by the client's session GUID
+	if request.SessionGuid == uuid.Nil {
+		return authorizeLogin(serviceContext, request, authPassword, relayNkUserID)
+	}
+	replay, owned, apiErr := loginReplays.begin(request.SessionGuid, loginFingerprint(relayNkUserID, request, authPassword))
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	if !owned {
+		logger.WithField("sessionGuid", request.SessionGuid).Debug("Replaying login for user %s", request.EchoUserId)
+		return replay.wait(ctx)
+	}
+	response, apiErr := authorizeLogin(serviceContext, request, authPassword, relayNkUserID)
+	loginReplays.finish(request.SessionGuid, replay, response, apiErr)
+	return response, apiErr
+}
+
+// authorizeLogin authenticates the login, and starts a session with the player's profiles.
+func authorizeLogin(serviceContext *services.ServiceContext, request *LoginRequest, authPassword string, relayNkUserID string) (*LoginSuccessResponse, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	logger := serviceContext.Logger
+	nk := serviceContext.NakamaModule
+
+	// Refuse logins barred by the access control list, before a link ticket or session is issued
+	if apiErr := relayconfig.CheckAccess(serviceContext, relayconfig.AccessRequest{
+		ClientIp:     request.ClientIpAddress,
+		EchoUserId:   request.EchoUserId,
+		AppId:        request.Metadata.AppId,
+		BuildVersion: request.Metadata.BuildVersion,
+	}); apiErr != nil {
+		return nil, apiErr
+	}
+
+	account, guildMember, apiErr := authenticateAccountDevice(serviceContext, request, authPassword)
+	if apiErr != nil {
+		return nil, apiErr
 	}
 
 	// Authorize the client to use the authenticated account
-	playerNkUserID := account.User.Id
 	currentTimestamp := time.Now().UTC().Unix()
 	sessionGuid := uuid.New()
 
@@ -101,9 +134,52 @@ func ProcessLoginRequest(serviceContext *services.ServiceContext, request *Login
 	token, _, err := nk.AuthenticateTokenGenerate(account.User.Id, account.User.Username, 0, map[string]string{"sessionGuid": sessionGuid.String()})
 	if err != nil {
 		logger.WithField("err", err).Error("authenticate token generate error.")
-		return nil, runtime.NewError("authenticate token generation error.", StatusInternalError)
+		return nil, apierror.Internal("unable to start a session", err)
+	}
+
+	// Write the profiles, starting over with the stored profiles if they change during the login
+	var gameProfiles *game.GameProfiles
+	var profileVersion string
+	for attempt := 1; ; attempt++ {
+		gameProfiles, profileVersion, apiErr = saveLoginProfiles(serviceContext, request, account, guildMember, relayNkUserID, currentTimestamp)
+		if apiErr == nil || apiErr.Reason != apierror.ReasonConflict || attempt == loginWriteAttempts {
+			break
+		}
+		logger.WithField("attempt", attempt).Debug("Profile changed during the login of %s, retrying", request.EchoUserId)
+	}
+	if apiErr != nil {
+		return nil, apiErr
 	}
 
+	// Resolve the relay's client settings (the global settings, overlaid by the relay's overrides)
+	loginSettings, err := relayconfig.ResolveClientSettings(ctx, nk, relayNkUserID)
+	if err != nil {
+		logger.WithField("err", err).Warn("error resolving client settings, using the defaults.")
+	}
+
+	loginSuccess := LoginSuccessResponse{
+		EchoUserId:         request.EchoUserId,
+		DeviceAuthToken:    request.DeviceId().Token(),
+		EchoSessionToken:   sessionGuid.String(),
+		NkSessionToken:     token,
+		EchoClientSettings: loginSettings,
+		GameProfiles:       *gameProfiles,
+		ProfileVersion:     profileVersion,
+	}
+
+	logger.Debug("Logged %s in successfully.", gameProfiles.Server.DisplayName)
+	return &loginSuccess, nil
+}
+
+// saveLoginProfiles reads the player's profiles, updates them for the login, and writes them back with their
+// history. The writes are conditional on the versions read, so a concurrent profile update, rollback or history
+// write fails them with a conflict instead of being overwritten. It returns the profiles and the client profile's version.
+func saveLoginProfiles(serviceContext *services.ServiceContext, request *LoginRequest, account *api.Account, guildMember *discordgo.Member, relayNkUserID string, currentTimestamp int64) (*game.GameProfiles, string, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	logger := serviceContext.Logger
+	nk := serviceContext.NakamaModule
+	playerNkUserID := account.User.Id
+
 	// generate a blank playerData object
 	gameProfiles := game.DefaultGameProfiles(request.EchoUserId, request.Metadata.DisplayName)
 
@@ -117,10 +193,6 @@ func ProcessLoginRequest(serviceContext *services.ServiceContext, request *Login
 		Collection: GameProfileStorageCollection,
 		Key:        ServerGameProfileStorageKey,
 		UserID:     playerNkUserID,
-	}, {
-		Collection: GameClientSettingsStorageCollection,
-		Key:        GameClientSettingsStorageKey,
-		UserID:     relayNkUserID,
 	}, /* {
 		Collection: "Login:linking_settings",
 		Key:        "linking_settings",
@@ -128,29 +200,28 @@ func ProcessLoginRequest(serviceContext *services.ServiceContext, request *Login
 	}, */
 	}
 
-	var loginSettings game.EchoClientSettings
-
+	// The profiles are written back only if they are unchanged since they were read ("*" if they did not exist)
+	clientVersion, serverVersion := "*", "*"
 	records, err := nk.StorageRead(ctx, objectIds)
 	if err != nil {
-		logger.WithField("err", err).Error("storage read error.")
-	} else {
-		for _, record := range records {
-			if record.Key == ClientGameProfileStorageKey {
-				err = json.Unmarshal([]byte(record.Value), &gameProfiles.Client)
-				if err != nil {
-					return nil, runtime.NewError(fmt.Sprintf("error unmarshaling client playerData: %v", err), StatusInternalError)
-				}
-			} else if record.Key == ServerGameProfileStorageKey {
-				err = json.Unmarshal([]byte(record.Value), &gameProfiles.Server)
-				if err != nil {
-					return nil, runtime.NewError(fmt.Sprintf("error unmarshaling server playerData: %v", err), StatusInternalError)
-				}
-			} else if record.Key == GameClientSettingsStorageKey {
-				err = json.Unmarshal([]byte(record.Value), &loginSettings)
-				if err != nil {
-					return nil, runtime.NewError(fmt.Sprintf("error unmarshaling server playerData: %v", err), StatusInternalError)
-				}
+		return nil, "", apierror.Internal("unable to load your profile", fmt.Errorf("error reading playerData: %w", err))
+	}
+	for _, record := range records {
+		if err := migration.ApplyObject(record); err != nil {
+			return nil, "", apierror.Internal("unable to load your profile", fmt.Errorf("error migrating %s playerData: %w", record.Key, err))
+		}
+		if record.Key == ClientGameProfileStorageKey {
+			err = json.Unmarshal([]byte(record.Value), &gameProfiles.Client)
+			if err != nil {
+				return nil, "", apierror.Internal("unable to load your profile", fmt.Errorf("error unmarshaling client playerData: %w", err))
+			}
+			clientVersion = record.Version
+		} else if record.Key == ServerGameProfileStorageKey {
+			err = json.Unmarshal([]byte(record.Value), &gameProfiles.Server)
+			if err != nil {
+				return nil, "", apierror.Internal("unable to load your profile", fmt.Errorf("error unmarshaling server playerData: %w", err))
 			}
+			serverVersion = record.Version
 		}
 	}
 
@@ -162,19 +233,45 @@ func ProcessLoginRequest(serviceContext *services.ServiceContext, request *Login
 	gameProfiles.Server.DisplayName = account.User.DisplayName
 	gameProfiles.Client.DisplayName = account.User.DisplayName
 
+	// Assign the player to a social channel by the one they chose in the game, or their Discord roles
+	socialChannel, err := channel.AssignChannel(serviceContext, playerNkUserID, guildMember.Roles)
+	if err != nil {
+		logger.WithField("err", err).Warn("error assigning social channel.")
+	} else if socialChannel != nil {
+		gameProfiles.Client.Social.Group = socialChannel.ChannelUuid
+	}
+
+	// Ask the player to accept the legal documents again if they have changed since they were accepted
+	resetOutdatedConsents(serviceContext, &gameProfiles.Client)
+
+	// Replace any equipped cosmetics the player does not own before serving the profile.
+	correctionObject, err := correctLoadout(serviceContext, &gameProfiles.Server, playerNkUserID, relayNkUserID, currentTimestamp)
+	if err != nil {
+		return nil, "", apierror.Internal("unable to load your profile", err)
+	}
+
+	// Validate the profiles before they are written to storage. A stored profile that predates a rule, or was
+	// corrupted, has its invalid fields reset to the defaults, so the player is not locked out
+	invalidFields, err := gameProfiles.Repair(game.DefaultGameProfiles(request.EchoUserId, account.User.DisplayName))
+	if err != nil {
+		return nil, "", apierror.Internal("unable to load your profile", fmt.Errorf("invalid game profile: %w", err))
+	}
+	if len(invalidFields) > 0 {
+		logger.WithField("fields", invalidFields).Warn("Reset invalid profile fields for %s", request.EchoUserId.String())
+	}
+
 	// Write the profile data to storage
 	jsonRequest, err := json.Marshal(request)
 	if err != nil {
-		logger.WithField("err", err).Error("invalid account info.")
-		return nil, runtime.NewError(fmt.Sprintf("error marshaling accountInfo: %v", err), StatusInternalError)
+		return nil, "", apierror.Internal("unable to save your profile", fmt.Errorf("error marshaling accountInfo: %w", err))
 	}
 	clientProfileJson, err := json.Marshal(gameProfiles.Client)
 	if err != nil {
-		return nil, runtime.NewError(fmt.Sprintf("error marshaling client profile playerData: %v", err), StatusInternalError)
+		return nil, "", apierror.Internal("unable to save your profile", fmt.Errorf("error marshaling client profile playerData: %w", err))
 	}
 	serverProfileJson, err := json.Marshal(gameProfiles.Server)
 	if err != nil {
-		return nil, runtime.NewError(fmt.Sprintf("error marshaling server profile playerData: %v", err), StatusInternalError)
+		return nil, "", apierror.Internal("unable to save your profile", fmt.Errorf("error marshaling server profile playerData: %w", err))
 	}
 
 	// Write the latest profile data to storage
@@ -187,62 +284,41 @@ func ProcessLoginRequest(serviceContext *services.ServiceContext, request *Login
 			PermissionRead:  0,
 			PermissionWrite: 0,
 		},
-		{
-			Collection:      GameProfileStorageCollection,
-			Key:             ClientGameProfileStorageKey,
-			UserID:          playerNkUserID,
-			Value:           string(clientProfileJson),
-			PermissionRead:  1,
-			PermissionWrite: 0,
-		},
-		{
-			Collection:      GameProfileStorageCollection,
-			Key:             ServerGameProfileStorageKey,
-			UserID:          playerNkUserID,
-			Value:           string(serverProfileJson),
-			PermissionRead:  2,
-			PermissionWrite: 0,
-		}}
-
-	// Get the login settings from storage
-	// TODO: extract method
-	var loginSettingsJson []byte
-
-	// if loginSettings is empty, create a default loginSettings object, and write it storage
-	// TODO move this to a hook when a relay is authenticated
-	if loginSettings.Env == "" {
-		loginSettings = game.DefaultEchoClientSettings()
-		loginSettingsJson, err = json.Marshal(loginSettings)
-		if err != nil {
-			return nil, runtime.NewError(fmt.Sprintf("error marshalling LoginSettings: %v", err), StatusInternalError)
-		}
-
-		objectIDs = append(objectIDs, &runtime.StorageWrite{
-			Collection:      GameClientSettingsStorageCollection,
-			Key:             GameClientSettingsStorageKey,
-			UserID:          relayNkUserID,
-			Value:           string(loginSettingsJson),
-			PermissionRead:  2,
-			PermissionWrite: 0,
-		})
+		gameProfileStorageObject(playerNkUserID, ClientGameProfileStorageKey, string(clientProfileJson), clientVersion),
+		gameProfileStorageObject(playerNkUserID, ServerGameProfileStorageKey, string(serverProfileJson), serverVersion),
 	}
-	_, err = nk.StorageWrite(ctx, objectIDs)
+
+	// Record the written profiles in the profile history
+	historyWrites, err := ProfileHistoryWrites(ctx, nk, ProfileWriterLogin, relayNkUserID, currentTimestamp, objectIDs)
 	if err != nil {
-		logger.WithField("err", err).Error("storage write error.")
-		return nil, runtime.NewError(fmt.Sprintf("error writing profile data: %v", err), StatusInternalError)
+		return nil, "", apierror.Internal("unable to save your profile", fmt.Errorf("error preparing profile history: %w", err))
 	}
+	objectIDs = append(objectIDs, historyWrites...)
 
-	loginSuccess := LoginSuccessResponse{
-		EchoUserId:         request.EchoUserId,
-		DeviceAuthToken:    request.DeviceId().Token(),
-		EchoSessionToken:   sessionGuid.String(),
-		NkSessionToken:     token,
-		EchoClientSettings: loginSettings,
-		GameProfiles:       gameProfiles,
+	if correctionObject != nil {
+		objectIDs = append(objectIDs, correctionObject)
 	}
 
-	logger.Debug("Logged %s in successfully.", gameProfiles.Server.DisplayName)
-	return &loginSuccess, nil
+	acks, err := nk.StorageWrite(ctx, objectIDs)
+	if errors.Is(err, runtime.ErrStorageRejectedVersion) {
+		// A profile update or rollback was written since the profiles were read
+		return nil, "", apierror.New(apierror.StatusAborted, apierror.ReasonConflict, "your profile was changed while logging in, try again").Wrap(err)
+	} else if err != nil {
+		return nil, "", apierror.Internal("unable to save your profile", fmt.Errorf("error writing profile data: %w", err))
+	}
+
+	tags := metrics.Tags(metrics.RelayId(ctx), request.EchoUserId.PlatformCode.String())
+	nk.MetricsGaugeSet(metrics.ProfileSize, metrics.With(tags, "profile", ClientGameProfileStorageKey), float64(len(clientProfileJson)))
+	nk.MetricsGaugeSet(metrics.ProfileSize, metrics.With(tags, "profile", ServerGameProfileStorageKey), float64(len(serverProfileJson)))
+
+	// The relay uses the client profile version to make conditional profile updates
+	clientProfileVersion := ""
+	for _, ack := range acks {
+		if ack.Collection == GameProfileStorageCollection && ack.Key == ClientGameProfileStorageKey {
+			clientProfileVersion = ack.Version
+		}
+	}
+	return &gameProfiles, clientProfileVersion, nil
 }
 
 // GenerateLinkCode generates a 4 character random link code.
@@ -272,23 +348,21 @@ func GenerateLinkCode() string {
 }
 
 // authenticateClient is a function that authenticates a client using the provided service context and login request.
-// It returns the Nakama user ID, username, and any error that occurred during authentication.
-func authenticateAccountDevice(serviceContext *services.ServiceContext, loginRequest *LoginRequest, authPassword string) (*api.Account, *runtime.Error) {
+// It returns the Nakama account, the player's Discord guild member, and any error that occurred during authentication.
+func authenticateAccountDevice(serviceContext *services.ServiceContext, loginRequest *LoginRequest, authPassword string) (*api.Account, *discordgo.Member, *apierror.Error) {
 	ctx := serviceContext.Ctx
 	nk := serviceContext.NakamaModule
 	logger := serviceContext.Logger
-	discordBot := serviceContext.DiscordBot
-	// Get the linking page url from the environment
-	vars, _ := ctx.Value(runtime.RUNTIME_CTX_ENV).(map[string]string)
-	linkingPageUrl := vars["LINK_PAGE_URL"]
-	placeholderEmailDomain := vars["PLACEHOLDER_EMAIL_DOMAIN"]
+	discordClient := serviceContext.Discord
+	linkingPageUrl := serviceContext.Config.LinkPageUrl
+	placeholderEmailDomain := serviceContext.Config.PlaceholderEmailDomain
 	var nkUserId string
 	var err error
 	UserIdToken := loginRequest.EchoUserId.String()
 
 	// Validate the user identifier
 	if !loginRequest.EchoUserId.Valid() {
-		return nil, runtime.NewError(fmt.Sprintf("invalid Game User ID: %q", UserIdToken), StatusInvalidArgument)
+		return nil, nil, apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, fmt.Sprintf("invalid Game User ID: %q", UserIdToken))
 	}
 
 	// Check if the account is linked
@@ -301,84 +375,91 @@ func authenticateAccountDevice(serviceContext *services.ServiceContext, loginReq
 	// If the account is not linked, create a link ticket and return an error
 	if nkUserId == "" {
 		// No Account. Create link ticket and return error
-		linkTicket, err := loginRequest.LinkTicket(serviceContext, SystemUserId)
+		linkTicket, err := loginRequest.LinkTicket(serviceContext, services.SystemUserId)
 		if err != nil {
-			logger.WithField("err", err).Error("unable to generate link ticket.")
-			return nil, runtime.NewError(fmt.Sprintf("unable to generate link ticket: %q", UserIdToken), StatusPermissionDenied)
+			return nil, nil, apierror.Internal(fmt.Sprintf("unable to generate link ticket: %q", UserIdToken), err)
 		}
 
 		logger.WithField("linkTicket", linkTicket).Debug("Link ticket found/generated.")
 		// Return the link ticket to the client
-		return nil, runtime.NewError(fmt.Sprintf("visit %s and enter code: %s", linkingPageUrl, linkTicket.Code), StatusInvalidArgument)
+		return nil, nil, apierror.New(apierror.StatusInvalidArgument, apierror.ReasonLinkRequired, fmt.Sprintf("visit %s and enter code: %s", linkingPageUrl, linkTicket.Code)).
+			WithDetail("link_code", linkTicket.Code).
+			WithDetail("link_url", linkingPageUrl)
 
 	}
 
 	// Authorize the authenticated account
 	account, err := nk.AccountGetId(ctx, nkUserId)
 	if err != nil {
-		return nil, runtime.NewError(fmt.Sprintf("unable to get account for Id: %q", UserIdToken), StatusInternalError)
+		return nil, nil, apierror.Internal(fmt.Sprintf("unable to get account for Id: %q", UserIdToken), err)
 	}
 
 	// Check if the account is disabled/banned
 	if account.GetDisableTime() != nil {
-		return nil, runtime.NewError(fmt.Sprintf("account Permanently Banned: %q", UserIdToken), StatusPermissionDenied)
+		return nil, nil, apierror.New(apierror.StatusPermissionDenied, apierror.ReasonAccountBanned, fmt.Sprintf("account Permanently Banned: %q", UserIdToken))
+	}
+	if bannedUntil := BannedUntil(account); bannedUntil.After(time.Now()) {
+		return nil, nil, apierror.New(apierror.StatusPermissionDenied, apierror.ReasonAccountBanned, fmt.Sprintf("account banned until %s: %q", bannedUntil.UTC().Format(time.RFC3339), UserIdToken))
 	}
 
 	// Authenticate if the accounts has a password set (i.e. an email is set)
 	if account.Email != "" {
 		_, _, _, err = nk.AuthenticateEmail(ctx, account.Email, authPassword, "", false)
 		if err != nil {
-			return nil, runtime.NewError(fmt.Sprintf("invalid password for account: %q", UserIdToken), StatusUnauthenticated)
+			return nil, nil, apierror.New(apierror.StatusUnauthenticated, apierror.ReasonInvalidPassword, fmt.Sprintf("invalid password for account: %q", UserIdToken)).Wrap(err)
 		}
 
 	} else if authPassword != "" {
 		// if the login contains a password, but there is no password set. set the password.
 		err = nk.LinkEmail(ctx, nkUserId, account.User.Id+"@"+placeholderEmailDomain, authPassword)
 		if err != nil {
-			return nil, runtime.NewError(fmt.Sprintf("unable to set password for account: %q", UserIdToken), StatusInternalError)
+			return nil, nil, apierror.Internal(fmt.Sprintf("unable to set password for account: %q", UserIdToken), err)
 		}
 	}
 
 	if account.CustomId == "" {
 		// if the account does not have a customId, the account needs to be linked to discord.
 		// return nothing, and let the client know that they need to link their account
-		return nil, runtime.NewError(fmt.Sprintf("Re-link %s at %s", UserIdToken, linkingPageUrl), StatusInternalError)
+		return nil, nil, apierror.New(apierror.StatusFailedPrecondition, apierror.ReasonRelinkRequired, fmt.Sprintf("Re-link %s at %s", UserIdToken, linkingPageUrl)).
+			WithDetail("link_url", linkingPageUrl)
 	}
 
 	/*
 		// The tokens expire too quickly to use this method
 		// get the discord access token from storage
-		accessToken, err := ReadAccessTokenFromStorage(ctx, logger, nk, account.User.Id, vars["DISCORD_CLIENT_ID"], vars["DISCORD_CLIENT_SECRET"])
+		accessToken, err := ReadAccessTokenFromStorage(ctx, logger, nk, account.User.Id, serviceContext.Config.DiscordClientId, serviceContext.Config.DiscordClientSecret)
 		if err != nil {
 			logger.Warn("error reading discord access token from storage: %v", err)
-			return nil, runtime.NewError("error reading discord access token from storage", StatusInternalError)
+			return nil, nil, apierror.Internal("error reading discord access token from storage", err)
 		}
 		if accessToken == nil {
-			return nil, runtime.NewError(fmt.Sprintf("Re-link Discord at %s", linkingPageUrl), StatusUnauthenticated)
+			return nil, nil, apierror.New(apierror.StatusUnauthenticated, apierror.ReasonRelinkRequired, fmt.Sprintf("Re-link Discord at %s", linkingPageUrl))
 		}
 
 		// Refresh the access token
-		if err := accessToken.Refresh(vars["DISCORD_CLIENT_ID"], vars["DISCORD_CLIENT_SECRET"]); err != nil {
+		accessToken, err = discordClient.RefreshToken(ctx, accessToken)
+		if err != nil {
 			logger.Warn("error refreshing DiscordAccessToken: %v", err)
 			nk.UnlinkCustom(ctx, account.User.Id, account.CustomId)
-			return nil, runtime.NewError("error refreshing DiscordAccessToken", StatusUnauthenticated)
+			return nil, nil, apierror.New(apierror.StatusUnauthenticated, apierror.ReasonRelinkRequired, "error refreshing DiscordAccessToken").Wrap(err)
 		}
 
 		// Write the refreshed token to storage
 		if err := WriteAccessTokenToStorage(ctx, logger, nk, account.User.Id, accessToken); err != nil {
 			logger.Warn("error writing DiscordAccessToken to storage: %v", err)
-			return nil, runtime.NewError("error writing DiscordAccessToken to storage", StatusInternalError)
+			return nil, nil, apierror.Internal("error writing DiscordAccessToken to storage", err)
 		}
 	*/
 
 	// Use the discordbot to get the guild members ID
 	// Get the Discord guildMember
 
-	botGuildId := vars["DISCORD_BOT_GUILD"]
-	guildMember, err := discordBot.GuildMember(botGuildId, account.User.Username)
-	if err != nil {
-		logger.Warn("error getting guild member: %v", err)
-		return nil, runtime.NewError("error getting guild member", StatusInternalError)
+	guildMember, err := discordClient.GuildMember(serviceContext.Config.DiscordBotGuild, account.User.Username)
+	if errors.Is(err, discord.ErrNotFound) {
+		return nil, nil, apierror.New(apierror.StatusPermissionDenied, apierror.ReasonNotGuildMember, "join the Discord server to play").Wrap(err)
+	} else if err != nil {
+		// Without the bot or the Discord API, membership cannot be checked, and the player is never let in unchecked
+		return nil, nil, apierror.New(apierror.StatusUnavailable, apierror.ReasonDiscordUnavailable, "Discord is unavailable, try again in a few minutes").Wrap(err)
 	}
 
 	// if the nakama custom id isn't composed of only numbers, then update the customId to be the discord ID
@@ -419,8 +500,11 @@ func authenticateAccountDevice(serviceContext *services.ServiceContext, loginReq
 	// Update the Nakama user
 	if err := nk.AccountUpdateId(ctx, account.User.Id, "", nil, displayName, "", "", "", guildMember.AvatarURL("")); err != nil {
 		logger.Warn("error updating nakama user: %v", err)
-		return nil, runtime.NewError(fmt.Sprintf("%v", err), StatusInternalError)
+		return nil, nil, apierror.Internal("unable to update your account", err)
 	}
+	// Reflect the update in the returned account, so the profiles get the current display name
+	account.User.DisplayName = displayName
+	account.User.AvatarUrl = guildMember.AvatarURL("")
 
-	return account, nil
+	return account, guildMember, nil
 }
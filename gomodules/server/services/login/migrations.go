@@ -0,0 +1,15 @@
+package login
+
+import (
+	"echonakama/server/services/migration"
+)
+
+// Migrations transform the stored Profile, XPlatformId and Login:* objects, oldest first.
+// When the stored shape of one of those objects changes, append a migration that converts the old shape;
+// never change or remove a migration once it has shipped, as its progress is recorded under its ID.
+var Migrations = []*migration.Migration{}
+
+// RegisterMigrations registers the login service's migrations with the module's registry.
+func RegisterMigrations() error {
+	return migration.Register(Migrations...)
+}
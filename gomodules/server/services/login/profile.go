@@ -0,0 +1,227 @@
+package login
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"echonakama/game"
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+	"echonakama/server/services/channel"
+	"echonakama/server/services/migration"
+	"echonakama/server/services/relayconfig"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// This is sent by the relay to persist changes a game client made to its profile
+type ProfileUpdateRequest struct {
+	DeviceAuthToken string          `json:"nk_device_auth_token"` // the device auth token returned in the login success response
+	EchoUserId      game.EchoUserId `json:"echo_user_id"`         // the game user id of the profile
+	Version         string          `json:"version"`              // the storage version the update is based on (empty to use the latest)
+	ClientProfile   json.RawMessage `json:"client_profile"`       // the changed fields of the client profile
+}
+
+// The data sent to the relay when a profile update is written.
+type ProfileUpdateResponse struct {
+	Version       string                     `json:"version"`        // the storage version of the written profile
+	ClientProfile game.EchoPlayerPreferences `json:"client_profile"` // the merged client profile
+}
+
+// ProcessProfileUpdate merges a partial client profile into the stored profile and writes it back.
+// The write is conditional on the stored version, so concurrent or stale updates are rejected.
+func ProcessProfileUpdate(serviceContext *services.ServiceContext, request *ProfileUpdateRequest) (*ProfileUpdateResponse, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	logger := serviceContext.Logger
+	nk := serviceContext.NakamaModule
+
+	relayNkUserID, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	if !ok {
+		return nil, apierror.New(apierror.StatusUnauthenticated, apierror.ReasonUnauthenticated, "relay must authenticate")
+	}
+
+	userIdToken := request.EchoUserId.String()
+	if !request.EchoUserId.Valid() {
+		return nil, apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, fmt.Sprintf("invalid Game User ID: %q", userIdToken))
+	}
+
+	// The device auth token is "appid:xplatformid:hmdserial"; it must belong to the profile being updated.
+	if parts := strings.SplitN(request.DeviceAuthToken, ":", 3); len(parts) != 3 || parts[1] != userIdToken {
+		return nil, apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, fmt.Sprintf("device auth token does not match %q", userIdToken))
+	}
+	if len(request.ClientProfile) == 0 {
+		return nil, apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, "client profile is empty")
+	}
+
+	// Find the player's account without creating one
+	playerNkUserID, _, _, err := nk.AuthenticateDevice(ctx, request.DeviceAuthToken, "", false)
+	if err != nil {
+		return nil, apierror.New(apierror.StatusNotFound, apierror.ReasonNotFound, fmt.Sprintf("device not linked: %q", userIdToken))
+	}
+	account, err := nk.AccountGetId(ctx, playerNkUserID)
+	if err != nil {
+		return nil, apierror.New(apierror.StatusInternalError, apierror.ReasonInternal, fmt.Sprintf("unable to get account for Id: %q", userIdToken))
+	}
+
+	// Read the current profiles and their versions
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+		Collection: GameProfileStorageCollection,
+		Key:        ClientGameProfileStorageKey,
+		UserID:     playerNkUserID,
+	}, {
+		Collection: GameProfileStorageCollection,
+		Key:        ServerGameProfileStorageKey,
+		UserID:     playerNkUserID,
+	}})
+	if err != nil {
+		return nil, apierror.Internal("error reading client profile", err)
+	}
+	var object, serverObject *api.StorageObject
+	for _, o := range objects {
+		switch o.Key {
+		case ClientGameProfileStorageKey:
+			object = o
+		case ServerGameProfileStorageKey:
+			serverObject = o
+		}
+	}
+	if object == nil {
+		return nil, apierror.New(apierror.StatusNotFound, apierror.ReasonNotFound, fmt.Sprintf("client profile not found: %q", userIdToken))
+	}
+	if request.Version != "" && request.Version != object.Version {
+		return nil, apierror.New(apierror.StatusFailedPrecondition, apierror.ReasonConflict, "client profile has changed since version "+request.Version)
+	}
+
+	if err := migration.ApplyObject(object); err != nil {
+		return nil, apierror.Internal("error migrating client playerData", err)
+	}
+
+	var current game.EchoPlayerPreferences
+	if err := json.Unmarshal([]byte(object.Value), &current); err != nil {
+		return nil, apierror.Internal("error unmarshaling client playerData", err)
+	}
+
+	// Merge the changed fields into the stored profile
+	profile, err := current.Merge(request.ClientProfile)
+	if err != nil {
+		return nil, apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, "invalid client profile: "+err.Error())
+	}
+
+	// The identity fields are owned by the server
+	profile.DisplayName = account.User.DisplayName
+	profile.EchoUserIdToken = current.EchoUserIdToken
+	profile.ModifyTime = time.Now().UTC().Unix()
+	resetOutdatedConsents(serviceContext, profile)
+
+	if err := profile.Validate(); err != nil {
+		logger.WithField("err", err).Warn("rejected client profile update.")
+		return nil, apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, err.Error())
+	}
+
+	profileJson, err := json.Marshal(profile)
+	if err != nil {
+		return nil, apierror.Internal("error marshaling client profile playerData", err)
+	}
+
+	// Only write if the profile has not changed since it was read
+	writes := []*runtime.StorageWrite{gameProfileStorageObject(playerNkUserID, ClientGameProfileStorageKey, string(profileJson), object.Version)}
+
+	// The login overwrites the profile's channel with the assigned one, so only a change is the player's choice
+	if profile.Social.Group != "" && !strings.EqualFold(profile.Social.Group, current.Social.Group) {
+		preferenceWrite, err := channel.PreferenceWrite(playerNkUserID, profile.Social.Group)
+		if err != nil {
+			return nil, apierror.Internal("error marshaling channel preference", err)
+		}
+		writes = append(writes, preferenceWrite)
+	}
+
+	// The loadout is checked whenever the profile is saved, so the corrections are written with the update
+	if serverObject != nil {
+		correctionWrites, rerr := correctServerLoadout(serviceContext, serverObject, playerNkUserID, relayNkUserID, profile.ModifyTime)
+		if rerr != nil {
+			return nil, rerr
+		}
+		writes = append(writes, correctionWrites...)
+	}
+	historyWrites, err := ProfileHistoryWrites(ctx, nk, ProfileWriterRelay, relayNkUserID, profile.ModifyTime, writes)
+	if err != nil {
+		return nil, apierror.Internal("error preparing profile history", err)
+	}
+
+	acks, err := nk.StorageWrite(ctx, append(writes, historyWrites...))
+	if err != nil {
+		if errors.Is(err, runtime.ErrStorageRejectedVersion) {
+			return nil, apierror.New(apierror.StatusFailedPrecondition, apierror.ReasonConflict, "client profile was modified concurrently")
+		}
+		return nil, apierror.Internal("error writing client profile", err)
+	}
+
+	return &ProfileUpdateResponse{
+		Version:       acks[0].Version,
+		ClientProfile: *profile,
+	}, nil
+}
+
+// resetOutdatedConsents resets the legal consents the player accepted in an older version than the current documents.
+// The profile is served unchanged if the documents cannot be read, so a broken document does not block the player.
+func resetOutdatedConsents(serviceContext *services.ServiceContext, profile *game.EchoPlayerPreferences) {
+	versions, apiErr := relayconfig.ConsentVersions(serviceContext)
+	if apiErr != nil {
+		apiErr.Log(serviceContext.Logger, "unable to check the legal consents")
+		return
+	}
+	if reset := profile.LegalConsents.ResetOutdated(versions); len(reset) > 0 {
+		serviceContext.Logger.WithField("consents", reset).Debug("Reset outdated legal consents.")
+	}
+}
+
+// correctServerLoadout checks the loadout of the stored server profile, and returns the writes of the corrected
+// profile and its correction record, conditional on the profile's version. A valid loadout needs no writes.
+func correctServerLoadout(serviceContext *services.ServiceContext, object *api.StorageObject, userId string, relayUserId string, timestamp int64) ([]*runtime.StorageWrite, *apierror.Error) {
+	if err := migration.ApplyObject(object); err != nil {
+		return nil, apierror.Internal("error migrating server playerData", err)
+	}
+	var server game.ServerProfile
+	if err := json.Unmarshal([]byte(object.Value), &server); err != nil {
+		return nil, apierror.Internal("error unmarshaling server playerData", err)
+	}
+
+	correctionObject, err := correctLoadout(serviceContext, &server, userId, relayUserId, timestamp)
+	if err != nil {
+		return nil, apierror.Internal("error recording loadout corrections", err)
+	}
+	if correctionObject == nil {
+		return nil, nil
+	}
+
+	serverJson, err := json.Marshal(server)
+	if err != nil {
+		return nil, apierror.Internal("error marshaling server profile playerData", err)
+	}
+	return []*runtime.StorageWrite{
+		gameProfileStorageObject(userId, ServerGameProfileStorageKey, string(serverJson), object.Version),
+		correctionObject,
+	}, nil
+}
+
+// gameProfileStorageObject returns the storage write for a client or server game profile.
+// The client profile is readable by its owner, the server profile by everyone.
+func gameProfileStorageObject(userId string, key string, value string, version string) *runtime.StorageWrite {
+	permissionRead := 1
+	if key == ServerGameProfileStorageKey {
+		permissionRead = 2
+	}
+	return &runtime.StorageWrite{
+		Collection:      GameProfileStorageCollection,
+		Key:             key,
+		UserID:          userId,
+		Value:           value,
+		Version:         version,
+		PermissionRead:  permissionRead,
+		PermissionWrite: 0,
+	}
+}
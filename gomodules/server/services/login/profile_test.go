@@ -0,0 +1,144 @@
+package login
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"echonakama/game"
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+	"echonakama/server/services/channel"
+	"echonakama/server/services/nakamatest"
+	"echonakama/server/services/relayconfig"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// racingModule changes the client profile right before each write, as a concurrent update would.
+type racingModule struct {
+	*nakamatest.Module
+	userId string
+}
+
+func (m *racingModule) StorageWrite(ctx context.Context, writes []*runtime.StorageWrite) ([]*api.StorageObjectAck, error) {
+	if _, err := m.Module.StorageWrite(ctx, []*runtime.StorageWrite{{Collection: GameProfileStorageCollection, Key: ClientGameProfileStorageKey, UserID: m.userId, Value: `{}`}}); err != nil {
+		return nil, err
+	}
+	return m.Module.StorageWrite(ctx, writes)
+}
+
+func TestProcessProfileUpdate(t *testing.T) {
+	nk := nakamatest.NewModule()
+	echoUserId := *game.NewEchoUserId(game.OVR_ORG, 1234)
+	deviceToken := DeviceId{AppId: QuestAppId, UserIdToken: echoUserId.String(), HmdSerialNumber: "HMD-1"}.Token()
+	ctx := context.WithValue(context.Background(), runtime.RUNTIME_CTX_USER_ID, "relay-user")
+
+	playerUserId, _, _, err := nk.AuthenticateDevice(ctx, deviceToken, "player", true)
+	if err != nil {
+		t.Fatalf("AuthenticateDevice() error: %v", err)
+	}
+	if err := nk.AccountUpdateId(ctx, playerUserId, "", nil, "Player", "", "", "", ""); err != nil {
+		t.Fatalf("AccountUpdateId() error: %v", err)
+	}
+
+	// The stored profiles; the server profile has an emote equipped that the player does not own
+	profiles := game.DefaultGameProfiles(echoUserId, "Player")
+	profiles.Client.CombatGrenade = "det"
+	profiles.Server.EquippedCosmetics.Instances.Unified.Slots.Emote = "emote_not_owned"
+	clientJson, _ := json.Marshal(profiles.Client)
+	serverJson, _ := json.Marshal(profiles.Server)
+	acks, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
+		gameProfileStorageObject(playerUserId, ClientGameProfileStorageKey, string(clientJson), ""),
+		gameProfileStorageObject(playerUserId, ServerGameProfileStorageKey, string(serverJson), ""),
+	})
+	if err != nil {
+		t.Fatalf("StorageWrite() error: %v", err)
+	}
+	storedVersion := acks[0].Version
+
+	serviceContext := &services.ServiceContext{Ctx: ctx, Logger: nakamatest.NewLogger(t), NakamaModule: nk}
+	update := func(version string, clientProfile string) (*ProfileUpdateResponse, *apierror.Error) {
+		return ProcessProfileUpdate(serviceContext, &ProfileUpdateRequest{
+			DeviceAuthToken: deviceToken,
+			EchoUserId:      echoUserId,
+			Version:         version,
+			ClientProfile:   json.RawMessage(clientProfile),
+		})
+	}
+
+	// Only the changed fields are merged into the stored profile
+	response, apiErr := update(storedVersion, `{"weapon": "rocket", "mute": {"users": ["someone"]}}`)
+	if apiErr != nil {
+		t.Fatalf("ProcessProfileUpdate() error: %v", apiErr)
+	}
+	if response.ClientProfile.CombatWeapon != "rocket" || len(response.ClientProfile.MutedPlayers.UserIds) != 1 || response.ClientProfile.CombatGrenade != "det" {
+		t.Errorf("ProcessProfileUpdate() = %+v, want the weapon and mutes changed, and the grenade kept", response.ClientProfile)
+	}
+	if response.Version == "" || response.Version == storedVersion {
+		t.Errorf("ProcessProfileUpdate() version = %q, want a new version", response.Version)
+	}
+
+	// The server profile's loadout is corrected with the update, and the correction recorded
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: GameProfileStorageCollection, Key: ServerGameProfileStorageKey, UserID: playerUserId}})
+	if err != nil || len(objects) != 1 {
+		t.Fatalf("StorageRead() = %v, error = %v, want the server profile", objects, err)
+	}
+	var server game.ServerProfile
+	if err := json.Unmarshal([]byte(objects[0].Value), &server); err != nil {
+		t.Fatalf("json.Unmarshal() error: %v", err)
+	}
+	if emote := server.EquippedCosmetics.Instances.Unified.Slots.Emote; emote != game.DefaultLoadoutSlots().Emote {
+		t.Errorf("server profile emote = %q, want the default", emote)
+	}
+	if corrections, _, _ := nk.StorageList(ctx, "", playerUserId, LoadoutCorrectionStorageCollection, 10, ""); len(corrections) != 1 {
+		t.Errorf("StorageList() = %d correction records, want 1", len(corrections))
+	}
+
+	// An update based on an old version is rejected
+	if _, apiErr := update(storedVersion, `{"weapon": "scout"}`); apiErr == nil || apiErr.Code != apierror.StatusFailedPrecondition {
+		t.Errorf("ProcessProfileUpdate() error = %v, want a failed precondition for a stale version", apiErr)
+	}
+
+	// An invalid profile is rejected, and not written
+	if _, apiErr := update("", `{"weapon": "sword"}`); apiErr == nil || apiErr.Code != apierror.StatusInvalidArgument {
+		t.Errorf("ProcessProfileUpdate() error = %v, want an invalid argument", apiErr)
+	}
+	objects, _ = nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: GameProfileStorageCollection, Key: ClientGameProfileStorageKey, UserID: playerUserId}})
+	if len(objects) != 1 || objects[0].Version != response.Version {
+		t.Errorf("StorageRead() = %v, want the client profile unchanged at version %s", objects, response.Version)
+	}
+
+	// Consents accepted in an older version than the current documents are reset, so the game asks again
+	eula := `{"type":"eula","lang":"en","version":3,"version_ga":1,"text":"terms","mark_as_read_profile_key":"legal|eula_version","mark_as_read_profile_key_ga":"legal|game_admin_version"}`
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{Collection: relayconfig.DocumentStorageCollection("eula"), Key: relayconfig.DocumentStorageKey("eula", "en"), UserID: services.SystemUserId, Value: eula}}); err != nil {
+		t.Fatalf("StorageWrite() error: %v", err)
+	}
+	response, apiErr = update("", `{"legal": {"eula_version": 2, "game_admin_version": 1}}`)
+	if apiErr != nil {
+		t.Fatalf("ProcessProfileUpdate() error: %v", apiErr)
+	}
+	if consents := response.ClientProfile.LegalConsents; consents.EulaVersion != 0 || consents.GameAdminVersion != 1 {
+		t.Errorf("ProcessProfileUpdate() consents = %+v, want the EULA reset and the game admin terms kept", consents)
+	}
+	response, apiErr = update("", `{"legal": {"eula_version": 3}}`)
+	if apiErr != nil || response.ClientProfile.LegalConsents.EulaVersion != 3 {
+		t.Errorf("ProcessProfileUpdate() = %+v, error = %v, want the current EULA accepted", response, apiErr)
+	}
+
+	// Changing the profile's channel records it as the player's choice
+	if _, apiErr := update("", `{"social": {"group": "2b3c4d5e-6f70-4182-93a4-b5c6d7e8f901"}}`); apiErr != nil {
+		t.Fatalf("ProcessProfileUpdate() error: %v", apiErr)
+	}
+	objects, _ = nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: channel.ChannelStorageCollection, Key: channel.PreferenceStorageKey, UserID: playerUserId}})
+	if len(objects) != 1 || objects[0].Value != `{"channel_uuid":"2B3C4D5E-6F70-4182-93A4-B5C6D7E8F901"}` {
+		t.Errorf("StorageRead() = %v, want the chosen channel", objects)
+	}
+
+	// A profile changed between the read and the write is rejected
+	serviceContext.NakamaModule = &racingModule{Module: nk, userId: playerUserId}
+	if _, apiErr := update("", `{"weapon": "scout"}`); apiErr == nil || apiErr.Code != apierror.StatusFailedPrecondition {
+		t.Errorf("ProcessProfileUpdate() error = %v, want a failed precondition for a concurrent write", apiErr)
+	}
+}
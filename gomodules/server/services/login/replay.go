@@ -0,0 +1,114 @@
+package login
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"echonakama/server/services/apierror"
+
+	"github.com/google/uuid"
+)
+
+// LoginReplayWindow is how long a relay may retry a login and be sent the response of the first attempt.
+const LoginReplayWindow = 30 * time.Second
+
+// loginReplays holds the recent logins of this node, by the client's session GUID.
+var loginReplays = newReplayCache(LoginReplayWindow)
+
+// loginReplay is a login attempt, in progress until done is closed.
+type loginReplay struct {
+	fingerprint string
+	done        chan struct{}
+	response    *LoginSuccessResponse
+	err         *apierror.Error
+	expires     time.Time
+}
+
+// replayCache makes logins idempotent: a login repeated with the same session GUID is served
+// the response of the first attempt instead of being processed again.
+type replayCache struct {
+	mu        sync.Mutex
+	window    time.Duration
+	entries   map[uuid.UUID]*loginReplay
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newReplayCache(window time.Duration) *replayCache {
+	return &replayCache{
+		window:  window,
+		entries: make(map[uuid.UUID]*loginReplay),
+		now:     time.Now,
+	}
+}
+
+// loginFingerprint identifies what a login was made with, so a session GUID cannot be replayed by another login.
+func loginFingerprint(relayUserId string, request *LoginRequest, password string) string {
+	hash := sha256.New()
+	for _, value := range []string{relayUserId, request.DeviceId().Token(), password} {
+		hash.Write([]byte(value))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// begin returns the login attempt of the session. If the session has no recent login, a new attempt is
+// started and owned is true: the caller processes the login and must call finish. Otherwise the caller
+// waits for the existing attempt. A session GUID used by a different login is refused.
+func (c *replayCache) begin(sessionGuid uuid.UUID, fingerprint string) (replay *loginReplay, owned bool, apiErr *apierror.Error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	c.sweep(now)
+
+	if replay, ok := c.entries[sessionGuid]; ok && now.Before(replay.expires) {
+		if replay.fingerprint != fingerprint {
+			return nil, false, apierror.New(apierror.StatusAlreadyExists, apierror.ReasonConflict, "session already in use")
+		}
+		return replay, false, nil
+	}
+	replay = &loginReplay{
+		fingerprint: fingerprint,
+		done:        make(chan struct{}),
+		expires:     now.Add(c.window),
+	}
+	c.entries[sessionGuid] = replay
+	return replay, true, nil
+}
+
+// finish records the result of a login attempt. Failed logins are forgotten, so a retry is processed again.
+func (c *replayCache) finish(sessionGuid uuid.UUID, replay *loginReplay, response *LoginSuccessResponse, apiErr *apierror.Error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	replay.response, replay.err = response, apiErr
+	if apiErr != nil && c.entries[sessionGuid] == replay {
+		delete(c.entries, sessionGuid)
+	}
+	close(replay.done)
+}
+
+// wait returns the result of the login attempt once it is done.
+func (replay *loginReplay) wait(ctx context.Context) (*LoginSuccessResponse, *apierror.Error) {
+	select {
+	case <-replay.done:
+		return replay.response, replay.err
+	case <-ctx.Done():
+		return nil, apierror.New(apierror.StatusDeadlineExceeded, apierror.ReasonUnavailable, "login timed out").Wrap(ctx.Err())
+	}
+}
+
+// sweep drops the expired logins.
+func (c *replayCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < c.window {
+		return
+	}
+	c.lastSweep = now
+	for sessionGuid, replay := range c.entries {
+		if !now.Before(replay.expires) {
+			delete(c.entries, sessionGuid)
+		}
+	}
+}
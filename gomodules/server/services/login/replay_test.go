@@ -0,0 +1,74 @@
+package login
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"echonakama/server/services/apierror"
+
+	"github.com/google/uuid"
+)
+
+func TestReplayCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	cache := newReplayCache(time.Minute)
+	cache.now = func() time.Time { return now }
+	sessionGuid := uuid.New()
+
+	first, owned, apiErr := cache.begin(sessionGuid, "a")
+	if apiErr != nil || !owned {
+		t.Fatalf("begin() = %v, %v, want a new attempt", owned, apiErr)
+	}
+
+	// A retry while the first attempt is in progress waits for its response
+	retry, owned, apiErr := cache.begin(sessionGuid, "a")
+	if apiErr != nil || owned || retry != first {
+		t.Fatalf("begin() = %v, %v, want the first attempt", owned, apiErr)
+	}
+	response := &LoginSuccessResponse{EchoSessionToken: "session"}
+	result := make(chan *LoginSuccessResponse)
+	go func() {
+		replayed, _ := retry.wait(context.Background())
+		result <- replayed
+	}()
+	cache.finish(sessionGuid, first, response, nil)
+	if replayed := <-result; replayed != response {
+		t.Errorf("wait() = %v, want the first response", replayed)
+	}
+
+	// Another login cannot use the session GUID
+	if _, _, apiErr := cache.begin(sessionGuid, "b"); apiErr == nil || apiErr.Reason != apierror.ReasonConflict {
+		t.Errorf("begin() error = %v, want %s", apiErr, apierror.ReasonConflict)
+	}
+
+	// After the window, the session GUID starts a new attempt
+	now = now.Add(time.Minute)
+	if _, owned, apiErr := cache.begin(sessionGuid, "b"); apiErr != nil || !owned {
+		t.Errorf("begin() = %v, %v, want a new attempt after the window", owned, apiErr)
+	}
+}
+
+func TestReplayCacheForgetsFailures(t *testing.T) {
+	cache := newReplayCache(time.Minute)
+	sessionGuid := uuid.New()
+
+	first, _, _ := cache.begin(sessionGuid, "a")
+	cache.finish(sessionGuid, first, nil, apierror.New(apierror.StatusInvalidArgument, apierror.ReasonLinkRequired, "link"))
+	if _, apiErr := first.wait(context.Background()); apiErr == nil || apiErr.Reason != apierror.ReasonLinkRequired {
+		t.Errorf("wait() error = %v, want %s", apiErr, apierror.ReasonLinkRequired)
+	}
+	if _, owned, _ := cache.begin(sessionGuid, "a"); !owned {
+		t.Error("begin() replayed a failed login, want it processed again")
+	}
+}
+
+func TestReplayWaitCanceled(t *testing.T) {
+	cache := newReplayCache(time.Minute)
+	replay, _, _ := cache.begin(uuid.New(), "a")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, apiErr := replay.wait(ctx); apiErr == nil || apiErr.Code != apierror.StatusDeadlineExceeded {
+		t.Errorf("wait() error = %v, want %d", apiErr, apierror.StatusDeadlineExceeded)
+	}
+}
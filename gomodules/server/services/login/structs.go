@@ -3,8 +3,12 @@ package login
 import (
 	"echonakama/game"
 	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+	"echonakama/server/services/metrics"
+	"echonakama/server/services/migration"
 	"encoding/json"
 	"fmt"
+	"strconv"
 
 	"github.com/google/uuid"
 	"github.com/heroiclabs/nakama-common/runtime"
@@ -18,6 +22,7 @@ type LoginSuccessResponse struct {
 	NkSessionToken     string                  `json:"nk_session_token"`
 	EchoClientSettings game.EchoClientSettings `json:"client_settings"`
 	GameProfiles       game.GameProfiles       `json:"game_profiles"`
+	ProfileVersion     string                  `json:"client_profile_version"` // the storage version of the client profile, used for profile updates
 }
 
 // LinkTicket represents a ticket used for linking accounts to Discord.
@@ -29,23 +34,27 @@ type LinkTicket struct {
 	// NOTE: The UserIDToken has an index that is created in the InitModule function
 	UserIDToken  string        `json:"game_user_id_token"` // the xplatform ID used by EchoVR as a UserID
 	LoginRequest *LoginRequest `json:"game_login_request"` // the login request payload that generated this link ticket
+	RelayId      string        `json:"relay_id,omitempty"` // the relay the login request came from
 }
 
 // LinkTicket generates a link ticket for the provided xplatformId and hmdSerialNumber.
-func (request *LoginRequest) LinkTicket(serviceContext *services.ServiceContext, userID string) (*LinkTicket, *runtime.Error) {
+func (request *LoginRequest) LinkTicket(serviceContext *services.ServiceContext, userID string) (*LinkTicket, *apierror.Error) {
 	linkTicket := &LinkTicket{}
 	ctx := serviceContext.Ctx
 	nk := serviceContext.NakamaModule
 	logger := serviceContext.Logger
 	// Check if a link ticket already exists for the provided xplatformId and hmdSerialNumber
-	objectIDs, err := nk.StorageIndexList(ctx, SystemUserId, LinkTicketIndex, fmt.Sprintf("+value.game_user_id_token:%s", request.DeviceId().UserIdToken), 10)
+	objectIDs, err := nk.StorageIndexList(ctx, services.SystemUserId, LinkTicketIndex, fmt.Sprintf("+value.game_user_id_token:%s", request.DeviceId().UserIdToken), 10)
 	if err != nil {
-		return nil, runtime.NewError(fmt.Sprintf("error listing link tickets: `%q`  %v", request.DeviceId().UserIdToken, err), StatusInternalError)
+		return nil, apierror.Internal("error listing link tickets", fmt.Errorf("error listing link tickets of %q: %w", request.DeviceId().UserIdToken, err))
 	}
 	logger.WithField("objectIds", objectIDs).Debug("Link ticket found/generated.")
 	// Link ticket was found. Return the link ticket.
 	if objectIDs != nil {
 		for _, record := range objectIDs.Objects {
+			if err := migration.ApplyObject(record); err != nil {
+				return nil, apierror.Internal("error migrating link ticket", err)
+			}
 			json.Unmarshal([]byte(record.Value), &linkTicket)
 
 			return linkTicket, nil
@@ -61,11 +70,12 @@ func (request *LoginRequest) LinkTicket(serviceContext *services.ServiceContext,
 			DeviceAuthToken: request.DeviceId().Token(),
 			UserIDToken:     request.DeviceId().UserIdToken,
 			LoginRequest:    request,
+			RelayId:         metrics.RelayId(ctx),
 		}
 
 		linkTicketStorageObject, err := linkTicket.StorageObject()
 		if err != nil {
-			return nil, runtime.NewError(fmt.Sprintf("error preparing link ticket storage object: %v", err), StatusInternalError)
+			return nil, apierror.Internal("error preparing link ticket storage object", err)
 		}
 
 		// Write the link code to storage
@@ -78,6 +88,7 @@ func (request *LoginRequest) LinkTicket(serviceContext *services.ServiceContext,
 		if err != nil {
 			continue
 		}
+		nk.MetricsCounterAdd(metrics.LinkTicketsIssued, metrics.Tags(linkTicket.RelayId, request.EchoUserId.PlatformCode.String()), 1)
 		return linkTicket, nil
 	}
 }
@@ -91,7 +102,7 @@ func (l *LinkTicket) StorageObject() (*runtime.StorageWrite, error) {
 	return &runtime.StorageWrite{
 		Collection:      LinkTicketCollection,
 		Key:             l.Code,
-		UserID:          SystemUserId,
+		UserID:          services.SystemUserId,
 		Value:           string(linkTicketJson),
 		PermissionRead:  0,
 		PermissionWrite: 0,
@@ -99,6 +110,52 @@ func (l *LinkTicket) StorageObject() (*runtime.StorageWrite, error) {
 	}, nil
 }
 
+// LoadoutCorrectionRecord records the loadout slots that were reset for a player.
+// Each record is kept under its own key, so corrections made in the same second are all kept.
+type LoadoutCorrectionRecord struct {
+	EchoUserIdToken string                   `json:"game_user_id_token"` // the xplatform ID of the profile
+	RelayUserId     string                   `json:"relay_user_id"`      // the relay that served the profile
+	Corrections     []game.LoadoutCorrection `json:"corrections"`        // the slots that were reset
+	Timestamp       int64                    `json:"timestamp"`          // when the corrections were made
+}
+
+func (r *LoadoutCorrectionRecord) StorageObject(userID string) (*runtime.StorageWrite, error) {
+	recordJson, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &runtime.StorageWrite{
+		Collection:      LoadoutCorrectionStorageCollection,
+		Key:             strconv.FormatInt(r.Timestamp, 10) + "-" + uuid.New().String(), // sorted by time, and unique
+		UserID:          userID,
+		Value:           string(recordJson),
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}, nil
+}
+
+// correctLoadout replaces the equipped cosmetics the player does not own, and returns the storage write
+// that records the corrections, or nil if the loadout is valid.
+func correctLoadout(serviceContext *services.ServiceContext, profile *game.ServerProfile, userId string, relayUserId string, timestamp int64) (*runtime.StorageWrite, error) {
+	corrections := profile.ValidateLoadout()
+	if len(corrections) == 0 {
+		return nil, nil
+	}
+	serviceContext.Logger.WithField("corrections", corrections).Warn("Corrected invalid loadout for %s", profile.EchoUserIdToken)
+	record := &LoadoutCorrectionRecord{
+		EchoUserIdToken: profile.EchoUserIdToken,
+		RelayUserId:     relayUserId,
+		Corrections:     corrections,
+		Timestamp:       timestamp,
+	}
+	object, err := record.StorageObject(userId)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling loadout corrections: %w", err)
+	}
+	return object, nil
+}
+
 // The data used to generate the Device ID authentication string.
 type DeviceId struct {
 	AppId           int64  `json:"game_app_id"`        // The application ID for the game
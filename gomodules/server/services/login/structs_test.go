@@ -0,0 +1,32 @@
+package login
+
+import (
+	"strings"
+	"testing"
+
+	"echonakama/game"
+)
+
+func TestLoadoutCorrectionRecordKey(t *testing.T) {
+	record := &LoadoutCorrectionRecord{
+		EchoUserIdToken: "OVR-ORG-123",
+		Corrections:     []game.LoadoutCorrection{{Slot: "emote", Item: "emote_dab", Replacement: "emote_default", Reason: game.LoadoutCorrectionNotOwned}},
+		Timestamp:       1700000000,
+	}
+
+	// Corrections made in the same second are kept under different keys
+	first, err := record.StorageObject("user")
+	if err != nil {
+		t.Fatalf("StorageObject() error: %v", err)
+	}
+	second, err := record.StorageObject("user")
+	if err != nil {
+		t.Fatalf("StorageObject() error: %v", err)
+	}
+	if first.Key == second.Key {
+		t.Errorf("StorageObject() key = %q twice, want unique keys", first.Key)
+	}
+	if !strings.HasPrefix(first.Key, "1700000000-") {
+		t.Errorf("StorageObject() key = %q, want it prefixed with the timestamp", first.Key)
+	}
+}
@@ -0,0 +1,361 @@
+package matchmaking
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"echonakama/game"
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+	"echonakama/server/services/gameserver"
+	"echonakama/server/services/party"
+	"echonakama/server/services/relay"
+
+	"github.com/google/uuid"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	AssignmentStorageCollection = "Matchmaking:assignment"
+	AssignmentStorageKey        = "current"
+
+	// The notification sent to each matched player's session, which the relay holds
+	AssignmentNotificationSubject = "lobby_assignment"
+	AssignmentNotificationCode    = 100
+
+	// The notification sent to each matched player's session when no lobby could be allocated, so the relay requeues them
+	AssignmentFailedNotificationSubject = "lobby_assignment_failed"
+	AssignmentFailedNotificationCode    = 102
+
+	// The notification sent to the relay of the game server a lobby is reserved on, so it prepares the session
+	ReservationNotificationSubject = "session_reserved"
+	ReservationNotificationCode    = 103
+
+	// How far apart the levels of players matched together may be
+	LevelRange = 10
+)
+
+// MatchSize is the number of players a matched lobby of a mode may have.
+type MatchSize struct {
+	Min int
+	Max int
+}
+
+// MatchSizes lists the modes players can matchmake for. Private modes are not matchmade.
+var MatchSizes = map[game.GameMode]MatchSize{
+	game.ModeArena:  {Min: 2, Max: 8},
+	game.ModeCombat: {Min: 2, Max: 8},
+	game.ModeSocial: {Min: 1, Max: 12},
+}
+
+// LobbyFindRequest is sent by a relay when a player asks to find a lobby.
+type LobbyFindRequest struct {
+	UserId       string        `json:"user_id"`       // the Nakama user ID of the player (or of the party leader)
+	Mode         game.GameMode `json:"mode"`          // the game mode to find a lobby for
+	Region       string        `json:"region"`        // the region to play in
+	Level        int           `json:"level"`         // the player's level, matched within LevelRange
+	PartyId      string        `json:"party_id"`      // the player's party (set by the matchmaking service)
+	PartyMembers []string      `json:"party_members"` // the party's members, the leader included (set by the matchmaking service)
+}
+
+// Validate checks the request's mode, region and level.
+func (r *LobbyFindRequest) Validate() error {
+	if r.UserId == "" {
+		return errors.New("user_id is empty")
+	}
+	if _, ok := MatchSizes[r.Mode]; !ok {
+		return fmt.Errorf("mode cannot be matchmade: %q", r.Mode)
+	}
+	if r.Region == "" || strings.ContainsAny(r.Region, " \"\\") {
+		return fmt.Errorf("invalid region: %q", r.Region)
+	}
+	if r.Level < 0 {
+		return fmt.Errorf("invalid level: %d", r.Level)
+	}
+	return nil
+}
+
+// Ticket is the Nakama matchmaker ticket the relay submits over the player's realtime session.
+type Ticket struct {
+	Query             string             `json:"query"`
+	MinCount          int                `json:"min_count"`
+	MaxCount          int                `json:"max_count"`
+	CountMultiple     int                `json:"count_multiple,omitempty"`
+	StringProperties  map[string]string  `json:"string_properties"`
+	NumericProperties map[string]float64 `json:"numeric_properties"`
+}
+
+// NewTicket turns a lobby find request into a matchmaker ticket. Players must share the
+// mode and region, and are preferably matched with players within LevelRange of their level.
+// A party's ticket is submitted by its leader and carries all its members, but the matchmaker counts
+// it as one entry. So a ticket only matches tickets of parties no larger than its own, and its counts
+// are in entries of at most its party size: with as many entries as it allows, the lobby is never
+// overfilled. The matchmaker only evaluates the query of the ticket being matched, so a party is
+// matched with smaller parties and solo players by its own ticket.
+func NewTicket(request *LobbyFindRequest) (*Ticket, error) {
+	if err := request.Validate(); err != nil {
+		return nil, err
+	}
+	size := MatchSizes[request.Mode]
+	partySize := len(request.PartyMembers)
+	if partySize < 1 {
+		partySize = 1
+	}
+	if partySize > size.Max {
+		return nil, fmt.Errorf("a party of %d does not fit in a %s lobby", partySize, request.Mode)
+	}
+
+	query := fmt.Sprintf(`+properties.mode:"%s" +properties.region:"%s" +properties.party_size:<=%d properties.level:>=%d properties.level:<=%d`,
+		request.Mode, request.Region, partySize, request.Level-LevelRange, request.Level+LevelRange)
+
+	// The other entries bring at least one player each, and at most partySize
+	ticket := &Ticket{
+		Query:    query,
+		MinCount: size.Min - (partySize - 1),
+		MaxCount: size.Max / partySize,
+		StringProperties: map[string]string{
+			"mode":          string(request.Mode),
+			"region":        request.Region,
+			"party_id":      request.PartyId,
+			"party_members": strings.Join(request.PartyMembers, ","),
+		},
+		NumericProperties: map[string]float64{
+			"level":      float64(request.Level),
+			"party_size": float64(partySize),
+		},
+	}
+	if ticket.MinCount < 1 {
+		ticket.MinCount = 1
+	}
+	return ticket, nil
+}
+
+// Assignment tells a relay where a matched player's lobby is hosted.
+type Assignment struct {
+	SessionId  string              `json:"session_id"` // the lobby session GUID
+	ServerKey  string              `json:"server_key"` // the game server's key in the registry
+	RelayId    string              `json:"relay_id"`   // the relay the game server registered through
+	Endpoint   gameserver.Endpoint `json:"endpoint"`
+	Mode       game.GameMode       `json:"mode"`
+	Region     string              `json:"region"`
+	UserIds    []string            `json:"user_ids"` // the players matched into the lobby
+	AssignedAt int64               `json:"assigned_at"`
+}
+
+// matchedProperties returns the mode and region shared by a matched group.
+func matchedProperties(entries []runtime.MatchmakerEntry) (game.GameMode, string, error) {
+	if len(entries) == 0 {
+		return "", "", errors.New("no matched entries")
+	}
+	properties := entries[0].GetProperties()
+	mode, _ := properties["mode"].(string)
+	region, _ := properties["region"].(string)
+	if mode == "" || region == "" {
+		return "", "", errors.New("matched entries have no mode or region")
+	}
+	return game.GameMode(mode), region, nil
+}
+
+// matchedUserIds returns the players in a matched group: each entry's player, and the members of their party.
+func matchedUserIds(entries []runtime.MatchmakerEntry) []string {
+	userIds := make([]string, 0, len(entries))
+	seen := make(map[string]bool)
+	add := func(userId string) {
+		if userId != "" && !seen[userId] {
+			seen[userId] = true
+			userIds = append(userIds, userId)
+		}
+	}
+	for _, entry := range entries {
+		if presence := entry.GetPresence(); presence != nil {
+			add(presence.GetUserId())
+		}
+		members, _ := entry.GetProperties()["party_members"].(string)
+		for _, member := range strings.Split(members, ",") {
+			add(member)
+		}
+	}
+	return userIds
+}
+
+// Allocate reserves a session on the least loaded available game server that hosts the mode in the region.
+// The reservation is a conditional write, so concurrent allocations never share a session slot.
+func Allocate(serviceContext *services.ServiceContext, mode game.GameMode, region string, userIds []string) (*Assignment, *apierror.Error) {
+	servers, apiErr := gameserver.ListGameServers(serviceContext, gameserver.Filter{Region: region, Mode: mode, Available: true})
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	session := &gameserver.Session{
+		SessionId:   strings.ToUpper(uuid.New().String()),
+		Mode:        mode,
+		PlayerCount: len(userIds),
+		MaxPlayers:  MatchSizes[mode].Max,
+	}
+	for _, server := range servers {
+		reserved, apiErr := gameserver.ReserveSession(serviceContext, server.Key(), session)
+		if apiErr != nil {
+			if apiErr.Code == apierror.StatusAborted || apiErr.Code == apierror.StatusResourceExhausted {
+				continue // another allocation took the server
+			}
+			return nil, apiErr
+		}
+		assignment := &Assignment{
+			SessionId:  session.SessionId,
+			ServerKey:  reserved.Key(),
+			RelayId:    reserved.RelayId,
+			Endpoint:   reserved.Endpoint,
+			Mode:       mode,
+			Region:     region,
+			UserIds:    userIds,
+			AssignedAt: time.Now().UTC().Unix(),
+		}
+		notifyReservation(serviceContext, reserved, assignment)
+		return assignment, nil
+	}
+	return nil, apierror.New(apierror.StatusResourceExhausted, apierror.ReasonUnavailable, fmt.Sprintf("no game server available for %s in %s", mode, region))
+}
+
+// notifyReservation tells the relay hosting the game server about the session reserved on it. A relay that
+// misses the notification still learns of the session when the players join it; until then the reservation
+// holds the server's slot for gameserver.ReservationTimeout.
+func notifyReservation(serviceContext *services.ServiceContext, server *gameserver.GameServer, assignment *Assignment) {
+	ctx := serviceContext.Ctx
+	logger := serviceContext.Logger.WithField("relayId", server.RelayId).WithField("sessionId", assignment.SessionId)
+	nk := serviceContext.NakamaModule
+
+	r, _, err := relay.ReadRelay(ctx, nk, server.RelayId)
+	if err != nil || r == nil {
+		logger.WithField("err", err).Warn("Unable to find the relay of a reserved session.")
+		return
+	}
+	content := map[string]interface{}{
+		"server_id":  server.ServerId,
+		"session_id": assignment.SessionId,
+		"mode":       string(assignment.Mode),
+		"user_ids":   assignment.UserIds,
+	}
+	if err := nk.NotificationSend(ctx, r.UserId, ReservationNotificationSubject, content, ReservationNotificationCode, "", false); err != nil {
+		logger.WithField("err", err).Warn("Unable to send session reservation.")
+	}
+}
+
+// ProcessMatched allocates a game server for a group the Nakama matchmaker matched, and delivers the
+// assignment to each player: it is stored for the player, and sent to the player's session as a notification.
+// If no game server can host the lobby, each player's session is sent a failure notification instead.
+func ProcessMatched(serviceContext *services.ServiceContext, entries []runtime.MatchmakerEntry) (*Assignment, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	logger := serviceContext.Logger
+	nk := serviceContext.NakamaModule
+
+	mode, region, err := matchedProperties(entries)
+	if err != nil {
+		return nil, apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, err.Error())
+	}
+	userIds := matchedUserIds(entries)
+
+	assignment, apiErr := Allocate(serviceContext, mode, region, userIds)
+	if apiErr != nil {
+		logger.WithField("err", apiErr).WithField("mode", mode).WithField("region", region).Warn("Unable to allocate a game server.")
+		content := map[string]interface{}{
+			"mode":     string(mode),
+			"region":   region,
+			"user_ids": userIds,
+			"reason":   string(apiErr.Reason),
+			"message":  apiErr.Message,
+		}
+		for _, userId := range userIds {
+			if err := nk.NotificationSend(ctx, userId, AssignmentFailedNotificationSubject, content, AssignmentFailedNotificationCode, "", false); err != nil {
+				logger.WithField("err", err).WithField("userId", userId).Warn("Unable to send lobby assignment failure.")
+			}
+		}
+		return nil, apiErr
+	}
+
+	data, err := json.Marshal(assignment)
+	if err != nil {
+		return nil, apierror.Internal("error marshaling assignment", err)
+	}
+	content := make(map[string]interface{})
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, apierror.Internal("error marshaling assignment", err)
+	}
+
+	writes := make([]*runtime.StorageWrite, 0, len(userIds))
+	for _, userId := range userIds {
+		writes = append(writes, &runtime.StorageWrite{
+			Collection:      AssignmentStorageCollection,
+			Key:             AssignmentStorageKey,
+			UserID:          userId,
+			Value:           string(data),
+			PermissionRead:  1,
+			PermissionWrite: 0,
+		})
+	}
+	if _, err := nk.StorageWrite(ctx, writes); err != nil {
+		return nil, apierror.Internal("error writing assignments", err)
+	}
+	for _, userId := range userIds {
+		if err := nk.NotificationSend(ctx, userId, AssignmentNotificationSubject, content, AssignmentNotificationCode, "", false); err != nil {
+			logger.WithField("err", err).WithField("userId", userId).Warn("Unable to send lobby assignment.")
+		}
+	}
+
+	logger.WithField("sessionId", assignment.SessionId).WithField("server", assignment.ServerKey).Info("Lobby allocated for %d players.", len(userIds))
+	return assignment, nil
+}
+
+// ReadAssignment returns the last lobby assignment of the player, or nil if there is none.
+func ReadAssignment(serviceContext *services.ServiceContext, userId string) (*Assignment, *apierror.Error) {
+
+	objects, err := serviceContext.NakamaModule.StorageRead(serviceContext.Ctx, []*runtime.StorageRead{{
+		Collection: AssignmentStorageCollection,
+		Key:        AssignmentStorageKey,
+		UserID:     userId,
+	}})
+	if err != nil {
+		return nil, apierror.Internal("error reading assignment", err)
+	}
+	if len(objects) == 0 {
+		return nil, nil
+	}
+	assignment := &Assignment{}
+	if err := json.Unmarshal([]byte(objects[0].Value), assignment); err != nil {
+		return nil, apierror.New(apierror.StatusDataLoss, apierror.ReasonInternal, "error unmarshaling assignment").Wrap(err)
+	}
+	return assignment, nil
+}
+
+// FindLobby returns the matchmaker ticket for a player's lobby find request.
+// A player in a party queues for the whole party, and only the party leader may queue.
+func FindLobby(serviceContext *services.ServiceContext, request *LobbyFindRequest) (*Ticket, *apierror.Error) {
+
+	users, err := serviceContext.NakamaModule.UsersGetId(serviceContext.Ctx, []string{request.UserId}, nil)
+	if err != nil {
+		return nil, apierror.Internal("error getting user", err)
+	}
+	if len(users) == 0 {
+		return nil, apierror.New(apierror.StatusNotFound, apierror.ReasonNotFound, fmt.Sprintf("user not found: %q", request.UserId))
+	}
+
+	p, err := party.PartyOf(serviceContext.Ctx, serviceContext.NakamaModule, request.UserId)
+	if err != nil {
+		return nil, apierror.Internal("error reading party", err)
+	}
+	request.PartyId, request.PartyMembers = "", nil
+	if p != nil {
+		if p.LeaderUserId != request.UserId {
+			return nil, apierror.New(apierror.StatusFailedPrecondition, apierror.ReasonConflict, "only the party leader may queue for the party")
+		}
+		request.PartyId, request.PartyMembers = p.PartyId, p.Members
+	}
+
+	ticket, err := NewTicket(request)
+	if err != nil {
+		return nil, apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, err.Error())
+	}
+	return ticket, nil
+}
@@ -0,0 +1,249 @@
+package matchmaking
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"echonakama/game"
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+	"echonakama/server/services/config"
+	"echonakama/server/services/gameserver"
+	"echonakama/server/services/nakamatest"
+	"echonakama/server/services/relay"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+type testEntry struct {
+	properties map[string]interface{}
+}
+
+func (e *testEntry) GetPresence() runtime.Presence         { return nil }
+func (e *testEntry) GetTicket() string                     { return "ticket" }
+func (e *testEntry) GetProperties() map[string]interface{} { return e.properties }
+func (e *testEntry) GetPartyId() string                    { return "" }
+
+func TestNewTicket(t *testing.T) {
+	ticket, err := NewTicket(&LobbyFindRequest{UserId: "a", Mode: game.ModeArena, Region: "us-east", Level: 20, PartyId: "party", PartyMembers: []string{"a", "b", "c"}})
+	if err != nil {
+		t.Fatalf("NewTicket() error: %v", err)
+	}
+	for _, want := range []string{`+properties.mode:"echo_arena"`, `+properties.region:"us-east"`, "properties.level:>=10", "properties.level:<=30", "+properties.party_size:<=3"} {
+		if !strings.Contains(ticket.Query, want) {
+			t.Errorf("Query = %q, want it to contain %q", ticket.Query, want)
+		}
+	}
+	if ticket.MinCount != 1 || ticket.MaxCount != 2 {
+		t.Errorf("counts = %d-%d, want 1-2 for a party of 3", ticket.MinCount, ticket.MaxCount)
+	}
+	if ticket.StringProperties["party_members"] != "a,b,c" || ticket.NumericProperties["party_size"] != 3 {
+		t.Errorf("properties = %v %v", ticket.StringProperties, ticket.NumericProperties)
+	}
+
+	tests := []struct {
+		name    string
+		request LobbyFindRequest
+	}{
+		{"private mode", LobbyFindRequest{UserId: "user", Mode: game.ModeArenaPrivate, Region: "us-east"}},
+		{"no region", LobbyFindRequest{UserId: "user", Mode: game.ModeArena}},
+		{"quoted region", LobbyFindRequest{UserId: "user", Mode: game.ModeArena, Region: `us" +properties.mode:x`}},
+		{"no user", LobbyFindRequest{Mode: game.ModeArena, Region: "us-east"}},
+		{"party too large", LobbyFindRequest{UserId: "user", Mode: game.ModeCombat, Region: "us-east", PartyMembers: make([]string, 9)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewTicket(&tt.request); err == nil {
+				t.Errorf("NewTicket() should fail")
+			}
+		})
+	}
+}
+
+// requiredTermsMatch reports whether a ticket has the properties required by a query, which is how the
+// matchmaker picks the entries it may match with a ticket. Optional terms only affect the ordering.
+func requiredTermsMatch(t *testing.T, query string, ticket *Ticket) bool {
+	t.Helper()
+	for _, term := range strings.Fields(query) {
+		if !strings.HasPrefix(term, "+properties.") {
+			continue
+		}
+		name, value, _ := strings.Cut(strings.TrimPrefix(term, "+properties."), ":")
+		if s, ok := ticket.StringProperties[name]; ok {
+			if strconv.Quote(s) != value {
+				return false
+			}
+			continue
+		}
+		atMost := strings.HasPrefix(value, "<=")
+		n, err := strconv.ParseFloat(strings.TrimPrefix(value, "<="), 64)
+		if err != nil {
+			t.Fatalf("unsupported query term %q", term)
+		}
+		if property := ticket.NumericProperties[name]; property != n && !(atMost && property < n) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNewTicketPartyMix(t *testing.T) {
+	size := MatchSizes[game.ModeArena]
+	tickets := make([]*Ticket, 0)
+	add := func(members ...string) {
+		ticket, err := NewTicket(&LobbyFindRequest{UserId: members[0], Mode: game.ModeArena, Region: "us-east", Level: 20, PartyMembers: members})
+		if err != nil {
+			t.Fatalf("NewTicket() error: %v", err)
+		}
+		tickets = append(tickets, ticket)
+	}
+	add("solo1")
+	add("solo2")
+	for i := 0; i < 4; i++ {
+		add(fmt.Sprintf("party%d-a", i), fmt.Sprintf("party%d-b", i), fmt.Sprintf("party%d-c", i))
+	}
+	add("duo-a", "duo-b")
+
+	// Whichever ticket is matched, as many entries as it allows do not fill the lobby past its size
+	for i, active := range tickets {
+		entries, players := 1, int(active.NumericProperties["party_size"])
+		for j, other := range tickets {
+			if i == j || entries == active.MaxCount || !requiredTermsMatch(t, active.Query, other) {
+				continue
+			}
+			entries++
+			players += int(other.NumericProperties["party_size"])
+		}
+		if players > size.Max {
+			t.Errorf("ticket of %s matched %d players, want at most %d", active.StringProperties["party_members"], players, size.Max)
+		}
+	}
+
+	// A party is matched with the solo players and smaller parties by its own ticket, and can fill a lobby
+	party, duo, solo := tickets[2], tickets[len(tickets)-1], tickets[0]
+	if !requiredTermsMatch(t, party.Query, solo) || !requiredTermsMatch(t, party.Query, duo) || requiredTermsMatch(t, solo.Query, party) || requiredTermsMatch(t, duo.Query, party) {
+		t.Errorf("party query = %q, duo query = %q, solo query = %q, want parties matched with smaller ones", party.Query, duo.Query, solo.Query)
+	}
+	for _, ticket := range tickets {
+		matches := 0
+		for _, other := range tickets {
+			if other != ticket && requiredTermsMatch(t, ticket.Query, other) {
+				matches++
+			}
+		}
+		if matches+1 < ticket.MinCount {
+			t.Errorf("ticket of %s matches %d entries, want at least %d", ticket.StringProperties["party_members"], matches, ticket.MinCount-1)
+		}
+	}
+}
+
+func TestMatchedProperties(t *testing.T) {
+	entries := []runtime.MatchmakerEntry{&testEntry{map[string]interface{}{"mode": "echo_combat", "region": "eu", "level": 4.0}}}
+	mode, region, err := matchedProperties(entries)
+	if err != nil || mode != game.ModeCombat || region != "eu" {
+		t.Errorf("matchedProperties() = %q, %q, %v", mode, region, err)
+	}
+
+	if _, _, err := matchedProperties([]runtime.MatchmakerEntry{&testEntry{map[string]interface{}{"mode": "echo_combat"}}}); err == nil {
+		t.Errorf("matchedProperties() without a region should fail")
+	}
+	if _, _, err := matchedProperties(nil); err == nil {
+		t.Errorf("matchedProperties() without entries should fail")
+	}
+}
+
+func TestMatchedUserIds(t *testing.T) {
+	entries := []runtime.MatchmakerEntry{
+		&testEntry{map[string]interface{}{"party_members": "a,b,c"}},
+		&testEntry{map[string]interface{}{"party_members": ""}},
+		&testEntry{map[string]interface{}{"party_members": "c,d"}},
+	}
+	got := matchedUserIds(entries)
+	if strings.Join(got, ",") != "a,b,c,d" {
+		t.Errorf("matchedUserIds() = %v, want [a b c d]", got)
+	}
+}
+
+func TestProcessMatchedUnavailable(t *testing.T) {
+	nk := nakamatest.NewModule()
+	serviceContext := &services.ServiceContext{Ctx: context.Background(), Logger: nakamatest.NewLogger(t), NakamaModule: nk, Config: &config.Config{RelayPresenceTTL: time.Minute}}
+	entries := []runtime.MatchmakerEntry{
+		&testEntry{map[string]interface{}{"mode": "echo_arena", "region": "us-east", "party_members": "a,b"}},
+		&testEntry{map[string]interface{}{"mode": "echo_arena", "region": "us-east", "party_members": "c"}},
+	}
+
+	// No game server hosts the lobby, so each player's relay is told to requeue them
+	if _, apiErr := ProcessMatched(serviceContext, entries); apiErr == nil || apiErr.Code != apierror.StatusResourceExhausted {
+		t.Fatalf("ProcessMatched() error = %v, want resource exhausted", apiErr)
+	}
+	notified := make([]string, 0)
+	for _, notification := range nk.Notifications() {
+		if notification.Subject != AssignmentFailedNotificationSubject || notification.Code != AssignmentFailedNotificationCode {
+			t.Errorf("notification %s (%d), want %s", notification.Subject, notification.Code, AssignmentFailedNotificationSubject)
+		}
+		notified = append(notified, notification.UserID)
+	}
+	if strings.Join(notified, ",") != "a,b,c" {
+		t.Errorf("notified %v, want [a b c]", notified)
+	}
+}
+
+func TestProcessMatchedReservation(t *testing.T) {
+	nk := nakamatest.NewModule()
+	serviceContext := &services.ServiceContext{Ctx: context.Background(), Logger: nakamatest.NewLogger(t), NakamaModule: nk, Config: &config.Config{RelayPresenceTTL: time.Minute}}
+
+	// An online relay with an idle game server
+	caller, apiErr := relay.SetRelay(serviceContext, &relay.Relay{Id: "relay-1", OwnerUserId: "owner", Enabled: true})
+	if apiErr != nil {
+		t.Fatalf("SetRelay() error: %v", apiErr)
+	}
+	if _, apiErr := relay.RecordHeartbeat(serviceContext, caller, &relay.Heartbeat{Region: "us-east"}); apiErr != nil {
+		t.Fatalf("RecordHeartbeat() error: %v", apiErr)
+	}
+	server := &gameserver.GameServer{ServerId: "1", Endpoint: gameserver.Endpoint{ExternalIp: "203.0.113.10", Port: 6792}, Region: "us-east", Modes: []game.GameMode{game.ModeArena}, Capacity: 1}
+	if _, apiErr := gameserver.RegisterGameServer(serviceContext, caller, server); apiErr != nil {
+		t.Fatalf("RegisterGameServer() error: %v", apiErr)
+	}
+
+	entries := []runtime.MatchmakerEntry{&testEntry{map[string]interface{}{"mode": "echo_arena", "region": "us-east", "party_members": "a,b"}}}
+	assignment, apiErr := ProcessMatched(serviceContext, entries)
+	if apiErr != nil {
+		t.Fatalf("ProcessMatched() error: %v", apiErr)
+	}
+
+	// The relay is told about the session reserved on its server
+	var reservation *runtime.NotificationSend
+	for _, notification := range nk.Notifications() {
+		if notification.Subject == ReservationNotificationSubject {
+			reservation = notification
+		}
+	}
+	if reservation == nil || reservation.UserID != caller.UserId || reservation.Content["session_id"] != assignment.SessionId || reservation.Content["server_id"] != "1" {
+		t.Fatalf("reservation notification = %+v, want the session sent to the relay's user", reservation)
+	}
+
+	// A report sent before the relay started the session keeps the reservation, so the slot is not reused
+	reported, apiErr := gameserver.ReportSessions(serviceContext, caller, "1", nil)
+	if apiErr != nil {
+		t.Fatalf("ReportSessions() error: %v", apiErr)
+	}
+	if len(reported.Sessions) != 1 || reported.Sessions[0].SessionId != assignment.SessionId || reported.Sessions[0].ReservedAt == 0 {
+		t.Errorf("ReportSessions() sessions = %+v, want the pending reservation", reported.Sessions)
+	}
+	if _, apiErr := Allocate(serviceContext, game.ModeArena, "us-east", []string{"c"}); apiErr == nil || apiErr.Code != apierror.StatusResourceExhausted {
+		t.Errorf("Allocate() error = %v, want resource exhausted while the reservation is pending", apiErr)
+	}
+
+	// Once reported, the session is no longer pending
+	reported, apiErr = gameserver.ReportSessions(serviceContext, caller, "1", []*gameserver.Session{{SessionId: assignment.SessionId, Mode: game.ModeArena, PlayerCount: 2, MaxPlayers: 8}})
+	if apiErr != nil {
+		t.Fatalf("ReportSessions() error: %v", apiErr)
+	}
+	if len(reported.Sessions) != 1 || reported.Sessions[0].ReservedAt != 0 {
+		t.Errorf("ReportSessions() sessions = %+v, want the reported session", reported.Sessions)
+	}
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"echonakama/server/services/discord"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// discordClient is a discord.Client that times its requests.
+type discordClient struct {
+	client discord.Client
+	nk     runtime.NakamaModule
+}
+
+// InstrumentDiscord returns the client with the latency and errors of its requests recorded.
+func InstrumentDiscord(nk runtime.NakamaModule, client discord.Client) discord.Client {
+	return &discordClient{client: client, nk: nk}
+}
+
+func (c *discordClient) record(operation string, start time.Time, err error) {
+	tags := map[string]string{"operation": operation}
+	c.nk.MetricsTimerRecord(DiscordRequestLatency, tags, time.Since(start))
+	switch {
+	case err == nil:
+	case errors.Is(err, discord.ErrNotFound):
+		c.nk.MetricsCounterAdd(DiscordRequestErrors, With(tags, "error", "not_found"), 1)
+	case errors.Is(err, discord.ErrNotConnected):
+		c.nk.MetricsCounterAdd(DiscordRequestErrors, With(tags, "error", "not_connected"), 1)
+	default:
+		c.nk.MetricsCounterAdd(DiscordRequestErrors, With(tags, "error", "failed"), 1)
+	}
+}
+
+func (c *discordClient) GuildMember(guildId string, userId string) (*discordgo.Member, error) {
+	start := time.Now()
+	member, err := c.client.GuildMember(guildId, userId)
+	c.record("guild_member", start, err)
+	return member, err
+}
+
+func (c *discordClient) InteractionRespond(interaction *discordgo.Interaction, response *discordgo.InteractionResponse) error {
+	start := time.Now()
+	err := c.client.InteractionRespond(interaction, response)
+	c.record("interaction_respond", start, err)
+	return err
+}
+
+func (c *discordClient) ExchangeCode(ctx context.Context, code string, redirectUrl string) (*discord.AccessToken, error) {
+	start := time.Now()
+	token, err := c.client.ExchangeCode(ctx, code, redirectUrl)
+	c.record("exchange_code", start, err)
+	return token, err
+}
+
+func (c *discordClient) RefreshToken(ctx context.Context, token *discord.AccessToken) (*discord.AccessToken, error) {
+	start := time.Now()
+	refreshed, err := c.client.RefreshToken(ctx, token)
+	c.record("refresh_token", start, err)
+	return refreshed, err
+}
+
+func (c *discordClient) CurrentUser(ctx context.Context, accessToken string) (*discordgo.User, error) {
+	start := time.Now()
+	user, err := c.client.CurrentUser(ctx, accessToken)
+	c.record("current_user", start, err)
+	return user, err
+}
@@ -0,0 +1,68 @@
+// Package metrics records the login flow's metrics with Nakama's metrics API, which exposes them
+// on its Prometheus endpoint.
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"echonakama/server/services/relay"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Metric names. Nakama prefixes them with its namespace on the Prometheus endpoint.
+const (
+	LoginAttempts         = "echo_login_attempts"          // counter: relay, platform, outcome
+	LoginLatency          = "echo_login_latency"           // timer: relay, platform, outcome
+	LinkTicketsIssued     = "echo_link_tickets_issued"     // counter: relay, platform
+	LinkTicketsRedeemed   = "echo_link_tickets_redeemed"   // counter: relay, platform
+	ProfileSize           = "echo_profile_size_bytes"      // gauge: relay, platform, profile
+	DiscordRequestLatency = "echo_discord_request_latency" // timer: operation
+	DiscordRequestErrors  = "echo_discord_request_errors"  // counter: operation, error
+	StorageLatency        = "echo_storage_latency"         // timer: operation
+	StorageErrors         = "echo_storage_errors"          // counter: operation
+
+	// OutcomeSuccess is the outcome of a successful login; failures are labelled with their error reason.
+	OutcomeSuccess = "success"
+
+	// unknownTag is the value of a tag that is not known
+	unknownTag = "unknown"
+)
+
+// RelayId returns the ID of the relay whose session made the request, or "unknown".
+func RelayId(ctx context.Context) string {
+	vars, _ := ctx.Value(runtime.RUNTIME_CTX_VARS).(map[string]string)
+	if relayId := vars[relay.RelayIdSessionVar]; relayId != "" {
+		return relayId
+	}
+	return unknownTag
+}
+
+// Tags returns the relay and platform tags.
+func Tags(relayId string, platform string) map[string]string {
+	if relayId == "" {
+		relayId = unknownTag
+	}
+	if platform == "" {
+		platform = unknownTag
+	}
+	return map[string]string{"relay": relayId, "platform": platform}
+}
+
+// With returns a copy of the tags with one more tag.
+func With(tags map[string]string, key string, value string) map[string]string {
+	t := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		t[k] = v
+	}
+	t[key] = value
+	return t
+}
+
+// RecordLogin records a login attempt and how long it took.
+func RecordLogin(nk runtime.NakamaModule, tags map[string]string, outcome string, duration time.Duration) {
+	tags = With(tags, "outcome", outcome)
+	nk.MetricsCounterAdd(LoginAttempts, tags, 1)
+	nk.MetricsTimerRecord(LoginLatency, tags, duration)
+}
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+
+	"echonakama/server/services/discordtest"
+	"echonakama/server/services/nakamatest"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+func TestInstrumentDiscord(t *testing.T) {
+	nk := nakamatest.NewModule()
+	fake := discordtest.NewClient()
+	fake.AddMember("guild", &discordgo.Member{User: &discordgo.User{ID: "member"}})
+	client := InstrumentDiscord(nk, fake)
+
+	if _, err := client.GuildMember("guild", "member"); err != nil {
+		t.Fatalf("GuildMember() error: %v", err)
+	}
+	if _, err := client.GuildMember("guild", "other"); err == nil {
+		t.Fatal("GuildMember() error = nil, want not found")
+	}
+	if _, err := client.CurrentUser(context.Background(), "token"); err == nil {
+		t.Fatal("CurrentUser() error = nil, want an error")
+	}
+
+	tags := map[string]string{"operation": "guild_member"}
+	if got := len(nk.Timings(DiscordRequestLatency, tags)); got != 2 {
+		t.Errorf("Timings(%s) = %d, want 2", DiscordRequestLatency, got)
+	}
+	if got := nk.Counter(DiscordRequestErrors, With(tags, "error", "not_found")); got != 1 {
+		t.Errorf("Counter(%s, not_found) = %d, want 1", DiscordRequestErrors, got)
+	}
+	if got := nk.Counter(DiscordRequestErrors, map[string]string{"operation": "current_user", "error": "failed"}); got != 1 {
+		t.Errorf("Counter(%s, failed) = %d, want 1", DiscordRequestErrors, got)
+	}
+}
+
+func TestInstrumentStorage(t *testing.T) {
+	ctx := context.Background()
+	fake := nakamatest.NewModule()
+	nk := InstrumentStorage(fake)
+	if InstrumentStorage(nk) != nk {
+		t.Error("InstrumentStorage() instrumented an instrumented module again")
+	}
+
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{Collection: "c", Key: "k", Value: `{}`}}); err != nil {
+		t.Fatalf("StorageWrite() error: %v", err)
+	}
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{Collection: "c", Key: "k", Value: `{}`, Version: "*"}}); err == nil {
+		t.Fatal("StorageWrite() error = nil, want a version conflict")
+	}
+	if _, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: "c", Key: "k"}}); err != nil {
+		t.Fatalf("StorageRead() error: %v", err)
+	}
+
+	if got := len(fake.Timings(StorageLatency, map[string]string{"operation": "write"})); got != 2 {
+		t.Errorf("Timings(%s, write) = %d, want 2", StorageLatency, got)
+	}
+	if got := fake.Counter(StorageErrors, map[string]string{"operation": "write"}); got != 1 {
+		t.Errorf("Counter(%s, write) = %d, want 1", StorageErrors, got)
+	}
+	if got := len(fake.Timings(StorageLatency, map[string]string{"operation": "read"})); got != 1 {
+		t.Errorf("Timings(%s, read) = %d, want 1", StorageLatency, got)
+	}
+}
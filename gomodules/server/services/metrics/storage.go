@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// storage is a runtime.NakamaModule that times its storage calls.
+type storage struct {
+	runtime.NakamaModule
+}
+
+// InstrumentStorage returns the module with the latency and errors of its storage calls recorded.
+func InstrumentStorage(nk runtime.NakamaModule) runtime.NakamaModule {
+	if _, ok := nk.(*storage); ok {
+		return nk
+	}
+	return &storage{NakamaModule: nk}
+}
+
+func (s *storage) record(operation string, start time.Time, err error) {
+	tags := map[string]string{"operation": operation}
+	s.NakamaModule.MetricsTimerRecord(StorageLatency, tags, time.Since(start))
+	if err != nil {
+		s.NakamaModule.MetricsCounterAdd(StorageErrors, tags, 1)
+	}
+}
+
+func (s *storage) StorageRead(ctx context.Context, reads []*runtime.StorageRead) ([]*api.StorageObject, error) {
+	start := time.Now()
+	objects, err := s.NakamaModule.StorageRead(ctx, reads)
+	s.record("read", start, err)
+	return objects, err
+}
+
+func (s *storage) StorageWrite(ctx context.Context, writes []*runtime.StorageWrite) ([]*api.StorageObjectAck, error) {
+	start := time.Now()
+	acks, err := s.NakamaModule.StorageWrite(ctx, writes)
+	s.record("write", start, err)
+	return acks, err
+}
+
+func (s *storage) StorageDelete(ctx context.Context, deletes []*runtime.StorageDelete) error {
+	start := time.Now()
+	err := s.NakamaModule.StorageDelete(ctx, deletes)
+	s.record("delete", start, err)
+	return err
+}
+
+func (s *storage) StorageList(ctx context.Context, callerID, userID, collection string, limit int, cursor string) ([]*api.StorageObject, string, error) {
+	start := time.Now()
+	objects, next, err := s.NakamaModule.StorageList(ctx, callerID, userID, collection, limit, cursor)
+	s.record("list", start, err)
+	return objects, next, err
+}
+
+func (s *storage) StorageIndexList(ctx context.Context, callerID, indexName, query string, limit int) (*api.StorageObjects, error) {
+	start := time.Now()
+	objects, err := s.NakamaModule.StorageIndexList(ctx, callerID, indexName, query, limit)
+	s.record("index_list", start, err)
+	return objects, err
+}
@@ -0,0 +1,290 @@
+package migration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"echonakama/server/services"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	StateStorageCollection = "Migration:state" // the progress of each migration, keyed by migration ID, owned by the system user
+
+	pageSize     = 100
+	writeRetries = 3
+)
+
+// ErrRunning is returned when another node recorded progress on a migration while this node was running it.
+var ErrRunning = errors.New("migration is running elsewhere")
+
+// Migration transforms the stored objects of a collection from one shape to the next.
+type Migration struct {
+	Id          string // identifies the migration; its progress is recorded under this ID, so it must never change
+	Collection  string // the collection of the objects to migrate
+	Key         string // the key of the objects to migrate, or empty for every key
+	Description string // what the migration changes
+
+	// Migrate returns the migrated value, or the value unchanged if it needs no migration.
+	// Objects may be migrated more than once (on read, and by a resumed batch), so it must be idempotent.
+	Migrate func(value string) (string, error)
+
+	// Copy is set instead of Migrate by migrations that copy objects to another owner (e.g. the system user).
+	// It is called with each stored object, and reports whether it wrote anything. Copy migrations only run
+	// as a batch, not as the objects are read; a resumed batch copies objects again, so it must be idempotent.
+	Copy func(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, object *api.StorageObject) (bool, error)
+}
+
+// State is the progress of a migration's batch job.
+type State struct {
+	Id           string `json:"id"`
+	Cursor       string `json:"cursor"`        // where the batch resumes
+	Scanned      int    `json:"scanned"`       // the objects read so far
+	Migrated     int    `json:"migrated"`      // the objects rewritten so far
+	StartTime    int64  `json:"start_time"`    // when the batch first ran
+	CompleteTime int64  `json:"complete_time"` // when every object was migrated, or 0
+}
+
+// Registry holds the migrations, in the order they are applied.
+type Registry struct {
+	mu         sync.RWMutex
+	migrations []*Migration
+	completed  map[string]bool // the migrations whose batch has completed, which no longer run on read
+}
+
+// registry is the module's registry: services register their migrations with it when the module starts,
+// and apply them to the objects they read.
+var registry = NewRegistry()
+
+// Register appends migrations to the module's registry.
+func Register(migrations ...*Migration) error {
+	return registry.Register(migrations...)
+}
+
+// ApplyObject migrates an object read from storage with the module's registry.
+func ApplyObject(object *api.StorageObject) error {
+	return registry.ApplyObject(object)
+}
+
+// Run runs the batch jobs of the module's registry.
+func Run(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule) error {
+	return registry.Run(ctx, logger, nk)
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{completed: make(map[string]bool)}
+}
+
+// Register appends migrations to the registry. Migrations of the same collection are applied in registration order.
+func (r *Registry) Register(migrations ...*Migration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range migrations {
+		if m.Id == "" || m.Collection == "" || (m.Migrate == nil) == (m.Copy == nil) {
+			return fmt.Errorf("migration %q must have an ID, a collection and either a Migrate or a Copy function", m.Id)
+		}
+		for _, registered := range r.migrations {
+			if registered.Id == m.Id {
+				return fmt.Errorf("migration %q is already registered", m.Id)
+			}
+		}
+		r.migrations = append(r.migrations, m)
+	}
+	return nil
+}
+
+// Apply migrates a value read from storage with the migrations whose batch has not completed.
+// It reports whether the value changed; the caller decides whether to write it back.
+func (r *Registry) Apply(collection string, key string, value string) (string, bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	migrated := value
+	for _, m := range r.migrations {
+		if r.completed[m.Id] || m.Migrate == nil || !m.matches(collection, key) {
+			continue
+		}
+		var err error
+		if migrated, err = m.Migrate(migrated); err != nil {
+			return value, false, fmt.Errorf("migration %s: %w", m.Id, err)
+		}
+	}
+	return migrated, migrated != value, nil
+}
+
+// ApplyObject migrates the value of an object read from storage, in place.
+func (r *Registry) ApplyObject(object *api.StorageObject) error {
+	value, changed, err := r.Apply(object.Collection, object.Key, object.Value)
+	if err != nil {
+		return err
+	}
+	if changed {
+		object.Value = value
+	}
+	return nil
+}
+
+// Run migrates every stored object, one migration at a time, recording the progress of each after every page.
+// A run resumes where the last one stopped, and skips the migrations that have completed.
+// It stops at the first object that fails to migrate, so a migration never runs ahead of the ones before it.
+func (r *Registry) Run(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule) error {
+	r.mu.RLock()
+	migrations := append([]*Migration(nil), r.migrations...)
+	r.mu.RUnlock()
+
+	for _, m := range migrations {
+		if err := r.run(ctx, logger.WithField("migration", m.Id), nk, m); err != nil {
+			return fmt.Errorf("migration %s: %w", m.Id, err)
+		}
+	}
+	return nil
+}
+
+func (r *Registry) run(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, m *Migration) error {
+	state, version, err := ReadState(ctx, nk, m.Id)
+	if err != nil {
+		return err
+	}
+	if state.CompleteTime == 0 {
+		if state.StartTime == 0 {
+			state.StartTime = time.Now().UTC().Unix()
+		}
+		logger.WithField("cursor", state.Cursor).Info("Running migration: %s", m.Description)
+
+		for {
+			objects, next, err := nk.StorageList(ctx, "", "", m.Collection, pageSize, state.Cursor)
+			if err != nil {
+				return fmt.Errorf("error listing %s: %w", m.Collection, err)
+			}
+			for _, object := range objects {
+				if !m.matches(object.Collection, object.Key) {
+					continue
+				}
+				var migrated bool
+				if m.Copy != nil {
+					migrated, err = m.Copy(ctx, logger, nk, object)
+				} else {
+					migrated, err = migrateObject(ctx, nk, m, object)
+				}
+				if err != nil {
+					return fmt.Errorf("error migrating %s/%s of %s: %w", object.Collection, object.Key, object.UserId, err)
+				}
+				state.Scanned++
+				if migrated {
+					state.Migrated++
+				}
+			}
+
+			state.Cursor = next
+			if next == "" {
+				state.CompleteTime = time.Now().UTC().Unix()
+			}
+			if version, err = writeState(ctx, nk, state, version); err != nil {
+				return err
+			}
+			if next == "" {
+				break
+			}
+		}
+		logger.WithField("scanned", state.Scanned).WithField("migrated", state.Migrated).Info("Migration complete.")
+	}
+
+	r.mu.Lock()
+	r.completed[m.Id] = true
+	r.mu.Unlock()
+	return nil
+}
+
+func (m *Migration) matches(collection string, key string) bool {
+	return m.Collection == collection && (m.Key == "" || m.Key == key)
+}
+
+// migrateObject rewrites an object if the migration changes it, and reports whether it did.
+// If the object is written concurrently, the latest value is migrated instead.
+func migrateObject(ctx context.Context, nk runtime.NakamaModule, m *Migration, object *api.StorageObject) (bool, error) {
+	for attempt := 0; attempt < writeRetries; attempt++ {
+		value, err := m.Migrate(object.Value)
+		if err != nil {
+			return false, err
+		}
+		if value == object.Value {
+			return false, nil
+		}
+
+		_, err = nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+			Collection:      object.Collection,
+			Key:             object.Key,
+			UserID:          object.UserId,
+			Value:           value,
+			Version:         object.Version,
+			PermissionRead:  int(object.PermissionRead),
+			PermissionWrite: int(object.PermissionWrite),
+		}})
+		if !errors.Is(err, runtime.ErrStorageRejectedVersion) {
+			return err == nil, err
+		}
+
+		objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+			Collection: object.Collection,
+			Key:        object.Key,
+			UserID:     object.UserId,
+		}})
+		if err != nil {
+			return false, err
+		}
+		if len(objects) == 0 {
+			return false, nil // deleted since it was listed
+		}
+		object = objects[0]
+	}
+	return false, fmt.Errorf("object kept changing: %w", runtime.ErrStorageRejectedVersion)
+}
+
+// ReadState returns the progress of a migration, and its storage version ("*" if it has not run).
+func ReadState(ctx context.Context, nk runtime.NakamaModule, migrationId string) (*State, string, error) {
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+		Collection: StateStorageCollection,
+		Key:        migrationId,
+		UserID:     services.SystemUserId,
+	}})
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading migration state: %w", err)
+	}
+	if len(objects) == 0 {
+		return &State{Id: migrationId}, "*", nil
+	}
+	state := &State{}
+	if err := json.Unmarshal([]byte(objects[0].Value), state); err != nil {
+		return nil, "", fmt.Errorf("error unmarshaling migration state: %w", err)
+	}
+	return state, objects[0].Version, nil
+}
+
+// writeState records the progress of a migration, unless another node has recorded progress since it was read.
+func writeState(ctx context.Context, nk runtime.NakamaModule, state *State, version string) (string, error) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return "", fmt.Errorf("error marshaling migration state: %w", err)
+	}
+	acks, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      StateStorageCollection,
+		Key:             state.Id,
+		UserID:          services.SystemUserId,
+		Value:           string(data),
+		Version:         version,
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}})
+	if errors.Is(err, runtime.ErrStorageRejectedVersion) {
+		return "", ErrRunning
+	} else if err != nil {
+		return "", fmt.Errorf("error writing migration state: %w", err)
+	}
+	return acks[0].Version, nil
+}
@@ -0,0 +1,242 @@
+package migration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"echonakama/server/services"
+	"echonakama/server/services/nakamatest"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// renameField returns a migration that renames a JSON field of the objects of a collection.
+func renameField(id string, collection string, from string, to string) *Migration {
+	return &Migration{
+		Id:          id,
+		Collection:  collection,
+		Description: fmt.Sprintf("rename %s to %s", from, to),
+		Migrate: func(value string) (string, error) {
+			if strings.Contains(value, `"fail"`) {
+				return "", errors.New("unable to migrate")
+			}
+			return strings.ReplaceAll(value, `"`+from+`"`, `"`+to+`"`), nil
+		},
+	}
+}
+
+func writeObjects(t *testing.T, nk runtime.NakamaModule, collection string, values ...string) {
+	t.Helper()
+	writes := make([]*runtime.StorageWrite, 0, len(values))
+	for i, value := range values {
+		writes = append(writes, &runtime.StorageWrite{
+			Collection: collection,
+			Key:        fmt.Sprintf("key%03d", i),
+			UserID:     fmt.Sprintf("user%d", i%3),
+			Value:      value,
+		})
+	}
+	if _, err := nk.StorageWrite(context.Background(), writes); err != nil {
+		t.Fatalf("StorageWrite() error: %v", err)
+	}
+}
+
+func readValues(t *testing.T, nk runtime.NakamaModule, collection string) []string {
+	t.Helper()
+	objects, _, err := nk.StorageList(context.Background(), "", "", collection, 1000, "")
+	if err != nil {
+		t.Fatalf("StorageList() error: %v", err)
+	}
+	values := make([]string, 0, len(objects))
+	for _, object := range objects {
+		values = append(values, object.Value)
+	}
+	return values
+}
+
+func TestRegister(t *testing.T) {
+	registry := NewRegistry()
+	if err := registry.Register(renameField("001", "c", "a", "b")); err != nil {
+		t.Fatalf("Register() error: %v", err)
+	}
+	if err := registry.Register(renameField("001", "c", "b", "c")); err == nil {
+		t.Error("Register() error = nil, want an error for a duplicate ID")
+	}
+	if err := registry.Register(&Migration{Id: "002", Collection: "c"}); err == nil {
+		t.Error("Register() error = nil, want an error for a missing Migrate function")
+	}
+	if err := registry.Register(&Migration{Id: "003", Collection: "c", Migrate: func(value string) (string, error) { return value, nil }, Copy: copyToSystemUser}); err == nil {
+		t.Error("Register() error = nil, want an error for both a Migrate and a Copy function")
+	}
+}
+
+func TestApply(t *testing.T) {
+	registry := NewRegistry()
+	registry.Register(renameField("001", "c", "a", "b"), renameField("002", "c", "b", "c"), renameField("003", "other", "c", "d"))
+
+	value, changed, err := registry.Apply("c", "key", `{"a":1}`)
+	if err != nil || !changed || value != `{"c":1}` {
+		t.Errorf("Apply() = %s, %v, %v, want {\"c\":1}, true, nil", value, changed, err)
+	}
+	value, changed, err = registry.Apply("c", "key", `{"c":1}`)
+	if err != nil || changed || value != `{"c":1}` {
+		t.Errorf("Apply() = %s, %v, %v, want the migrated value unchanged", value, changed, err)
+	}
+	if _, _, err := registry.Apply("c", "key", `{"fail":1}`); err == nil {
+		t.Error("Apply() error = nil, want the migration error")
+	}
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	nk := nakamatest.NewModule()
+	logger := nakamatest.NewLogger(t)
+
+	values := make([]string, 0, 250)
+	for i := 0; i < 250; i++ {
+		values = append(values, fmt.Sprintf(`{"a":%d}`, i))
+	}
+	writeObjects(t, nk, "c", values...)
+
+	registry := NewRegistry()
+	registry.Register(renameField("001", "c", "a", "b"))
+	if err := registry.Run(ctx, logger, nk); err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+	for _, value := range readValues(t, nk, "c") {
+		if !strings.HasPrefix(value, `{"b":`) {
+			t.Fatalf("Run() left %s, want every object migrated", value)
+		}
+	}
+
+	state, _, err := ReadState(ctx, nk, "001")
+	if err != nil {
+		t.Fatalf("ReadState() error: %v", err)
+	}
+	if state.CompleteTime == 0 || state.Scanned != 250 || state.Migrated != 250 {
+		t.Errorf("ReadState() = %+v, want 250 objects migrated and complete", state)
+	}
+
+	// A completed migration no longer runs on read
+	if value, changed, _ := registry.Apply("c", "key", `{"a":1}`); changed {
+		t.Errorf("Apply() = %s, want completed migrations skipped", value)
+	}
+
+	// A completed migration is not run again
+	writeObjects(t, nk, "d", `{"a":1}`)
+	rerun := NewRegistry()
+	rerun.Register(renameField("001", "c", "a", "b"), renameField("002", "d", "a", "b"))
+	if err := rerun.Run(ctx, logger, nk); err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+	if state, _, _ := ReadState(ctx, nk, "001"); state.Scanned != 250 {
+		t.Errorf("ReadState() scanned = %d, want the completed migration skipped", state.Scanned)
+	}
+	if values := readValues(t, nk, "d"); values[0] != `{"b":1}` {
+		t.Errorf("Run() left %s, want the new migration run", values[0])
+	}
+}
+
+func TestRunResumes(t *testing.T) {
+	ctx := context.Background()
+	nk := nakamatest.NewModule()
+	logger := nakamatest.NewLogger(t)
+
+	values := make([]string, 0, 150)
+	for i := 0; i < 150; i++ {
+		values = append(values, fmt.Sprintf(`{"a":%d}`, i))
+	}
+	values[120] = `{"fail":1}`
+	writeObjects(t, nk, "c", values...)
+
+	registry := NewRegistry()
+	registry.Register(renameField("001", "c", "a", "b"), renameField("002", "c", "b", "c"))
+	if err := registry.Run(ctx, logger, nk); err == nil {
+		t.Fatal("Run() error = nil, want the migration error")
+	}
+
+	// The first page is recorded; the failed page and the later migration are not
+	state, _, _ := ReadState(ctx, nk, "001")
+	if state.CompleteTime != 0 || state.Scanned != 100 || state.Cursor == "" {
+		t.Errorf("ReadState() = %+v, want the first page recorded", state)
+	}
+	if state, version, _ := ReadState(ctx, nk, "002"); version != "*" || state.Scanned != 0 {
+		t.Errorf("ReadState() = %+v, want the later migration not started", state)
+	}
+
+	// Fix the object and resume
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{Collection: "c", Key: "key120", UserID: "user0", Value: `{"a":120}`}}); err != nil {
+		t.Fatalf("StorageWrite() error: %v", err)
+	}
+	if err := registry.Run(ctx, logger, nk); err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+	if state, _, _ := ReadState(ctx, nk, "001"); state.CompleteTime == 0 || state.Scanned != 150 {
+		t.Errorf("ReadState() = %+v, want the migration resumed after the first page", state)
+	}
+	for _, value := range readValues(t, nk, "c") {
+		if !strings.HasPrefix(value, `{"c":`) {
+			t.Fatalf("Run() left %s, want every object migrated by both migrations", value)
+		}
+	}
+}
+
+// copyToSystemUser copies each object to the system user.
+func copyToSystemUser(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, object *api.StorageObject) (bool, error) {
+	if object.UserId == services.SystemUserId {
+		return false, nil
+	}
+	_, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{Collection: object.Collection, Key: object.Key, UserID: services.SystemUserId, Value: object.Value}})
+	return err == nil, err
+}
+
+func TestRunCopy(t *testing.T) {
+	ctx := context.Background()
+	nk := nakamatest.NewModule()
+	writeObjects(t, nk, "c", `{"a":1}`, `{"a":2}`)
+
+	registry := NewRegistry()
+	registry.Register(&Migration{Id: "001", Collection: "c", Copy: copyToSystemUser})
+	if err := registry.Run(ctx, nakamatest.NewLogger(t), nk); err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+	if objects, _, _ := nk.StorageList(ctx, "", services.SystemUserId, "c", 10, ""); len(objects) != 2 {
+		t.Errorf("StorageList() = %d objects of the system user, want both copied", len(objects))
+	}
+	if state, _, _ := ReadState(ctx, nk, "001"); state.CompleteTime == 0 || state.Migrated != 2 {
+		t.Errorf("ReadState() = %+v, want both copies counted", state)
+	}
+
+	// Copy migrations are not applied to the objects as they are read
+	pending := NewRegistry()
+	pending.Register(&Migration{Id: "002", Collection: "c", Copy: copyToSystemUser})
+	if value, changed, err := pending.Apply("c", "key", `{"a":1}`); changed || err != nil {
+		t.Errorf("Apply() = %s, want the value unchanged", value)
+	}
+}
+
+func TestRunElsewhere(t *testing.T) {
+	ctx := context.Background()
+	nk := nakamatest.NewModule()
+	writeObjects(t, nk, "c", `{"a":1}`)
+
+	registry := NewRegistry()
+	registry.Register(&Migration{
+		Id:         "001",
+		Collection: "c",
+		Migrate: func(value string) (string, error) {
+			// Another node records progress while this one migrates
+			if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{Collection: StateStorageCollection, Key: "001", UserID: services.SystemUserId, Value: `{"id":"001"}`}}); err != nil {
+				t.Fatalf("StorageWrite() error: %v", err)
+			}
+			return value, nil
+		},
+	})
+	if err := registry.Run(ctx, nakamatest.NewLogger(t), nk); !errors.Is(err, ErrRunning) {
+		t.Errorf("Run() error = %v, want %v", err, ErrRunning)
+	}
+}
@@ -0,0 +1,59 @@
+package nakamatest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Logger is a runtime.Logger that writes to the test log.
+type Logger struct {
+	t      testing.TB
+	fields map[string]interface{}
+}
+
+// NewLogger returns a logger that writes to the test log.
+func NewLogger(t testing.TB) *Logger {
+	return &Logger{t: t, fields: make(map[string]interface{})}
+}
+
+func (l *Logger) log(level string, format string, v ...interface{}) {
+	l.t.Helper()
+	keys := make([]string, 0, len(l.fields))
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fields := make([]string, 0, len(keys))
+	for _, k := range keys {
+		fields = append(fields, fmt.Sprintf("%s=%v", k, l.fields[k]))
+	}
+	l.t.Logf("%s %s %s", level, fmt.Sprintf(format, v...), strings.Join(fields, " "))
+}
+
+func (l *Logger) Debug(format string, v ...interface{}) { l.t.Helper(); l.log("DEBUG", format, v...) }
+func (l *Logger) Info(format string, v ...interface{})  { l.t.Helper(); l.log("INFO", format, v...) }
+func (l *Logger) Warn(format string, v ...interface{})  { l.t.Helper(); l.log("WARN", format, v...) }
+func (l *Logger) Error(format string, v ...interface{}) { l.t.Helper(); l.log("ERROR", format, v...) }
+
+func (l *Logger) WithField(key string, v interface{}) runtime.Logger {
+	return l.WithFields(map[string]interface{}{key: v})
+}
+
+func (l *Logger) WithFields(fields map[string]interface{}) runtime.Logger {
+	merged := make(map[string]interface{}, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{t: l.t, fields: merged}
+}
+
+func (l *Logger) Fields() map[string]interface{} {
+	return l.fields
+}
@@ -0,0 +1,862 @@
+// Package nakamatest provides an in-memory runtime.NakamaModule for testing the services in-process.
+package nakamatest
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+var (
+	ErrAccountNotFound   = errors.New("User account not found.")
+	ErrInvalidPassword   = errors.New("Invalid credentials.")
+	ErrUsernameInUse     = errors.New("Username is already in use.")
+	ErrIdentifierInUse   = errors.New("Identifier is already in use.")
+	ErrGroupNotFound     = errors.New("Group not found.")
+	ErrInvalidIdentifier = errors.New("Invalid identifier.")
+)
+
+// Module is an in-memory runtime.NakamaModule. It implements the storage, authentication, account,
+// group, notification and metrics functions the services use; calling any other function panics.
+type Module struct {
+	runtime.NakamaModule
+
+	mu            sync.Mutex
+	objects       map[storageId]*api.StorageObject
+	indexes       map[string]storageIndex
+	accounts      map[string]*account
+	groups        map[string]*group
+	tokens        map[string]map[string]string
+	notifications []*runtime.NotificationSend
+	counters      map[string]int64
+	gauges        map[string]float64
+	timers        map[string][]time.Duration
+	now           func() time.Time
+}
+
+type storageId struct {
+	collection string
+	key        string
+	userId     string
+}
+
+type storageIndex struct {
+	collection string
+	key        string
+	fields     []string
+}
+
+type account struct {
+	user       *api.User
+	customId   string
+	deviceIds  []string
+	email      string
+	password   string
+	disabledAt *timestamppb.Timestamp
+}
+
+type group struct {
+	group   *api.Group
+	members map[string]int // the member states by user ID: 0 superadmin, 1 admin, 2 member
+}
+
+// NewModule returns an empty in-memory module.
+func NewModule() *Module {
+	return &Module{
+		objects:  make(map[storageId]*api.StorageObject),
+		indexes:  make(map[string]storageIndex),
+		accounts: make(map[string]*account),
+		groups:   make(map[string]*group),
+		tokens:   make(map[string]map[string]string),
+		counters: make(map[string]int64),
+		gauges:   make(map[string]float64),
+		timers:   make(map[string][]time.Duration),
+		now:      time.Now,
+	}
+}
+
+// Initializer returns a runtime.Initializer that registers storage indexes with the module.
+// Registering anything else panics.
+func (m *Module) Initializer() runtime.Initializer {
+	return &initializer{module: m}
+}
+
+type initializer struct {
+	runtime.Initializer
+	module *Module
+}
+
+func (i *initializer) RegisterStorageIndex(name, collection, key string, fields []string, maxEntries int, indexOnly bool) error {
+	i.module.mu.Lock()
+	defer i.module.mu.Unlock()
+	i.module.indexes[name] = storageIndex{collection: collection, key: key, fields: fields}
+	return nil
+}
+
+// TokenVars returns the session variables of a token issued by AuthenticateTokenGenerate.
+func (m *Module) TokenVars(token string) (map[string]string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	vars, ok := m.tokens[token]
+	return vars, ok
+}
+
+// Notifications returns the notifications that have been sent.
+func (m *Module) Notifications() []*runtime.NotificationSend {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*runtime.NotificationSend(nil), m.notifications...)
+}
+
+// DisableAccount bans an account, as the console does.
+func (m *Module) DisableAccount(userId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.accounts[userId]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	a.disabledAt = timestamppb.New(m.now())
+	return nil
+}
+
+func storageVersion(value string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(value)))
+}
+
+// checkVersion reports whether an operation with the version precondition may proceed:
+// "" always may, "*" only if the object does not exist, and any other version only if it matches.
+func checkVersion(existing *api.StorageObject, version string) bool {
+	switch version {
+	case "":
+		return true
+	case "*":
+		return existing == nil
+	default:
+		return existing != nil && existing.Version == version
+	}
+}
+
+func (m *Module) StorageRead(ctx context.Context, reads []*runtime.StorageRead) ([]*api.StorageObject, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	objects := make([]*api.StorageObject, 0, len(reads))
+	for _, read := range reads {
+		if object, ok := m.objects[storageId{read.Collection, read.Key, read.UserID}]; ok {
+			objects = append(objects, copyObject(object))
+		}
+	}
+	return objects, nil
+}
+
+func (m *Module) StorageWrite(ctx context.Context, writes []*runtime.StorageWrite) ([]*api.StorageObjectAck, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// The writes are applied together, or not at all
+	for _, write := range writes {
+		if !json.Valid([]byte(write.Value)) {
+			return nil, fmt.Errorf("value must be a JSON object: %s/%s", write.Collection, write.Key)
+		}
+		if !checkVersion(m.objects[storageId{write.Collection, write.Key, write.UserID}], write.Version) {
+			return nil, runtime.ErrStorageRejectedVersion
+		}
+	}
+
+	now := timestamppb.New(m.now())
+	acks := make([]*api.StorageObjectAck, 0, len(writes))
+	for _, write := range writes {
+		id := storageId{write.Collection, write.Key, write.UserID}
+		object := &api.StorageObject{
+			Collection:      write.Collection,
+			Key:             write.Key,
+			UserId:          write.UserID,
+			Value:           write.Value,
+			Version:         storageVersion(write.Value),
+			PermissionRead:  int32(write.PermissionRead),
+			PermissionWrite: int32(write.PermissionWrite),
+			CreateTime:      now,
+			UpdateTime:      now,
+		}
+		if existing, ok := m.objects[id]; ok {
+			object.CreateTime = existing.CreateTime
+		}
+		m.objects[id] = object
+		acks = append(acks, &api.StorageObjectAck{
+			Collection: object.Collection,
+			Key:        object.Key,
+			Version:    object.Version,
+			UserId:     object.UserId,
+			CreateTime: object.CreateTime,
+			UpdateTime: object.UpdateTime,
+		})
+	}
+	return acks, nil
+}
+
+func (m *Module) StorageDelete(ctx context.Context, deletes []*runtime.StorageDelete) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, object := range deletes {
+		existing := m.objects[storageId{object.Collection, object.Key, object.UserID}]
+		if object.Version != "" && !checkVersion(existing, object.Version) {
+			return runtime.ErrStorageRejectedVersion
+		}
+	}
+	for _, object := range deletes {
+		delete(m.objects, storageId{object.Collection, object.Key, object.UserID})
+	}
+	return nil
+}
+
+// StorageList lists a collection ordered by key. An empty userID lists the objects of every user.
+func (m *Module) StorageList(ctx context.Context, callerID, userID, collection string, limit int, cursor string) ([]*api.StorageObject, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	objects := make([]*api.StorageObject, 0)
+	for id, object := range m.objects {
+		if id.collection == collection && (userID == "" || id.userId == userID) {
+			objects = append(objects, object)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].Key != objects[j].Key {
+			return objects[i].Key < objects[j].Key
+		}
+		return objects[i].UserId < objects[j].UserId
+	})
+	return page(objects, limit, cursor, copyObject)
+}
+
+// StorageIndexList supports queries of required terms, such as `+value.field:value +value.other:"quoted"`.
+func (m *Module) StorageIndexList(ctx context.Context, callerID, indexName, query string, limit int) (*api.StorageObjects, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	index, ok := m.indexes[indexName]
+	if !ok {
+		return nil, fmt.Errorf("index %q not found", indexName)
+	}
+	terms, err := parseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]*api.StorageObject, 0)
+	for id, object := range m.objects {
+		if id.collection != index.collection || (index.key != "" && id.key != index.key) {
+			continue
+		}
+		if index.matches(object.Value, terms) {
+			objects = append(objects, copyObject(object))
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].UpdateTime.AsTime().After(objects[j].UpdateTime.AsTime())
+	})
+	if limit > 0 && len(objects) > limit {
+		objects = objects[:limit]
+	}
+	return &api.StorageObjects{Objects: objects}, nil
+}
+
+type queryTerm struct {
+	field string
+	value string
+}
+
+func parseQuery(query string) ([]queryTerm, error) {
+	terms := make([]queryTerm, 0)
+	for _, token := range strings.Fields(query) {
+		token = strings.TrimPrefix(token, "+")
+		field, value, ok := strings.Cut(token, ":")
+		if !ok || !strings.HasPrefix(field, "value.") {
+			return nil, fmt.Errorf("unsupported query term %q", token)
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		terms = append(terms, queryTerm{field: strings.TrimPrefix(field, "value."), value: value})
+	}
+	return terms, nil
+}
+
+func (index storageIndex) matches(value string, terms []queryTerm) bool {
+	document := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(value), &document); err != nil {
+		return false
+	}
+	for _, term := range terms {
+		indexed := false
+		for _, field := range index.fields {
+			indexed = indexed || field == term.field
+		}
+		fieldValue, ok := document[term.field]
+		if !indexed || !ok || fmt.Sprint(fieldValue) != term.value {
+			return false
+		}
+	}
+	return true
+}
+
+func copyObject(object *api.StorageObject) *api.StorageObject {
+	return proto.Clone(object).(*api.StorageObject)
+}
+
+// page returns a page of items, and the cursor of the next page ("" if there is none).
+func page[T any](items []T, limit int, cursor string, copy func(T) T) ([]T, string, error) {
+	offset := 0
+	if cursor != "" {
+		var err error
+		if offset, err = strconv.Atoi(cursor); err != nil || offset < 0 || offset > len(items) {
+			return nil, "", errors.New("invalid cursor")
+		}
+	}
+	end := len(items)
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+	result := make([]T, 0, end-offset)
+	for _, item := range items[offset:end] {
+		result = append(result, copy(item))
+	}
+	next := ""
+	if end < len(items) {
+		next = strconv.Itoa(end)
+	}
+	return result, next, nil
+}
+
+// findAccount returns the account matching a predicate. The caller must hold the lock.
+func (m *Module) findAccount(match func(a *account) bool) *account {
+	for _, a := range m.accounts {
+		if match(a) {
+			return a
+		}
+	}
+	return nil
+}
+
+func (m *Module) usernameInUse(username string) bool {
+	return m.findAccount(func(a *account) bool { return a.user.Username == username }) != nil
+}
+
+// authenticate returns the account matching a predicate, creating it if allowed.
+// The caller must hold the lock.
+func (m *Module) authenticate(match func(a *account) bool, username string, create bool, init func(a *account)) (string, string, bool, error) {
+	if a := m.findAccount(match); a != nil {
+		return a.user.Id, a.user.Username, false, nil
+	}
+	if !create {
+		return "", "", false, ErrAccountNotFound
+	}
+	if username == "" {
+		username = strings.ReplaceAll(uuid.NewString(), "-", "")[:10]
+	}
+	if m.usernameInUse(username) {
+		return "", "", false, ErrUsernameInUse
+	}
+	now := timestamppb.New(m.now())
+	a := &account{user: &api.User{
+		Id:         uuid.NewString(),
+		Username:   username,
+		Metadata:   "{}",
+		CreateTime: now,
+		UpdateTime: now,
+	}}
+	init(a)
+	m.accounts[a.user.Id] = a
+	return a.user.Id, a.user.Username, true, nil
+}
+
+func (m *Module) AuthenticateCustom(ctx context.Context, id, username string, create bool) (string, string, bool, error) {
+	if id == "" {
+		return "", "", false, ErrInvalidIdentifier
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.authenticate(func(a *account) bool { return a.customId == id }, username, create, func(a *account) {
+		a.customId = id
+	})
+}
+
+func (m *Module) AuthenticateDevice(ctx context.Context, id, username string, create bool) (string, string, bool, error) {
+	if id == "" {
+		return "", "", false, ErrInvalidIdentifier
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.authenticate(func(a *account) bool { return hasDevice(a, id) }, username, create, func(a *account) {
+		a.deviceIds = append(a.deviceIds, id)
+	})
+}
+
+func (m *Module) AuthenticateEmail(ctx context.Context, email, password, username string, create bool) (string, string, bool, error) {
+	if email == "" {
+		return "", "", false, ErrInvalidIdentifier
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if a := m.findAccount(func(a *account) bool { return a.email == email }); a != nil && a.password != password {
+		return "", "", false, ErrInvalidPassword
+	}
+	return m.authenticate(func(a *account) bool { return a.email == email }, username, create, func(a *account) {
+		a.email = email
+		a.password = password
+	})
+}
+
+// AuthenticateTokenGenerate issues an opaque token, whose variables are available from TokenVars.
+func (m *Module) AuthenticateTokenGenerate(userID, username string, exp int64, vars map[string]string) (string, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if exp == 0 {
+		exp = m.now().Add(time.Hour).Unix()
+	}
+	token := uuid.NewString()
+	tokenVars := map[string]string{"uid": userID, "usn": username}
+	for k, v := range vars {
+		tokenVars[k] = v
+	}
+	m.tokens[token] = tokenVars
+	return token, exp, nil
+}
+
+func hasDevice(a *account, deviceId string) bool {
+	for _, id := range a.deviceIds {
+		if id == deviceId {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *account) apiAccount() *api.Account {
+	user := proto.Clone(a.user).(*api.User)
+	devices := make([]*api.AccountDevice, 0, len(a.deviceIds))
+	for _, id := range a.deviceIds {
+		devices = append(devices, &api.AccountDevice{Id: id})
+	}
+	return &api.Account{
+		User:        user,
+		Email:       a.email,
+		Devices:     devices,
+		CustomId:    a.customId,
+		DisableTime: a.disabledAt,
+	}
+}
+
+func (m *Module) AccountGetId(ctx context.Context, userID string) (*api.Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.accounts[userID]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	return a.apiAccount(), nil
+}
+
+// AccountUpdateId updates the account; empty values (and nil metadata) are left unchanged.
+func (m *Module) AccountUpdateId(ctx context.Context, userID, username string, metadata map[string]interface{}, displayName, timezone, location, langTag, avatarUrl string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.accounts[userID]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	if username != "" && username != a.user.Username {
+		if m.usernameInUse(username) {
+			return ErrUsernameInUse
+		}
+		a.user.Username = username
+	}
+	if metadata != nil {
+		data, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		a.user.Metadata = string(data)
+	}
+	for _, field := range []struct {
+		value  string
+		target *string
+	}{
+		{displayName, &a.user.DisplayName},
+		{timezone, &a.user.Timezone},
+		{location, &a.user.Location},
+		{langTag, &a.user.LangTag},
+		{avatarUrl, &a.user.AvatarUrl},
+	} {
+		if field.value != "" {
+			*field.target = field.value
+		}
+	}
+	a.user.UpdateTime = timestamppb.New(m.now())
+	return nil
+}
+
+// AccountDeleteId deletes the account, its storage objects and its group memberships.
+func (m *Module) AccountDeleteId(ctx context.Context, userID string, recorded bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.accounts[userID]; !ok {
+		return ErrAccountNotFound
+	}
+	delete(m.accounts, userID)
+	for id := range m.objects {
+		if id.userId == userID {
+			delete(m.objects, id)
+		}
+	}
+	for _, g := range m.groups {
+		delete(g.members, userID)
+	}
+	return nil
+}
+
+// UsersGetId returns the users with the IDs; the facebook IDs are not supported.
+func (m *Module) UsersGetId(ctx context.Context, userIDs []string, facebookIDs []string) ([]*api.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := make([]*api.User, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if a, ok := m.accounts[userID]; ok {
+			users = append(users, proto.Clone(a.user).(*api.User))
+		}
+	}
+	return users, nil
+}
+
+func (m *Module) UsersGetUsername(ctx context.Context, usernames []string) ([]*api.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := make([]*api.User, 0, len(usernames))
+	for _, username := range usernames {
+		if a := m.findAccount(func(a *account) bool { return a.user.Username == username }); a != nil {
+			users = append(users, proto.Clone(a.user).(*api.User))
+		}
+	}
+	return users, nil
+}
+
+// link sets an identifier on an account, if no other account has it. The caller must hold the lock.
+func (m *Module) link(userID string, id string, owns func(a *account) bool, set func(a *account)) error {
+	if id == "" {
+		return ErrInvalidIdentifier
+	}
+	a, ok := m.accounts[userID]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	if other := m.findAccount(owns); other != nil && other != a {
+		return ErrIdentifierInUse
+	}
+	set(a)
+	return nil
+}
+
+func (m *Module) LinkCustom(ctx context.Context, userID, customID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.link(userID, customID, func(a *account) bool { return a.customId == customID }, func(a *account) {
+		a.customId = customID
+	})
+}
+
+func (m *Module) LinkDevice(ctx context.Context, userID, deviceID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.link(userID, deviceID, func(a *account) bool { return hasDevice(a, deviceID) }, func(a *account) {
+		if !hasDevice(a, deviceID) {
+			a.deviceIds = append(a.deviceIds, deviceID)
+		}
+	})
+}
+
+func (m *Module) LinkEmail(ctx context.Context, userID, email, password string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.link(userID, email, func(a *account) bool { return a.email == email }, func(a *account) {
+		a.email = email
+		a.password = password
+	})
+}
+
+func (m *Module) UnlinkCustom(ctx context.Context, userID, customID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.accounts[userID]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	if a.customId == customID {
+		a.customId = ""
+	}
+	return nil
+}
+
+func (m *Module) UnlinkDevice(ctx context.Context, userID, deviceID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.accounts[userID]
+	if !ok {
+		return ErrAccountNotFound
+	}
+	for i, id := range a.deviceIds {
+		if id == deviceID {
+			a.deviceIds = append(a.deviceIds[:i], a.deviceIds[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *Module) GroupCreate(ctx context.Context, userID, name, creatorID, langTag, description, avatarUrl string, open bool, metadata map[string]interface{}, maxCount int) (*api.Group, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, g := range m.groups {
+		if g.group.Name == name {
+			return nil, errors.New("Group name is in use.")
+		}
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	now := timestamppb.New(m.now())
+	g := &group{
+		group: &api.Group{
+			Id:          uuid.NewString(),
+			CreatorId:   creatorID,
+			Name:        name,
+			Description: description,
+			LangTag:     langTag,
+			Metadata:    string(data),
+			AvatarUrl:   avatarUrl,
+			Open:        wrapperspb.Bool(open),
+			MaxCount:    int32(maxCount),
+			CreateTime:  now,
+			UpdateTime:  now,
+		},
+		members: make(map[string]int),
+	}
+	m.groups[g.group.Id] = g
+	return g.apiGroup(), nil
+}
+
+func (m *Module) GroupUpdate(ctx context.Context, id, userID, name, creatorID, langTag, description, avatarUrl string, open bool, metadata map[string]interface{}, maxCount int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, ok := m.groups[id]
+	if !ok {
+		return ErrGroupNotFound
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	g.group.Name = name
+	g.group.CreatorId = creatorID
+	g.group.LangTag = langTag
+	g.group.Description = description
+	g.group.AvatarUrl = avatarUrl
+	g.group.Open = wrapperspb.Bool(open)
+	g.group.Metadata = string(data)
+	g.group.MaxCount = int32(maxCount)
+	g.group.UpdateTime = timestamppb.New(m.now())
+	return nil
+}
+
+func (m *Module) GroupDelete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.groups, id)
+	return nil
+}
+
+func (m *Module) GroupUsersAdd(ctx context.Context, callerID, groupID string, userIDs []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, ok := m.groups[groupID]
+	if !ok {
+		return ErrGroupNotFound
+	}
+	for _, userID := range userIDs {
+		if _, ok := m.accounts[userID]; !ok {
+			return ErrAccountNotFound
+		}
+	}
+	for _, userID := range userIDs {
+		if _, ok := g.members[userID]; !ok {
+			g.members[userID] = 2
+		}
+	}
+	return nil
+}
+
+// GroupUsersPromote promotes members to admins, and admins to superadmins.
+func (m *Module) GroupUsersPromote(ctx context.Context, callerID, groupID string, userIDs []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, ok := m.groups[groupID]
+	if !ok {
+		return ErrGroupNotFound
+	}
+	for _, userID := range userIDs {
+		if state, ok := g.members[userID]; ok && state > 0 {
+			g.members[userID] = state - 1
+		}
+	}
+	return nil
+}
+
+func (m *Module) GroupUsersKick(ctx context.Context, callerID, groupID string, userIDs []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, ok := m.groups[groupID]
+	if !ok {
+		return ErrGroupNotFound
+	}
+	for _, userID := range userIDs {
+		delete(g.members, userID)
+	}
+	return nil
+}
+
+// GroupsList lists the groups ordered by name; only the name filter is supported.
+func (m *Module) GroupsList(ctx context.Context, name, langTag string, members *int, open *bool, limit int, cursor string) ([]*api.Group, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	groups := make([]*group, 0, len(m.groups))
+	for _, g := range m.groups {
+		if name == "" || g.group.Name == name {
+			groups = append(groups, g)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].group.Name < groups[j].group.Name })
+	result, next, err := page(groups, limit, cursor, func(g *group) *group { return g })
+	if err != nil {
+		return nil, "", err
+	}
+	apiGroups := make([]*api.Group, 0, len(result))
+	for _, g := range result {
+		apiGroups = append(apiGroups, g.apiGroup())
+	}
+	return apiGroups, next, nil
+}
+
+// UserGroupsList lists the groups a user is a member of, ordered by name, with the user's state.
+func (m *Module) UserGroupsList(ctx context.Context, userID string, limit int, state *int, cursor string) ([]*api.UserGroupList_UserGroup, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	groups := make([]*group, 0)
+	for _, g := range m.groups {
+		if memberState, ok := g.members[userID]; ok && (state == nil || *state == memberState) {
+			groups = append(groups, g)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].group.Name < groups[j].group.Name })
+	result, next, err := page(groups, limit, cursor, func(g *group) *group { return g })
+	if err != nil {
+		return nil, "", err
+	}
+	userGroups := make([]*api.UserGroupList_UserGroup, 0, len(result))
+	for _, g := range result {
+		userGroups = append(userGroups, &api.UserGroupList_UserGroup{Group: g.apiGroup(), State: wrapperspb.Int32(int32(g.members[userID]))})
+	}
+	return userGroups, next, nil
+}
+
+func (g *group) apiGroup() *api.Group {
+	c := proto.Clone(g.group).(*api.Group)
+	c.EdgeCount = int32(len(g.members))
+	return c
+}
+
+func (m *Module) NotificationSend(ctx context.Context, userID, subject string, content map[string]interface{}, code int, sender string, persistent bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notifications = append(m.notifications, &runtime.NotificationSend{
+		UserID:     userID,
+		Subject:    subject,
+		Content:    content,
+		Code:       code,
+		Sender:     sender,
+		Persistent: persistent,
+	})
+	return nil
+}
+
+func (m *Module) NotificationsSend(ctx context.Context, notifications []*runtime.NotificationSend) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notifications = append(m.notifications, notifications...)
+	return nil
+}
+
+// metricKey identifies a metric by its name and tags, such as `name{a=1,b=2}`.
+func metricKey(name string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+tags[k])
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *Module) MetricsCounterAdd(name string, tags map[string]string, delta int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[metricKey(name, tags)] += delta
+}
+
+func (m *Module) MetricsGaugeSet(name string, tags map[string]string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[metricKey(name, tags)] = value
+}
+
+func (m *Module) MetricsTimerRecord(name string, tags map[string]string, value time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := metricKey(name, tags)
+	m.timers[key] = append(m.timers[key], value)
+}
+
+// Counter returns the value of a counter with exactly these tags.
+func (m *Module) Counter(name string, tags map[string]string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[metricKey(name, tags)]
+}
+
+// Gauge returns the value of a gauge with exactly these tags, and whether it has been set.
+func (m *Module) Gauge(name string, tags map[string]string) (float64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, ok := m.gauges[metricKey(name, tags)]
+	return value, ok
+}
+
+// Timings returns the durations recorded by a timer with exactly these tags.
+func (m *Module) Timings(name string, tags map[string]string) []time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]time.Duration(nil), m.timers[metricKey(name, tags)]...)
+}
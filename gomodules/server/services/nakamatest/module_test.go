@@ -0,0 +1,150 @@
+package nakamatest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+func TestStorageWriteVersion(t *testing.T) {
+	ctx := context.Background()
+	nk := NewModule()
+	acks, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{Collection: "c", Key: "k", Value: `{"n":1}`}})
+	if err != nil {
+		t.Fatalf("StorageWrite() error: %v", err)
+	}
+	version := acks[0].Version
+
+	tests := []struct {
+		name    string
+		version string
+		wantErr bool
+	}{
+		{"must not exist", "*", true},
+		{"stale version", "stale", true},
+		{"current version", version, false},
+		{"previous version", version, true},
+		{"unconditional", "", false},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{Collection: "c", Key: "k", Value: fmt.Sprintf(`{"n":%d}`, i+2), Version: tt.version}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("StorageWrite() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, runtime.ErrStorageRejectedVersion) {
+				t.Errorf("StorageWrite() error = %v, want %v", err, runtime.ErrStorageRejectedVersion)
+			}
+		})
+	}
+}
+
+func TestStorageWriteAtomic(t *testing.T) {
+	ctx := context.Background()
+	nk := NewModule()
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{Collection: "c", Key: "exists", Value: `{}`}}); err != nil {
+		t.Fatalf("StorageWrite() error: %v", err)
+	}
+
+	_, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
+		{Collection: "c", Key: "new", Value: `{}`, Version: "*"},
+		{Collection: "c", Key: "exists", Value: `{}`, Version: "*"},
+	})
+	if !errors.Is(err, runtime.ErrStorageRejectedVersion) {
+		t.Fatalf("StorageWrite() error = %v, want %v", err, runtime.ErrStorageRejectedVersion)
+	}
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: "c", Key: "new"}})
+	if err != nil {
+		t.Fatalf("StorageRead() error: %v", err)
+	}
+	if len(objects) != 0 {
+		t.Errorf("StorageRead() = %d objects, want none from the rejected write", len(objects))
+	}
+}
+
+func TestStorageIndexList(t *testing.T) {
+	ctx := context.Background()
+	nk := NewModule()
+	if err := nk.Initializer().RegisterStorageIndex("index", "c", "", []string{"name", "level"}, 100, false); err != nil {
+		t.Fatalf("RegisterStorageIndex() error: %v", err)
+	}
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
+		{Collection: "c", Key: "a", Value: `{"name":"alpha","level":1,"other":"x"}`},
+		{Collection: "c", Key: "b", Value: `{"name":"beta","level":2,"other":"x"}`},
+		{Collection: "d", Key: "a", Value: `{"name":"alpha","level":1}`},
+	}); err != nil {
+		t.Fatalf("StorageWrite() error: %v", err)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"+value.name:alpha", []string{"a"}},
+		{`+value.name:"beta" +value.level:2`, []string{"b"}},
+		{"+value.name:alpha +value.level:2", nil},
+		{"+value.other:x", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			objects, err := nk.StorageIndexList(ctx, "", "index", tt.query, 10)
+			if err != nil {
+				t.Fatalf("StorageIndexList() error: %v", err)
+			}
+			if len(objects.Objects) != len(tt.want) {
+				t.Fatalf("StorageIndexList() = %d objects, want %d", len(objects.Objects), len(tt.want))
+			}
+			for i, object := range objects.Objects {
+				if object.Collection != "c" || object.Key != tt.want[i] {
+					t.Errorf("StorageIndexList()[%d] = %s/%s, want c/%s", i, object.Collection, object.Key, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	ctx := context.Background()
+	nk := NewModule()
+
+	if _, _, _, err := nk.AuthenticateDevice(ctx, "device", "", false); !errors.Is(err, ErrAccountNotFound) {
+		t.Fatalf("AuthenticateDevice() error = %v, want %v", err, ErrAccountNotFound)
+	}
+	userId, _, created, err := nk.AuthenticateCustom(ctx, "custom", "player", true)
+	if err != nil || !created {
+		t.Fatalf("AuthenticateCustom() created = %v, error = %v", created, err)
+	}
+	if _, _, _, err := nk.AuthenticateCustom(ctx, "other", "player", true); !errors.Is(err, ErrUsernameInUse) {
+		t.Errorf("AuthenticateCustom() error = %v, want %v", err, ErrUsernameInUse)
+	}
+
+	if err := nk.LinkDevice(ctx, userId, "device"); err != nil {
+		t.Fatalf("LinkDevice() error: %v", err)
+	}
+	if id, _, created, err := nk.AuthenticateDevice(ctx, "device", "", false); err != nil || created || id != userId {
+		t.Errorf("AuthenticateDevice() = %s, %v, %v, want %s", id, created, err, userId)
+	}
+
+	if err := nk.LinkEmail(ctx, userId, "player@example.com", "secret"); err != nil {
+		t.Fatalf("LinkEmail() error: %v", err)
+	}
+	if _, _, _, err := nk.AuthenticateEmail(ctx, "player@example.com", "wrong", "", false); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("AuthenticateEmail() error = %v, want %v", err, ErrInvalidPassword)
+	}
+	if id, _, _, err := nk.AuthenticateEmail(ctx, "player@example.com", "secret", "", false); err != nil || id != userId {
+		t.Errorf("AuthenticateEmail() = %s, %v, want %s", id, err, userId)
+	}
+
+	account, err := nk.AccountGetId(ctx, userId)
+	if err != nil {
+		t.Fatalf("AccountGetId() error: %v", err)
+	}
+	if account.CustomId != "custom" || account.Email != "player@example.com" || len(account.Devices) != 1 {
+		t.Errorf("AccountGetId() = %v, want the linked identifiers", account)
+	}
+}
@@ -0,0 +1,511 @@
+package party
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+
+	"github.com/google/uuid"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	PartyStorageCollection      = "Party:party"      // parties, keyed by party ID, owned by the system user
+	PartyCodeStorageCollection  = "Party:code"       // party IDs, keyed by party code, owned by the system user
+	MembershipStorageCollection = "Party:membership" // each player's party, owned by the player
+	MembershipStorageKey        = "party"
+
+	// The notification sent to an invited player
+	InviteNotificationSubject = "party_invite"
+	InviteNotificationCode    = 101
+
+	// MaxPartySize is the number of players that fit in a team
+	MaxPartySize = 4
+	// InviteTTL is how long an invite can be accepted for
+	InviteTTL = 10 * time.Minute
+
+	// The characters party codes are made of (without ones that are easily confused)
+	codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	codeLength   = 6
+)
+
+// Invite is an outstanding invitation to join a party.
+type Invite struct {
+	UserId    string `json:"user_id"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// Party is a group of players who queue together. Its members are Nakama user IDs.
+type Party struct {
+	PartyId      string    `json:"party_id"`
+	LeaderUserId string    `json:"leader_user_id"` // the member who queues for the party
+	Members      []string  `json:"members"`        // the members, in the order they joined (the leader included)
+	Invites      []*Invite `json:"invites"`
+	Code         string    `json:"code"` // a short code players can join the party with, without an invite
+	CreatedAt    int64     `json:"created_at"`
+}
+
+// IsMember returns true if the user is in the party.
+func (p *Party) IsMember(userId string) bool {
+	for _, member := range p.Members {
+		if member == userId {
+			return true
+		}
+	}
+	return false
+}
+
+// IsInvited returns true if the user has an invite that has not expired.
+func (p *Party) IsInvited(userId string, now time.Time) bool {
+	for _, invite := range p.Invites {
+		if invite.UserId == userId && invite.ExpiresAt > now.Unix() {
+			return true
+		}
+	}
+	return false
+}
+
+// AddInvite invites the user, replacing any previous invite, and drops expired invites.
+func (p *Party) AddInvite(userId string, now time.Time) {
+	p.removeInvite(userId, now)
+	p.Invites = append(p.Invites, &Invite{UserId: userId, ExpiresAt: now.Add(InviteTTL).Unix()})
+}
+
+func (p *Party) removeInvite(userId string, now time.Time) {
+	invites := make([]*Invite, 0, len(p.Invites))
+	for _, invite := range p.Invites {
+		if invite.UserId != userId && invite.ExpiresAt > now.Unix() {
+			invites = append(invites, invite)
+		}
+	}
+	p.Invites = invites
+}
+
+// AddMember adds the user to the party, consuming their invite.
+func (p *Party) AddMember(userId string, now time.Time) error {
+	if p.IsMember(userId) {
+		return errors.New("already a member of the party")
+	}
+	if len(p.Members) >= MaxPartySize {
+		return fmt.Errorf("the party is full (%d members)", MaxPartySize)
+	}
+	p.removeInvite(userId, now)
+	p.Members = append(p.Members, userId)
+	return nil
+}
+
+// RemoveMember removes the user from the party. If the leader leaves, the longest standing member leads.
+func (p *Party) RemoveMember(userId string) {
+	members := make([]string, 0, len(p.Members))
+	for _, member := range p.Members {
+		if member != userId {
+			members = append(members, member)
+		}
+	}
+	p.Members = members
+	if p.LeaderUserId == userId {
+		p.LeaderUserId = ""
+		if len(members) > 0 {
+			p.LeaderUserId = members[0]
+		}
+	}
+}
+
+// NormalizeCode returns the code as parties store it.
+func NormalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func newCode() (string, error) {
+	var b strings.Builder
+	for i := 0; i < codeLength; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(codeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(codeAlphabet[n.Int64()])
+	}
+	return b.String(), nil
+}
+
+// readParty returns the party and its storage version, or nil if there is no such party.
+func readParty(ctx context.Context, nk runtime.NakamaModule, partyId string) (*Party, string, error) {
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+		Collection: PartyStorageCollection,
+		Key:        partyId,
+		UserID:     services.SystemUserId,
+	}})
+	if err != nil {
+		return nil, "", err
+	}
+	if len(objects) == 0 {
+		return nil, "", nil
+	}
+	party := &Party{}
+	if err := json.Unmarshal([]byte(objects[0].Value), party); err != nil {
+		return nil, "", err
+	}
+	return party, objects[0].Version, nil
+}
+
+// readMembership returns the ID of the user's party ("" if the user is not in a party), and the storage version
+// of the membership ("*" if there is none). A membership can outlive its party, or name one the user was kicked from.
+func readMembership(ctx context.Context, nk runtime.NakamaModule, userId string) (string, string, error) {
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+		Collection: MembershipStorageCollection,
+		Key:        MembershipStorageKey,
+		UserID:     userId,
+	}})
+	if err != nil {
+		return "", "", err
+	}
+	if len(objects) == 0 {
+		return "", "*", nil
+	}
+	membership := struct {
+		PartyId string `json:"party_id"`
+	}{}
+	if err := json.Unmarshal([]byte(objects[0].Value), &membership); err != nil {
+		return "", "", err
+	}
+	return membership.PartyId, objects[0].Version, nil
+}
+
+// partyIdOf returns the ID of the user's party, or "" if the user is not in a party.
+func partyIdOf(ctx context.Context, nk runtime.NakamaModule, userId string) (string, error) {
+	partyId, _, err := readMembership(ctx, nk, userId)
+	return partyId, err
+}
+
+// PartyOf returns the user's party, or nil if the user is not in a party.
+func PartyOf(ctx context.Context, nk runtime.NakamaModule, userId string) (*Party, error) {
+	partyId, err := partyIdOf(ctx, nk, userId)
+	if err != nil || partyId == "" {
+		return nil, err
+	}
+	party, _, err := readParty(ctx, nk, partyId)
+	if err != nil || party == nil || !party.IsMember(userId) {
+		return nil, err
+	}
+	return party, nil
+}
+
+func partyWrite(party *Party, version string) (*runtime.StorageWrite, error) {
+	data, err := json.Marshal(party)
+	if err != nil {
+		return nil, err
+	}
+	return &runtime.StorageWrite{
+		Collection:      PartyStorageCollection,
+		Key:             party.PartyId,
+		UserID:          services.SystemUserId,
+		Value:           string(data),
+		Version:         version,
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}, nil
+}
+
+// membershipWrite returns the write of the user's membership, if the stored membership still has the version.
+func membershipWrite(userId string, partyId string, version string) *runtime.StorageWrite {
+	return &runtime.StorageWrite{
+		Collection:      MembershipStorageCollection,
+		Key:             MembershipStorageKey,
+		UserID:          userId,
+		Value:           fmt.Sprintf(`{"party_id":%q}`, partyId),
+		Version:         version,
+		PermissionRead:  1,
+		PermissionWrite: 0,
+	}
+}
+
+// writeParty stores the party (if the stored party still has the version) with any other writes, in one transaction.
+func writeParty(serviceContext *services.ServiceContext, party *Party, version string, writes ...*runtime.StorageWrite) *apierror.Error {
+
+	write, err := partyWrite(party, version)
+	if err != nil {
+		return apierror.Internal("error marshaling party", err)
+	}
+	if _, err := serviceContext.NakamaModule.StorageWrite(serviceContext.Ctx, append([]*runtime.StorageWrite{write}, writes...)); err != nil {
+		if errors.Is(err, runtime.ErrStorageRejectedVersion) {
+			return apierror.New(apierror.StatusAborted, apierror.ReasonConflict, "party or membership was modified concurrently")
+		}
+		return apierror.Internal("error writing party", err)
+	}
+	return nil
+}
+
+// requireNoParty returns an error if the user is already in a party. Otherwise it returns the version of the
+// user's membership, which joining a party must be conditional on, so the user never joins two parties at once.
+func requireNoParty(serviceContext *services.ServiceContext, userId string) (string, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	nk := serviceContext.NakamaModule
+
+	partyId, version, err := readMembership(ctx, nk, userId)
+	if err != nil {
+		return "", apierror.Internal("error reading party", err)
+	}
+	if partyId == "" {
+		return version, nil
+	}
+	existing, _, err := readParty(ctx, nk, partyId)
+	if err != nil {
+		return "", apierror.Internal("error reading party", err)
+	}
+	if existing != nil && existing.IsMember(userId) {
+		return "", apierror.New(apierror.StatusAlreadyExists, apierror.ReasonConflict, "already in a party; leave it first")
+	}
+	return version, nil
+}
+
+// requireParty returns the user's party and its storage version, or an error if the user is not in one.
+func requireParty(serviceContext *services.ServiceContext, userId string) (*Party, string, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	nk := serviceContext.NakamaModule
+
+	partyId, err := partyIdOf(ctx, nk, userId)
+	if err != nil {
+		return nil, "", apierror.Internal("error reading party", err)
+	}
+	if partyId == "" {
+		return nil, "", apierror.New(apierror.StatusNotFound, apierror.ReasonNotFound, "not in a party")
+	}
+	party, version, err := readParty(ctx, nk, partyId)
+	if err != nil {
+		return nil, "", apierror.Internal("error reading party", err)
+	}
+	if party == nil || !party.IsMember(userId) {
+		return nil, "", apierror.New(apierror.StatusNotFound, apierror.ReasonNotFound, "not in a party")
+	}
+	return party, version, nil
+}
+
+// CreateParty creates a party led by the user.
+func CreateParty(serviceContext *services.ServiceContext, userId string) (*Party, *apierror.Error) {
+	logger := serviceContext.Logger
+
+	membershipVersion, apiErr := requireNoParty(serviceContext, userId)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	// A new code is tried if the first collides with another party's
+	for attempt := 0; attempt < 3; attempt++ {
+		code, err := newCode()
+		if err != nil {
+			return nil, apierror.Internal("error generating party code", err)
+		}
+
+		party := &Party{
+			PartyId:      uuid.New().String(),
+			LeaderUserId: userId,
+			Members:      []string{userId},
+			Invites:      []*Invite{},
+			Code:         code,
+			CreatedAt:    time.Now().UTC().Unix(),
+		}
+		codeWrite := &runtime.StorageWrite{
+			Collection:      PartyCodeStorageCollection,
+			Key:             code,
+			UserID:          services.SystemUserId,
+			Value:           fmt.Sprintf(`{"party_id":%q}`, party.PartyId),
+			Version:         "*",
+			PermissionRead:  0,
+			PermissionWrite: 0,
+		}
+		if apiErr = writeParty(serviceContext, party, "*", codeWrite, membershipWrite(userId, party.PartyId, membershipVersion)); apiErr != nil {
+			if apiErr.Code == apierror.StatusAborted && codeTaken(serviceContext, code) {
+				continue
+			}
+			return nil, apiErr
+		}
+		logger.WithField("partyId", party.PartyId).WithField("userId", userId).Info("Party created.")
+		return party, nil
+	}
+	return nil, apiErr
+}
+
+// codeTaken returns true if another party has the code.
+func codeTaken(serviceContext *services.ServiceContext, code string) bool {
+	objects, err := serviceContext.NakamaModule.StorageRead(serviceContext.Ctx, []*runtime.StorageRead{{
+		Collection: PartyCodeStorageCollection,
+		Key:        code,
+		UserID:     services.SystemUserId,
+	}})
+	return err == nil && len(objects) > 0
+}
+
+// GetParty returns the user's party.
+func GetParty(serviceContext *services.ServiceContext, userId string) (*Party, *apierror.Error) {
+	party, _, apiErr := requireParty(serviceContext, userId)
+	return party, apiErr
+}
+
+// InviteUser invites a user to the leader's party, and notifies them.
+func InviteUser(serviceContext *services.ServiceContext, leaderUserId string, userId string) (*Party, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	logger := serviceContext.Logger
+	nk := serviceContext.NakamaModule
+
+	party, version, apiErr := requireParty(serviceContext, leaderUserId)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	if party.LeaderUserId != leaderUserId {
+		return nil, apierror.New(apierror.StatusPermissionDenied, apierror.ReasonPermissionDenied, "only the party leader may invite")
+	}
+	if party.IsMember(userId) {
+		return nil, apierror.New(apierror.StatusAlreadyExists, apierror.ReasonConflict, "already a member of the party")
+	}
+	if len(party.Members) >= MaxPartySize {
+		return nil, apierror.New(apierror.StatusResourceExhausted, apierror.ReasonUnavailable, fmt.Sprintf("the party is full (%d members)", MaxPartySize))
+	}
+	users, err := nk.UsersGetId(ctx, []string{userId}, nil)
+	if err != nil {
+		return nil, apierror.Internal("error getting user", err)
+	}
+	if len(users) == 0 {
+		return nil, apierror.New(apierror.StatusNotFound, apierror.ReasonNotFound, fmt.Sprintf("user not found: %q", userId))
+	}
+
+	party.AddInvite(userId, time.Now().UTC())
+	if apiErr := writeParty(serviceContext, party, version); apiErr != nil {
+		return nil, apiErr
+	}
+	content := map[string]interface{}{"party_id": party.PartyId, "leader_user_id": leaderUserId}
+	if err := nk.NotificationSend(ctx, userId, InviteNotificationSubject, content, InviteNotificationCode, leaderUserId, true); err != nil {
+		logger.WithField("err", err).Warn("Unable to send party invite.")
+	}
+	return party, nil
+}
+
+// Accept adds the user to a party they were invited to, or whose code they have.
+// Set either partyId or code.
+func Accept(serviceContext *services.ServiceContext, userId string, partyId string, code string) (*Party, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	logger := serviceContext.Logger
+	nk := serviceContext.NakamaModule
+
+	membershipVersion, apiErr := requireNoParty(serviceContext, userId)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	byCode := partyId == ""
+	if byCode {
+		objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+			Collection: PartyCodeStorageCollection,
+			Key:        NormalizeCode(code),
+			UserID:     services.SystemUserId,
+		}})
+		if err != nil {
+			return nil, apierror.Internal("error reading party code", err)
+		}
+		if len(objects) > 0 {
+			index := struct {
+				PartyId string `json:"party_id"`
+			}{}
+			if err := json.Unmarshal([]byte(objects[0].Value), &index); err == nil {
+				partyId = index.PartyId
+			}
+		}
+		if partyId == "" {
+			return nil, apierror.New(apierror.StatusNotFound, apierror.ReasonNotFound, "no party has that code")
+		}
+	}
+
+	party, version, err := readParty(ctx, nk, partyId)
+	if err != nil {
+		return nil, apierror.Internal("error reading party", err)
+	}
+	now := time.Now().UTC()
+	if party == nil || (!byCode && !party.IsInvited(userId, now)) {
+		return nil, apierror.New(apierror.StatusNotFound, apierror.ReasonNotFound, "no invite to that party")
+	}
+	if err := party.AddMember(userId, now); err != nil {
+		return nil, apierror.New(apierror.StatusFailedPrecondition, apierror.ReasonConflict, err.Error())
+	}
+	if apiErr := writeParty(serviceContext, party, version, membershipWrite(userId, party.PartyId, membershipVersion)); apiErr != nil {
+		return nil, apiErr
+	}
+	logger.WithField("partyId", party.PartyId).WithField("userId", userId).Info("Joined party.")
+	return party, nil
+}
+
+// removeMember removes a member from their party. The last member to leave disbands the party.
+func removeMember(serviceContext *services.ServiceContext, party *Party, version string, userId string) *apierror.Error {
+	ctx := serviceContext.Ctx
+	logger := serviceContext.Logger
+	nk := serviceContext.NakamaModule
+
+	party.RemoveMember(userId)
+	deletes := []*runtime.StorageDelete{{
+		Collection: MembershipStorageCollection,
+		Key:        MembershipStorageKey,
+		UserID:     userId,
+	}}
+
+	if len(party.Members) == 0 {
+		deletes = append(deletes, &runtime.StorageDelete{
+			Collection: PartyStorageCollection,
+			Key:        party.PartyId,
+			UserID:     services.SystemUserId,
+			Version:    version,
+		}, &runtime.StorageDelete{
+			Collection: PartyCodeStorageCollection,
+			Key:        party.Code,
+			UserID:     services.SystemUserId,
+		})
+		if err := nk.StorageDelete(ctx, deletes); err != nil {
+			return apierror.Internal("error disbanding party", err)
+		}
+		logger.WithField("partyId", party.PartyId).Info("Party disbanded.")
+		return nil
+	}
+
+	if apiErr := writeParty(serviceContext, party, version); apiErr != nil {
+		return apiErr
+	}
+	if err := nk.StorageDelete(ctx, deletes); err != nil {
+		logger.WithField("err", err).Warn("Unable to remove party membership.")
+	}
+	return nil
+}
+
+// Leave removes the user from their party.
+func Leave(serviceContext *services.ServiceContext, userId string) *apierror.Error {
+	party, version, apiErr := requireParty(serviceContext, userId)
+	if apiErr != nil {
+		return apiErr
+	}
+	return removeMember(serviceContext, party, version, userId)
+}
+
+// Kick removes a member from the leader's party.
+func Kick(serviceContext *services.ServiceContext, leaderUserId string, userId string) (*Party, *apierror.Error) {
+	party, version, apiErr := requireParty(serviceContext, leaderUserId)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	if party.LeaderUserId != leaderUserId {
+		return nil, apierror.New(apierror.StatusPermissionDenied, apierror.ReasonPermissionDenied, "only the party leader may kick")
+	}
+	if userId == leaderUserId {
+		return nil, apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, "the leader cannot kick themselves; leave instead")
+	}
+	if !party.IsMember(userId) {
+		return nil, apierror.New(apierror.StatusNotFound, apierror.ReasonNotFound, "not a member of the party")
+	}
+	if apiErr := removeMember(serviceContext, party, version, userId); apiErr != nil {
+		return nil, apiErr
+	}
+	return party, nil
+}
@@ -0,0 +1,167 @@
+package party
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+	"echonakama/server/services/nakamatest"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+func TestPartyMembers(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	party := &Party{LeaderUserId: "a", Members: []string{"a"}}
+
+	party.AddInvite("b", now)
+	if !party.IsInvited("b", now) || party.IsInvited("b", now.Add(InviteTTL+time.Second)) {
+		t.Errorf("IsInvited() does not honor the invite's expiry")
+	}
+	if err := party.AddMember("b", now); err != nil {
+		t.Fatalf("AddMember() error: %v", err)
+	}
+	if party.IsInvited("b", now) || len(party.Invites) != 0 {
+		t.Errorf("AddMember() did not consume the invite")
+	}
+	if err := party.AddMember("b", now); err == nil {
+		t.Errorf("AddMember() of a member should fail")
+	}
+	for _, userId := range []string{"c", "d"} {
+		if err := party.AddMember(userId, now); err != nil {
+			t.Fatalf("AddMember() error: %v", err)
+		}
+	}
+	if err := party.AddMember("e", now); err == nil {
+		t.Errorf("AddMember() to a full party should fail")
+	}
+
+	party.RemoveMember("a")
+	if party.LeaderUserId != "b" || party.IsMember("a") {
+		t.Errorf("RemoveMember() of the leader: leader = %q, members = %v, want b to lead", party.LeaderUserId, party.Members)
+	}
+	party.RemoveMember("c")
+	if party.LeaderUserId != "b" || len(party.Members) != 2 {
+		t.Errorf("RemoveMember() of a member: leader = %q, members = %v", party.LeaderUserId, party.Members)
+	}
+}
+
+func TestNewCode(t *testing.T) {
+	code, err := newCode()
+	if err != nil {
+		t.Fatalf("newCode() error: %v", err)
+	}
+	if len(code) != codeLength || strings.Trim(code, codeAlphabet) != "" {
+		t.Errorf("newCode() = %q, want %d characters from the code alphabet", code, codeLength)
+	}
+	if NormalizeCode(" ab2cd3 ") != "AB2CD3" {
+		t.Errorf("NormalizeCode() = %q", NormalizeCode(" ab2cd3 "))
+	}
+}
+
+// joiningModule makes the user join another party right before each write, as a concurrent accept would.
+type joiningModule struct {
+	*nakamatest.Module
+	userId string
+}
+
+func (m *joiningModule) StorageWrite(ctx context.Context, writes []*runtime.StorageWrite) ([]*api.StorageObjectAck, error) {
+	if _, err := m.Module.StorageWrite(ctx, []*runtime.StorageWrite{membershipWrite(m.userId, "other-party", "")}); err != nil {
+		return nil, err
+	}
+	return m.Module.StorageWrite(ctx, writes)
+}
+
+func TestPartyService(t *testing.T) {
+	nk := nakamatest.NewModule()
+	ctx := context.Background()
+	serviceContext := &services.ServiceContext{Ctx: ctx, Logger: nakamatest.NewLogger(t), NakamaModule: nk}
+
+	userIds := make(map[string]string)
+	for _, name := range []string{"leader", "invited", "coder", "late"} {
+		userId, _, _, err := nk.AuthenticateDevice(ctx, name+"-device", name, true)
+		if err != nil {
+			t.Fatalf("AuthenticateDevice() error: %v", err)
+		}
+		userIds[name] = userId
+	}
+	leader, invited, coder, late := userIds["leader"], userIds["invited"], userIds["coder"], userIds["late"]
+
+	party, apiErr := CreateParty(serviceContext, leader)
+	if apiErr != nil {
+		t.Fatalf("CreateParty() error: %v", apiErr)
+	}
+	if _, apiErr := CreateParty(serviceContext, leader); apiErr == nil || apiErr.Code != apierror.StatusAlreadyExists {
+		t.Errorf("CreateParty() error = %v, want already exists for a party member", apiErr)
+	}
+
+	// An invited player is notified, and can accept the invite
+	if _, apiErr := Accept(serviceContext, invited, party.PartyId, ""); apiErr == nil || apiErr.Code != apierror.StatusNotFound {
+		t.Errorf("Accept() error = %v, want not found without an invite", apiErr)
+	}
+	if _, apiErr := InviteUser(serviceContext, leader, invited); apiErr != nil {
+		t.Fatalf("InviteUser() error: %v", apiErr)
+	}
+	if notifications := nk.Notifications(); len(notifications) != 1 || notifications[0].UserID != invited || notifications[0].Subject != InviteNotificationSubject {
+		t.Errorf("notifications = %v, want an invite to the invited player", notifications)
+	}
+	if _, apiErr := Accept(serviceContext, invited, party.PartyId, ""); apiErr != nil {
+		t.Fatalf("Accept() error: %v", apiErr)
+	}
+	if _, apiErr := InviteUser(serviceContext, invited, late); apiErr == nil || apiErr.Code != apierror.StatusPermissionDenied {
+		t.Errorf("InviteUser() error = %v, want permission denied for a member", apiErr)
+	}
+
+	// A player with the code joins without an invite
+	party, apiErr = Accept(serviceContext, coder, "", strings.ToLower(party.Code))
+	if apiErr != nil {
+		t.Fatalf("Accept() error: %v", apiErr)
+	}
+	if strings.Join(party.Members, ",") != strings.Join([]string{leader, invited, coder}, ",") {
+		t.Errorf("Members = %v, want the leader, the invited player and the player with the code", party.Members)
+	}
+
+	// A player who joins another party meanwhile is not added to this one
+	serviceContext.NakamaModule = &joiningModule{Module: nk, userId: late}
+	if _, apiErr := Accept(serviceContext, late, "", party.Code); apiErr == nil || apiErr.Code != apierror.StatusAborted {
+		t.Errorf("Accept() error = %v, want aborted when the player joined another party", apiErr)
+	}
+	serviceContext.NakamaModule = nk
+	if p, _ := GetParty(serviceContext, leader); p.IsMember(late) {
+		t.Errorf("Members = %v, want the player who joined another party left out", p.Members)
+	}
+
+	// The leader kicks a member, whose membership is removed
+	if _, apiErr := Kick(serviceContext, invited, coder); apiErr == nil || apiErr.Code != apierror.StatusPermissionDenied {
+		t.Errorf("Kick() error = %v, want permission denied for a member", apiErr)
+	}
+	if party, apiErr = Kick(serviceContext, leader, coder); apiErr != nil {
+		t.Fatalf("Kick() error: %v", apiErr)
+	}
+	if party.IsMember(coder) {
+		t.Errorf("Members = %v, want the kicked member removed", party.Members)
+	}
+	if _, apiErr := GetParty(serviceContext, coder); apiErr == nil || apiErr.Code != apierror.StatusNotFound {
+		t.Errorf("GetParty() error = %v, want not found for the kicked member", apiErr)
+	}
+
+	// The party is disbanded when its last member leaves, and its code is freed
+	for _, userId := range []string{leader, invited} {
+		if apiErr := Leave(serviceContext, userId); apiErr != nil {
+			t.Fatalf("Leave() error: %v", apiErr)
+		}
+	}
+	if p, _, err := readParty(ctx, nk, party.PartyId); err != nil || p != nil {
+		t.Errorf("readParty() = %v, error = %v, want the party disbanded", p, err)
+	}
+	if codeTaken(serviceContext, party.Code) {
+		t.Errorf("codeTaken(%q) = true, want the code freed", party.Code)
+	}
+	if _, apiErr := Accept(serviceContext, late, "", party.Code); apiErr == nil || apiErr.Code != apierror.StatusNotFound {
+		t.Errorf("Accept() error = %v, want not found for a disbanded party's code", apiErr)
+	}
+}
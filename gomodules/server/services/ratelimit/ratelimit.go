@@ -0,0 +1,162 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"echonakama/server/services/apierror"
+)
+
+// sweepInterval is how often the buckets that have refilled are dropped.
+const sweepInterval = time.Minute
+
+// DefaultLimits are the limits of the RPCs that are rate limited, by RPC ID. An RPC limited by more
+// than one kind of caller has a limit for each, named after the RPC ID and the kind of caller.
+var DefaultLimits = map[string]Limit{
+	"relay/loginrequest":       {Requests: 30, Per: time.Minute},  // per client IP
+	"relay/loginrequest/relay": {Requests: 600, Per: time.Minute}, // per relay
+	"signin/discord":           {Requests: 10, Per: time.Minute},  // per Discord ID
+	"signin/discord/caller":    {Requests: 20, Per: time.Minute},  // per session user or client IP, before the code is exchanged
+	"link/device":              {Requests: 10, Per: time.Minute},  // per user
+}
+
+// Limit allows a burst of Requests, refilled evenly over Per. A zero limit is unlimited.
+type Limit struct {
+	Requests int
+	Per      time.Duration
+}
+
+// ParseLimit parses a limit such as "30/1m" (30 requests a minute), or "off" for no limit.
+func ParseLimit(value string) (Limit, error) {
+	if value == "off" {
+		return Limit{}, nil
+	}
+	requests, per, ok := strings.Cut(value, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid rate limit: %q", value)
+	}
+	n, err := strconv.Atoi(requests)
+	if err != nil || n <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit: %q", value)
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit: %q", value)
+	}
+	return Limit{Requests: n, Per: d}, nil
+}
+
+// ParseLimits parses a comma-separated list of RPC limits, such as "relay/loginrequest=60/1m,link/device=off".
+// The listed limits override the defaults.
+func ParseLimits(value string) (map[string]Limit, error) {
+	limits := make(map[string]Limit, len(DefaultLimits))
+	for rpcId, limit := range DefaultLimits {
+		limits[rpcId] = limit
+	}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		rpcId, limitValue, ok := strings.Cut(entry, "=")
+		if !ok || rpcId == "" {
+			return nil, fmt.Errorf("invalid rate limit entry: %q", entry)
+		}
+		limit, err := ParseLimit(limitValue)
+		if err != nil {
+			return nil, err
+		}
+		limits[rpcId] = limit
+	}
+	return limits, nil
+}
+
+func (l Limit) unlimited() bool {
+	return l.Requests <= 0 || l.Per <= 0
+}
+
+// bucket is a token bucket: it holds up to Requests tokens, and each request takes one.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter rate limits the RPCs with a token bucket per caller.
+// The buckets are held in memory, so each node limits the requests it serves.
+type Limiter struct {
+	mu        sync.Mutex
+	limits    map[string]Limit
+	buckets   map[string]*bucket // by RPC ID and caller
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewLimiter returns a limiter with the limits of each RPC, by RPC ID. RPCs without a limit are unlimited.
+func NewLimiter(limits map[string]Limit) *Limiter {
+	return &Limiter{
+		limits:  limits,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the caller's bucket for the RPC.
+// If the bucket is empty, it returns false and how long until the next token.
+func (l *Limiter) Allow(rpcId string, caller string) (bool, time.Duration) {
+	limit := l.limits[rpcId]
+	if limit.unlimited() {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	rate := float64(limit.Requests) / limit.Per.Seconds() // tokens per second
+	id := rpcId + "\x00" + caller
+	b, ok := l.buckets[id]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Requests), last: now}
+		l.buckets[id] = b
+	}
+	b.tokens = math.Min(float64(limit.Requests), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Check takes a token from the caller's bucket for the RPC, and returns a resource exhausted error
+// with the seconds to wait in its "retry_after" detail if the bucket is empty.
+func (l *Limiter) Check(rpcId string, caller string) *apierror.Error {
+	if ok, retryAfter := l.Allow(rpcId, caller); !ok {
+		seconds := int(math.Ceil(retryAfter.Seconds()))
+		return apierror.New(apierror.StatusResourceExhausted, apierror.ReasonRateLimited, fmt.Sprintf("too many requests, try again in %d seconds", seconds)).
+			WithDetail("retry_after", strconv.Itoa(seconds)).
+			Wrap(fmt.Errorf("%s rate limit exceeded by %q", rpcId, caller))
+	}
+	return nil
+}
+
+// sweep drops the buckets that have refilled, as they are the same as new ones.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for id, b := range l.buckets {
+		rpcId, _, _ := strings.Cut(id, "\x00")
+		limit := l.limits[rpcId]
+		if now.Sub(b.last) >= limit.Per {
+			delete(l.buckets, id)
+		}
+	}
+}
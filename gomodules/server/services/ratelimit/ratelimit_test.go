@@ -0,0 +1,112 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"echonakama/server/services/apierror"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Limit
+		ok    bool
+	}{
+		{"30/1m", Limit{Requests: 30, Per: time.Minute}, true},
+		{"5/10s", Limit{Requests: 5, Per: 10 * time.Second}, true},
+		{"off", Limit{}, true},
+		{"30", Limit{}, false},
+		{"0/1m", Limit{}, false},
+		{"30/m", Limit{}, false},
+		{"30/-1m", Limit{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseLimit(tt.value)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseLimit(%q) = %v, %v, want %v, ok %v", tt.value, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	limits, err := ParseLimits("link/device=5/1m, relay/loginrequest=off")
+	if err != nil {
+		t.Fatalf("ParseLimits() error: %v", err)
+	}
+	if limits["link/device"] != (Limit{Requests: 5, Per: time.Minute}) {
+		t.Errorf("ParseLimits() link/device = %v, want 5/1m", limits["link/device"])
+	}
+	if !limits["relay/loginrequest"].unlimited() {
+		t.Errorf("ParseLimits() relay/loginrequest = %v, want unlimited", limits["relay/loginrequest"])
+	}
+	if limits["signin/discord"] != DefaultLimits["signin/discord"] {
+		t.Errorf("ParseLimits() signin/discord = %v, want the default", limits["signin/discord"])
+	}
+	if _, err := ParseLimits("link/device"); err == nil {
+		t.Error("ParseLimits() error = nil, want an error for an entry without a limit")
+	}
+}
+
+func TestLimiterAllow(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := NewLimiter(map[string]Limit{"rpc": {Requests: 3, Per: 3 * time.Second}})
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.Allow("rpc", "a"); !ok {
+			t.Fatalf("Allow() request %d refused, want the burst allowed", i)
+		}
+	}
+	ok, retryAfter := limiter.Allow("rpc", "a")
+	if ok || retryAfter != time.Second {
+		t.Errorf("Allow() = %v, %v, want refused for 1s", ok, retryAfter)
+	}
+
+	// Each caller has its own bucket, and unlimited RPCs are always allowed
+	if ok, _ := limiter.Allow("rpc", "b"); !ok {
+		t.Error("Allow() refused another caller")
+	}
+	if ok, _ := limiter.Allow("other", "a"); !ok {
+		t.Error("Allow() refused an unlimited RPC")
+	}
+
+	// The bucket refills at the rate of the limit
+	now = now.Add(time.Second)
+	if ok, _ := limiter.Allow("rpc", "a"); !ok {
+		t.Error("Allow() refused after a token was refilled")
+	}
+	if ok, _ := limiter.Allow("rpc", "a"); ok {
+		t.Error("Allow() allowed more than the refilled tokens")
+	}
+}
+
+func TestLimiterSweep(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := NewLimiter(map[string]Limit{"rpc": {Requests: 1, Per: time.Second}})
+	limiter.now = func() time.Time { return now }
+
+	limiter.Allow("rpc", "a")
+	now = now.Add(sweepInterval)
+	limiter.Allow("rpc", "b")
+	if _, ok := limiter.buckets["rpc\x00a"]; ok || len(limiter.buckets) != 1 {
+		t.Errorf("Allow() kept %d buckets, want the refilled bucket dropped", len(limiter.buckets))
+	}
+}
+
+func TestLimiterCheck(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := NewLimiter(map[string]Limit{"rpc": {Requests: 1, Per: time.Minute}})
+	limiter.now = func() time.Time { return now }
+
+	if err := limiter.Check("rpc", "a"); err != nil {
+		t.Fatalf("Check() error: %v", err)
+	}
+	err := limiter.Check("rpc", "a")
+	if err == nil || err.Code != apierror.StatusResourceExhausted || err.Reason != apierror.ReasonRateLimited {
+		t.Fatalf("Check() error = %v, want %s", err, apierror.ReasonRateLimited)
+	}
+	if err.Details["retry_after"] != "60" {
+		t.Errorf("Check() retry_after = %q, want 60", err.Details["retry_after"])
+	}
+}
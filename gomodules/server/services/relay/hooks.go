@@ -0,0 +1,31 @@
+package relay
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"echonakama/server/services/apierror"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// BeforeAuthenticateCustom refuses the custom IDs of relay users. Relays exchange their API keys for
+// sessions; otherwise any client could open a session for a relay user, with the relay's session vars.
+func BeforeAuthenticateCustom(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.AuthenticateCustomRequest) (*api.AuthenticateCustomRequest, error) {
+	if strings.HasPrefix(strings.ToLower(in.GetAccount().GetId()), CustomIdPrefix) {
+		logger.WithField("customId", in.GetAccount().GetId()).Warn("Refused a relay custom ID")
+		return nil, apierror.New(apierror.StatusPermissionDenied, apierror.ReasonPermissionDenied, "custom ID is reserved").Runtime()
+	}
+	return in, nil
+}
+
+// BeforeLinkCustom refuses the custom IDs of relay users, so a player cannot link one to their account.
+func BeforeLinkCustom(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *api.AccountCustom) (*api.AccountCustom, error) {
+	if strings.HasPrefix(strings.ToLower(in.GetId()), CustomIdPrefix) {
+		logger.WithField("customId", in.GetId()).Warn("Refused a relay custom ID")
+		return nil, apierror.New(apierror.StatusPermissionDenied, apierror.ReasonPermissionDenied, "custom ID is reserved").Runtime()
+	}
+	return in, nil
+}
@@ -0,0 +1,53 @@
+package relay
+
+import (
+	"context"
+	"testing"
+
+	"echonakama/server/services"
+	"echonakama/server/services/nakamatest"
+
+	"github.com/heroiclabs/nakama-common/api"
+)
+
+func TestRelayCustomIdHooks(t *testing.T) {
+	ctx := context.Background()
+	logger := nakamatest.NewLogger(t)
+
+	for _, id := range []string{"relay-eu1", "Relay-EU1"} {
+		if _, err := BeforeAuthenticateCustom(ctx, logger, nil, nil, &api.AuthenticateCustomRequest{Account: &api.AccountCustom{Id: id}}); err == nil {
+			t.Errorf("BeforeAuthenticateCustom(%q) = nil, want a relay custom ID refused", id)
+		}
+		if _, err := BeforeLinkCustom(ctx, logger, nil, nil, &api.AccountCustom{Id: id}); err == nil {
+			t.Errorf("BeforeLinkCustom(%q) = nil, want a relay custom ID refused", id)
+		}
+	}
+
+	custom := &api.AccountCustom{Id: "123456789012345678"}
+	if in, err := BeforeAuthenticateCustom(ctx, logger, nil, nil, &api.AuthenticateCustomRequest{Account: custom}); err != nil || in == nil {
+		t.Errorf("BeforeAuthenticateCustom() = %v, %v, want a player's custom ID allowed", in, err)
+	}
+	if in, err := BeforeLinkCustom(ctx, logger, nil, nil, custom); err != nil || in != custom {
+		t.Errorf("BeforeLinkCustom() = %v, %v, want a player's custom ID allowed", in, err)
+	}
+}
+
+func TestSetRelayUser(t *testing.T) {
+	nk := nakamatest.NewModule()
+	ctx := context.Background()
+	serviceContext := &services.ServiceContext{Ctx: ctx, Logger: nakamatest.NewLogger(t), NakamaModule: nk}
+
+	// A player linked the relay's former custom ID before the relay was registered
+	playerUserId, _, _, err := nk.AuthenticateCustom(ctx, CustomIdPrefix+"eu1", "player", true)
+	if err != nil {
+		t.Fatalf("AuthenticateCustom() error: %v", err)
+	}
+
+	relay, apiErr := SetRelay(serviceContext, &Relay{Id: "eu1", OwnerUserId: playerUserId, Enabled: true})
+	if apiErr != nil {
+		t.Fatalf("SetRelay() error: %v", apiErr)
+	}
+	if relay.UserId == "" || relay.UserId == playerUserId {
+		t.Errorf("SetRelay() user = %q, want a user of its own", relay.UserId)
+	}
+}
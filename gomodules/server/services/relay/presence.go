@@ -0,0 +1,209 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	PresenceStorageCollection = "Relay:presence"
+)
+
+// Heartbeat is sent by a relay on each stats interval.
+type Heartbeat struct {
+	Version string         `json:"version"` // the relay's build version
+	Region  string         `json:"region"`  // the region the relay is serving
+	Peers   map[string]int `json:"peers"`   // the number of connected peers, by service (e.g. login, config, matching, serverdb)
+}
+
+// Presence is the last heartbeat of a relay, stored under the system user.
+type Presence struct {
+	RelayId   string         `json:"relay_id"`
+	Version   string         `json:"version"`
+	Region    string         `json:"region"`
+	Peers     map[string]int `json:"peers"`
+	FirstSeen int64          `json:"first_seen"` // when the relay came online (its first heartbeat after being expired)
+	LastSeen  int64          `json:"last_seen"`  // when the relay's last heartbeat was received
+}
+
+// PeerCount returns the total number of peers connected to the relay.
+func (p *Presence) PeerCount() int {
+	total := 0
+	for _, count := range p.Peers {
+		total += count
+	}
+	return total
+}
+
+// Expired returns true if the relay has not sent a heartbeat within the TTL.
+func (p *Presence) Expired(now time.Time, ttl time.Duration) bool {
+	return now.Sub(time.Unix(p.LastSeen, 0)) > ttl
+}
+
+// RelayStatus is a registered relay's entry in the network status.
+type RelayStatus struct {
+	RelayId  string    `json:"relay_id"`
+	Enabled  bool      `json:"enabled"`
+	Online   bool      `json:"online"`
+	Presence *Presence `json:"presence,omitempty"` // the relay's last heartbeat, if it is online
+}
+
+// NetworkStatus summarizes the registered relays, and the peers connected to those online.
+type NetworkStatus struct {
+	Relays        []*RelayStatus `json:"relays"`
+	OnlineRelays  int            `json:"online_relays"`
+	PeersByRegion map[string]int `json:"peers_by_region"`
+	TotalPeers    int            `json:"total_peers"`
+}
+
+// RecordHeartbeat updates the relay's presence. The heartbeat's region must be one the relay may serve.
+func RecordHeartbeat(serviceContext *services.ServiceContext, relay *Relay, heartbeat *Heartbeat) (*Presence, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	nk := serviceContext.NakamaModule
+
+	if !relay.AllowsRegion(heartbeat.Region) {
+		return nil, apierror.New(apierror.StatusPermissionDenied, apierror.ReasonPermissionDenied, fmt.Sprintf("relay %s may not serve region %q", relay.Id, heartbeat.Region))
+	}
+	for service, count := range heartbeat.Peers {
+		if count < 0 {
+			return nil, apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, fmt.Sprintf("invalid peer count for %s: %d", service, count))
+		}
+	}
+
+	now := time.Now().UTC()
+	presence := &Presence{
+		RelayId:   relay.Id,
+		Version:   heartbeat.Version,
+		Region:    heartbeat.Region,
+		Peers:     heartbeat.Peers,
+		FirstSeen: now.Unix(),
+		LastSeen:  now.Unix(),
+	}
+	if presence.Peers == nil {
+		presence.Peers = make(map[string]int)
+	}
+
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+		Collection: PresenceStorageCollection,
+		Key:        relay.Id,
+		UserID:     services.SystemUserId,
+	}})
+	if err != nil {
+		return nil, apierror.Internal("error reading relay presence", err)
+	}
+	if len(objects) > 0 {
+		previous := &Presence{}
+		if err := json.Unmarshal([]byte(objects[0].Value), previous); err == nil && !previous.Expired(now, presenceTTL(serviceContext)) {
+			presence.FirstSeen = previous.FirstSeen
+		}
+	}
+
+	data, err := json.Marshal(presence)
+	if err != nil {
+		return nil, apierror.Internal("error marshaling presence", err)
+	}
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      PresenceStorageCollection,
+		Key:             relay.Id,
+		UserID:          services.SystemUserId,
+		Value:           string(data),
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}}); err != nil {
+		return nil, apierror.Internal("error writing relay presence", err)
+	}
+	return presence, nil
+}
+
+// presenceTTL returns the configured presence TTL.
+func presenceTTL(serviceContext *services.ServiceContext) time.Duration {
+	return serviceContext.Config.RelayPresenceTTL
+}
+
+// ListPresences returns the presence of each online relay, by relay ID.
+// Relays that have not sent a heartbeat within the TTL are removed from the registry.
+func ListPresences(serviceContext *services.ServiceContext) (map[string]*Presence, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	logger := serviceContext.Logger
+	nk := serviceContext.NakamaModule
+
+	now := time.Now().UTC()
+	ttl := presenceTTL(serviceContext)
+	presences := make(map[string]*Presence)
+	expired := make([]*runtime.StorageDelete, 0)
+
+	cursor := ""
+	for {
+		objects, next, err := nk.StorageList(ctx, "", services.SystemUserId, PresenceStorageCollection, 100, cursor)
+		if err != nil {
+			return nil, apierror.Internal("error listing relay presence", err)
+		}
+		for _, object := range objects {
+			presence := &Presence{}
+			if err := json.Unmarshal([]byte(object.Value), presence); err != nil || presence.Expired(now, ttl) {
+				// The version guards against deleting a heartbeat that arrived since the list
+				expired = append(expired, &runtime.StorageDelete{
+					Collection: PresenceStorageCollection,
+					Key:        object.Key,
+					UserID:     services.SystemUserId,
+					Version:    object.Version,
+				})
+				continue
+			}
+			presences[presence.RelayId] = presence
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	for _, object := range expired {
+		if err := nk.StorageDelete(ctx, []*runtime.StorageDelete{object}); err != nil {
+			logger.WithField("err", err).WithField("relayId", object.Key).Debug("Expired relay presence was not removed.")
+			continue
+		}
+		logger.WithField("relayId", object.Key).Info("Relay went offline.")
+	}
+	return presences, nil
+}
+
+// GetNetworkStatus returns the status of each registered relay, and the peers connected to those online.
+func GetNetworkStatus(serviceContext *services.ServiceContext) (*NetworkStatus, *apierror.Error) {
+	relays, apiErr := ListRelays(serviceContext)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	presences, apiErr := ListPresences(serviceContext)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	status := &NetworkStatus{
+		Relays:        make([]*RelayStatus, 0, len(relays)),
+		PeersByRegion: make(map[string]int),
+	}
+	for _, relay := range relays {
+		relayStatus := &RelayStatus{RelayId: relay.Id, Enabled: relay.Enabled}
+		if presence, ok := presences[relay.Id]; ok {
+			relayStatus.Online = true
+			relayStatus.Presence = presence
+			status.OnlineRelays++
+			status.PeersByRegion[presence.Region] += presence.PeerCount()
+			status.TotalPeers += presence.PeerCount()
+		}
+		status.Relays = append(status.Relays, relayStatus)
+	}
+
+	sort.SliceStable(status.Relays, func(i, j int) bool {
+		return status.Relays[i].RelayId < status.Relays[j].RelayId
+	})
+	return status, nil
+}
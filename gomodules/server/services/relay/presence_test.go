@@ -0,0 +1,25 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPresenceExpired(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	presence := &Presence{LastSeen: now.Add(-30 * time.Second).Unix()}
+
+	if presence.Expired(now, time.Minute) {
+		t.Errorf("Expired() = true within the TTL")
+	}
+	if !presence.Expired(now, 10*time.Second) {
+		t.Errorf("Expired() = false after the TTL")
+	}
+}
+
+func TestPresencePeerCount(t *testing.T) {
+	presence := &Presence{Peers: map[string]int{"login": 3, "matching": 2, "serverdb": 1}}
+	if got := presence.PeerCount(); got != 6 {
+		t.Errorf("PeerCount() = %d, want 6", got)
+	}
+}
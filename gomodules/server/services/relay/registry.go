@@ -0,0 +1,459 @@
+package relay
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	RelayStorageCollection = "Relay:registry"
+
+	// The custom IDs of the users relay sessions are issued for start with this prefix. Clients may not
+	// authenticate with, or link, such custom IDs.
+	CustomIdPrefix = "relay-"
+
+	// Session variables set on the sessions issued to relays
+	RelayIdSessionVar = "relayId"
+	KeyIdSessionVar   = "relayKeyId"
+	RegionSessionVar  = "relayRegion"
+)
+
+// Scope is a permission granted to a relay API key.
+type Scope string
+
+const (
+	ScopeLogin       Scope = "login"       // relay/loginrequest
+	ScopeProfile     Scope = "profile"     // relay/profileupdate
+	ScopeHeartbeat   Scope = "heartbeat"   // relay/heartbeat
+	ScopeGameServer  Scope = "gameserver"  // relay/gameserverregister, relay/gameserversessions, relay/gameserverunregister
+	ScopeMatchmaking Scope = "matchmaking" // relay/lobbyfind, relay/lobbyassignment
+)
+
+// Scopes lists the scopes an API key may be granted.
+var Scopes = []Scope{ScopeLogin, ScopeProfile, ScopeHeartbeat, ScopeGameServer, ScopeMatchmaking}
+
+var relayIdPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{2,63}$`)
+
+// ApiKey is a credential a relay exchanges for a session. Only the hash of the secret is stored.
+type ApiKey struct {
+	Id         string  `json:"id"`          // the public part of the key
+	SecretHash string  `json:"secret_hash"` // the hex SHA-256 of the secret part of the key
+	Scopes     []Scope `json:"scopes"`      // the RPCs the key may call
+	Note       string  `json:"note"`        // why the key was issued
+	CreatedAt  int64   `json:"created_at"`
+	RevokedAt  int64   `json:"revoked_at,omitempty"` // when the key was revoked (0 if it is active)
+}
+
+// HasScope returns true if the key grants the scope.
+func (k *ApiKey) HasScope(scope Scope) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Relay is a registered relay, stored in the registry under the system user.
+type Relay struct {
+	Id          string    `json:"relay_id"`      // the relay's ID (lower case letters, digits, _ and -)
+	OwnerUserId string    `json:"owner_user_id"` // the Nakama user responsible for the relay
+	UserId      string    `json:"user_id"`       // the Nakama user the relay's sessions are issued for (set by the registry)
+	Enabled     bool      `json:"enabled"`       // disabled relays can neither authenticate nor call relay RPCs
+	Regions     []string  `json:"regions"`       // the regions the relay may serve (empty for any)
+	ApiKeys     []*ApiKey `json:"api_keys"`      // the relay's API keys (set by the registry)
+	CreatedAt   int64     `json:"created_at"`
+	UpdatedAt   int64     `json:"updated_at"`
+}
+
+// Validate checks the relay's ID, owner and regions.
+func (r *Relay) Validate() error {
+	if !relayIdPattern.MatchString(r.Id) {
+		return fmt.Errorf("invalid relay_id: %q", r.Id)
+	}
+	if r.OwnerUserId == "" {
+		return errors.New("owner_user_id is empty")
+	}
+	for _, region := range r.Regions {
+		if region == "" || len(region) > 32 {
+			return fmt.Errorf("invalid region: %q", region)
+		}
+	}
+	return nil
+}
+
+// AllowsRegion returns true if the relay may serve the region.
+func (r *Relay) AllowsRegion(region string) bool {
+	if len(r.Regions) == 0 {
+		return true
+	}
+	for _, allowed := range r.Regions {
+		if strings.EqualFold(allowed, region) {
+			return true
+		}
+	}
+	return false
+}
+
+// ApiKey returns the relay's key with the ID, or nil if there is none.
+func (r *Relay) ApiKey(keyId string) *ApiKey {
+	for _, key := range r.ApiKeys {
+		if key.Id == keyId {
+			return key
+		}
+	}
+	return nil
+}
+
+// Authorize returns an error unless the relay is enabled and its key is active and grants the scope.
+func (r *Relay) Authorize(keyId string, scope Scope) error {
+	if !r.Enabled {
+		return fmt.Errorf("relay %s is disabled", r.Id)
+	}
+	key := r.ApiKey(keyId)
+	if key == nil || key.RevokedAt != 0 {
+		return fmt.Errorf("relay %s key %s is not active", r.Id, keyId)
+	}
+	if scope != "" && !key.HasScope(scope) {
+		return fmt.Errorf("relay %s key %s lacks the %s scope", r.Id, keyId, scope)
+	}
+	return nil
+}
+
+// NewApiKey generates a key for the scopes. It returns the key to store, and the
+// credential ("<id>.<secret>") to hand to the relay, which cannot be recovered later.
+func NewApiKey(scopes []Scope, note string) (*ApiKey, string, error) {
+	if len(scopes) == 0 {
+		return nil, "", errors.New("an API key needs at least one scope")
+	}
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return nil, "", fmt.Errorf("invalid scope: %q", scope)
+		}
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+	key := &ApiKey{
+		Id:         id,
+		SecretHash: hashSecret(secret),
+		Scopes:     scopes,
+		Note:       note,
+		CreatedAt:  time.Now().UTC().Unix(),
+	}
+	return key, id + "." + secret, nil
+}
+
+// ParseCredential splits a credential into its key ID and secret.
+func ParseCredential(credential string) (string, string, error) {
+	id, secret, ok := strings.Cut(credential, ".")
+	if !ok || id == "" || secret == "" {
+		return "", "", errors.New("malformed API key")
+	}
+	return id, secret, nil
+}
+
+// Verify returns true if the secret matches the key.
+func (k *ApiKey) Verify(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(k.SecretHash)) == 1
+}
+
+func validScope(scope Scope) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ReadRelay returns the registered relay and its storage version, or nil if the relay is not registered.
+func ReadRelay(ctx context.Context, nk runtime.NakamaModule, relayId string) (*Relay, string, error) {
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+		Collection: RelayStorageCollection,
+		Key:        relayId,
+		UserID:     services.SystemUserId,
+	}})
+	if err != nil {
+		return nil, "", err
+	}
+	if len(objects) == 0 {
+		return nil, "", nil
+	}
+	relay := &Relay{}
+	if err := json.Unmarshal([]byte(objects[0].Value), relay); err != nil {
+		return nil, "", err
+	}
+	return relay, objects[0].Version, nil
+}
+
+// writeRelay stores the relay, if the stored relay still has the version.
+func writeRelay(ctx context.Context, nk runtime.NakamaModule, relay *Relay, version string) error {
+	relay.UpdatedAt = time.Now().UTC().Unix()
+	data, err := json.Marshal(relay)
+	if err != nil {
+		return err
+	}
+	_, err = nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      RelayStorageCollection,
+		Key:             relay.Id,
+		UserID:          services.SystemUserId,
+		Value:           string(data),
+		Version:         version,
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}})
+	return err
+}
+
+// writeError maps a relay write error to an API error.
+func writeError(err error) *apierror.Error {
+	if errors.Is(err, runtime.ErrStorageRejectedVersion) {
+		return apierror.New(apierror.StatusAborted, apierror.ReasonConflict, "relay was modified concurrently")
+	}
+	return apierror.Internal("error writing relay", err)
+}
+
+// ListRelays returns the registered relays.
+func ListRelays(serviceContext *services.ServiceContext) ([]*Relay, *apierror.Error) {
+
+	relays := make([]*Relay, 0)
+	cursor := ""
+	for {
+		objects, next, err := serviceContext.NakamaModule.StorageList(serviceContext.Ctx, "", services.SystemUserId, RelayStorageCollection, 100, cursor)
+		if err != nil {
+			return nil, apierror.Internal("error listing relays", err)
+		}
+		for _, object := range objects {
+			relay := &Relay{}
+			if err := json.Unmarshal([]byte(object.Value), relay); err != nil {
+				return nil, apierror.New(apierror.StatusDataLoss, apierror.ReasonInternal, "error reading relays").Wrap(fmt.Errorf("error unmarshaling relay %s: %w", object.Key, err))
+			}
+			relays = append(relays, relay)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	return relays, nil
+}
+
+// SetRelay registers a relay, or updates a registered relay's owner, enabled flag and regions.
+// A relay's sessions are issued for a Nakama user created when it is registered.
+func SetRelay(serviceContext *services.ServiceContext, relay *Relay) (*Relay, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	logger := serviceContext.Logger
+	nk := serviceContext.NakamaModule
+
+	relay.Id = strings.ToLower(relay.Id)
+	if err := relay.Validate(); err != nil {
+		return nil, apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, err.Error())
+	}
+	if relay.Regions == nil {
+		relay.Regions = []string{}
+	}
+
+	existing, version, err := ReadRelay(ctx, nk, relay.Id)
+	if err != nil {
+		return nil, apierror.Internal("error reading relay", err)
+	}
+
+	if existing != nil {
+		existing.OwnerUserId = relay.OwnerUserId
+		existing.Enabled = relay.Enabled
+		existing.Regions = relay.Regions
+		if err := writeRelay(ctx, nk, existing, version); err != nil {
+			return nil, writeError(err)
+		}
+		logger.WithField("relayId", existing.Id).Info("Relay updated.")
+		return existing, nil
+	}
+
+	// Create the user the relay's sessions are issued for. The custom ID is random, so a player cannot
+	// have linked it to their account before the relay is registered.
+	nonce, err := randomHex(16)
+	if err != nil {
+		return nil, apierror.Internal("error creating relay user", err)
+	}
+	userId, _, _, err := nk.AuthenticateCustom(ctx, CustomIdPrefix+relay.Id+"-"+nonce, CustomIdPrefix+relay.Id, true)
+	if err != nil {
+		return nil, apierror.Internal("error creating relay user", err)
+	}
+	relay.UserId = userId
+	relay.ApiKeys = []*ApiKey{}
+	relay.CreatedAt = time.Now().UTC().Unix()
+	if err := writeRelay(ctx, nk, relay, "*"); err != nil {
+		return nil, writeError(err)
+	}
+	logger.WithField("relayId", relay.Id).Info("Relay registered.")
+	return relay, nil
+}
+
+// DeleteRelay removes a relay from the registry. Its sessions are refused from their next call.
+func DeleteRelay(serviceContext *services.ServiceContext, relayId string) *apierror.Error {
+	logger := serviceContext.Logger
+
+	if err := serviceContext.NakamaModule.StorageDelete(serviceContext.Ctx, []*runtime.StorageDelete{{
+		Collection: RelayStorageCollection,
+		Key:        strings.ToLower(relayId),
+		UserID:     services.SystemUserId,
+	}}); err != nil {
+		return apierror.Internal("error deleting relay", err)
+	}
+	logger.WithField("relayId", relayId).Info("Relay deleted.")
+	return nil
+}
+
+// CreateApiKey issues an API key for a registered relay. It returns the key, and the credential to hand to the relay.
+func CreateApiKey(serviceContext *services.ServiceContext, relayId string, scopes []Scope, note string) (*ApiKey, string, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	logger := serviceContext.Logger
+	nk := serviceContext.NakamaModule
+
+	relay, version, err := ReadRelay(ctx, nk, strings.ToLower(relayId))
+	if err != nil {
+		return nil, "", apierror.Internal("error reading relay", err)
+	}
+	if relay == nil {
+		return nil, "", apierror.New(apierror.StatusNotFound, apierror.ReasonNotFound, fmt.Sprintf("relay not found: %q", relayId))
+	}
+
+	key, credential, err := NewApiKey(scopes, note)
+	if err != nil {
+		return nil, "", apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, err.Error())
+	}
+	relay.ApiKeys = append(relay.ApiKeys, key)
+	if err := writeRelay(ctx, nk, relay, version); err != nil {
+		return nil, "", writeError(err)
+	}
+	logger.WithField("relayId", relay.Id).WithField("keyId", key.Id).Info("Relay API key created.")
+	return key, credential, nil
+}
+
+// RevokeApiKey revokes a relay's API key. Sessions issued for the key are refused from their next call.
+func RevokeApiKey(serviceContext *services.ServiceContext, relayId string, keyId string) *apierror.Error {
+	ctx := serviceContext.Ctx
+	logger := serviceContext.Logger
+	nk := serviceContext.NakamaModule
+
+	relay, version, err := ReadRelay(ctx, nk, strings.ToLower(relayId))
+	if err != nil {
+		return apierror.Internal("error reading relay", err)
+	}
+	if relay == nil {
+		return apierror.New(apierror.StatusNotFound, apierror.ReasonNotFound, fmt.Sprintf("relay not found: %q", relayId))
+	}
+	key := relay.ApiKey(keyId)
+	if key == nil {
+		return apierror.New(apierror.StatusNotFound, apierror.ReasonNotFound, fmt.Sprintf("API key not found: %q", keyId))
+	}
+	if key.RevokedAt != 0 {
+		return nil
+	}
+	key.RevokedAt = time.Now().UTC().Unix()
+	if err := writeRelay(ctx, nk, relay, version); err != nil {
+		return writeError(err)
+	}
+	logger.WithField("relayId", relay.Id).WithField("keyId", key.Id).Info("Relay API key revoked.")
+	return nil
+}
+
+// Authenticate exchanges a relay's API key for a session token. The session carries the relay,
+// key and region, which relay RPCs check against the registry on every call.
+func Authenticate(serviceContext *services.ServiceContext, relayId string, credential string, region string) (string, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	logger := serviceContext.Logger
+	nk := serviceContext.NakamaModule
+
+	keyId, secret, err := ParseCredential(credential)
+	if err != nil {
+		return "", apierror.New(apierror.StatusUnauthenticated, apierror.ReasonUnauthenticated, err.Error())
+	}
+	relay, _, err := ReadRelay(ctx, nk, strings.ToLower(relayId))
+	if err != nil {
+		return "", apierror.Internal("error reading relay", err)
+	}
+	// Unknown relays and wrong secrets get the same answer
+	if relay == nil || relay.ApiKey(keyId) == nil || !relay.ApiKey(keyId).Verify(secret) {
+		logger.WithField("relayId", relayId).Warn("Relay authentication failed.")
+		return "", apierror.New(apierror.StatusUnauthenticated, apierror.ReasonUnauthenticated, "invalid relay credentials")
+	}
+	if err := relay.Authorize(keyId, ""); err != nil {
+		logger.WithField("err", err).Warn("Relay authentication refused.")
+		return "", apierror.New(apierror.StatusPermissionDenied, apierror.ReasonPermissionDenied, err.Error())
+	}
+	if !relay.AllowsRegion(region) {
+		return "", apierror.New(apierror.StatusPermissionDenied, apierror.ReasonPermissionDenied, fmt.Sprintf("relay %s may not serve region %q", relay.Id, region))
+	}
+
+	token, _, err := nk.AuthenticateTokenGenerate(relay.UserId, CustomIdPrefix+relay.Id, 0, map[string]string{
+		RelayIdSessionVar: relay.Id,
+		KeyIdSessionVar:   keyId,
+		RegionSessionVar:  region,
+	})
+	if err != nil {
+		return "", apierror.Internal("authenticate token generation error.", err)
+	}
+	logger.WithField("relayId", relay.Id).WithField("keyId", keyId).Info("Relay authenticated.")
+	return token, nil
+}
+
+// RequireRelay returns the relay that made the call, or an error unless the caller has a relay session
+// for a registered, enabled relay, whose key is still active and grants the scope.
+func RequireRelay(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, scope Scope) (*Relay, *apierror.Error) {
+	userId, _ := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	vars, _ := ctx.Value(runtime.RUNTIME_CTX_VARS).(map[string]string)
+	if userId == "" || vars[RelayIdSessionVar] == "" {
+		return nil, apierror.New(apierror.StatusUnauthenticated, apierror.ReasonUnauthenticated, "relay must authenticate")
+	}
+
+	relay, _, err := ReadRelay(ctx, nk, vars[RelayIdSessionVar])
+	if err != nil {
+		apiErr := apierror.Internal("error reading relay", err)
+		apiErr.Log(logger, "Relay RPC denied")
+		return nil, apiErr
+	}
+	if relay == nil || relay.UserId != userId {
+		logger.WithField("relayId", vars[RelayIdSessionVar]).Warn("Relay RPC denied: relay is not registered.")
+		return nil, apierror.New(apierror.StatusPermissionDenied, apierror.ReasonPermissionDenied, "relay is not registered")
+	}
+	if err := relay.Authorize(vars[KeyIdSessionVar], scope); err != nil {
+		logger.WithField("err", err).Warn("Relay RPC denied.")
+		return nil, apierror.New(apierror.StatusPermissionDenied, apierror.ReasonPermissionDenied, err.Error())
+	}
+	return relay, nil
+}
@@ -0,0 +1,101 @@
+package relay
+
+import (
+	"testing"
+)
+
+func TestApiKey(t *testing.T) {
+	key, credential, err := NewApiKey([]Scope{ScopeLogin}, "test")
+	if err != nil {
+		t.Fatalf("NewApiKey() error: %v", err)
+	}
+
+	keyId, secret, err := ParseCredential(credential)
+	if err != nil {
+		t.Fatalf("ParseCredential() error: %v", err)
+	}
+	if keyId != key.Id {
+		t.Errorf("ParseCredential() key id = %q, want %q", keyId, key.Id)
+	}
+	if !key.Verify(secret) {
+		t.Errorf("Verify() = false for the issued secret")
+	}
+	if key.Verify(secret + "0") {
+		t.Errorf("Verify() = true for a wrong secret")
+	}
+
+	if _, _, err := NewApiKey(nil, ""); err == nil {
+		t.Errorf("NewApiKey() without scopes should fail")
+	}
+	if _, _, err := NewApiKey([]Scope{"admin"}, ""); err == nil {
+		t.Errorf("NewApiKey() with an unknown scope should fail")
+	}
+	if _, _, err := ParseCredential("nodot"); err == nil {
+		t.Errorf("ParseCredential() of a malformed credential should fail")
+	}
+}
+
+func TestRelayAuthorize(t *testing.T) {
+	relay := &Relay{
+		Id:      "relay-1",
+		Enabled: true,
+		ApiKeys: []*ApiKey{
+			{Id: "active", Scopes: []Scope{ScopeLogin}},
+			{Id: "revoked", Scopes: []Scope{ScopeLogin}, RevokedAt: 1},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		enabled bool
+		keyId   string
+		scope   Scope
+		wantErr bool
+	}{
+		{"allowed", true, "active", ScopeLogin, false},
+		{"any scope", true, "active", "", false},
+		{"missing scope", true, "active", ScopeProfile, true},
+		{"revoked", true, "revoked", ScopeLogin, true},
+		{"unknown key", true, "other", ScopeLogin, true},
+		{"disabled", false, "active", ScopeLogin, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay.Enabled = tt.enabled
+			if err := relay.Authorize(tt.keyId, tt.scope); (err != nil) != tt.wantErr {
+				t.Errorf("Authorize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRelayValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		relay   Relay
+		wantErr bool
+	}{
+		{"valid", Relay{Id: "eu-west_1", OwnerUserId: "owner", Regions: []string{"eu"}}, false},
+		{"short id", Relay{Id: "eu", OwnerUserId: "owner"}, true},
+		{"upper case id", Relay{Id: "EU-WEST", OwnerUserId: "owner"}, true},
+		{"no owner", Relay{Id: "eu-west"}, true},
+		{"empty region", Relay{Id: "eu-west", OwnerUserId: "owner", Regions: []string{""}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.relay.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	relay := Relay{Regions: []string{"us-east"}}
+	if !relay.AllowsRegion("US-EAST") || relay.AllowsRegion("eu") || relay.AllowsRegion("") {
+		t.Errorf("AllowsRegion() does not match the relay's regions")
+	}
+	if !(&Relay{}).AllowsRegion("anywhere") {
+		t.Errorf("AllowsRegion() = false for a relay without regions")
+	}
+}
@@ -0,0 +1,166 @@
+package relayconfig
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"echonakama/game"
+)
+
+const (
+	// The login attributes an access control rule can match
+	AccessRuleIp       = "ip"       // a client IP address or CIDR (e.g. 10.0.0.0/8)
+	AccessRulePlatform = "platform" // an EchoUserId platform code (e.g. OVR_ORG)
+	AccessRuleApp      = "app"      // a game application ID (e.g. 1369078409873402)
+	AccessRuleBuild    = "build"    // a build version, or an inclusive range (e.g. 631547, 631547-, -631547)
+)
+
+// AccessControlRule matches logins by a single attribute.
+type AccessControlRule struct {
+	Type  string `json:"type"`           // the attribute to match (ip, platform, app, build)
+	Value string `json:"value"`          // the value to match
+	Note  string `json:"note,omitempty"` // why the rule exists
+}
+
+// AccessControlList restricts which clients may log in.
+// A login matching any deny rule is refused. For each rule type on the allow list,
+// a login must match at least one allow rule of that type.
+type AccessControlList struct {
+	Allow []AccessControlRule `json:"allow"`
+	Deny  []AccessControlRule `json:"deny"`
+}
+
+// AccessRequest holds the login attributes the access control rules are evaluated against.
+type AccessRequest struct {
+	ClientIp     string
+	EchoUserId   game.EchoUserId
+	AppId        int64
+	BuildVersion int64
+}
+
+// Validate checks that every rule has a known type and a parseable value.
+func (acl *AccessControlList) Validate() error {
+	for i, rule := range acl.Allow {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("allow[%d]: %v", i, err)
+		}
+	}
+	for i, rule := range acl.Deny {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("deny[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Check returns an error describing the first rule that refuses the request, or nil if it is allowed.
+func (acl *AccessControlList) Check(request AccessRequest) error {
+	for _, rule := range acl.Deny {
+		if rule.Matches(request) {
+			return fmt.Errorf("denied by %s rule %q", rule.Type, rule.Value)
+		}
+	}
+
+	// Group the allow rules by type; each type present must have a match
+	allowed := make(map[string]bool)
+	for _, rule := range acl.Allow {
+		allowed[rule.Type] = allowed[rule.Type] || rule.Matches(request)
+	}
+	for ruleType, matched := range allowed {
+		if !matched {
+			return fmt.Errorf("not on the %s allow list", ruleType)
+		}
+	}
+	return nil
+}
+
+func (rule AccessControlRule) validate() error {
+	switch rule.Type {
+	case AccessRuleIp:
+		if _, err := parseNetwork(rule.Value); err != nil {
+			return err
+		}
+	case AccessRulePlatform:
+		if game.PlatformCode(0).Parse(rule.Value) == 0 {
+			return fmt.Errorf("invalid platform code: %q", rule.Value)
+		}
+	case AccessRuleApp:
+		if _, err := strconv.ParseInt(rule.Value, 10, 64); err != nil {
+			return fmt.Errorf("invalid app id: %q", rule.Value)
+		}
+	case AccessRuleBuild:
+		if _, _, err := parseBuildRange(rule.Value); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown rule type: %q", rule.Type)
+	}
+	return nil
+}
+
+// Matches reports whether the request has the attribute the rule matches.
+// Rules that cannot be parsed never match.
+func (rule AccessControlRule) Matches(request AccessRequest) bool {
+	switch rule.Type {
+	case AccessRuleIp:
+		network, err := parseNetwork(rule.Value)
+		ip := net.ParseIP(request.ClientIp)
+		return err == nil && ip != nil && network.Contains(ip)
+	case AccessRulePlatform:
+		code := game.PlatformCode(0).Parse(rule.Value)
+		return code != 0 && code == request.EchoUserId.PlatformCode
+	case AccessRuleApp:
+		appId, err := strconv.ParseInt(rule.Value, 10, 64)
+		return err == nil && appId == request.AppId
+	case AccessRuleBuild:
+		first, last, err := parseBuildRange(rule.Value)
+		return err == nil && request.BuildVersion >= first && request.BuildVersion <= last
+	}
+	return false
+}
+
+// parseNetwork parses a CIDR, or a single IP address as a network containing only that address.
+func parseNetwork(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip address: %q", value)
+		}
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr: %q", value)
+	}
+	return network, nil
+}
+
+// parseBuildRange parses a build version ("631547") or an inclusive range ("631547-", "-631547", "631000-631547").
+func parseBuildRange(value string) (int64, int64, error) {
+	var err error
+	first, last := int64(0), int64(1<<63-1)
+	from, to, isRange := strings.Cut(value, "-")
+	if !isRange {
+		to = from
+	}
+	if from != "" {
+		if first, err = strconv.ParseInt(from, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid build version: %q", value)
+		}
+	}
+	if to != "" {
+		if last, err = strconv.ParseInt(to, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid build version: %q", value)
+		}
+	}
+	if (from == "" && to == "") || first > last {
+		return 0, 0, fmt.Errorf("invalid build version: %q", value)
+	}
+	return first, last, nil
+}
@@ -0,0 +1,81 @@
+package relayconfig
+
+import (
+	"testing"
+
+	"echonakama/game"
+)
+
+func TestAccessControlListCheck(t *testing.T) {
+	request := AccessRequest{
+		ClientIp:     "10.1.2.3",
+		EchoUserId:   *game.NewEchoUserId(game.OVR_ORG, 1234),
+		AppId:        1369078409873402,
+		BuildVersion: 631547,
+	}
+
+	tests := []struct {
+		name    string
+		acl     AccessControlList
+		allowed bool
+	}{
+		{"empty", AccessControlList{}, true},
+		{"denied cidr", AccessControlList{Deny: []AccessControlRule{{Type: AccessRuleIp, Value: "10.0.0.0/8"}}}, false},
+		{"denied ip", AccessControlList{Deny: []AccessControlRule{{Type: AccessRuleIp, Value: "10.1.2.3"}}}, false},
+		{"other ip", AccessControlList{Deny: []AccessControlRule{{Type: AccessRuleIp, Value: "10.1.2.4"}}}, true},
+		{"denied platform", AccessControlList{Deny: []AccessControlRule{{Type: AccessRulePlatform, Value: "OVR-ORG"}}}, false},
+		{"denied build range", AccessControlList{Deny: []AccessControlRule{{Type: AccessRuleBuild, Value: "-631546"}}}, true},
+		{"allowed app", AccessControlList{Allow: []AccessControlRule{{Type: AccessRuleApp, Value: "1369078409873402"}}}, true},
+		{"not allowed app", AccessControlList{Allow: []AccessControlRule{{Type: AccessRuleApp, Value: "2215004568539258"}}}, false},
+		{"allowed one of each type", AccessControlList{Allow: []AccessControlRule{
+			{Type: AccessRuleApp, Value: "2215004568539258"},
+			{Type: AccessRuleApp, Value: "1369078409873402"},
+			{Type: AccessRuleBuild, Value: "631547-"},
+		}}, true},
+		{"allowed app but not build", AccessControlList{Allow: []AccessControlRule{
+			{Type: AccessRuleApp, Value: "1369078409873402"},
+			{Type: AccessRuleBuild, Value: "631000-631500"},
+		}}, false},
+		{"deny overrides allow", AccessControlList{
+			Allow: []AccessControlRule{{Type: AccessRulePlatform, Value: "OVR_ORG"}},
+			Deny:  []AccessControlRule{{Type: AccessRuleIp, Value: "10.1.0.0/16"}},
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.acl.Check(request)
+			if (err == nil) != tt.allowed {
+				t.Errorf("Check() error = %v, allowed %v", err, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestAccessControlListValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    AccessControlRule
+		wantErr bool
+	}{
+		{"cidr", AccessControlRule{Type: AccessRuleIp, Value: "192.168.0.0/16"}, false},
+		{"ipv6", AccessControlRule{Type: AccessRuleIp, Value: "2001:db8::1"}, false},
+		{"invalid cidr", AccessControlRule{Type: AccessRuleIp, Value: "192.168.0.0/33"}, true},
+		{"platform", AccessControlRule{Type: AccessRulePlatform, Value: "STM"}, false},
+		{"invalid platform", AccessControlRule{Type: AccessRulePlatform, Value: "XYZ"}, true},
+		{"invalid app", AccessControlRule{Type: AccessRuleApp, Value: "quest"}, true},
+		{"build range", AccessControlRule{Type: AccessRuleBuild, Value: "631000-631547"}, false},
+		{"inverted build range", AccessControlRule{Type: AccessRuleBuild, Value: "631547-631000"}, true},
+		{"empty build range", AccessControlRule{Type: AccessRuleBuild, Value: "-"}, true},
+		{"unknown type", AccessControlRule{Type: "hmd", Value: "WMHD"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl := AccessControlList{Deny: []AccessControlRule{tt.rule}}
+			if err := acl.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
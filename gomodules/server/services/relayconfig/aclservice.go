@@ -0,0 +1,124 @@
+package relayconfig
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	AccessControlListStorageCollection = "Relay:acl"
+	AccessControlListStorageKey        = "allow_deny_list"
+)
+
+// ReadAccessControlList reads the access control list and its storage version.
+// If no list has been set, an empty list (which allows every login) is returned.
+func ReadAccessControlList(ctx context.Context, nk runtime.NakamaModule) (*AccessControlList, string, error) {
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+		Collection: AccessControlListStorageCollection,
+		Key:        AccessControlListStorageKey,
+		UserID:     services.SystemUserId,
+	}})
+	if err != nil {
+		return nil, "", err
+	}
+
+	acl := &AccessControlList{Allow: []AccessControlRule{}, Deny: []AccessControlRule{}}
+	if len(objects) == 0 {
+		return acl, "", nil
+	}
+	if err := json.Unmarshal([]byte(objects[0].Value), acl); err != nil {
+		return nil, "", err
+	}
+	return acl, objects[0].Version, nil
+}
+
+// GetAccessControlList returns the access control list, with its storage version in VersionField.
+func GetAccessControlList(serviceContext *services.ServiceContext) (json.RawMessage, *apierror.Error) {
+
+	acl, version, err := ReadAccessControlList(serviceContext.Ctx, serviceContext.NakamaModule)
+	if err != nil {
+		return nil, apierror.Internal("error reading access control list", err)
+	}
+	aclJson, err := json.Marshal(acl)
+	if err != nil {
+		return nil, apierror.Internal("error marshaling access control list", err)
+	}
+	data, err := withStorageVersion(aclJson, version)
+	if err != nil {
+		return nil, apierror.Internal("error marshaling access control list", err)
+	}
+	return data, nil
+}
+
+// SetAccessControlList validates and writes the access control list, returning its new storage version.
+// If the payload carries a storage version, the write only succeeds if the stored list still has it.
+func SetAccessControlList(serviceContext *services.ServiceContext, payload []byte) (string, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	logger := serviceContext.Logger
+	nk := serviceContext.NakamaModule
+
+	var request struct {
+		AccessControlList
+		Version string `json:"_version"`
+	}
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return "", apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, "invalid access control list: "+err.Error())
+	}
+	acl := request.AccessControlList
+	if err := acl.Validate(); err != nil {
+		return "", apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, "invalid access control list: "+err.Error())
+	}
+	if acl.Allow == nil {
+		acl.Allow = []AccessControlRule{}
+	}
+	if acl.Deny == nil {
+		acl.Deny = []AccessControlRule{}
+	}
+
+	aclJson, err := json.Marshal(acl)
+	if err != nil {
+		return "", apierror.Internal("error marshaling access control list", err)
+	}
+
+	acks, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      AccessControlListStorageCollection,
+		Key:             AccessControlListStorageKey,
+		UserID:          services.SystemUserId,
+		Value:           string(aclJson),
+		Version:         request.Version,
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}})
+	if err != nil {
+		if errors.Is(err, runtime.ErrStorageRejectedVersion) {
+			return "", apierror.New(apierror.StatusFailedPrecondition, apierror.ReasonConflict, "access control list has changed since version "+request.Version)
+		}
+		return "", apierror.Internal("error writing access control list", err)
+	}
+
+	logger.WithField("allow", len(acl.Allow)).WithField("deny", len(acl.Deny)).Info("Access control list updated.")
+	return acks[0].Version, nil
+}
+
+// CheckAccess evaluates the access control list against a login.
+// It returns an access denied error if the login is refused; the refusing rule is only logged.
+func CheckAccess(serviceContext *services.ServiceContext, request AccessRequest) *apierror.Error {
+	logger := serviceContext.Logger
+
+	acl, _, err := ReadAccessControlList(serviceContext.Ctx, serviceContext.NakamaModule)
+	if err != nil {
+		return apierror.Internal("error reading access control list", err)
+	}
+
+	if err := acl.Check(request); err != nil {
+		logger.WithField("xplatformid", request.EchoUserId.String()).WithField("clientIp", request.ClientIp).WithField("reason", err.Error()).Warn("Login refused by access control list.")
+		return apierror.New(apierror.StatusPermissionDenied, apierror.ReasonAccessDenied, "access denied").Wrap(err)
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package relayconfig
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"echonakama/game"
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	ClientSettingsStorageCollection      = "Relay:clientSettings"
+	ClientSettingsGlobalStorageKey       = "global"    // the global settings, owned by the system user
+	ClientSettingsOverridesStorageKey    = "overrides" // a relay's overrides, owned by the relay's user
+	ClientSettingsAuditStorageCollection = "Relay:clientSettingsAudit"
+)
+
+// ClientSettingsAuditRecord records a change to the global client settings or a relay's overrides.
+type ClientSettingsAuditRecord struct {
+	RelayUserId string          `json:"relay_user_id,omitempty"` // the relay whose overrides changed (empty for the global settings)
+	AdminUserId string          `json:"admin_user_id"`           // the user that made the change
+	Old         json.RawMessage `json:"old"`                     // the settings before the change (null if unset)
+	New         json.RawMessage `json:"new"`                     // the settings after the change (null if cleared)
+	Timestamp   int64           `json:"timestamp"`               // when the change was made
+}
+
+// ClientSettingsState describes a relay's settings and where they come from.
+type ClientSettingsState struct {
+	Global    json.RawMessage         `json:"global"`    // the global settings (null if unset)
+	Overrides json.RawMessage         `json:"overrides"` // the relay's overrides (null if unset)
+	Effective game.EchoClientSettings `json:"effective"` // the settings logins through the relay receive
+	Version   string                  `json:"_version"`  // the storage version of the global settings or overrides
+}
+
+// parseClientSettings checks that data is a (partial) EchoClientSettings object, with no unknown fields.
+func parseClientSettings(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	settings := game.EchoClientSettings{}
+	return decoder.Decode(&settings)
+}
+
+// effectiveClientSettings overlays the global settings, then the relay's overrides, onto the defaults.
+// Only the fields present in each layer replace the layer below; config_data is merged by key.
+func effectiveClientSettings(global json.RawMessage, overrides json.RawMessage) (game.EchoClientSettings, error) {
+	settings := game.DefaultEchoClientSettings()
+	for _, layer := range []json.RawMessage{global, overrides} {
+		if len(layer) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(layer, &settings); err != nil {
+			return game.DefaultEchoClientSettings(), err
+		}
+	}
+	if settings.ConfigData == nil {
+		settings.ConfigData = make(map[string]interface{})
+	}
+	return settings, nil
+}
+
+// clientSettingsOwner returns the user that owns a relay's overrides, or the global settings.
+func clientSettingsOwner(relayUserId string) (string, string) {
+	if relayUserId == "" {
+		return services.SystemUserId, ClientSettingsGlobalStorageKey
+	}
+	return relayUserId, ClientSettingsOverridesStorageKey
+}
+
+// readClientSettings returns the global settings and the relay's overrides, and their storage versions.
+func readClientSettings(ctx context.Context, nk runtime.NakamaModule, relayUserId string) (global json.RawMessage, globalVersion string, overrides json.RawMessage, overridesVersion string, err error) {
+	reads := []*runtime.StorageRead{{
+		Collection: ClientSettingsStorageCollection,
+		Key:        ClientSettingsGlobalStorageKey,
+		UserID:     services.SystemUserId,
+	}}
+	if relayUserId != "" {
+		reads = append(reads, &runtime.StorageRead{
+			Collection: ClientSettingsStorageCollection,
+			Key:        ClientSettingsOverridesStorageKey,
+			UserID:     relayUserId,
+		})
+	}
+
+	objects, err := nk.StorageRead(ctx, reads)
+	if err != nil {
+		return nil, "", nil, "", err
+	}
+	for _, object := range objects {
+		switch object.Key {
+		case ClientSettingsGlobalStorageKey:
+			global, globalVersion = json.RawMessage(object.Value), object.Version
+		case ClientSettingsOverridesStorageKey:
+			overrides, overridesVersion = json.RawMessage(object.Value), object.Version
+		}
+	}
+	return global, globalVersion, overrides, overridesVersion, nil
+}
+
+// ResolveClientSettings returns the client settings for logins through a relay:
+// the defaults, overlaid by the global settings, overlaid by the relay's overrides.
+func ResolveClientSettings(ctx context.Context, nk runtime.NakamaModule, relayUserId string) (game.EchoClientSettings, error) {
+	global, _, overrides, _, err := readClientSettings(ctx, nk, relayUserId)
+	if err != nil {
+		return game.DefaultEchoClientSettings(), err
+	}
+	return effectiveClientSettings(global, overrides)
+}
+
+// GetClientSettings returns the global settings, a relay's overrides, and the resulting settings.
+// With an empty relayUserId, only the global settings are described.
+func GetClientSettings(serviceContext *services.ServiceContext, relayUserId string) (*ClientSettingsState, *apierror.Error) {
+
+	global, globalVersion, overrides, overridesVersion, err := readClientSettings(serviceContext.Ctx, serviceContext.NakamaModule, relayUserId)
+	if err != nil {
+		return nil, apierror.Internal("error reading client settings", err)
+	}
+	effective, err := effectiveClientSettings(global, overrides)
+	if err != nil {
+		return nil, apierror.New(apierror.StatusDataLoss, apierror.ReasonInternal, "error unmarshaling client settings").Wrap(err)
+	}
+
+	state := &ClientSettingsState{
+		Global:    global,
+		Overrides: overrides,
+		Effective: effective,
+		Version:   globalVersion,
+	}
+	if relayUserId != "" {
+		state.Version = overridesVersion
+	}
+	return state, nil
+}
+
+// SetClientSettings replaces the global settings (with an empty relayUserId) or a relay's overrides,
+// and records the change in the audit log. The settings may set any subset of the fields;
+// null clears them. If version is set, the write only succeeds if the stored settings still have it.
+// Logins pick up the change the next time they resolve their settings.
+func SetClientSettings(serviceContext *services.ServiceContext, relayUserId string, settings json.RawMessage, version string, adminUserId string) (string, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	logger := serviceContext.Logger
+	nk := serviceContext.NakamaModule
+
+	clear := len(settings) == 0 || string(settings) == "null"
+	if !clear {
+		if err := parseClientSettings(settings); err != nil {
+			return "", apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, "invalid client settings: "+err.Error())
+		}
+		if _, err := effectiveClientSettings(settings, nil); err != nil {
+			return "", apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, "invalid client settings: "+err.Error())
+		}
+	}
+
+	owner, key := clientSettingsOwner(relayUserId)
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+		Collection: ClientSettingsStorageCollection,
+		Key:        key,
+		UserID:     owner,
+	}})
+	if err != nil {
+		return "", apierror.Internal("error reading client settings", err)
+	}
+	old := json.RawMessage("null")
+	storedVersion := ""
+	if len(objects) > 0 {
+		old, storedVersion = json.RawMessage(objects[0].Value), objects[0].Version
+	}
+	if version != "" && version != storedVersion {
+		return "", apierror.New(apierror.StatusFailedPrecondition, apierror.ReasonConflict, "client settings have changed since version "+version)
+	}
+
+	// Compact the settings, so they are stored and audited as they will be applied
+	var compacted bytes.Buffer
+	if !clear {
+		if err := json.Compact(&compacted, settings); err != nil {
+			return "", apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, "invalid client settings: "+err.Error())
+		}
+	}
+
+	timestamp := time.Now().UTC()
+	record := ClientSettingsAuditRecord{
+		RelayUserId: relayUserId,
+		AdminUserId: adminUserId,
+		Old:         old,
+		New:         json.RawMessage("null"),
+		Timestamp:   timestamp.Unix(),
+	}
+	if !clear {
+		record.New = compacted.Bytes()
+	}
+	recordJson, err := json.Marshal(record)
+	if err != nil {
+		return "", apierror.Internal("error marshaling audit record", err)
+	}
+	auditWrite := &runtime.StorageWrite{
+		Collection:      ClientSettingsAuditStorageCollection,
+		Key:             fmt.Sprintf("%020d_%s", timestamp.UnixNano(), owner), // listed in chronological order
+		UserID:          services.SystemUserId,
+		Value:           string(recordJson),
+		PermissionRead:  0,
+		PermissionWrite: 0,
+		Version:         "*",
+	}
+
+	if clear {
+		if len(objects) == 0 {
+			return "", nil
+		}
+		if err := nk.StorageDelete(ctx, []*runtime.StorageDelete{{
+			Collection: ClientSettingsStorageCollection,
+			Key:        key,
+			UserID:     owner,
+			Version:    storedVersion,
+		}}); err != nil {
+			if errors.Is(err, runtime.ErrStorageRejectedVersion) {
+				return "", apierror.New(apierror.StatusAborted, apierror.ReasonConflict, "client settings were modified concurrently")
+			}
+			return "", apierror.Internal("error clearing client settings", err)
+		}
+		if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{auditWrite}); err != nil {
+			logger.WithField("err", err).Error("error writing client settings audit record.")
+		}
+		logger.WithField("relayUserId", relayUserId).WithField("adminUserId", adminUserId).Info("Client settings cleared.")
+		return "", nil
+	}
+
+	// Writing the audit record with the settings keeps the two consistent
+	writeVersion := storedVersion
+	if writeVersion == "" {
+		writeVersion = "*" // the settings must not have been created since they were read
+	}
+	acks, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      ClientSettingsStorageCollection,
+		Key:             key,
+		UserID:          owner,
+		Value:           compacted.String(),
+		Version:         writeVersion,
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}, auditWrite})
+	if err != nil {
+		if errors.Is(err, runtime.ErrStorageRejectedVersion) {
+			return "", apierror.New(apierror.StatusAborted, apierror.ReasonConflict, "client settings were modified concurrently")
+		}
+		return "", apierror.Internal("error writing client settings", err)
+	}
+
+	logger.WithField("relayUserId", relayUserId).WithField("adminUserId", adminUserId).Info("Client settings updated.")
+	return acks[0].Version, nil
+}
+
+// ListClientSettingsAudit returns a page of the client settings audit log, oldest first.
+func ListClientSettingsAudit(serviceContext *services.ServiceContext, limit int, cursor string) ([]*ClientSettingsAuditRecord, string, *apierror.Error) {
+
+	objects, next, err := serviceContext.NakamaModule.StorageList(serviceContext.Ctx, "", services.SystemUserId, ClientSettingsAuditStorageCollection, limit, cursor)
+	if err != nil {
+		return nil, "", apierror.Internal("error listing client settings audit", err)
+	}
+
+	records := make([]*ClientSettingsAuditRecord, 0, len(objects))
+	for _, object := range objects {
+		record := &ClientSettingsAuditRecord{}
+		if err := json.Unmarshal([]byte(object.Value), record); err != nil {
+			return nil, "", apierror.New(apierror.StatusDataLoss, apierror.ReasonInternal, "error unmarshaling audit record").Wrap(err)
+		}
+		records = append(records, record)
+	}
+	return records, next, nil
+}
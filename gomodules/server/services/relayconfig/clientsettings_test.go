@@ -0,0 +1,54 @@
+package relayconfig
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEffectiveClientSettings(t *testing.T) {
+	global := json.RawMessage(`{"env":"staging","config_data":{"active_battle_pass_season":"season_1"}}`)
+	overrides := json.RawMessage(`{"matchmaker_queue_mode":"pvp","config_data":{"active_store_entry":"store_1"}}`)
+
+	settings, err := effectiveClientSettings(global, overrides)
+	if err != nil {
+		t.Fatalf("effectiveClientSettings() error: %v", err)
+	}
+	if settings.Env != "staging" {
+		t.Errorf("Env = %q, want the global setting", settings.Env)
+	}
+	if settings.MatchmakerQueueMode != "pvp" {
+		t.Errorf("MatchmakerQueueMode = %q, want the relay's override", settings.MatchmakerQueueMode)
+	}
+	if !settings.RemoteLogErrors {
+		t.Errorf("RemoteLogErrors = false, want the default")
+	}
+	if len(settings.ConfigData) != 2 {
+		t.Errorf("ConfigData = %v, want both layers' keys", settings.ConfigData)
+	}
+
+	settings, err = effectiveClientSettings(nil, nil)
+	if err != nil || settings.Env != "live" || settings.ConfigData == nil {
+		t.Errorf("effectiveClientSettings(nil, nil) = %+v, %v, want the defaults", settings, err)
+	}
+}
+
+func TestParseClientSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"partial", `{"env":"staging"}`, false},
+		{"empty", `{}`, false},
+		{"unknown field", `{"environment":"staging"}`, true},
+		{"wrong type", `{"iap_unlocked":"yes"}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := parseClientSettings([]byte(tt.data)); (err != nil) != tt.wantErr {
+				t.Errorf("parseClientSettings() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
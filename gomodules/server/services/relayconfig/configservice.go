@@ -0,0 +1,125 @@
+package relayconfig
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"echonakama/game"
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	ConfigStorageCollectionPrefix = "Config:"
+
+	// VersionField carries the storage version of a config resource in its JSON.
+	VersionField = "_version"
+)
+
+// ConfigKey identifies a config resource.
+type ConfigKey struct {
+	Type    string `json:"type"`     // the config type (e.g. main_menu)
+	Id      string `json:"id"`       // the config id
+	Version string `json:"_version"` // the storage version (set requests only; empty to overwrite)
+}
+
+// StorageCollection returns the storage collection that holds configs of the given type.
+func StorageCollection(configType string) string {
+	return ConfigStorageCollectionPrefix + configType
+}
+
+// GetConfig reads a config resource. The returned JSON includes its storage version in VersionField.
+func GetConfig(serviceContext *services.ServiceContext, key ConfigKey) (json.RawMessage, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	nk := serviceContext.NakamaModule
+
+	if _, err := game.NewConfigResource(key.Type); err != nil {
+		return nil, apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, err.Error())
+	}
+	if key.Id == "" {
+		return nil, apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, "id is empty")
+	}
+
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+		Collection: StorageCollection(key.Type),
+		Key:        key.Id,
+		UserID:     services.SystemUserId,
+	}})
+	if err != nil {
+		return nil, apierror.Internal("error reading config", err)
+	}
+	if len(objects) == 0 {
+		return nil, apierror.New(apierror.StatusNotFound, apierror.ReasonNotFound, fmt.Sprintf("%s/%s not found", StorageCollection(key.Type), key.Id))
+	}
+
+	data, err := withStorageVersion([]byte(objects[0].Value), objects[0].Version)
+	if err != nil {
+		return nil, apierror.New(apierror.StatusDataLoss, apierror.ReasonInternal, "error unmarshaling config").Wrap(err)
+	}
+	return data, nil
+}
+
+// SetConfig validates and writes a config resource, returning its new storage version.
+// If the payload carries a storage version, the write only succeeds if the stored config still has it.
+func SetConfig(serviceContext *services.ServiceContext, payload []byte) (string, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	logger := serviceContext.Logger
+	nk := serviceContext.NakamaModule
+
+	var key ConfigKey
+	if err := json.Unmarshal(payload, &key); err != nil {
+		return "", apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, "invalid config: "+err.Error())
+	}
+	resource, err := game.NewConfigResource(key.Type)
+	if err != nil {
+		return "", apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, err.Error())
+	}
+	if err := json.Unmarshal(payload, resource); err != nil {
+		return "", apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, "invalid config: "+err.Error())
+	}
+	if err := resource.Validate(); err != nil {
+		return "", apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, err.Error())
+	}
+
+	// Store the typed resource, so unknown fields and the version are dropped
+	resourceJson, err := json.Marshal(resource)
+	if err != nil {
+		return "", apierror.Internal("error marshaling config", err)
+	}
+
+	acks, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      StorageCollection(resource.ConfigType()),
+		Key:             resource.ConfigId(),
+		UserID:          services.SystemUserId,
+		Value:           string(resourceJson),
+		Version:         key.Version,
+		PermissionRead:  2,
+		PermissionWrite: 0,
+	}})
+	if err != nil {
+		if errors.Is(err, runtime.ErrStorageRejectedVersion) {
+			return "", apierror.New(apierror.StatusFailedPrecondition, apierror.ReasonConflict, "config has changed since version "+key.Version)
+		}
+		return "", apierror.Internal("error writing config", err)
+	}
+
+	logger.WithField("type", resource.ConfigType()).WithField("id", resource.ConfigId()).Info("Config updated.")
+	return acks[0].Version, nil
+}
+
+// withStorageVersion adds the storage version to a JSON object.
+func withStorageVersion(data []byte, version string) (json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	versionJson, err := json.Marshal(version)
+	if err != nil {
+		return nil, err
+	}
+	fields[VersionField] = versionJson
+	return json.Marshal(fields)
+}
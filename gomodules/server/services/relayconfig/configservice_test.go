@@ -0,0 +1,82 @@
+package relayconfig
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+	"echonakama/server/services/nakamatest"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+func TestWithStorageVersion(t *testing.T) {
+	data, err := withStorageVersion([]byte(`{"type":"main_menu","id":"main_menu","_version":"stale"}`), "abc123")
+	if err != nil {
+		t.Fatalf("withStorageVersion() error: %v", err)
+	}
+
+	var key ConfigKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		t.Fatalf("json.Unmarshal() error: %v", err)
+	}
+	expected := ConfigKey{Type: "main_menu", Id: "main_menu", Version: "abc123"}
+	if key != expected {
+		t.Errorf("withStorageVersion() = %+v, want %+v", key, expected)
+	}
+
+	if _, err := withStorageVersion([]byte(`[]`), "abc123"); err == nil {
+		t.Errorf("withStorageVersion() error = nil, want error for a non-object")
+	}
+}
+
+func TestGetConfigLegacy(t *testing.T) {
+	nk := nakamatest.NewModule()
+	ctx := context.Background()
+	serviceContext := &services.ServiceContext{Ctx: ctx, Logger: nakamatest.NewLogger(t), NakamaModule: nk}
+	key := ConfigKey{Type: "main_menu", Id: "main_menu"}
+
+	if _, apiErr := GetConfig(serviceContext, key); apiErr == nil || apiErr.Code != apierror.StatusNotFound {
+		t.Fatalf("GetConfig() error = %v, want not found", apiErr)
+	}
+
+	// The JS runtime stored the config under the relay's user; another relay set an older copy
+	for _, legacy := range []struct{ userId, value string }{
+		{"old-relay-user", `{"type":"main_menu","id":"main_menu","help_link":"https://old.example.com"}`},
+		{"relay-user", `{"type":"main_menu","id":"main_menu","help_link":"https://example.com"}`},
+	} {
+		if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{Collection: StorageCollection(key.Type), Key: key.Id, UserID: legacy.userId, Value: legacy.value}}); err != nil {
+			t.Fatalf("StorageWrite() error: %v", err)
+		}
+	}
+	if _, apiErr := GetConfig(serviceContext, key); apiErr == nil || apiErr.Code != apierror.StatusNotFound {
+		t.Fatalf("GetConfig() error = %v, want not found until the config is adopted", apiErr)
+	}
+
+	runMigrations(t, nk)
+	data, apiErr := GetConfig(serviceContext, key)
+	if apiErr != nil {
+		t.Fatalf("GetConfig() error: %v", apiErr)
+	}
+	var config struct {
+		HelpLink string `json:"help_link"`
+		Version  string `json:"_version"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatalf("json.Unmarshal() error: %v", err)
+	}
+	if config.HelpLink != "https://example.com" || config.Version == "" {
+		t.Errorf("GetConfig() = %s, want the legacy config with a version", data)
+	}
+
+	// The config is copied to the system user, so it can be updated with its version
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{Collection: StorageCollection(key.Type), Key: key.Id, UserID: services.SystemUserId}})
+	if err != nil || len(objects) != 1 || objects[0].Version != config.Version {
+		t.Fatalf("StorageRead() = %v, error = %v, want the adopted config", objects, err)
+	}
+	if _, apiErr := SetConfig(serviceContext, []byte(`{"type":"main_menu","id":"main_menu","_version":"`+config.Version+`"}`)); apiErr != nil {
+		t.Errorf("SetConfig() error: %v", apiErr)
+	}
+}
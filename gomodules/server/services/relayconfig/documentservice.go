@@ -0,0 +1,206 @@
+package relayconfig
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"echonakama/game"
+	"echonakama/server/services"
+	"echonakama/server/services/apierror"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	DocumentStorageCollectionPrefix = "Document:"
+)
+
+// DocumentKey identifies a localized document.
+type DocumentKey struct {
+	Type    string `json:"type"`     // the document type (e.g. eula)
+	Lang    string `json:"lang"`     // the language of the document (e.g. en, en-US)
+	Version string `json:"_version"` // the storage version (set requests only; empty to overwrite)
+}
+
+// DocumentStorageCollection returns the storage collection that holds documents of the given type.
+func DocumentStorageCollection(documentType string) string {
+	return DocumentStorageCollectionPrefix + documentType
+}
+
+// DocumentStorageKey returns the storage key of a document in the given language.
+func DocumentStorageKey(documentType string, lang string) string {
+	return documentType + "_" + normalizeLanguage(lang)
+}
+
+func normalizeLanguage(lang string) string {
+	return strings.ToLower(strings.ReplaceAll(lang, "_", "-"))
+}
+
+// documentLanguages returns the languages to try, in order, for a document requested in lang.
+// A regional language (e.g. en-US) falls back to its base language, then to the fallback language.
+func documentLanguages(lang string, fallback string) []string {
+	candidates := []string{normalizeLanguage(lang)}
+	if i := strings.Index(candidates[0], "-"); i > 0 {
+		candidates = append(candidates, candidates[0][:i])
+	}
+	candidates = append(candidates, normalizeLanguage(fallback))
+
+	languages := make([]string, 0, len(candidates))
+	seen := make(map[string]bool, len(candidates))
+	for _, candidate := range candidates {
+		if candidate != "" && !seen[candidate] {
+			seen[candidate] = true
+			languages = append(languages, candidate)
+		}
+	}
+	return languages
+}
+
+// GetDocument reads a document in the requested language, or the closest available one.
+// The returned JSON includes its storage version in VersionField.
+func GetDocument(serviceContext *services.ServiceContext, key DocumentKey) (json.RawMessage, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	nk := serviceContext.NakamaModule
+
+	if _, err := game.NewDocumentResource(key.Type); err != nil {
+		return nil, apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, err.Error())
+	}
+
+	languages := documentLanguages(key.Lang, serviceContext.Config.DocumentFallbackLanguage)
+	reads := make([]*runtime.StorageRead, 0, len(languages))
+	for _, lang := range languages {
+		reads = append(reads, &runtime.StorageRead{
+			Collection: DocumentStorageCollection(key.Type),
+			Key:        DocumentStorageKey(key.Type, lang),
+			UserID:     services.SystemUserId,
+		})
+	}
+	objects, err := nk.StorageRead(ctx, reads)
+	if err != nil {
+		return nil, apierror.Internal("error reading document", err)
+	}
+
+	// Serve the first language that is available
+	for _, lang := range languages {
+		for _, object := range objects {
+			if object.Key != DocumentStorageKey(key.Type, lang) {
+				continue
+			}
+			data, err := withStorageVersion([]byte(object.Value), object.Version)
+			if err != nil {
+				return nil, apierror.New(apierror.StatusDataLoss, apierror.ReasonInternal, "error unmarshaling document").Wrap(err)
+			}
+			return data, nil
+		}
+	}
+	return nil, apierror.New(apierror.StatusNotFound, apierror.ReasonNotFound, fmt.Sprintf("%s document not found for %q", key.Type, key.Lang))
+}
+
+// SetDocument validates and writes a document, returning its new storage version.
+// The consent versions of a document cannot decrease, so players are never asked to accept older terms.
+// If the payload carries a storage version, the write only succeeds if the stored document still has it.
+func SetDocument(serviceContext *services.ServiceContext, payload []byte) (string, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	logger := serviceContext.Logger
+	nk := serviceContext.NakamaModule
+
+	var key DocumentKey
+	if err := json.Unmarshal(payload, &key); err != nil {
+		return "", apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, "invalid document: "+err.Error())
+	}
+	document, err := game.NewDocumentResource(key.Type)
+	if err != nil {
+		return "", apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, err.Error())
+	}
+	if err := json.Unmarshal(payload, document); err != nil {
+		return "", apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, "invalid document: "+err.Error())
+	}
+	if err := document.Validate(); err != nil {
+		return "", apierror.New(apierror.StatusInvalidArgument, apierror.ReasonInvalidRequest, err.Error())
+	}
+
+	collection := DocumentStorageCollection(document.DocumentType())
+	storageKey := DocumentStorageKey(document.DocumentType(), document.DocumentLang())
+
+	// Compare the consent versions with the stored document
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+		Collection: collection,
+		Key:        storageKey,
+		UserID:     services.SystemUserId,
+	}})
+	if err != nil {
+		return "", apierror.Internal("error reading document", err)
+	}
+	if len(objects) > 0 {
+		stored, _ := game.NewDocumentResource(document.DocumentType())
+		if err := json.Unmarshal([]byte(objects[0].Value), stored); err != nil {
+			return "", apierror.New(apierror.StatusDataLoss, apierror.ReasonInternal, "error unmarshaling document").Wrap(err)
+		}
+		versions := document.ConsentVersions()
+		for profileKey, storedVersion := range stored.ConsentVersions() {
+			if version, found := versions[profileKey]; found && version < storedVersion {
+				return "", apierror.New(apierror.StatusFailedPrecondition, apierror.ReasonConflict, fmt.Sprintf("%s version %d is older than the stored version %d", profileKey, version, storedVersion))
+			}
+		}
+	}
+
+	documentJson, err := json.Marshal(document)
+	if err != nil {
+		return "", apierror.Internal("error marshaling document", err)
+	}
+
+	acks, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      collection,
+		Key:             storageKey,
+		UserID:          services.SystemUserId,
+		Value:           string(documentJson),
+		Version:         key.Version,
+		PermissionRead:  2,
+		PermissionWrite: 0,
+	}})
+	if err != nil {
+		if errors.Is(err, runtime.ErrStorageRejectedVersion) {
+			return "", apierror.New(apierror.StatusFailedPrecondition, apierror.ReasonConflict, "document has changed since version "+key.Version)
+		}
+		return "", apierror.Internal("error writing document", err)
+	}
+
+	logger.WithField("type", document.DocumentType()).WithField("lang", document.DocumentLang()).Info("Document updated.")
+	return acks[0].Version, nil
+}
+
+// ConsentVersions returns the current version of each legal consent, keyed by the client profile key it is
+// recorded in. Documents in several languages may ask for the same consent; the highest version is current.
+func ConsentVersions(serviceContext *services.ServiceContext) (map[string]int64, *apierror.Error) {
+	ctx := serviceContext.Ctx
+	nk := serviceContext.NakamaModule
+
+	versions := make(map[string]int64)
+	for _, documentType := range game.DocumentTypes() {
+		cursor := ""
+		for {
+			objects, next, err := nk.StorageList(ctx, "", services.SystemUserId, DocumentStorageCollection(documentType), 100, cursor)
+			if err != nil {
+				return nil, apierror.Internal("error listing documents", err)
+			}
+			for _, object := range objects {
+				document, _ := game.NewDocumentResource(documentType)
+				if err := json.Unmarshal([]byte(object.Value), document); err != nil {
+					return nil, apierror.New(apierror.StatusDataLoss, apierror.ReasonInternal, "error unmarshaling document").Wrap(err)
+				}
+				for profileKey, version := range document.ConsentVersions() {
+					if version > versions[profileKey] {
+						versions[profileKey] = version
+					}
+				}
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+	}
+	return versions, nil
+}
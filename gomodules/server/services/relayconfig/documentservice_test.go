@@ -0,0 +1,31 @@
+package relayconfig
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDocumentLanguages(t *testing.T) {
+	tests := []struct {
+		lang     string
+		fallback string
+		want     []string
+	}{
+		{"en", "en", []string{"en"}},
+		{"fr", "en", []string{"fr", "en"}},
+		{"en-US", "en", []string{"en-us", "en"}},
+		{"pt_BR", "en", []string{"pt-br", "pt", "en"}},
+		{"", "en", []string{"en"}},
+	}
+	for _, tt := range tests {
+		if got := documentLanguages(tt.lang, tt.fallback); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("documentLanguages(%q, %q) = %v, want %v", tt.lang, tt.fallback, got, tt.want)
+		}
+	}
+}
+
+func TestDocumentStorageKey(t *testing.T) {
+	if got := DocumentStorageKey("eula", "en_US"); got != "eula_en-us" {
+		t.Errorf("DocumentStorageKey() = %q, want %q", got, "eula_en-us")
+	}
+}
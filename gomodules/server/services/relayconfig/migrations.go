@@ -0,0 +1,181 @@
+package relayconfig
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"echonakama/game"
+	"echonakama/server/services"
+	"echonakama/server/services/migration"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Migrations adopt the objects the JS runtime stored under the user of the relay that set them,
+// by copying them to the system user. Never change or remove a migration once it has shipped,
+// as its progress is recorded under its ID.
+func Migrations() []*migration.Migration {
+	var migrations []*migration.Migration
+	for _, configType := range game.ConfigTypes() {
+		migrations = append(migrations, &migration.Migration{
+			Id:          "relayconfig-adopt-config-" + configType,
+			Collection:  StorageCollection(configType),
+			Description: "copies the " + configType + " configs set by the JS runtime to the system user",
+			Copy:        legacyObjects{permissionRead: 2, storageKey: legacyKey}.adopt,
+		})
+	}
+	for _, documentType := range game.DocumentTypes() {
+		documentType := documentType
+		storageKey := func(key string) (string, bool) {
+			return legacyDocumentKey(documentType, key)
+		}
+		migrations = append(migrations, &migration.Migration{
+			Id:          "relayconfig-adopt-document-" + documentType,
+			Collection:  DocumentStorageCollection(documentType),
+			Description: "copies the " + documentType + " documents set by the JS runtime to the system user, under their normalized language",
+			Copy:        legacyObjects{permissionRead: 2, storageKey: storageKey}.adopt,
+		})
+	}
+	migrations = append(migrations, &migration.Migration{
+		Id:          "relayconfig-adopt-acl",
+		Collection:  AccessControlListStorageCollection,
+		Key:         AccessControlListStorageKey,
+		Description: "converts the access control list set by the JS runtime to rules, and copies it to the system user",
+		Copy:        legacyObjects{permissionRead: 0, storageKey: legacyKey, convert: convertLegacyAccessControlList}.adopt,
+	})
+	return migrations
+}
+
+// RegisterMigrations registers the relay config service's migrations with the module's registry.
+func RegisterMigrations() error {
+	return migration.Register(Migrations()...)
+}
+
+// legacyKey keeps the key of a legacy object, such as a config keyed by its id.
+func legacyKey(key string) (string, bool) {
+	return key, true
+}
+
+// legacyDocumentKey keys a legacy document by its normalized language; the JS runtime keyed
+// documents by the language as the relay sent it (e.g. eula_en_US).
+func legacyDocumentKey(documentType string, key string) (string, bool) {
+	lang, found := strings.CutPrefix(key, documentType+"_")
+	if !found || lang == "" {
+		return "", false
+	}
+	return DocumentStorageKey(documentType, lang), true
+}
+
+// legacyAccessControlList is the access control list the JS runtime stored: bare IP addresses or platform codes.
+type legacyAccessControlList struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// convertLegacyAccessControlList converts each legacy entry to a rule of the type its value parses as.
+// Entries that are neither an IP address (or CIDR) nor a platform code are dropped, and logged.
+func convertLegacyAccessControlList(logger runtime.Logger, value string) (string, error) {
+	var legacy legacyAccessControlList
+	if err := json.Unmarshal([]byte(value), &legacy); err != nil {
+		return "", err
+	}
+	acl := AccessControlList{
+		Allow: legacyAccessRules(logger.WithField("list", "allow"), legacy.Allow),
+		Deny:  legacyAccessRules(logger.WithField("list", "deny"), legacy.Deny),
+	}
+	data, err := json.Marshal(acl)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func legacyAccessRules(logger runtime.Logger, values []string) []AccessControlRule {
+	rules := make([]AccessControlRule, 0, len(values))
+	for _, value := range values {
+		rule := AccessControlRule{Value: value, Note: "set by the JS runtime"}
+		if _, err := parseNetwork(value); err == nil {
+			rule.Type = AccessRuleIp
+		} else if game.PlatformCode(0).Parse(value) != 0 {
+			rule.Type = AccessRulePlatform
+		} else {
+			logger.WithField("value", value).Warn("Dropping access control entry that is neither an IP address nor a platform code.")
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// legacyObjects adopts the objects the JS runtime stored under a relay user, by copying them to the system user.
+type legacyObjects struct {
+	permissionRead int                                                       // the read permission of the copy
+	storageKey     func(key string) (string, bool)                           // maps the legacy key to the key of the copy, or false if it is unknown
+	convert        func(logger runtime.Logger, value string) (string, error) // maps the legacy value to the stored shape, or nil to copy it as is
+}
+
+// adopt copies the object to the system user, and reports whether it did. If several relays stored an object
+// under the same key, only the most recently updated one is adopted, and only if the system user has none yet,
+// so an object set since the upgrade is kept.
+func (a legacyObjects) adopt(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, object *api.StorageObject) (bool, error) {
+	if object.UserId == services.SystemUserId {
+		return false, nil
+	}
+	logger = logger.WithField("collection", object.Collection).WithField("key", object.Key).WithField("relay_user_id", object.UserId)
+	key, ok := a.storageKey(object.Key)
+	if !ok {
+		logger.Warn("Skipping object with an unknown key.")
+		return false, nil
+	}
+
+	cursor := ""
+	for {
+		objects, next, err := nk.StorageList(ctx, "", "", object.Collection, 100, cursor)
+		if err != nil {
+			return false, err
+		}
+		for _, other := range objects {
+			if other.UserId == services.SystemUserId || other.UserId == object.UserId || !other.UpdateTime.AsTime().After(object.UpdateTime.AsTime()) {
+				continue
+			}
+			if otherKey, ok := a.storageKey(other.Key); ok && otherKey == key {
+				return false, nil
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	value := object.Value
+	if a.convert != nil {
+		var err error
+		if value, err = a.convert(logger, object.Value); err != nil {
+			logger.Warn("Skipping object that cannot be converted: %v", err)
+			return false, nil
+		}
+	}
+
+	// Only create the copy, so an object set meanwhile is not overwritten
+	_, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      object.Collection,
+		Key:             key,
+		UserID:          services.SystemUserId,
+		Value:           value,
+		Version:         "*",
+		PermissionRead:  a.permissionRead,
+		PermissionWrite: 0,
+	}})
+	if errors.Is(err, runtime.ErrStorageRejectedVersion) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	logger.Info("Adopted object set by the JS runtime.")
+	return true, nil
+}
@@ -0,0 +1,107 @@
+package relayconfig
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"echonakama/server/services"
+	"echonakama/server/services/config"
+	"echonakama/server/services/migration"
+	"echonakama/server/services/nakamatest"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// runMigrations runs the relay config service's migrations on the module's storage.
+func runMigrations(t *testing.T, nk runtime.NakamaModule) {
+	t.Helper()
+	registry := migration.NewRegistry()
+	if err := registry.Register(Migrations()...); err != nil {
+		t.Fatalf("Register() error: %v", err)
+	}
+	if err := registry.Run(context.Background(), nakamatest.NewLogger(t), nk); err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+}
+
+func TestMigrationsAdoptDocuments(t *testing.T) {
+	nk := nakamatest.NewModule()
+	ctx := context.Background()
+	serviceContext := &services.ServiceContext{Ctx: ctx, Logger: nakamatest.NewLogger(t), NakamaModule: nk, Config: &config.Config{DocumentFallbackLanguage: config.DefaultDocumentFallbackLanguage}}
+
+	// The JS runtime keyed documents by the language as the relay sent it
+	legacy := []*runtime.StorageWrite{
+		{Collection: DocumentStorageCollection("eula"), Key: "eula_en_US", UserID: "relay-user", Value: `{"type":"eula","lang":"en_US","text":"legacy"}`},
+		{Collection: DocumentStorageCollection("eula"), Key: "eula_fr", UserID: "relay-user", Value: `{"type":"eula","lang":"fr","text":"legacy"}`},
+		{Collection: DocumentStorageCollection("eula"), Key: "unknown", UserID: "relay-user", Value: `{}`},
+	}
+	if _, err := nk.StorageWrite(ctx, legacy); err != nil {
+		t.Fatalf("StorageWrite() error: %v", err)
+	}
+	// A document set since the upgrade is kept
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{Collection: DocumentStorageCollection("eula"), Key: DocumentStorageKey("eula", "fr"), UserID: services.SystemUserId, Value: `{"type":"eula","lang":"fr","text":"current"}`}}); err != nil {
+		t.Fatalf("StorageWrite() error: %v", err)
+	}
+
+	runMigrations(t, nk)
+
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{
+		{Collection: DocumentStorageCollection("eula"), Key: DocumentStorageKey("eula", "en-US"), UserID: services.SystemUserId},
+		{Collection: DocumentStorageCollection("eula"), Key: DocumentStorageKey("eula", "fr"), UserID: services.SystemUserId},
+	})
+	if err != nil || len(objects) != 2 {
+		t.Fatalf("StorageRead() = %v, error = %v, want both documents", objects, err)
+	}
+	for _, object := range objects {
+		want := `{"type":"eula","lang":"en_US","text":"legacy"}`
+		if object.Key == DocumentStorageKey("eula", "fr") {
+			want = `{"type":"eula","lang":"fr","text":"current"}`
+		}
+		if object.Value != want {
+			t.Errorf("%s = %s, want %s", object.Key, object.Value, want)
+		}
+	}
+
+	// The adopted document is served in the requested language
+	if _, apiErr := GetDocument(serviceContext, DocumentKey{Type: "eula", Lang: "en_US"}); apiErr != nil {
+		t.Errorf("GetDocument() error: %v", apiErr)
+	}
+}
+
+func TestMigrationsAdoptAccessControlList(t *testing.T) {
+	nk := nakamatest.NewModule()
+	ctx := context.Background()
+	serviceContext := &services.ServiceContext{Ctx: ctx, Logger: nakamatest.NewLogger(t), NakamaModule: nk}
+
+	// The JS runtime stored bare values under the relay's user
+	legacy := `{"allow":["10.0.0.0/8","OVR_ORG"],"deny":["192.0.2.1","not-a-value"]}`
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{Collection: AccessControlListStorageCollection, Key: AccessControlListStorageKey, UserID: "relay-user", Value: legacy}}); err != nil {
+		t.Fatalf("StorageWrite() error: %v", err)
+	}
+
+	runMigrations(t, nk)
+
+	data, apiErr := GetAccessControlList(serviceContext)
+	if apiErr != nil {
+		t.Fatalf("GetAccessControlList() error: %v", apiErr)
+	}
+	var acl AccessControlList
+	if err := json.Unmarshal(data, &acl); err != nil {
+		t.Fatalf("json.Unmarshal() error: %v", err)
+	}
+	rule := func(ruleType, value string) AccessControlRule {
+		return AccessControlRule{Type: ruleType, Value: value, Note: "set by the JS runtime"}
+	}
+	expected := AccessControlList{
+		Allow: []AccessControlRule{rule(AccessRuleIp, "10.0.0.0/8"), rule(AccessRulePlatform, "OVR_ORG")},
+		Deny:  []AccessControlRule{rule(AccessRuleIp, "192.0.2.1")},
+	}
+	if !reflect.DeepEqual(acl, expected) {
+		t.Errorf("GetAccessControlList() = %+v, want %+v", acl, expected)
+	}
+	if err := acl.Validate(); err != nil {
+		t.Errorf("Validate() error: %v", err)
+	}
+}
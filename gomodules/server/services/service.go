@@ -4,14 +4,20 @@ import (
 	"context"
 	"database/sql"
 
-	"github.com/bwmarrin/discordgo"
+	"echonakama/server/services/config"
+	"echonakama/server/services/discord"
+
 	"github.com/heroiclabs/nakama-common/runtime"
 )
 
+// SystemUserId is the Nakama user that owns the server's storage objects and groups.
+const SystemUserId = "00000000-0000-0000-0000-000000000000"
+
 type ServiceContext struct {
 	Ctx          context.Context
 	Logger       runtime.Logger
 	DbConnection *sql.DB
 	NakamaModule runtime.NakamaModule
-	DiscordBot   *discordgo.Session
+	Discord      discord.Client
+	Config       *config.Config
 }
@@ -1,14 +1,6 @@
 import {
 	setAccountRpc,
 	getAccountRpc,
-	setConfigRpc,
-	getConfigRpc,
-	setDocumentRpc,
-	getDocumentRpc,
-	setAccessControlListRpc,
-	getAccessControlListRpc,
-	setChannelInfoRpc,
-	getChannelInfoRpc,
 	setLoginSettingsRpc,
 	getLoginSettingsRpc,
   discordLinkDeviceRpc
@@ -23,14 +15,6 @@ let InitModule: nkruntime.InitModule =
 
     initializer.registerRpc('echorelay/setAccount', setAccountRpc);
     initializer.registerRpc('echorelay/getAccount', getAccountRpc);
-    initializer.registerRpc('echorelay/setConfig', setConfigRpc);
-    initializer.registerRpc('echorelay/getConfig', getConfigRpc);
-    initializer.registerRpc('echorelay/setDocument', setDocumentRpc);
-    initializer.registerRpc('echorelay/getDocument', getDocumentRpc);
-    initializer.registerRpc('echorelay/setAccessControlList', setAccessControlListRpc);
-    initializer.registerRpc('echorelay/getAccessControlList', getAccessControlListRpc);
-    initializer.registerRpc('echorelay/setChannelInfo', setChannelInfoRpc);
-    initializer.registerRpc('echorelay/getChannelInfo', getChannelInfoRpc);
     initializer.registerRpc('echorelay/setLoginSettings', setLoginSettingsRpc);
     initializer.registerRpc('echorelay/getLoginSettings', getLoginSettingsRpc);
     initializer.registerRpc('discordLinkDevice', discordLinkDeviceRpc);
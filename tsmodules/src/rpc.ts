@@ -12,9 +12,6 @@ import {
   Server as AccountProfile,
   Client as ClientProfile,
   Server as ServerProfile,
-  Config,
-  Document,
-  AccessControlList,
   ChannelInfo,
   LoginSettings
 } from './types';
@@ -367,12 +364,6 @@ let generateRpcSetFunction = <T>(dataType: T, collectionSelect: Function, keySel
 
 
 // NOTE: Due to Nakama's mapping method, all Rpc functions must be globally assigned
-let setConfigRpc = generateRpcSetFunction<Config>({} as Config, (e: any) => `Config:${e.type}`, (e: any) => e.id);
-let getConfigRpc = generateRpcGetFunction<Config>({} as Config, (e: any) => `Config:${e.type}`, (e: any) => e.id);
-let setDocumentRpc = generateRpcSetFunction<Document>({} as Document, (e: any) => `Document:${e.type}`, (e: any) => `${e.type}_${e.lang}`);
-let getDocumentRpc = generateRpcGetFunction<Document>({} as Document, (e: any) => `Document:${e.type}`, (e: any) => e.id);
-let setAccessControlListRpc = generateRpcSetFunction<AccessControlList>({} as AccessControlList, (e: any) => `Relay:acl`, (e: any) => 'allow_deny_list');
-let getAccessControlListRpc = generateRpcGetFunction<AccessControlList>({} as AccessControlList, (e: any) => `Relay:acl`, (e: any) => 'allow_deny_list');
 let setChannelInfoRpc = generateRpcSetFunction<ChannelInfo>({} as ChannelInfo, (e: any) => `Login:channel_info`, (e: any) => 'channel_info');
 let getChannelInfoRpc = generateRpcGetFunction<ChannelInfo>({} as ChannelInfo, (e: any) => `Login:channel_info`, (e: any) => 'channel_info');
 let setLoginSettingsRpc = generateRpcSetFunction<LoginSettings>({} as LoginSettings, (e: any) => `Login:login_settings`, (e: any) => 'login_settings');
@@ -382,12 +373,6 @@ let getLoginSettingsRpc = generateRpcGetFunction<LoginSettings>({} as LoginSetti
 export {
   setAccountRpc,
   getAccountRpc,
-  setConfigRpc,
-  getConfigRpc,
-  setDocumentRpc,
-  getDocumentRpc,
-  setAccessControlListRpc,
-  getAccessControlListRpc,
   setChannelInfoRpc,
   getChannelInfoRpc,
   setLoginSettingsRpc,
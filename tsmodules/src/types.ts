@@ -1,10 +1,5 @@
 import { XPlatformId } from "./game/x-platform-id";
 
-export interface AccessControlList {
-    allow: string[];
-    deny: string[];
-  }
-
   export interface Account {
     profile:           Profile;
     is_moderator:      boolean;
@@ -222,40 +217,6 @@ export interface ChannelInfo {
     priority:     number;
     rad:          boolean;
   }
-  export interface Document {
-    type: string;
-    lang: string;
-    version: number;
-    versionGa: number;
-    text: string;
-    textGa: string;
-    markAsReadProfileKey: string;
-    markAsReadProfileKeyGa: string;
-    linkCc: string;
-    linkPp: string;
-    linkVR: string;
-    linkCp: string;
-    linkEc: string;
-    linkEa: string;
-    linkGa: string;
-    linkTc: string;
-  }
-  export interface Config {
-    type: string
-    id: string
-    _ts: number
-    news: NewsItem[]
-    splash: NewsItem[]
-    splash_version: number
-    help_link: string
-    news_link: string
-    discord_link: string
-  }
-  
-  export interface NewsItem {
-    texture: string
-    link: string
-  }
   export interface LoginSettings {
     iapUnlocked:           boolean;
     remoteLogSocial:       boolean;